@@ -0,0 +1,43 @@
+// Package bufpool recycles the fixed-size packet buffers used on the hot path.
+//
+// Ownership rules: a buffer from Get belongs to whoever holds it until it is
+// handed to Put, after which it must not be touched again. Put is always
+// optional (an un-returned buffer is simply garbage collected) and ignores
+// slices that didn't come from the pool, so it is safe to call on any packet
+// a function owns. See vpn.Transport for how packets move between owners.
+package bufpool
+
+import "sync"
+
+// Size is the length of every pooled buffer: an MTU-sized packet (at most
+// 1500) plus encryption overhead (12 byte nonce + 16 byte tag), rounded up
+const Size = 2048
+
+var pool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, Size)
+	},
+}
+
+// Get returns a buffer with len and cap Size. Its contents are not zeroed.
+func Get() []byte {
+	return pool.Get().([]byte)
+}
+
+// Put returns buf to the pool. Buffers of the wrong capacity are dropped.
+func Put(buf []byte) {
+	if cap(buf) != Size {
+		return
+	}
+	pool.Put(buf[:Size])
+}
+
+// Copy returns a pooled copy of pkt, or a plain one when pkt doesn't fit
+func Copy(pkt []byte) []byte {
+	if len(pkt) > Size {
+		return append([]byte(nil), pkt...)
+	}
+	buf := Get()
+	n := copy(buf, pkt)
+	return buf[:n]
+}
@@ -0,0 +1,25 @@
+package bufpool
+
+import "testing"
+
+// sink keeps the compiler from optimizing the allocations away
+var sink []byte
+
+// BenchmarkGet compares a pooled buffer per packet with a fresh one, the
+// way the receive paths allocated before the pool
+func BenchmarkGet(b *testing.B) {
+	b.Run("pool", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			buf := Get()
+			sink = buf
+			Put(buf)
+		}
+	})
+	b.Run("make", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			sink = make([]byte, Size)
+		}
+	})
+}
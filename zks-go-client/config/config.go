@@ -0,0 +1,660 @@
+// Package config loads client settings from a file as an alternative to CLI flags
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zks-vpn/zks-go-client/control"
+	"github.com/zks-vpn/zks-go-client/dns"
+	"github.com/zks-vpn/zks-go-client/entry"
+	"github.com/zks-vpn/zks-go-client/exit"
+	"github.com/zks-vpn/zks-go-client/mode"
+	"github.com/zks-vpn/zks-go-client/profiling"
+	"github.com/zks-vpn/zks-go-client/relay"
+	"github.com/zks-vpn/zks-go-client/socks5"
+	"github.com/zks-vpn/zks-go-client/vpn"
+	"github.com/zks-vpn/zks-go-client/wgproto"
+)
+
+// DefaultRelayURL is the public ZKS relay
+const DefaultRelayURL = "wss://zks-tunnel-relay.md-wasif-faisal.workers.dev"
+
+// DefaultProbeTimeout bounds a whole --mode probe run
+const DefaultProbeTimeout = 15 * time.Second
+
+// DefaultPcapMaxMB caps each --pcap file; the previous one is kept as .1
+const DefaultPcapMaxMB = 100
+
+// DefaultConnectRetries rides out a relay (e.g. a Cloudflare Worker) that
+// is still starting up
+const DefaultConnectRetries = 4
+
+// Config holds every runtime setting. Each field's `key` tag is both its
+// config file key and its CLI flag name.
+type Config struct {
+	Mode      string `key:"mode"`
+	Room      string `key:"room"`
+	Relay     string `key:"relay"`
+	PinSHA256 string `key:"pin-sha256"`
+	Proxy     string `key:"upstream-proxy"`
+	Listen    string `key:"listen"`
+	Socks     bool   `key:"socks"`
+	Transport string `key:"transport"`
+	EntryNode string `key:"entry-node"`
+	UDPBind   string `key:"udp-bind"`
+	UDPListen string `key:"udp-listen"`
+	SocksUser string `key:"socks-user"`
+	SocksPass string `key:"socks-pass"`
+
+	SocksSocketMode string `key:"socks-socket-mode"`
+	SocksAllow      string `key:"socks-allow"`
+	SocksDeny       string `key:"socks-deny"`
+	FallbackSocks   bool   `key:"fallback-socks"`
+	HTTPProxy       string `key:"http-proxy"`
+
+	ShutdownGrace    time.Duration `key:"shutdown-grace"`
+	SocksIdleTimeout time.Duration `key:"socks-idle-timeout"`
+	Timeout          time.Duration `key:"timeout"`
+
+	VPNIP         string  `key:"vpn-ip"`
+	VPNNetmask    string  `key:"vpn-netmask"`
+	VPNIPv6       string  `key:"vpn-ipv6"`
+	DNS           string  `key:"dns"`
+	InternalDNS   bool    `key:"internal-dns"`
+	DNSListen     string  `key:"internal-dns-listen"`
+	DoHURL        string  `key:"doh-url"`
+	MTU           int     `key:"mtu"`
+	ClampMSS      bool    `key:"clamp-mss"`
+	MSS           int     `key:"mss"`
+	InterfaceName string  `key:"interface-name"`
+	ReuseExisting bool    `key:"reuse-existing"`
+	Gateway       string  `key:"gateway"`
+	BindInterface string  `key:"bind-interface"`
+	KillSwitch    bool    `key:"kill-switch"`
+	PSK           string  `key:"psk"`
+	RoomSecret    string  `key:"room-secret"`
+	AllowedRooms  string  `key:"allowed-rooms"`
+	ExitNetstack  bool    `key:"exit-netstack"`
+	WGPrivateKey  string  `key:"wg-private-key"`
+	WGPeers       string  `key:"wg-peer-public-key"`
+	Compress      bool    `key:"compress"`
+	UplinkMbps    float64 `key:"uplink-mbps"`
+	FragmentSize  int     `key:"fragment-size"`
+	MaxMessage    int     `key:"max-message-size"`
+
+	Sequence       bool `key:"sequence"`
+	DropDuplicates bool `key:"drop-duplicates"`
+	PreserveDSCP   bool `key:"preserve-dscp"`
+
+	IncludeRoutes  string `key:"include-routes"`
+	ExcludeRoutes  string `key:"exclude-routes"`
+	NoDefaultRoute bool   `key:"no-default-route"`
+	AllowProto     string `key:"allow-proto"`
+	AllowPort      string `key:"allow-port"`
+
+	BatchFlushInterval time.Duration `key:"batch-flush-interval"`
+	BatchMaxPackets    int           `key:"batch-max-packets"`
+	BatchMaxBytes      int           `key:"batch-max-bytes"`
+
+	BatchAdaptive         bool          `key:"batch-adaptive"`
+	BatchMinFlushInterval time.Duration `key:"batch-min-flush-interval"`
+	BatchMinPackets       int           `key:"batch-min-packets"`
+
+	WriteFlushInterval time.Duration `key:"write-flush-interval"`
+	WriteMaxPackets    int           `key:"write-max-packets"`
+	SendQueuePackets   int           `key:"send-queue-packets"`
+	SendQueuePolicy    string        `key:"send-queue-policy"`
+	OnDeviceLost       string        `key:"on-device-lost"`
+	Queues             int           `key:"queues"`
+
+	ReconnectMaxAttempts int           `key:"reconnect-max-attempts"`
+	ConnectRetries       int           `key:"connect-retries"`
+	ConnectTimeout       time.Duration `key:"connect-timeout"`
+	KeepaliveInterval    time.Duration `key:"keepalive-interval"`
+	KeepaliveTimeout     time.Duration `key:"keepalive-timeout"`
+	ProbeInterval        time.Duration `key:"probe-interval"`
+	HeartbeatInterval    time.Duration `key:"heartbeat-interval"`
+	HeartbeatTimeout     time.Duration `key:"heartbeat-timeout"`
+	RekeyInterval        time.Duration `key:"rekey-interval"`
+	FlowIdleTimeout      time.Duration `key:"flow-idle-timeout"`
+	ClientIdleTimeout    time.Duration `key:"client-idle-timeout"`
+	SessionResumeTimeout time.Duration `key:"session-resume-timeout"`
+	TrafficReport        time.Duration `key:"traffic-report-interval"`
+
+	MetricsAddr   string `key:"metrics-addr"`
+	PprofAddr     string `key:"pprof-addr"`
+	Pcap          string `key:"pcap"`
+	TracePackets  bool   `key:"trace-packets"`
+	PcapMaxMB     int    `key:"pcap-max-mb"`
+	ControlSocket string `key:"control-socket"`
+	NoColor       bool   `key:"no-color"`
+	Quiet         bool   `key:"quiet"`
+	JSONEvents    string `key:"json-events"`
+}
+
+// Transports lists the valid values of Transport for p2p-vpn
+var Transports = []string{"relay", "udp", "tcp"}
+
+// Default returns the built-in settings, the same ones the flags default to
+func Default() *Config {
+	return &Config{
+		Mode:   string(mode.Client),
+		Relay:  DefaultRelayURL,
+		Listen: "127.0.0.1:1080",
+
+		UDPListen: entry.DefaultListen,
+
+		ShutdownGrace:    socks5.DefaultShutdownGrace,
+		SocksIdleTimeout: socks5.DefaultIdleTimeout,
+		Timeout:          DefaultProbeTimeout,
+
+		VPNIP:         vpn.DefaultIP,
+		VPNNetmask:    vpn.DefaultNetmask,
+		VPNIPv6:       vpn.DefaultIPv6,
+		DNS:           vpn.DefaultDNS,
+		DoHURL:        dns.DefaultUpstream,
+		MTU:           vpn.DefaultMTU,
+		InterfaceName: vpn.DefaultInterfaceName,
+		MaxMessage:    vpn.DefaultMaxMessageSize,
+
+		BatchFlushInterval: vpn.DefaultBatchFlushInterval,
+		BatchMaxPackets:    vpn.DefaultBatchMaxPackets,
+		BatchMaxBytes:      vpn.DefaultBatchMaxBytes,
+
+		BatchMinFlushInterval: vpn.DefaultBatchMinFlushInterval,
+		BatchMinPackets:       vpn.DefaultBatchMinPackets,
+
+		WriteFlushInterval: vpn.DefaultWriteFlushInterval,
+		WriteMaxPackets:    vpn.DefaultWriteMaxPackets,
+		SendQueuePackets:   vpn.DefaultSendQueuePackets,
+		SendQueuePolicy:    string(vpn.DropOldest),
+		OnDeviceLost:       string(vpn.DeviceLostExit),
+
+		ConnectRetries:       DefaultConnectRetries,
+		ConnectTimeout:       relay.DefaultConnectTimeout,
+		KeepaliveInterval:    relay.DefaultKeepaliveInterval,
+		KeepaliveTimeout:     relay.DefaultKeepaliveTimeout,
+		FlowIdleTimeout:      exit.DefaultIdleTimeout,
+		ClientIdleTimeout:    exit.DefaultClientIdleTimeout,
+		SessionResumeTimeout: exit.DefaultSessionResumeTimeout,
+
+		PcapMaxMB:     DefaultPcapMaxMB,
+		ControlSocket: control.DefaultSocketPath(),
+	}
+}
+
+// Load reads a config file on top of Default.
+//
+// The format is the flat subset of YAML the settings need: one
+// "key: value" per line, "#" comments, and optionally quoted values.
+// Keys are the CLI flag names, e.g.
+//
+//	mode: p2p-vpn
+//	room: my-room
+//	vpn-ip: 10.0.85.1
+//	mtu: 1380
+func Load(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+	defer f.Close()
+
+	cfg := Default()
+	seen := make(map[string]int)
+
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" || line == "---" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected \"key: value\", got %q", path, lineNo, line)
+		}
+		key = strings.TrimSpace(key)
+		value = unquote(strings.TrimSpace(value))
+
+		if prev, dup := seen[key]; dup {
+			return nil, fmt.Errorf("%s:%d: key %q already set on line %d", path, lineNo, key, prev)
+		}
+		seen[key] = lineNo
+
+		if err := cfg.Set(key, value); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+	return cfg, nil
+}
+
+// Set assigns one setting by key, parsing value for the field's type.
+// main uses it to lay explicitly passed flags over the file.
+func (c *Config) Set(key, value string) error {
+	field, ok := c.field(key)
+	if !ok {
+		return fmt.Errorf("unknown key %q", key)
+	}
+
+	switch field.Interface().(type) {
+	case string:
+		field.SetString(value)
+	case bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("key %q: %q is not a boolean (true or false)", key, value)
+		}
+		field.SetBool(b)
+	case int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("key %q: %q is not an integer", key, value)
+		}
+		field.SetInt(int64(n))
+	case float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("key %q: %q is not a number", key, value)
+		}
+		field.SetFloat(f)
+	case time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("key %q: %q is not a duration (e.g. 30s, 2m)", key, value)
+		}
+		field.SetInt(int64(d))
+	}
+	return nil
+}
+
+// EnvVars are the environment variables that stand in for a key, so
+// containers can pass the room and secrets without them showing up in
+// process listings
+var EnvVars = []struct{ Name, Key string }{
+	{"ZKS_ROOM", "room"},
+	{"ZKS_RELAY", "relay"},
+	{"ZKS_ROOM_SECRET", "room-secret"},
+	{"ZKS_PSK", "psk"},
+}
+
+// ApplyEnv sets the keys in EnvVars from the environment, skipping empty
+// variables and the keys in explicit (flags given on the command line, which
+// take precedence). Variables override the config file.
+func (c *Config) ApplyEnv(explicit map[string]bool) error {
+	for _, v := range EnvVars {
+		value := os.Getenv(v.Name)
+		if value == "" || explicit[v.Key] {
+			continue
+		}
+		if err := c.Set(v.Key, value); err != nil {
+			return fmt.Errorf("%s: %w", v.Name, err)
+		}
+	}
+	return nil
+}
+
+// Validate checks the settings every mode depends on
+func (c *Config) Validate() error {
+	// The self-test brings its own relay, room and exit peer
+	if c.Mode == string(mode.SelfTest) {
+		return nil
+	}
+	if c.Room == "" {
+		return fmt.Errorf("key %q is required (or set ZKS_ROOM)", "room")
+	}
+	if len(c.RelayURLs()) == 0 {
+		return fmt.Errorf("key %q is required (or set ZKS_RELAY)", "relay")
+	}
+	for _, relayURL := range c.RelayURLs() {
+		// Caught here, a bad URL can't leave the relay without a bypass route
+		if _, err := relay.Host(relayURL); err != nil {
+			return fmt.Errorf("key %q: %v", "relay", err)
+		}
+	}
+	for _, pin := range c.Pins() {
+		if _, err := relay.ParsePin(pin); err != nil {
+			return fmt.Errorf("key %q: %v", "pin-sha256", err)
+		}
+	}
+	if _, err := relay.ParseProxy(c.Proxy); err != nil {
+		return fmt.Errorf("key %q: %v", "upstream-proxy", err)
+	}
+	m, _, err := mode.ParseMode(c.Mode)
+	if err != nil {
+		return fmt.Errorf("key %q: %v", "mode", err)
+	}
+	if len(c.Rooms()) > 1 && m != mode.ExitPeer {
+		return fmt.Errorf("key %q: only exit-peer can serve several rooms", "room")
+	}
+	if c.AllowedRooms != "" {
+		if m != mode.ExitPeer {
+			return fmt.Errorf("key %q only applies to mode %q", "allowed-rooms", mode.ExitPeer)
+		}
+		allowed := c.AllowedRoomSecrets()
+		if _, ok := allowed[""]; ok {
+			return fmt.Errorf("key %q: want room or room=secret entries, not %q", "allowed-rooms", c.AllowedRooms)
+		}
+		served := 0
+		for _, room := range c.Rooms() {
+			if _, ok := allowed[room]; ok {
+				served++
+			}
+		}
+		if served == 0 {
+			return fmt.Errorf("key %q: none of the rooms in %q is allowed", "allowed-rooms", "room")
+		}
+	}
+	if c.ExitNetstack && m != mode.ExitPeer {
+		return fmt.Errorf("key %q only applies to mode %q", "exit-netstack", mode.ExitPeer)
+	}
+	if c.SocksPass != "" && c.SocksUser == "" {
+		return fmt.Errorf("key %q is set but %q is empty", "socks-pass", "socks-user")
+	}
+	if len(c.SocksUser) > 255 || len(c.SocksPass) > 255 {
+		return fmt.Errorf("keys %q and %q must be at most 255 bytes (RFC 1929)", "socks-user", "socks-pass")
+	}
+	if c.PprofAddr != "" {
+		if err := profiling.CheckAddr(c.PprofAddr); err != nil {
+			return fmt.Errorf("key %q: %v", "pprof-addr", err)
+		}
+	}
+	if _, err := c.SocksRules(); err != nil {
+		return fmt.Errorf("keys %q/%q: %v", "socks-allow", "socks-deny", err)
+	}
+	if _, err := c.SocketMode(); err != nil {
+		return fmt.Errorf("key %q: %v", "socks-socket-mode", err)
+	}
+	if wg, err := c.WireGuard(); err != nil {
+		return err
+	} else if wg != nil && m != mode.VPN && m != mode.ExitPeer {
+		return fmt.Errorf("key %q only applies to modes %q and %q", "wg-private-key", mode.VPN, mode.ExitPeer)
+	}
+
+	// No explicit transport keeps the old behaviour: an Entry Node means UDP
+	if c.Transport == "" {
+		c.Transport = "relay"
+		if c.EntryNode != "" {
+			c.Transport = "udp"
+		}
+	}
+	if !contains(Transports, c.Transport) {
+		return fmt.Errorf("key %q: unknown transport %q (want one of %s)", "transport", c.Transport, strings.Join(Transports, ", "))
+	}
+	if p := vpn.QueuePolicy(c.SendQueuePolicy); p != vpn.DropOldest && p != vpn.DropNewest {
+		return fmt.Errorf("key %q: unknown policy %q (want %s or %s)", "send-queue-policy", c.SendQueuePolicy, vpn.DropOldest, vpn.DropNewest)
+	}
+	if p := vpn.DeviceLostPolicy(c.OnDeviceLost); p != vpn.DeviceLostExit && p != vpn.DeviceLostRecreate {
+		return fmt.Errorf("key %q: unknown policy %q (want %s or %s)", "on-device-lost", c.OnDeviceLost, vpn.DeviceLostExit, vpn.DeviceLostRecreate)
+	}
+	if c.Queues < 0 || c.Queues > vpn.MaxQueues {
+		return fmt.Errorf("key %q must be between 0 and %d", "queues", vpn.MaxQueues)
+	}
+	if c.Queues > 1 && m != mode.VPN {
+		return fmt.Errorf("key %q only applies to mode %q", "queues", mode.VPN)
+	}
+	if m == mode.Probe && c.Timeout <= 0 {
+		return fmt.Errorf("key %q must be positive", "timeout")
+	}
+	if c.DropDuplicates && !c.Sequence {
+		return fmt.Errorf("key %q needs %q", "drop-duplicates", "sequence")
+	}
+	if c.UplinkMbps < 0 {
+		return fmt.Errorf("key %q must not be negative", "uplink-mbps")
+	}
+	if c.PcapMaxMB < 0 {
+		return fmt.Errorf("key %q must not be negative", "pcap-max-mb")
+	}
+	if c.Pcap != "" && m != mode.VPN {
+		return fmt.Errorf("key %q only applies to mode %q", "pcap", mode.VPN)
+	}
+	if c.TracePackets && m != mode.VPN {
+		return fmt.Errorf("key %q only applies to mode %q", "trace-packets", mode.VPN)
+	}
+	if _, err := c.PacketFilter(); err != nil {
+		return fmt.Errorf("keys %q/%q: %v", "allow-proto", "allow-port", err)
+	}
+	if (c.AllowProto != "" || c.AllowPort != "") && m != mode.VPN {
+		return fmt.Errorf("keys %q and %q only apply to mode %q", "allow-proto", "allow-port", mode.VPN)
+	}
+	if c.ConnectRetries < 0 {
+		return fmt.Errorf("key %q must not be negative", "connect-retries")
+	}
+	if c.MSS != 0 && !c.ClampMSS {
+		return fmt.Errorf("key %q only applies with %q", "mss", "clamp-mss")
+	}
+	if c.MaxMessage < 0 {
+		return fmt.Errorf("key %q must not be negative", "max-message-size")
+	}
+	if c.FragmentSize != 0 && c.FragmentSize < vpn.MinFragmentSize {
+		return fmt.Errorf("key %q must be 0 (off) or at least %d", "fragment-size", vpn.MinFragmentSize)
+	}
+	if c.Transport != "relay" && c.EntryNode == "" {
+		return fmt.Errorf("key %q is required with transport %q", "entry-node", c.Transport)
+	}
+	if c.PreserveDSCP {
+		if m != mode.VPN || c.Transport != "udp" {
+			return fmt.Errorf("key %q only applies to mode %q with transport %q", "preserve-dscp", mode.VPN, "udp")
+		}
+		// These hide the inner IP header from the UDP transport
+		if c.Sequence || c.FragmentSize != 0 || c.WGPrivateKey != "" {
+			return fmt.Errorf("key %q can't be combined with %q, %q or %q", "preserve-dscp", "sequence", "fragment-size", "wg-private-key")
+		}
+	}
+	if c.UDPBind != "" {
+		if m != mode.VPN || c.Transport != "udp" {
+			return fmt.Errorf("key %q only applies to mode %q with transport %q", "udp-bind", mode.VPN, "udp")
+		}
+		if _, err := vpn.ParseUDPBind(c.UDPBind); err != nil {
+			return fmt.Errorf("key %q: %w", "udp-bind", err)
+		}
+	}
+	if m == mode.Entry {
+		if _, _, err := net.SplitHostPort(c.UDPListen); err != nil {
+			return fmt.Errorf("key %q: want host:port, e.g. %s, not %q", "udp-listen", entry.DefaultListen, c.UDPListen)
+		}
+		// Clients and the exit peer apply these to each other's packets
+		if c.PSK != "" || c.Sequence || c.FragmentSize != 0 {
+			return fmt.Errorf("keys %q, %q and %q work end to end: set them on the clients and the exit peer, not on mode %q", "psk", "sequence", "fragment-size", mode.Entry)
+		}
+	}
+	if c.Socks && (m != mode.VPN || c.Transport != "relay") {
+		return fmt.Errorf("key %q only applies to mode %q with transport %q", "socks", mode.VPN, "relay")
+	}
+	if c.FallbackSocks && (m != mode.VPN || c.Transport != "relay") {
+		return fmt.Errorf("key %q only applies to mode %q with transport %q", "fallback-socks", mode.VPN, "relay")
+	}
+	if c.HTTPProxy != "" {
+		// It opens its streams through the SOCKS5 server
+		if m != mode.Client && !c.Socks && !c.FallbackSocks {
+			return fmt.Errorf("key %q needs the SOCKS5 proxy: mode %q, or %q/%q", "http-proxy", mode.Client, "socks", "fallback-socks")
+		}
+		if c.HTTPProxy == c.Listen {
+			return fmt.Errorf("key %q must differ from %q", "http-proxy", "listen")
+		}
+	}
+	if c.InternalDNS {
+		if m != mode.VPN {
+			return fmt.Errorf("key %q only applies to mode %q", "internal-dns", mode.VPN)
+		}
+		if _, err := dns.UpstreamAddr(c.DoHURL); err != nil {
+			return fmt.Errorf("key %q: %v", "doh-url", err)
+		}
+		if c.DNSListen != "" {
+			if ap, err := netip.ParseAddrPort(c.DNSListen); err != nil || !ap.Addr().Is4() {
+				return fmt.Errorf("key %q: want an IPv4 address and port, e.g. %s:53, not %q", "internal-dns-listen", vpn.DefaultIP, c.DNSListen)
+			}
+		}
+	}
+	if c.Transport == "relay" && c.EntryNode != "" {
+		return fmt.Errorf("key %q is only used with transports %q and %q", "entry-node", "udp", "tcp")
+	}
+	return nil
+}
+
+// RelayURLs splits the comma-separated relay setting, in failover order
+func (c *Config) RelayURLs() []string {
+	return splitList(c.Relay)
+}
+
+// Pins splits the comma-separated relay certificate pins
+func (c *Config) Pins() []string {
+	return splitList(c.PinSHA256)
+}
+
+// Rooms splits the comma-separated room setting; an exit peer serves one client link per room
+func (c *Config) Rooms() []string {
+	return splitList(c.Room)
+}
+
+// AllowedRoomSecrets parses allowed-rooms into each room's secret, empty
+// for rooms listed without one (they use room-secret). Nil means any room.
+func (c *Config) AllowedRoomSecrets() map[string]string {
+	list := splitList(c.AllowedRooms)
+	if len(list) == 0 {
+		return nil
+	}
+	allowed := make(map[string]string, len(list))
+	for _, entry := range list {
+		room, secret, _ := strings.Cut(entry, "=")
+		allowed[strings.TrimSpace(room)] = strings.TrimSpace(secret)
+	}
+	return allowed
+}
+
+// DNSServers splits the comma-separated DNS setting; empty means none
+func (c *Config) DNSServers() []string {
+	return splitList(c.DNS)
+}
+
+// RunMode returns Mode as a mode.Mode; Validate has checked it
+func (c *Config) RunMode() mode.Mode {
+	return mode.Mode(c.Mode)
+}
+
+// IncludeRouteList splits the comma-separated CIDRs to route through the tunnel
+func (c *Config) IncludeRouteList() []string {
+	return splitList(c.IncludeRoutes)
+}
+
+// ExcludeRouteList splits the comma-separated CIDRs to keep off the tunnel
+func (c *Config) ExcludeRouteList() []string {
+	return splitList(c.ExcludeRoutes)
+}
+
+// PacketFilter parses the comma-separated protocols and ports the tunnel forwards
+func (c *Config) PacketFilter() (*vpn.PacketFilter, error) {
+	return vpn.ParseFilter(splitList(c.AllowProto), splitList(c.AllowPort))
+}
+
+// SocksRules parses the comma-separated SOCKS5 destination allow and deny lists
+func (c *Config) SocksRules() (*socks5.Rules, error) {
+	return socks5.ParseRules(splitList(c.SocksAllow), splitList(c.SocksDeny))
+}
+
+// WireGuard returns the wgproto options for the wg-* keys, or nil if they
+// are unset. The p2p-vpn client initiates; the Exit Peer answers.
+func (c *Config) WireGuard() (*wgproto.Options, error) {
+	if c.WGPrivateKey == "" && c.WGPeers == "" {
+		return nil, nil
+	}
+	if c.WGPrivateKey == "" || c.WGPeers == "" {
+		return nil, fmt.Errorf("keys %q and %q must be set together", "wg-private-key", "wg-peer-public-key")
+	}
+	private, err := wgproto.ParseKey(c.WGPrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("key %q: %v", "wg-private-key", err)
+	}
+	peers, err := wgproto.ParseKeys(splitList(c.WGPeers))
+	if err != nil {
+		return nil, fmt.Errorf("key %q: %v", "wg-peer-public-key", err)
+	}
+	initiator := c.RunMode() != mode.ExitPeer
+	if initiator && len(peers) != 1 {
+		return nil, fmt.Errorf("key %q: %s takes exactly one key, the Exit Peer's", "wg-peer-public-key", c.Mode)
+	}
+	return &wgproto.Options{PrivateKey: private, Peers: peers, Initiator: initiator}, nil
+}
+
+// SocketMode parses the octal file mode for a "unix:" listen address;
+// empty means the SOCKS5 server's default
+func (c *Config) SocketMode() (os.FileMode, error) {
+	if c.SocksSocketMode == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(c.SocksSocketMode, 8, 32)
+	if err != nil || mode == 0 || mode > 0o777 {
+		return 0, fmt.Errorf("invalid mode %q: want octal permissions such as 0660", c.SocksSocketMode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// splitList splits a comma-separated setting, dropping empty entries
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// field finds the struct field tagged with key
+func (c *Config) field(key string) (reflect.Value, bool) {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("key") == key {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// stripComment drops a "#" comment that isn't inside quotes. As in YAML the
+// "#" must start the line or follow whitespace, so "pass#word" is kept.
+func stripComment(line string) string {
+	var quote rune
+	for i, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// unquote removes matching single or double quotes around a value
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
@@ -0,0 +1,146 @@
+// Package console tones the client's output down for scripts, log files
+// and consoles that show emoji as mojibake (--quiet). Quiet strips emoji
+// and box-drawing characters from everything printed, whichever package
+// prints it: stdout goes through a pipe that filters each line, and the
+// log package through a filtering writer.
+package console
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// flushMarker is written through the pipe by Flush; no output contains NUL
+const flushMarker = "\x00\n"
+
+// flushTimeout bounds how long Flush waits for the filter to catch up
+const flushTimeout = time.Second
+
+var (
+	mu      sync.Mutex
+	pipe    *os.File      // Write end standing in for os.Stdout, nil until Quiet
+	flushed chan struct{} // The filter saw a flushMarker
+)
+
+// IsTerminal reports whether f is an interactive terminal (or console)
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Quiet filters os.Stdout and the log output from now on. Call Flush
+// before os.Exit, or the last lines may be lost in the pipe.
+func Quiet() error {
+	mu.Lock()
+	defer mu.Unlock()
+	if pipe != nil {
+		return nil
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	out := os.Stdout
+	pipe, flushed = w, make(chan struct{}, 1)
+	os.Stdout = w
+	log.SetOutput(writer{log.Writer()})
+	go filter(r, out, flushed)
+	return nil
+}
+
+// Flush waits until everything printed so far has left the filter
+func Flush() {
+	mu.Lock()
+	defer mu.Unlock()
+	if pipe == nil {
+		return
+	}
+	if _, err := pipe.WriteString(flushMarker); err != nil {
+		return
+	}
+	select {
+	case <-flushed:
+	case <-time.After(flushTimeout):
+	}
+}
+
+// filter copies r to out line by line, stripped
+func filter(r io.Reader, out io.Writer, flushed chan<- struct{}) {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if line, ok := strings.CutSuffix(line, flushMarker); ok {
+			io.WriteString(out, Strip(line))
+			select {
+			case flushed <- struct{}{}:
+			default:
+			}
+			continue
+		}
+		io.WriteString(out, Strip(line))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// writer strips what the log package writes, one whole line per call
+type writer struct{ w io.Writer }
+
+func (w writer) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.w, Strip(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// labels replace the emoji that carry meaning scripts may grep for
+var labels = map[rune]string{
+	'❌': "Error: ",
+	'⚠': "Warning: ",
+}
+
+// Strip removes emoji and box drawing from s, with the spaces that follow
+// them, e.g. "✅ Connected" becomes "Connected" and "❌ Failed" "Error: Failed"
+func Strip(s string) string {
+	var b strings.Builder
+	skipSpace := false
+	for _, r := range s {
+		if label, ok := labels[r]; ok {
+			b.WriteString(label)
+			skipSpace = true
+			continue
+		}
+		switch {
+		case decoration(r):
+			skipSpace = true
+			continue
+		case r == ' ' && skipSpace:
+			continue
+		}
+		skipSpace = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// decoration reports whether r is an emoji, one of the modifiers emoji are
+// built with, or a box-drawing character
+func decoration(r rune) bool {
+	switch {
+	case r >= 0x1F000 && r <= 0x1FAFF: // Pictographs, emoticons, transport, ...
+	case r >= 0x2300 && r <= 0x23FF: // ⏹ ⏳ ⌛
+	case r >= 0x2500 && r <= 0x257F: // Box drawing
+	case r >= 0x2600 && r <= 0x27BF: // ✅ ❌ ⚠ ⚡ and other symbols and dingbats
+	case r >= 0x2B00 && r <= 0x2BFF: // ⭐ ⬆
+	case r >= 0xFE00 && r <= 0xFE0F, r == 0x200D, r == 0x20E3: // Variation selectors, ZWJ, keycap
+	default:
+		return false
+	}
+	return true
+}
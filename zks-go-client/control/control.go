@@ -0,0 +1,114 @@
+// Package control is the local status socket of a running client, queried
+// by `zks-vpn status`: a Unix domain socket in a directory only its user
+// can enter (control_unix.go), or a named pipe on Windows
+// (control_windows.go). Either way only the user running the client (or,
+// on Windows, administrators) can connect, since the answer includes the
+// room and traffic stats.
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/zks-vpn/zks-go-client/metrics"
+)
+
+// ioTimeout bounds one request/response exchange
+const ioTimeout = 5 * time.Second
+
+// Status is the answer to a "status" request
+type Status struct {
+	Mode          string  `json:"mode"`
+	Room          string  `json:"room"`
+	Relay         string  `json:"relay,omitempty"`
+	Connected     bool    `json:"connected"`
+	PeerIP        string  `json:"peer_ip,omitempty"`
+	UptimeSeconds int64   `json:"uptime_seconds"`
+	BytesSent     uint64  `json:"bytes_sent"`
+	BytesReceived uint64  `json:"bytes_received"`
+	RTTMillis     float64 `json:"rtt_ms"`
+	ProbeLoss     float64 `json:"probe_loss"`
+
+	SocksConnections int `json:"socks_connections"`
+
+	// Peers is the per-client traffic of an Exit Peer, by tunnel address
+	Peers map[string]metrics.PeerTotals `json:"peers,omitempty"`
+	// TUN is the p2p-vpn device's own counters (vpn.TunStats)
+	TUN any `json:"tun,omitempty"`
+}
+
+// Serve listens on path and answers requests in the background. status
+// supplies the mode-specific fields; traffic, uptime and RTT come from the
+// metrics package. Close the returned listener to stop.
+func Serve(path string, status func() Status) (io.Closer, error) {
+	ln, err := listen(path)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn, status)
+		}
+	}()
+	return ln, nil
+}
+
+func handle(conn net.Conn, status func() Status) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(ioTimeout))
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && line == "" {
+		return
+	}
+
+	enc := json.NewEncoder(conn)
+	switch cmd := strings.TrimSpace(line); cmd {
+	case "status":
+		st := status()
+		st.UptimeSeconds = int64(metrics.Uptime().Seconds())
+		st.BytesSent = metrics.TunToRelayBytes.Load()
+		st.BytesReceived = metrics.RelayToTunBytes.Load()
+		st.RTTMillis = metrics.PeerRTTSeconds.Load() * 1000
+		st.ProbeLoss = metrics.PeerLossRatio.Load()
+		st.Peers = metrics.PeerSnapshot()
+		st.TUN = metrics.TUNStats()
+		st.SocksConnections = int(metrics.SocksConnections.Load())
+		enc.Encode(st)
+	default:
+		enc.Encode(map[string]string{"error": fmt.Sprintf("unknown command %q", cmd)})
+	}
+}
+
+// Query sends cmd to the client listening on path and returns its JSON reply
+func Query(path, cmd string) ([]byte, error) {
+	conn, err := dial(path, ioTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("no client running on %s: %w", path, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(ioTimeout))
+
+	if _, err := fmt.Fprintf(conn, "%s\n", cmd); err != nil {
+		return nil, err
+	}
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) == 0 {
+		return nil, errors.New("empty reply")
+	}
+	return reply, nil
+}
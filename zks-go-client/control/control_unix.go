@@ -0,0 +1,87 @@
+//go:build !windows
+
+package control
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// DefaultSocketPath is where the client listens unless configured
+// otherwise: in $XDG_RUNTIME_DIR, which only its user can enter, or else in
+// a directory of the user's own under the temp directory
+func DefaultSocketPath() string {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), fmt.Sprintf("zks-vpn-%d", os.Getuid()))
+	}
+	return filepath.Join(dir, "zks-vpn.sock")
+}
+
+// listen creates the socket at path, accessible to our user alone from
+// the moment it exists
+func listen(path string) (net.Listener, error) {
+	if err := privateDir(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+
+	// A socket file nobody answers on is left over from a killed client
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := dial(path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("control socket %s is in use by another client", path)
+		}
+		os.Remove(path)
+	}
+
+	// Traffic stats and the room name are nobody else's business. The umask
+	// covers the window between bind and chmod; the chmod covers systems
+	// that ignore it for sockets.
+	umask := syscall.Umask(0o177)
+	ln, err := net.Listen("unix", path)
+	syscall.Umask(umask)
+	if err != nil {
+		return nil, fmt.Errorf("control listen failed: %w", err)
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("control socket %s: %w", path, err)
+	}
+	return ln, nil
+}
+
+// privateDir creates dir for our user alone if it doesn't exist. One in
+// the shared temp directory must already be ours alone, or another user may
+// have created it to get at the socket.
+func privateDir(dir string) error {
+	err := os.Mkdir(dir, 0o700)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("control socket directory: %w", err)
+	}
+	if filepath.Dir(dir) != filepath.Clean(os.TempDir()) {
+		return nil
+	}
+
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return fmt.Errorf("control socket directory: %w", err)
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !fi.IsDir() || fi.Mode().Perm()&0o077 != 0 || !ok || int(st.Uid) != os.Geteuid() {
+		return fmt.Errorf("control socket directory %s must be ours with mode 0700", dir)
+	}
+	return nil
+}
+
+func dial(path string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("unix", path, timeout)
+}
@@ -0,0 +1,42 @@
+package control
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/sys/windows"
+	"golang.zx2c4.com/wireguard/ipc/namedpipe"
+)
+
+// DefaultSocketPath is where the client listens unless configured otherwise
+func DefaultSocketPath() string {
+	return `\\.\pipe\zks-vpn`
+}
+
+// pipeSecurity lets SYSTEM, administrators and the pipe's creator (the
+// client runs elevated to manage its TUN adapter) connect, nobody else
+const pipeSecurity = "O:SYD:P(A;;GA;;;SY)(A;;GA;;;BA)(A;;GA;;;OW)"
+
+// listen creates the named pipe at path. Unlike a socket file, a pipe
+// vanishes with the process that created it, so there is nothing stale to
+// remove; creating one that exists fails.
+func listen(path string) (net.Listener, error) {
+	sd, err := windows.SecurityDescriptorFromString(pipeSecurity)
+	if err != nil {
+		return nil, fmt.Errorf("control pipe security: %w", err)
+	}
+	ln, err := (&namedpipe.ListenConfig{SecurityDescriptor: sd}).Listen(path)
+	if err != nil {
+		if conn, dialErr := dial(path, time.Second); dialErr == nil {
+			conn.Close()
+			return nil, fmt.Errorf("control pipe %s is in use by another client", path)
+		}
+		return nil, fmt.Errorf("control listen failed: %w", err)
+	}
+	return ln, nil
+}
+
+func dial(path string, timeout time.Duration) (net.Conn, error) {
+	return namedpipe.DialTimeout(path, timeout)
+}
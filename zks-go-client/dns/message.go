@@ -0,0 +1,81 @@
+package dns
+
+import "encoding/binary"
+
+// headerLen is the size of the fixed DNS message header
+const headerLen = 12
+
+const (
+	flagQR    = 0x80 // In the first flags byte
+	flagTC    = 0x02 // In the first flags byte
+	rcodeMask = 0x0f // In the second flags byte
+
+	rcodeServFail = 2
+)
+
+// questionEnd returns the offset just past msg's question section, or 0
+// if it can't be parsed (we only handle the usual single question)
+func questionEnd(msg []byte) int {
+	if len(msg) < headerLen || binary.BigEndian.Uint16(msg[4:6]) != 1 {
+		return 0
+	}
+	off := headerLen
+	for {
+		if off >= len(msg) {
+			return 0
+		}
+		n := int(msg[off])
+		if n == 0 {
+			off++
+			break
+		}
+		if n&0xc0 != 0 {
+			return 0 // Queries don't use compression
+		}
+		off += 1 + n
+	}
+	if off+4 > len(msg) {
+		return 0
+	}
+	return off + 4
+}
+
+// headerOnly returns a reply to query carrying just the header and
+// question, with the answer counts cleared
+func headerOnly(query []byte) []byte {
+	end := questionEnd(query)
+	if end == 0 {
+		end = headerLen
+	}
+	reply := append([]byte(nil), query[:end]...)
+	if end == headerLen {
+		binary.BigEndian.PutUint16(reply[4:6], 0)
+	}
+	clear(reply[6:12])
+	reply[2] |= flagQR
+	return reply
+}
+
+// serverFailure is the SERVFAIL reply to query
+func serverFailure(query []byte) []byte {
+	reply := headerOnly(query)
+	reply[3] = reply[3]&^rcodeMask | rcodeServFail
+	return reply
+}
+
+// truncate returns reply as it may go over UDP: whole if it fits the size
+// the client can take, otherwise emptied with TC set so it asks again over
+// TCP. A query with additional records is assumed to carry an EDNS OPT.
+func truncate(query, reply []byte) []byte {
+	limit := 512
+	if binary.BigEndian.Uint16(query[10:12]) > 0 {
+		limit = maxUDPReply
+	}
+	if len(reply) <= limit {
+		return reply
+	}
+	short := headerOnly(reply)
+	short[2] |= flagTC
+	short[3] = reply[3] // Keep the rcode
+	return short
+}
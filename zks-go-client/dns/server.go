@@ -0,0 +1,239 @@
+// Package dns is the client's own resolver (--internal-dns). The system is
+// pointed at it instead of at public resolvers, and it forwards every query
+// with DNS-over-HTTPS (RFC 8484). The DoH connection is routed into the
+// tunnel like any other traffic, so queries leave through the Exit Peer,
+// encrypted, and nothing leaks to the local network's resolver whatever
+// the OS does with its DNS settings.
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultUpstream is the DoH server queries go to
+	DefaultUpstream = "https://1.1.1.1/dns-query"
+	// DefaultTimeout bounds one query's round trip to the upstream
+	DefaultTimeout = 5 * time.Second
+
+	// maxUDPReply is the reply size we send over UDP to clients that
+	// advertise EDNS, the DNS Flag Day 2020 value. Without EDNS it's 512.
+	// Larger replies are truncated so the client retries over TCP.
+	maxUDPReply = 1232
+	// tcpIdleTimeout closes a TCP client connection that sends nothing
+	tcpIdleTimeout = 10 * time.Second
+
+	mediaType = "application/dns-message"
+)
+
+// Options configures a Server
+type Options struct {
+	// Upstream is the DoH URL (empty = DefaultUpstream). Its host must be an
+	// IP address: a name would have to be resolved through this resolver.
+	Upstream string
+	// Timeout bounds each upstream query (0 = DefaultTimeout)
+	Timeout time.Duration
+}
+
+// UpstreamAddr checks that upstream is an https URL with an IP address
+// host and returns that address, which has to be routed into the tunnel
+func UpstreamAddr(upstream string) (netip.Addr, error) {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	if u.Scheme != "https" {
+		return netip.Addr{}, fmt.Errorf("DoH URL %q must use https", upstream)
+	}
+	addr, err := netip.ParseAddr(u.Hostname())
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("DoH URL %q must name the server by IP address (a host name would be resolved through the internal resolver itself)", upstream)
+	}
+	return addr, nil
+}
+
+// Server answers DNS over UDP and TCP on one address
+type Server struct {
+	opts   Options
+	client *http.Client
+
+	mu       sync.Mutex
+	udp      net.PacketConn
+	tcp      net.Listener
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewServer creates a resolver forwarding to DefaultUpstream
+func NewServer() *Server {
+	return NewServerWithOptions(Options{})
+}
+
+// NewServerWithOptions is NewServer with another upstream or timeout
+func NewServerWithOptions(opts Options) *Server {
+	if opts.Upstream == "" {
+		opts.Upstream = DefaultUpstream
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil // The point is to go through the tunnel
+	return &Server{
+		opts:   opts,
+		client: &http.Client{Transport: transport, Timeout: opts.Timeout},
+		done:   make(chan struct{}),
+	}
+}
+
+// Start listens on addr ("host:port") for UDP and TCP queries and answers
+// them until Stop is called, when it returns nil
+func (s *Server) Start(addr string) error {
+	udp, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	tcp, err := net.Listen("tcp", addr)
+	if err != nil {
+		udp.Close()
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	s.mu.Lock()
+	s.udp, s.tcp = udp, tcp
+	s.mu.Unlock()
+	select {
+	case <-s.done:
+		udp.Close()
+		tcp.Close()
+		return nil
+	default:
+	}
+
+	fmt.Printf("🧭 Internal DNS on %s, forwarding to %s\n", addr, s.opts.Upstream)
+	go s.serveTCP(tcp)
+
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := udp.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.done:
+				return nil
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			continue
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			reply := s.answer(query)
+			if reply == nil {
+				return
+			}
+			udp.WriteTo(truncate(query, reply), from)
+		}()
+	}
+}
+
+// Stop closes both listeners
+func (s *Server) Stop() {
+	s.stopOnce.Do(func() {
+		s.mu.Lock()
+		close(s.done)
+		if s.udp != nil {
+			s.udp.Close()
+			s.tcp.Close()
+		}
+		s.mu.Unlock()
+	})
+}
+
+// serveTCP answers length-prefixed queries (RFC 1035 4.2.2) on each connection
+func (s *Server) serveTCP(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				conn.SetDeadline(time.Now().Add(tcpIdleTimeout))
+				var size [2]byte
+				if _, err := io.ReadFull(conn, size[:]); err != nil {
+					return
+				}
+				query := make([]byte, binary.BigEndian.Uint16(size[:]))
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+				reply := s.answer(query)
+				if reply == nil {
+					return
+				}
+				conn.SetDeadline(time.Now().Add(s.opts.Timeout))
+				msg := binary.BigEndian.AppendUint16(nil, uint16(len(reply)))
+				if _, err := conn.Write(append(msg, reply...)); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// answer forwards query and returns the reply, SERVFAIL if the upstream
+// fails, or nil for something that isn't a DNS query
+func (s *Server) answer(query []byte) []byte {
+	if len(query) < headerLen || query[2]&flagQR != 0 {
+		return nil // Too short, or a response
+	}
+	reply, err := s.forward(query)
+	if err != nil {
+		fmt.Printf("⚠️ Internal DNS: %v\n", err)
+		return serverFailure(query)
+	}
+	return reply
+}
+
+// forward sends query to the DoH server (POST, RFC 8484 4.1)
+func (s *Server) forward(query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.opts.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.opts.Upstream, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", mediaType)
+	req.Header.Set("Accept", mediaType)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH server replied %s", resp.Status)
+	}
+	reply, err := io.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) < headerLen {
+		return nil, fmt.Errorf("DoH server sent a %d byte reply", len(reply))
+	}
+	copy(reply[0:2], query[0:2]) // Servers may zero the ID
+	return reply, nil
+}
@@ -0,0 +1,161 @@
+package entry
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zks-vpn/zks-go-client/metrics"
+)
+
+// How replies find their client
+//
+// Like the exit, the entry node sees no client identity in the packets
+// themselves, only the UDP address they came from and, when the client
+// sends raw IP, the packet's source: its TUN address. A client's TUN
+// address is bound to the UDP address it was last seen from, and replies
+// are sent to whichever client their destination is bound to.
+//
+// With --psk or WireGuard the packets are sealed end to end between client
+// and exit, and the entry node can't read any address. Replies then go to
+// the client that sent last, so such a node serves one client at a time.
+//
+// A TUN address moves to another UDP address (the client's NAT rebound, or
+// it restarted on a new port) once its old one has been silent for
+// takeoverAfter. Until then the newcomer's packets are dropped, so a
+// stranger can't redirect a live client's replies by claiming its address.
+
+// takeoverAfter is how long a TUN address must go quiet on one UDP address
+// before another may claim it
+const takeoverAfter = 15 * time.Second
+
+// client is one UDP address packets come from
+type client struct {
+	addr     netip.AddrPort
+	lastSeen atomic.Int64 // UnixNano of the last packet from the client
+	traffic  *metrics.PeerTraffic
+}
+
+func (c *client) touch() {
+	c.lastSeen.Store(time.Now().UnixNano())
+}
+
+// idleFor is how long the client has been silent, as of now
+func (c *client) idleFor(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, c.lastSeen.Load()))
+}
+
+// clientTable maps UDP addresses and the TUN addresses behind them to clients
+type clientTable struct {
+	mu     sync.Mutex
+	byAddr map[netip.AddrPort]*client
+	byIP   map[netip.Addr]*client
+	last   *client // Most recent sender, for replies whose address can't be read
+}
+
+func newClientTable() *clientTable {
+	return &clientTable{
+		byAddr: make(map[netip.AddrPort]*client),
+		byIP:   make(map[netip.Addr]*client),
+	}
+}
+
+// seen records a packet from the UDP address from carrying pkt, and
+// returns its client, and whether it is new. It fails when pkt's source
+// is another client's TUN address that is still in use.
+func (t *clientTable) seen(from netip.AddrPort, pkt []byte) (*client, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c, known := t.byAddr[from]
+	src, hasSrc := packetAddr(pkt, true)
+	if hasSrc {
+		if owner := t.byIP[src]; owner != nil && owner != c {
+			if idle := owner.idleFor(time.Now()); idle < takeoverAfter {
+				return nil, false, fmt.Errorf("%s is using %s, in use by %s (silent for %s)", from, src, owner.addr, idle.Round(time.Second))
+			}
+		}
+	}
+	if !known {
+		c = &client{addr: from, traffic: metrics.AddPeer(from.String())}
+		t.byAddr[from] = c
+	}
+	if hasSrc {
+		t.byIP[src] = c
+	}
+	c.touch()
+	t.last = c
+	return c, !known, nil
+}
+
+// route returns the client a reply goes to, or nil if there's none
+func (t *clientTable) route(pkt []byte) *client {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if dst, ok := packetAddr(pkt, false); ok {
+		return t.byIP[dst]
+	}
+	return t.last
+}
+
+// expire forgets the clients silent for longer than idle and returns them
+func (t *clientTable) expire(idle time.Duration) []*client {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	var expired []*client
+	for addr, c := range t.byAddr {
+		if c.idleFor(now) > idle {
+			delete(t.byAddr, addr)
+			expired = append(expired, c)
+			c.traffic.Remove()
+		}
+	}
+	for ip, c := range t.byIP {
+		if t.byAddr[c.addr] != c {
+			delete(t.byIP, ip)
+		}
+	}
+	if t.last != nil && t.byAddr[t.last.addr] != t.last {
+		t.last = nil
+	}
+	return expired
+}
+
+func (t *clientTable) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.byAddr)
+}
+
+// packetAddr returns the source (or destination) address of pkt when it is
+// a plain IPv4 or IPv6 packet. Its length must match the header's, which
+// an encrypted datagram passes only by chance (1 in 65536).
+func packetAddr(pkt []byte, source bool) (netip.Addr, bool) {
+	if len(pkt) < 1 {
+		return netip.Addr{}, false
+	}
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < 20 || pkt[0]&0x0f < 5 || int(binary.BigEndian.Uint16(pkt[2:4])) != len(pkt) {
+			return netip.Addr{}, false
+		}
+		if source {
+			return netip.AddrFrom4([4]byte(pkt[12:16])), true
+		}
+		return netip.AddrFrom4([4]byte(pkt[16:20])), true
+	case 6:
+		if len(pkt) < 40 || int(binary.BigEndian.Uint16(pkt[4:6]))+40 != len(pkt) {
+			return netip.Addr{}, false
+		}
+		if source {
+			return netip.AddrFrom16([16]byte(pkt[8:24])), true
+		}
+		return netip.AddrFrom16([16]byte(pkt[24:40])), true
+	}
+	return netip.Addr{}, false
+}
@@ -0,0 +1,280 @@
+// Package entry implements the Entry Node: the UDP gateway that clients
+// with --transport udp (vpn.UDPTransport) send their packets to.
+//
+// It listens on a UDP port, takes every datagram as one packet, and
+// forwards it over a single relay connection to the Exit Peer in its room,
+// which sees the entry node as one more client link and tells the clients
+// behind it apart by their TUN addresses (see exit/session.go). Replies
+// come back the same way and go out as datagrams to the client they are
+// addressed to (see client.go).
+//
+// The entry node only moves packets. --psk, WireGuard, --sequence and
+// --fragment-size work end to end between client and exit, which must agree
+// on them; the entry node neither needs nor gets them.
+package entry
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/zks-vpn/zks-go-client/bufpool"
+	"github.com/zks-vpn/zks-go-client/events"
+	"github.com/zks-vpn/zks-go-client/metrics"
+	"github.com/zks-vpn/zks-go-client/protocol"
+	"github.com/zks-vpn/zks-go-client/relay"
+	"github.com/zks-vpn/zks-go-client/vpn"
+)
+
+const (
+	// DefaultListen is the UDP address clients reach the entry node on
+	DefaultListen = ":51820"
+	// DefaultClientIdleTimeout is how long a client's UDP address is
+	// remembered without a packet from it
+	DefaultClientIdleTimeout = 2 * time.Minute
+
+	// outQueueSize bounds the number of client packets waiting for the relay
+	outQueueSize = 1024
+	// maxBatch caps how many client packets are coalesced into one BatchIpPacket
+	maxBatch = 64
+)
+
+// Options configures an EntryNode
+type Options struct {
+	// Listen is the UDP address to serve clients on (empty = DefaultListen)
+	Listen string
+	// ClientIdleTimeout forgets a client after this long without a packet
+	// from it. Zero means DefaultClientIdleTimeout.
+	ClientIdleTimeout time.Duration
+	// Relay configures the link to the Exit Peer
+	Relay vpn.RelayTransportOptions
+}
+
+// EntryNode bridges clients' UDP datagrams to the relay and back
+type EntryNode struct {
+	opts      Options
+	conn      *relay.Connection
+	transport vpn.Transport
+	udp       *net.UDPConn
+	clients   *clientTable
+
+	out chan []byte
+
+	dropLogged bool // Only touched by recvLoop
+
+	errOnce  sync.Once
+	err      error
+	failed   chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewEntryNode listens on opts.Listen for the clients to forward over conn
+func NewEntryNode(conn *relay.Connection, opts Options) (*EntryNode, error) {
+	if opts.Listen == "" {
+		opts.Listen = DefaultListen
+	}
+	if opts.ClientIdleTimeout <= 0 {
+		opts.ClientIdleTimeout = DefaultClientIdleTimeout
+	}
+	addr, err := net.ResolveUDPAddr("udp", opts.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address %q: %w", opts.Listen, err)
+	}
+	udp, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", opts.Listen, err)
+	}
+	return &EntryNode{
+		opts:      opts,
+		conn:      conn,
+		transport: vpn.NewRelayTransportWithOptions(conn, opts.Relay),
+		udp:       udp,
+		clients:   newClientTable(),
+		out:       make(chan []byte, outQueueSize),
+		failed:    make(chan struct{}),
+		done:      make(chan struct{}),
+	}, nil
+}
+
+// Addr is the UDP address the entry node listens on
+func (n *EntryNode) Addr() net.Addr {
+	return n.udp.LocalAddr()
+}
+
+// Start forwards packets until the relay connection or the UDP socket
+// fails, or Stop is called
+func (n *EntryNode) Start() error {
+	log.Printf("🚪 Entry Node forwarding started on udp %s (client idle timeout: %s)", n.Addr(), n.opts.ClientIdleTimeout)
+
+	go n.recvLoop()
+	go n.sendLoop()
+	go n.relayLoop()
+	go n.cleanupLoop()
+
+	select {
+	case <-n.failed:
+		n.Stop()
+		return n.err
+	case <-n.done:
+		return nil
+	}
+}
+
+// Stop closes the UDP socket and stops the forwarding loops. The relay
+// connection is the caller's to close.
+func (n *EntryNode) Stop() {
+	n.stopOnce.Do(func() {
+		close(n.done)
+		n.udp.Close()
+	})
+}
+
+// fail makes Start return err, unless the entry node is stopping anyway
+func (n *EntryNode) fail(err error) {
+	select {
+	case <-n.done:
+		return
+	default:
+	}
+	n.errOnce.Do(func() {
+		n.err = err
+		close(n.failed)
+	})
+}
+
+// recvLoop reads client datagrams and queues them for the relay
+func (n *EntryNode) recvLoop() {
+	for {
+		buf := bufpool.Get()
+		size, from, err := n.udp.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			bufpool.Put(buf)
+			n.fail(fmt.Errorf("udp recv error: %w", err))
+			return
+		}
+		if size == len(buf) {
+			// Filled the buffer: the kernel discarded the rest of the datagram
+			bufpool.Put(buf)
+			metrics.OversizedPackets.Inc()
+			metrics.DroppedPackets.Inc()
+			continue
+		}
+		pkt := buf[:size]
+		from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+
+		c, isNew, err := n.clients.seen(from, pkt)
+		if err != nil {
+			bufpool.Put(buf)
+			metrics.DroppedPackets.Inc()
+			if !n.dropLogged {
+				n.dropLogged = true
+				log.Printf("⚠️ Dropping packets: %v", err)
+			}
+			continue
+		}
+		if isNew {
+			log.Printf("👤 Client %s joined (%d clients)", from, n.clients.len())
+			events.Emit("peer_joined", events.Fields{"client": from.String(), "room": n.conn.RoomID(), "clients": n.clients.len()})
+		}
+		c.traffic.Received(size)
+
+		select {
+		case n.out <- pkt:
+		default:
+			bufpool.Put(buf)
+			metrics.DroppedPackets.Inc()
+		}
+	}
+}
+
+// sendLoop drains queued client packets and sends them over the relay.
+// Like the exit's, it batches whatever is queued without holding a lone
+// packet back.
+func (n *EntryNode) sendLoop() {
+	for {
+		var pkt []byte
+		select {
+		case pkt = <-n.out:
+		case <-n.done:
+			return
+		}
+
+		batch := [][]byte{pkt}
+	drain:
+		for len(batch) < maxBatch {
+			select {
+			case pkt = <-n.out:
+				batch = append(batch, pkt)
+			default:
+				break drain
+			}
+		}
+
+		if err := n.transport.SendBatch(batch); err != nil {
+			log.Printf("⚠️ Entry Node send error: %v", err)
+		}
+		for _, pkt := range batch {
+			bufpool.Put(pkt)
+		}
+	}
+}
+
+// relayLoop sends the Exit Peer's replies to their clients
+func (n *EntryNode) relayLoop() {
+	for {
+		msg, err := n.transport.Recv()
+		if err != nil {
+			n.fail(fmt.Errorf("relay recv error: %w", err))
+			return
+		}
+		switch m := msg.(type) {
+		case *protocol.IpPacket:
+			n.reply(m.Payload)
+		case *protocol.BatchIpPacket:
+			for _, pkt := range m.Packets {
+				n.reply(pkt)
+			}
+		default:
+			log.Printf("⚠️ Entry Node ignoring message type 0x%02x", msg.Type())
+		}
+	}
+}
+
+// reply sends pkt to the client it is addressed to, dropping it if there's none
+func (n *EntryNode) reply(pkt []byte) {
+	c := n.clients.route(pkt)
+	if c == nil {
+		metrics.DroppedPackets.Inc()
+		return
+	}
+	if _, err := n.udp.WriteToUDPAddrPort(pkt, c.addr); err != nil {
+		metrics.TransportSendErrors.Inc()
+		return
+	}
+	c.traffic.Sent(len(pkt))
+}
+
+// cleanupLoop periodically forgets idle clients
+func (n *EntryNode) cleanupLoop() {
+	interval := n.opts.ClientIdleTimeout / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, c := range n.clients.expire(n.opts.ClientIdleTimeout) {
+				log.Printf("👋 Forgot idle client %s (%d clients)", c.addr, n.clients.len())
+			}
+		case <-n.done:
+			return
+		}
+	}
+}
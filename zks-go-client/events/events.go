@@ -0,0 +1,83 @@
+// Package events writes the client's lifecycle as newline-delimited JSON
+// (--json-events), for GUIs and scripts that shouldn't parse the emoji
+// output. Each line is one object with "time", "type" and the event's
+// fields, e.g.
+//
+//	{"time":"2026-01-02T15:04:05.123Z","type":"connected","relay":"wss://...","room":"demo"}
+//
+// Types: connecting, connected, reconnecting, tunnel_up, peer_joined,
+// bytes_update, error and shutdown. Emit is a no-op until Open is called.
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultBytesInterval is how often bytes_update is sent when
+// --traffic-report-interval doesn't set it
+const DefaultBytesInterval = 5 * time.Second
+
+// Fields are an event's payload next to its type
+type Fields map[string]any
+
+var (
+	mu  sync.Mutex
+	out io.Writer
+)
+
+// Open starts the event stream on "stdout", "stderr" or a file path, which
+// is appended to (a named pipe works too). The human output moves out of
+// the way so the stream carries nothing else: with stdout, fmt prints go to
+// stderr; with stderr, log lines go to stdout.
+func Open(target string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	switch target {
+	case "stdout":
+		out = os.Stdout
+		os.Stdout = os.Stderr
+	case "stderr":
+		out = os.Stderr
+		log.SetOutput(os.Stdout)
+	default:
+		f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return fmt.Errorf("json events: %w", err)
+		}
+		out = f
+	}
+	return nil
+}
+
+// Enabled reports whether Open was called
+func Enabled() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return out != nil
+}
+
+// Emit writes one event. Fields may be nil.
+func Emit(typ string, fields Fields) {
+	mu.Lock()
+	defer mu.Unlock()
+	if out == nil {
+		return
+	}
+	event := make(Fields, len(fields)+2)
+	for k, v := range fields {
+		event[k] = v
+	}
+	event["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	event["type"] = typ
+	line, err := json.Marshal(event)
+	if err != nil {
+		line, _ = json.Marshal(Fields{"type": "error", "message": fmt.Sprintf("event %s: %v", typ, err)})
+	}
+	out.Write(append(line, '\n'))
+}
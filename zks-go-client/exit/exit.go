@@ -0,0 +1,569 @@
+// Package exit implements the Exit Peer side of the VPN.
+// It receives raw IP packets from the client over the relay, forwards them
+// through the host's network stack using ordinary sockets (userspace NAT),
+// and returns the replies to the client as IP packets. With Options.Netstack,
+// TCP and UDP are terminated by a gVisor userspace stack instead.
+package exit
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/zks-vpn/zks-go-client/events"
+	"github.com/zks-vpn/zks-go-client/protocol"
+	"github.com/zks-vpn/zks-go-client/relay"
+	"github.com/zks-vpn/zks-go-client/vpn"
+	"github.com/zks-vpn/zks-go-client/wgproto"
+)
+
+const (
+	// DefaultIdleTimeout is how long a flow may stay silent before it is reaped
+	DefaultIdleTimeout = 2 * time.Minute
+
+	// outQueueSize bounds the number of reply packets waiting for the relay
+	outQueueSize = 1024
+	// maxReplyBatch caps how many reply packets are coalesced into one BatchIpPacket
+	maxReplyBatch = 64
+)
+
+// Options configures an ExitPeer
+type Options struct {
+	// IdleTimeout closes flows with no traffic in either direction for this long.
+	// Zero means DefaultIdleTimeout.
+	IdleTimeout time.Duration
+	// ClientIdleTimeout evicts a client session after this long without a packet
+	// from it. Zero means DefaultClientIdleTimeout.
+	ClientIdleTimeout time.Duration
+	// SessionResumeTimeout keeps the session of a client whose link went away
+	// this long for it to come back with its session token. Zero means
+	// DefaultSessionResumeTimeout.
+	SessionResumeTimeout time.Duration
+	// ClientSubnet is the pool client addresses are leased or suggested from.
+	// The zero value means DefaultClientSubnet.
+	ClientSubnet netip.Prefix
+	// PSK, if set, is the passphrase the client uses with --psk.
+	// Packets are then decrypted/encrypted with vpn.EncryptedTransport,
+	// or it becomes the WireGuard preshared key.
+	PSK string
+	// FragmentSize, when positive, splits replies larger than this many
+	// bytes and reassembles fragmented packets, like the client's --fragment-size
+	FragmentSize int
+	// WireGuard, if set, answers the clients' WireGuard handshakes (see
+	// wgproto); only clients whose public keys are listed get through
+	WireGuard *wgproto.Options
+	// Compress DEFLATEs reply batches when the client supports it
+	Compress bool
+	// AllowedRooms, if set, are the only rooms AddClient accepts
+	// connections for
+	AllowedRooms []string
+	// MaxMessageSize splits reply batches larger than this many bytes
+	// (0 = vpn.DefaultMaxMessageSize)
+	MaxMessageSize int
+	// Sequence numbers packets like the client's --sequence, which it must
+	// match. DropDuplicates drops repeated packets instead of only counting them.
+	Sequence       bool
+	DropDuplicates bool
+	// Netstack forwards TCP and UDP through gVisor's userspace TCP/IP stack
+	// instead of the built-in flows, see netstack.go. Like the rest of the
+	// exit it is IPv4-only.
+	Netstack bool
+}
+
+// ExitPeer forwards client IP packets to the internet and relays replies back.
+// It can serve several clients at once, see session.go.
+type ExitPeer struct {
+	opts     Options
+	flows    *flowTable
+	sessions *sessionTable
+	hop      netip.Addr // Source of the exit's own ICMP errors
+	netstack *netstack  // nil unless Options.Netstack
+
+	mu      sync.Mutex
+	links   []*clientLink
+	started bool
+	lastErr error
+
+	allDown  chan struct{} // closed when the last link goes away
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewExitPeer creates an ExitPeer serving the client(s) on the other end of conn
+func NewExitPeer(conn *relay.Connection, opts Options) (*ExitPeer, error) {
+	if opts.IdleTimeout <= 0 {
+		opts.IdleTimeout = DefaultIdleTimeout
+	}
+	if opts.ClientIdleTimeout <= 0 {
+		opts.ClientIdleTimeout = DefaultClientIdleTimeout
+	}
+	if opts.SessionResumeTimeout <= 0 {
+		opts.SessionResumeTimeout = DefaultSessionResumeTimeout
+	}
+	if !opts.ClientSubnet.IsValid() {
+		opts.ClientSubnet = DefaultClientSubnet
+	}
+
+	e := &ExitPeer{
+		opts:     opts,
+		flows:    newFlowTable(),
+		sessions: newSessionTable(opts.ClientSubnet),
+		hop:      hopAddr(opts.ClientSubnet),
+		allDown:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if opts.Netstack {
+		ns, err := newNetstack(e)
+		if err != nil {
+			return nil, err
+		}
+		e.netstack = ns
+	}
+	if err := e.AddClient(conn); err != nil {
+		e.Stop()
+		return nil, err
+	}
+	return e, nil
+}
+
+// AddClient serves another relay connection, e.g. one per room.
+// It may be called before or after Start.
+func (e *ExitPeer) AddClient(conn *relay.Connection) error {
+	if e.opts.AllowedRooms != nil && !slices.Contains(e.opts.AllowedRooms, conn.RoomID()) {
+		log.Printf("🚫 Refusing clients in room %s: it is not an allowed room", conn.RoomID())
+		return fmt.Errorf("room %s is not allowed", conn.RoomID())
+	}
+	var transport vpn.Transport = vpn.NewRelayTransportWithOptions(conn, vpn.RelayTransportOptions{Compress: e.opts.Compress, MaxMessageSize: e.opts.MaxMessageSize})
+	if e.opts.FragmentSize > 0 {
+		fragmenting, err := vpn.NewFragmentingTransport(transport, vpn.FragmentOptions{MaxPacket: e.opts.FragmentSize})
+		if err != nil {
+			return err
+		}
+		transport = fragmenting
+	}
+	if e.opts.WireGuard != nil {
+		wgOpts := *e.opts.WireGuard
+		if e.opts.PSK != "" {
+			key, err := protocol.DerivePSK(conn.RoomID(), e.opts.PSK)
+			if err != nil {
+				return err
+			}
+			wgOpts.PresharedKey = key
+		}
+		wg, err := wgproto.NewTransport(transport, wgOpts)
+		if err != nil {
+			return err
+		}
+		transport = wg
+	} else if e.opts.PSK != "" {
+		encrypted, err := vpn.NewEncryptedTransport(transport, conn.RoomID(), e.opts.PSK)
+		if err != nil {
+			return err
+		}
+		transport = encrypted
+	}
+	if e.opts.Sequence {
+		transport = vpn.NewSequencedTransport(transport, vpn.SequencedTransportOptions{DropDuplicates: e.opts.DropDuplicates})
+	}
+
+	l := &clientLink{
+		conn:      conn,
+		transport: transport,
+		assocs:    newAssocTable(),
+		out:       make(chan []byte, outQueueSize),
+		done:      make(chan struct{}),
+	}
+
+	// A client that announced its address in the Hello gets it reserved up
+	// front. Clients that take leases are told which address to use: the one
+	// their session token already holds, the one they asked for if it's free,
+	// otherwise the next free one in ClientSubnet. The Lease is resent until
+	// the client acknowledges it.
+	caps := conn.Capabilities()
+	l.hellos = conn.PeerHellos()
+	addr, err := netip.ParseAddr(caps.PeerIP)
+	if s, ok := e.sessions.resume(caps.PeerSession, l); ok {
+		addr, err = s.addr, nil
+		log.Printf("🔁 Client %s resumed its session via room %s", addr, conn.RoomID())
+	} else if err == nil {
+		var evicted *clientSession
+		if _, evicted, _, err = e.sessions.bind(addr, l, caps.PeerSession); err != nil && !caps.Features.Has(protocol.FeatureLease) {
+			log.Printf("⚠️ Client in room %s: %v", conn.RoomID(), err)
+		}
+		e.closeEvicted(evicted)
+	}
+	if caps.Features.Has(protocol.FeatureLease) {
+		if err != nil {
+			addr, err = e.sessions.bindFree(l, caps.PeerSession)
+		}
+		if err != nil {
+			log.Printf("⚠️ No address to lease to the client in room %s: %v", conn.RoomID(), err)
+		} else if err := conn.SendControl(context.Background(), &protocol.Lease{IP: addr.String(), PrefixLen: uint8(e.opts.ClientSubnet.Bits())}); err != nil {
+			log.Printf("⚠️ Failed to send lease to room %s: %v", conn.RoomID(), err)
+		} else {
+			log.Printf("📇 Leased %s to the client in room %s", addr, conn.RoomID())
+		}
+	}
+
+	e.mu.Lock()
+	e.links = append(e.links, l)
+	started := e.started
+	e.mu.Unlock()
+
+	if started {
+		go e.runLink(l)
+	}
+	return nil
+}
+
+// Start processes packets until every relay connection has failed or Stop is called
+func (e *ExitPeer) Start() error {
+	log.Printf("🚪 Exit Peer forwarding started (flow idle timeout: %s, client idle timeout: %s, session resume timeout: %s)",
+		e.opts.IdleTimeout, e.opts.ClientIdleTimeout, e.opts.SessionResumeTimeout)
+	if e.netstack != nil {
+		log.Printf("   TCP and UDP go through the gVisor netstack")
+	}
+
+	e.mu.Lock()
+	e.started = true
+	links := append([]*clientLink(nil), e.links...)
+	e.mu.Unlock()
+
+	for _, l := range links {
+		go e.runLink(l)
+	}
+	go e.cleanupLoop()
+
+	select {
+	case <-e.allDown:
+		e.Stop()
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		return e.lastErr
+	case <-e.done:
+		return nil
+	}
+}
+
+// Stop closes all flows and stops the forwarding loops
+func (e *ExitPeer) Stop() {
+	e.stopOnce.Do(func() {
+		close(e.done)
+		e.flows.closeAll()
+		if e.netstack != nil {
+			e.netstack.close()
+		}
+
+		e.mu.Lock()
+		links := e.links
+		e.mu.Unlock()
+		for _, l := range links {
+			l.assocs.closeAll()
+		}
+	})
+}
+
+// runLink forwards packets from one relay connection until it fails
+func (e *ExitPeer) runLink(l *clientLink) {
+	go e.sendLoop(l)
+
+	// Relay -> Internet
+	for {
+		msg, err := l.transport.Recv()
+		if err != nil {
+			e.dropLink(l, fmt.Errorf("relay recv error: %v", err))
+			return
+		}
+		if n := l.conn.PeerHellos(); n != l.hellos {
+			l.hellos = n
+			e.peerHello(l)
+		}
+
+		switch m := msg.(type) {
+		case *protocol.IpPacket:
+			e.forward(l, m.Payload)
+		case *protocol.BatchIpPacket:
+			for _, pkt := range m.Packets {
+				e.forward(l, pkt)
+			}
+		case *protocol.UdpDatagram:
+			e.forwardDatagram(l, m)
+		case *protocol.Close:
+			l.assocs.close(m.StreamID)
+		default:
+			log.Printf("⚠️ Exit Peer ignoring message type 0x%02x", msg.Type())
+		}
+	}
+}
+
+// dropLink forgets a failed link and its clients. When it was the last one
+// Start returns err.
+func (e *ExitPeer) dropLink(l *clientLink, err error) {
+	e.mu.Lock()
+	for i, other := range e.links {
+		if other == l {
+			e.links = append(e.links[:i], e.links[i+1:]...)
+			break
+		}
+	}
+	remaining := len(e.links)
+	e.lastErr = err
+	e.mu.Unlock()
+
+	close(l.done)
+	l.assocs.closeAll()
+	dropped, detached := e.sessions.dropLink(l)
+	for _, s := range dropped {
+		e.flows.closeClient(s.addr)
+	}
+
+	select {
+	case <-e.done:
+		return
+	default:
+	}
+	log.Printf("⚠️ Client link for room %s closed: %v (%d links left)", l.conn.RoomID(), err, remaining)
+	if detached > 0 {
+		log.Printf("⏳ Keeping %d client sessions for %s in case they resume", detached, e.opts.SessionResumeTimeout)
+	}
+	if remaining == 0 {
+		close(e.allDown)
+	}
+}
+
+// peerHello handles the client on l saying Hello again after a reconnect.
+// With the token it had before it carries on where it left off; with a new
+// one it's a fresh start, and whatever it left open is closed.
+func (e *ExitPeer) peerHello(l *clientLink) {
+	if s := e.sessions.restarted(l, l.peerSession()); s != nil {
+		n := e.flows.closeClient(s.addr)
+		log.Printf("🔄 Client %s in room %s restarted (%d flows closed)", s.addr, l.conn.RoomID(), n)
+	}
+}
+
+// closeEvicted closes the flows of a detached session whose address was
+// taken by another client
+func (e *ExitPeer) closeEvicted(s *clientSession) {
+	if s == nil {
+		return
+	}
+	n := e.flows.closeClient(s.addr)
+	log.Printf("👋 Client %s did not resume its session (%d flows closed)", s.addr, n)
+}
+
+// forward dispatches a single client packet to its flow, creating the flow if needed
+func (e *ExitPeer) forward(l *clientLink, pkt []byte) {
+	ip, ok := parseIPv4(pkt)
+	if !ok {
+		return // Only IPv4 is forwarded for now
+	}
+
+	sess := e.sessions.get(ip.Src)
+	if sess == nil || sess.link.Load() != l {
+		var evicted *clientSession
+		var result bindResult
+		var err error
+		sess, evicted, result, err = e.sessions.bind(ip.Src, l, l.peerSession())
+		if err != nil {
+			if !l.conflictLogged.Swap(true) {
+				log.Printf("⚠️ Dropping packets from room %s: %v", l.conn.RoomID(), err)
+			}
+			return
+		}
+		e.closeEvicted(evicted)
+		switch result {
+		case bindNew:
+			log.Printf("👤 Client %s joined via room %s (%d clients)", ip.Src, l.conn.RoomID(), e.sessions.len())
+			events.Emit("peer_joined", events.Fields{"client": ip.Src.String(), "room": l.conn.RoomID(), "clients": e.sessions.len()})
+		case bindResumed:
+			log.Printf("🔁 Client %s resumed its session via room %s", ip.Src, l.conn.RoomID())
+		}
+	}
+	sess.touch()
+	sess.traffic.Received(len(pkt))
+
+	// Like a router: a packet with nowhere left to go is answered with time
+	// exceeded from our hop address, which makes the exit show up in
+	// traceroute. The rest leave with one hop less.
+	if ip.TTL <= 1 {
+		if !isICMPError(ip) {
+			e.reply(buildTimeExceeded(e.hop, pkt, ip))
+		}
+		return
+	}
+	ip.TTL = decrementTTL(pkt)
+
+	key, ok := flowKeyFor(ip)
+	if !ok {
+		return
+	}
+	if e.netstack != nil && key.Proto != protoICMP {
+		if entry := e.flows.get(key); entry != nil {
+			entry.touch()
+		}
+		e.netstack.inject(pkt)
+		return
+	}
+
+	entry := e.flows.get(key)
+	if entry == nil {
+		entry = e.newFlow(key, ip)
+		if entry == nil {
+			return
+		}
+	}
+	entry.touch()
+	entry.flow.handle(ip)
+}
+
+// flowKeyFor extracts the flow key from a packet's transport header
+func flowKeyFor(ip ipv4Packet) (flowKey, bool) {
+	p := ip.Payload
+	switch ip.Proto {
+	case protoTCP, protoUDP:
+		if len(p) < 4 {
+			return flowKey{}, false
+		}
+		return flowKey{
+			Proto: ip.Proto,
+			Src:   netip.AddrPortFrom(ip.Src, uint16(p[0])<<8|uint16(p[1])),
+			Dst:   netip.AddrPortFrom(ip.Dst, uint16(p[2])<<8|uint16(p[3])),
+		}, true
+	case protoICMP:
+		if len(p) < icmpHeaderLen || p[0] != icmpEchoRequest {
+			return flowKey{}, false
+		}
+		return flowKey{
+			Proto: protoICMP,
+			Src:   netip.AddrPortFrom(ip.Src, uint16(p[4])<<8|uint16(p[5])),
+			Dst:   netip.AddrPortFrom(ip.Dst, 0),
+		}, true
+	}
+	return flowKey{}, false
+}
+
+// newFlow creates and registers the flow for key. Returns nil if the packet
+// cannot start a flow or the outbound socket could not be opened.
+func (e *ExitPeer) newFlow(key flowKey, ip ipv4Packet) *flowEntry {
+	entry := newFlowEntry()
+
+	// The constructors return typed nil pointers when there's no flow to
+	// start, so check each one before it goes into the interface
+	var err error
+	switch key.Proto {
+	case protoTCP:
+		var f *tcpFlow
+		if f, err = newTCPFlow(e, entry, key, ip); f != nil {
+			entry.flow = f
+		}
+	case protoUDP:
+		var f *udpFlow
+		if f, err = newUDPFlow(e, entry, key); f != nil {
+			entry.flow = f
+		}
+	case protoICMP:
+		var f *icmpFlow
+		if f, err = newICMPFlow(e, entry, key); f != nil {
+			entry.flow = f
+		}
+	}
+	if err != nil {
+		log.Printf("⚠️ Exit flow %s -> %s failed: %v", key.Src, key.Dst, err)
+		return nil
+	}
+	if entry.flow == nil {
+		return nil
+	}
+
+	e.flows.add(key, entry)
+	return entry
+}
+
+// reply queues a packet for delivery to the client it is addressed to,
+// dropping it if that client is gone or its queue is full
+func (e *ExitPeer) reply(pkt []byte) {
+	if len(pkt) < 20 {
+		return
+	}
+	sess := e.sessions.get(netip.AddrFrom4([4]byte(pkt[16:20])))
+	if sess == nil {
+		return
+	}
+	l := sess.link.Load()
+	if l == nil {
+		return // Detached, waiting for the client to resume
+	}
+	select {
+	case l.out <- pkt:
+		sess.traffic.Sent(len(pkt))
+	default:
+	}
+}
+
+// sendLoop drains queued replies and sends them over l.
+// Like the TUN reader it batches opportunistically: whatever is queued
+// goes out together, but a lone packet is never held back.
+func (e *ExitPeer) sendLoop(l *clientLink) {
+	for {
+		var pkt []byte
+		select {
+		case pkt = <-l.out:
+		case <-l.done:
+			return
+		case <-e.done:
+			return
+		}
+
+		batch := [][]byte{pkt}
+	drain:
+		for len(batch) < maxReplyBatch {
+			select {
+			case pkt = <-l.out:
+				batch = append(batch, pkt)
+			default:
+				break drain
+			}
+		}
+
+		if err := l.transport.SendBatch(batch); err != nil {
+			log.Printf("⚠️ Exit Peer send error: %v", err)
+		}
+	}
+}
+
+// cleanupLoop periodically reaps idle flows and evicts idle clients
+func (e *ExitPeer) cleanupLoop() {
+	interval := e.opts.IdleTimeout / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if n := e.flows.expire(e.opts.IdleTimeout); n > 0 {
+				log.Printf("🧹 Closed %d idle flows (%d active)", n, e.flows.len())
+			}
+			e.mu.Lock()
+			links := append([]*clientLink(nil), e.links...)
+			e.mu.Unlock()
+			for _, l := range links {
+				if n := l.assocs.expire(e.opts.IdleTimeout); n > 0 {
+					log.Printf("🧹 Closed %d idle UDP associations", n)
+				}
+			}
+			for _, s := range e.sessions.expire(e.opts.ClientIdleTimeout, e.opts.SessionResumeTimeout) {
+				n := e.flows.closeClient(s.addr)
+				log.Printf("👋 Evicted idle client %s (%d flows closed)", s.addr, n)
+			}
+		case <-e.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package exit
+
+import (
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How return traffic finds its way back
+//
+// The flow table is the exit's source NAT. Each flow owns an ordinary host
+// socket (a connected UDP socket, a TCP connection, an ICMP echo socket), so
+// on the way out the kernel picks the exit's own address and an ephemeral
+// port, exactly as a NAT would rewrite 10.0.85.x:port. On the way back the
+// reply arrives on that socket, which identifies the flow, and the flow
+// rebuilds an IP packet from its flowKey with the remote as source and the
+// client's address and port as destination (see buildUDP, buildTCP,
+// buildICMP). The session table then picks the link to send it on.
+//
+// Entries expire after Options.IdleTimeout without traffic in either
+// direction, when their client is evicted, or, for TCP, when the connection
+// closes. Expiry closes the socket, which releases the kernel's mapping too.
+// Using sockets rather than rewriting raw packets keeps the exit unprivileged
+// (only ICMP may fall back to a raw socket, see icmp.go) and lets the host's
+// firewall and routing apply as usual.
+
+// hopLimit sends a flow's packets on with the TTL they arrived with (one
+// less, see forward) instead of the host default, so traceroute probes
+// expire at the right hop beyond the exit. TCP is terminated at the exit,
+// so its segments always leave with the host default.
+type hopLimit struct {
+	ttl byte
+	set func(int) error
+}
+
+// apply sets the socket TTL when it changes; a failure leaves the default
+func (h *hopLimit) apply(ttl byte) {
+	if ttl != h.ttl {
+		h.ttl = ttl
+		h.set(int(ttl))
+	}
+}
+
+// flowKey identifies a flow by protocol and the client-side 5-tuple.
+// For ICMP echo the echo identifier is stored in Src's port.
+type flowKey struct {
+	Proto byte
+	Src   netip.AddrPort
+	Dst   netip.AddrPort
+}
+
+// flow is a single forwarded connection owned by the flow table
+type flow interface {
+	// handle processes one packet from the client belonging to this flow
+	handle(pkt ipv4Packet)
+	// close releases the flow's sockets and goroutines
+	close()
+}
+
+type flowEntry struct {
+	flow     flow
+	lastSeen atomic.Int64 // UnixNano of last activity in either direction
+}
+
+func newFlowEntry() *flowEntry {
+	e := &flowEntry{}
+	e.touch()
+	return e
+}
+
+func (e *flowEntry) touch() {
+	e.lastSeen.Store(time.Now().UnixNano())
+}
+
+// flowTable tracks active flows so return traffic reaches the right client endpoint
+type flowTable struct {
+	mu    sync.Mutex
+	flows map[flowKey]*flowEntry
+}
+
+func newFlowTable() *flowTable {
+	return &flowTable{flows: make(map[flowKey]*flowEntry)}
+}
+
+func (t *flowTable) get(key flowKey) *flowEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.flows[key]
+}
+
+// add registers a flow entry; e.flow must already be set
+func (t *flowTable) add(key flowKey, e *flowEntry) {
+	t.mu.Lock()
+	t.flows[key] = e
+	t.mu.Unlock()
+}
+
+// remove drops e from the table without closing it.
+// A newer entry registered under the same key is left alone.
+func (t *flowTable) remove(key flowKey, e *flowEntry) {
+	t.mu.Lock()
+	if t.flows[key] == e {
+		delete(t.flows, key)
+	}
+	t.mu.Unlock()
+}
+
+// expire closes and removes flows idle for longer than timeout
+func (t *flowTable) expire(timeout time.Duration) int {
+	cutoff := time.Now().Add(-timeout).UnixNano()
+	var stale []flow
+
+	t.mu.Lock()
+	for key, e := range t.flows {
+		if e.lastSeen.Load() < cutoff {
+			stale = append(stale, e.flow)
+			delete(t.flows, key)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, f := range stale {
+		f.close()
+	}
+	return len(stale)
+}
+
+// closeClient closes and removes every flow started by the client at addr
+func (t *flowTable) closeClient(addr netip.Addr) int {
+	var gone []flow
+
+	t.mu.Lock()
+	for key, e := range t.flows {
+		if key.Src.Addr() == addr {
+			gone = append(gone, e.flow)
+			delete(t.flows, key)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, f := range gone {
+		f.close()
+	}
+	return len(gone)
+}
+
+// closeAll closes and removes every flow
+func (t *flowTable) closeAll() {
+	t.mu.Lock()
+	flows := t.flows
+	t.flows = make(map[flowKey]*flowEntry)
+	t.mu.Unlock()
+
+	for _, e := range flows {
+		e.flow.close()
+	}
+}
+
+func (t *flowTable) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.flows)
+}
@@ -0,0 +1,100 @@
+package exit
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// stubFlow records whether the flow table closed it
+type stubFlow struct{ closed bool }
+
+func (f *stubFlow) handle(ipv4Packet) {}
+func (f *stubFlow) close()            { f.closed = true }
+
+func TestFlowTableExpire(t *testing.T) {
+	table := newFlowTable()
+	idle, active := &stubFlow{}, &stubFlow{}
+	idleKey := flowKey{Proto: protoUDP, Src: netip.MustParseAddrPort("10.0.0.2:1000"), Dst: netip.MustParseAddrPort("192.0.2.1:53")}
+	activeKey := flowKey{Proto: protoUDP, Src: netip.MustParseAddrPort("10.0.0.2:1001"), Dst: netip.MustParseAddrPort("192.0.2.1:53")}
+
+	entry := newFlowEntry()
+	entry.flow = idle
+	entry.lastSeen.Store(time.Now().Add(-time.Hour).UnixNano())
+	table.add(idleKey, entry)
+	entry = newFlowEntry()
+	entry.flow = active
+	table.add(activeKey, entry)
+
+	if n := table.expire(time.Minute); n != 1 {
+		t.Fatalf("expired %d flows, want 1", n)
+	}
+	if !idle.closed || table.get(idleKey) != nil {
+		t.Fatal("idle flow was not closed and removed")
+	}
+	if active.closed || table.get(activeKey) == nil {
+		t.Fatal("active flow was expired")
+	}
+}
+
+func TestUDPFlowReturnRouting(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], from)
+		}
+	}()
+	server := conn.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	// Two clients behind the same exit, talking to the same server: each
+	// reply must go back to the client and port that sent the request
+	e := &ExitPeer{flows: newFlowTable(), sessions: newSessionTable(netip.MustParsePrefix("10.0.0.0/24"))}
+	clients := []netip.AddrPort{
+		netip.MustParseAddrPort("10.0.0.2:40000"),
+		netip.MustParseAddrPort("10.0.0.3:40000"),
+	}
+	outs := make([]chan []byte, len(clients))
+	for i, client := range clients {
+		l := &clientLink{out: make(chan []byte, 16), done: make(chan struct{})}
+		if _, _, _, err := e.sessions.bind(client.Addr(), l, [16]byte{}); err != nil {
+			t.Fatal(err)
+		}
+		outs[i] = l.out
+
+		key := flowKey{Proto: protoUDP, Src: client, Dst: server}
+		f, err := newUDPFlow(e, newFlowEntry(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(f.close)
+		pkt, _ := parseIPv4(buildUDP(client, server, []byte(client.String())))
+		f.handle(pkt)
+	}
+
+	for i, client := range clients {
+		select {
+		case pkt := <-outs[i]:
+			ip, ok := parseIPv4(pkt)
+			if !ok || ip.Proto != protoUDP {
+				t.Fatal("reply is not a UDP packet")
+			}
+			payload := ip.Payload[udpHeaderLen:]
+			dstPort := netip.AddrPortFrom(ip.Dst, uint16(ip.Payload[2])<<8|uint16(ip.Payload[3]))
+			if ip.Src != server.Addr() || dstPort != client || string(payload) != client.String() {
+				t.Fatalf("reply %q from %s to %s, want %q to %s", payload, ip.Src, dstPort, client, client)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no reply for %s", client)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package exit
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/icmp"
+)
+
+// icmpFlow forwards ICMP echo requests for one (client, destination, echo ID)
+// and relays the matching echo replies back.
+//
+// It prefers an unprivileged ping socket ("udp4", Linux/macOS) and falls back
+// to a raw ICMP socket, which requires root/Administrator.
+type icmpFlow struct {
+	ep         *ExitPeer
+	entry      *flowEntry
+	client     netip.Addr
+	remote     netip.Addr
+	id         uint16
+	conn       *icmp.PacketConn
+	privileged bool
+	hops       hopLimit
+}
+
+// icmpRetryInterval is how long the exit stops trying to open ICMP sockets
+// after both kinds failed, so every ping doesn't log the same error
+const icmpRetryInterval = time.Minute
+
+// icmpFailedAt is the UnixNano time both ICMP socket kinds last failed to open
+var icmpFailedAt atomic.Int64
+
+// newICMPFlow returns a nil flow without an error while ICMP sockets are
+// known to be unavailable; the client's ping then just times out
+func newICMPFlow(ep *ExitPeer, entry *flowEntry, key flowKey) (*icmpFlow, error) {
+	if failed := icmpFailedAt.Load(); failed != 0 && time.Since(time.Unix(0, failed)) < icmpRetryInterval {
+		return nil, nil
+	}
+
+	privileged := false
+	conn, err := icmp.ListenPacket("udp4", "0.0.0.0")
+	if err != nil {
+		var rawErr error
+		conn, rawErr = icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+		if rawErr != nil {
+			icmpFailedAt.Store(time.Now().UnixNano())
+			log.Printf("⚠️ Can't forward ping: no ping socket (%v) and no raw ICMP socket (%v)", err, rawErr)
+			log.Printf("   Run the Exit Peer as root/Administrator, or on Linux allow ping sockets with:")
+			log.Printf("   sysctl -w net.ipv4.ping_group_range=\"0 2147483647\"")
+			return nil, nil
+		}
+		privileged = true
+	}
+	icmpFailedAt.Store(0)
+
+	f := &icmpFlow{
+		ep:         ep,
+		entry:      entry,
+		client:     key.Src.Addr(),
+		remote:     key.Dst.Addr(),
+		id:         key.Src.Port(),
+		conn:       conn,
+		privileged: privileged,
+		hops:       hopLimit{set: conn.IPv4PacketConn().SetTTL},
+	}
+	go f.readLoop()
+	return f, nil
+}
+
+func (f *icmpFlow) handle(ip ipv4Packet) {
+	msg := ip.Payload
+	if len(msg) < icmpHeaderLen || msg[0] != icmpEchoRequest {
+		return
+	}
+
+	var dst net.Addr
+	if f.privileged {
+		dst = &net.IPAddr{IP: f.remote.AsSlice()}
+	} else {
+		// The kernel rewrites the echo ID and checksum for ping sockets
+		dst = &net.UDPAddr{IP: f.remote.AsSlice()}
+	}
+	f.hops.apply(ip.TTL)
+	f.conn.WriteTo(msg, dst)
+}
+
+// readLoop relays echo replies from the remote host back to the client
+func (f *icmpFlow) readLoop() {
+	buf := make([]byte, 65535)
+	for {
+		n, peer, err := f.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		msg := buf[:n]
+		if n < icmpHeaderLen || msg[0] != icmpEchoReply || !f.fromRemote(peer) {
+			continue
+		}
+		// Raw sockets see every ICMP reply on the host, so match on our echo ID
+		if f.privileged && binary.BigEndian.Uint16(msg[4:6]) != f.id {
+			continue
+		}
+
+		// Restore the client's original echo ID before handing the reply back
+		binary.BigEndian.PutUint16(msg[4:6], f.id)
+		f.entry.touch()
+		f.ep.reply(buildICMP(f.remote, f.client, msg))
+	}
+}
+
+func (f *icmpFlow) fromRemote(peer net.Addr) bool {
+	var ip net.IP
+	switch a := peer.(type) {
+	case *net.IPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		return false
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	return ok && addr.Unmap() == f.remote
+}
+
+func (f *icmpFlow) close() {
+	f.conn.Close()
+}
@@ -0,0 +1,235 @@
+package exit
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/zks-vpn/zks-go-client/vpn"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// Netstack egress
+//
+// With Options.Netstack the client's TCP and UDP go through gVisor's
+// userspace TCP/IP stack instead of tcp.go and udp.go. Client packets are
+// injected into a NIC that accepts any destination address and answers
+// from it. The stack terminates each connection, and its forwarders hand
+// every new one to a netstackFlow, which dials the destination with
+// net.Dial and copies between the two. Whatever the stack sends goes back
+// to the client through reply. Like the flows it replaces, this needs no
+// privileges, and the client gets a full TCP (SACK, window scaling,
+// congestion control) instead of tcpFlow's minimal one.
+//
+// Only IPv4 is registered, as forward only sees IPv4, so netstackKey can
+// take the 4-byte addresses.
+//
+// The flows are kept in the flow table like any other, so idle expiry and
+// client eviction close them too. ICMP echo still goes through icmp.go.
+
+const (
+	// netstackNIC is the stack's only interface
+	netstackNIC tcpip.NICID = 1
+	// netstackMaxInFlight bounds the TCP handshakes waiting for their dial
+	netstackMaxInFlight = 1024
+)
+
+// netstack is the gVisor stack of an ExitPeer
+type netstack struct {
+	e      *ExitPeer
+	stack  *stack.Stack
+	link   *channel.Endpoint
+	cancel context.CancelFunc
+}
+
+// newNetstack creates the stack and starts sending its packets to the clients
+func newNetstack(e *ExitPeer) (*netstack, error) {
+	s := stack.New(stack.Options{
+		// Like the built-in flows, let clients reach the exit's own loopback
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocolWithOptions(ipv4.Options{AllowExternalLoopbackTraffic: true})},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+	link := channel.New(outQueueSize, vpn.MaxMTU, "")
+
+	sack := tcpip.TCPSACKEnabled(true)
+	if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, &sack); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("netstack: enabling SACK: %v", err)
+	}
+	if err := s.CreateNIC(netstackNIC, link); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("netstack: creating NIC: %v", err)
+	}
+	// Every destination is ours to answer for, from its own address
+	if err := s.SetPromiscuousMode(netstackNIC, true); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("netstack: promiscuous mode: %v", err)
+	}
+	if err := s.SetSpoofing(netstackNIC, true); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("netstack: spoofing: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: netstackNIC}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ns := &netstack{e: e, stack: s, link: link, cancel: cancel}
+	s.SetTransportProtocolHandler(tcp.ProtocolNumber, tcp.NewForwarder(s, 0, netstackMaxInFlight, ns.acceptTCP).HandlePacket)
+	s.SetTransportProtocolHandler(udp.ProtocolNumber, udp.NewForwarder(s, ns.acceptUDP).HandlePacket)
+	go ns.replyLoop(ctx)
+	return ns, nil
+}
+
+// inject hands a client packet to the stack
+func (ns *netstack) inject(pkt []byte) {
+	pb := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(pkt)})
+	ns.link.InjectInbound(ipv4.ProtocolNumber, pb)
+	pb.DecRef()
+}
+
+// replyLoop sends what the stack transmits to the client it is addressed to
+func (ns *netstack) replyLoop(ctx context.Context) {
+	for {
+		pb := ns.link.ReadContext(ctx)
+		if pb == nil {
+			return // Closed
+		}
+		view := pb.ToView()
+		pb.DecRef()
+		ns.e.reply(append([]byte(nil), view.AsSlice()...))
+		view.Release()
+	}
+}
+
+// close tears the stack down; the flows are closed with the flow table
+func (ns *netstack) close() {
+	ns.cancel()
+	ns.stack.Close()
+	ns.link.Close()
+	ns.stack.Wait()
+}
+
+// acceptTCP connects a client's new TCP connection to its destination.
+// The handshake with the client is only completed once the dial succeeds,
+// so a refused or unreachable destination resets it instead.
+func (ns *netstack) acceptTCP(r *tcp.ForwarderRequest) {
+	key := netstackKey(protoTCP, r.ID())
+	remote, err := net.DialTimeout("tcp4", key.Dst.String(), tcpDialTimeout)
+	if err != nil {
+		r.Complete(true)
+		log.Printf("⚠️ Exit flow %s -> %s failed: %v", key.Src, key.Dst, err)
+		return
+	}
+	var wq waiter.Queue
+	ep, tcpErr := r.CreateEndpoint(&wq)
+	if tcpErr != nil {
+		remote.Close()
+		r.Complete(true)
+		log.Printf("⚠️ Exit flow %s -> %s failed: netstack: %v", key.Src, key.Dst, tcpErr)
+		return
+	}
+	r.Complete(false)
+	ns.run(key, &netstackFlow{client: gonet.NewTCPConn(&wq, ep), remote: remote})
+}
+
+// acceptUDP connects a client's new UDP 5-tuple to its destination
+func (ns *netstack) acceptUDP(r *udp.ForwarderRequest) {
+	key := netstackKey(protoUDP, r.ID())
+	remote, err := net.DialUDP("udp4", nil, net.UDPAddrFromAddrPort(key.Dst))
+	if err != nil {
+		log.Printf("⚠️ Exit flow %s -> %s failed: %v", key.Src, key.Dst, err)
+		return
+	}
+	var wq waiter.Queue
+	ep, tcpErr := r.CreateEndpoint(&wq)
+	if tcpErr != nil {
+		remote.Close()
+		log.Printf("⚠️ Exit flow %s -> %s failed: netstack: %v", key.Src, key.Dst, tcpErr)
+		return
+	}
+	ns.run(key, &netstackFlow{client: gonet.NewUDPConn(&wq, ep), remote: remote})
+}
+
+// run registers f and copies between its ends until both directions are done
+func (ns *netstack) run(key flowKey, f *netstackFlow) {
+	entry := newFlowEntry()
+	entry.flow = f
+	ns.e.flows.add(key, entry)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		pipe(entry, f.remote, f.client)
+	}()
+	go func() {
+		defer wg.Done()
+		pipe(entry, f.client, f.remote)
+	}()
+	go func() {
+		wg.Wait()
+		ns.e.flows.remove(key, entry)
+		f.close()
+	}()
+}
+
+// netstackKey is the flow key of a stack endpoint: the stack's local end is
+// the destination the client addressed
+func netstackKey(proto byte, id stack.TransportEndpointID) flowKey {
+	return flowKey{
+		Proto: proto,
+		Src:   netip.AddrPortFrom(netip.AddrFrom4(id.RemoteAddress.As4()), id.RemotePort),
+		Dst:   netip.AddrPortFrom(netip.AddrFrom4(id.LocalAddress.As4()), id.LocalPort),
+	}
+}
+
+// netstackFlow is a client connection terminated by the netstack, spliced
+// onto a host socket connected to its destination
+type netstackFlow struct {
+	client net.Conn // The stack's end, toward the client
+	remote net.Conn
+}
+
+// handle is never called: forward injects the flow's packets into the stack
+func (f *netstackFlow) handle(ipv4Packet) {}
+
+func (f *netstackFlow) close() {
+	f.client.Close()
+	f.remote.Close()
+}
+
+// pipe copies src to dst, touching entry as data passes. When src ends a
+// TCP dst gets a FIN, so the other direction can finish; a datagram flow
+// ends as a whole.
+func pipe(entry *flowEntry, dst, src net.Conn) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			entry.touch()
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	dst.Close()
+	src.Close()
+}
@@ -0,0 +1,132 @@
+package exit
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// newNetstackExit is an exit with a netstack and one bound client, whose
+// replies are captured instead of going over a relay
+func newNetstackExit(t *testing.T, client netip.Addr) (*ExitPeer, chan []byte) {
+	t.Helper()
+	e := &ExitPeer{flows: newFlowTable(), sessions: newSessionTable(netip.MustParsePrefix("10.0.0.0/24"))}
+	l := &clientLink{out: make(chan []byte, 1024), done: make(chan struct{})}
+	if _, _, _, err := e.sessions.bind(client, l, [16]byte{}); err != nil {
+		t.Fatal(err)
+	}
+	ns, err := newNetstack(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.netstack = ns
+	t.Cleanup(func() {
+		e.flows.closeAll()
+		ns.close()
+	})
+	return e, l.out
+}
+
+// expectPacket returns the next packet to the client of proto
+func expectPacket(t *testing.T, out chan []byte, proto byte) ipv4Packet {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case pkt := <-out:
+			if ip, ok := parseIPv4(pkt); ok && ip.Proto == proto {
+				return ip
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for a packet")
+		}
+	}
+}
+
+func TestNetstackTCP(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	server := serveOnce(t, data)
+	client := netip.MustParseAddrPort("10.0.0.2:40000")
+	e, out := newNetstackExit(t, client.Addr())
+
+	seq := uint32(1000)
+	e.netstack.inject(buildTCP(client, server, seq, 0, tcpSYN, 65535, 1380, nil))
+	seq++
+	ip := expectPacket(t, out, protoTCP)
+	synAck, _ := parseTCP(ip.Payload)
+	if synAck.Flags&(tcpSYN|tcpACK) != tcpSYN|tcpACK || synAck.Ack != seq {
+		t.Fatalf("want a SYN-ACK for %d, got flags 0x%02x ack %d", seq, synAck.Flags, synAck.Ack)
+	}
+	if ip.Src != server.Addr() || ip.Dst != client.Addr() {
+		t.Fatalf("SYN-ACK from %s to %s", ip.Src, ip.Dst)
+	}
+	rcvNxt := synAck.Seq + 1
+	e.netstack.inject(buildTCP(client, server, seq, rcvNxt, tcpACK, 65535, 0, nil))
+
+	var got []byte
+	for len(got) < len(data) {
+		seg, _ := parseTCP(expectPacket(t, out, protoTCP).Payload)
+		if len(seg.Payload) == 0 || seg.Seq != rcvNxt {
+			continue
+		}
+		got = append(got, seg.Payload...)
+		rcvNxt += uint32(len(seg.Payload))
+		e.netstack.inject(buildTCP(client, server, seq, rcvNxt, tcpACK, 65535, 0, nil))
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("data mismatch")
+	}
+	if e.flows.get(flowKey{Proto: protoTCP, Src: client, Dst: server}) == nil {
+		t.Fatal("flow not in the flow table")
+	}
+}
+
+func TestNetstackTCPRefused(t *testing.T) {
+	// A port nothing listens on: the dial fails, so the client gets a reset
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := ln.Addr().(*net.TCPAddr).AddrPort()
+	ln.Close()
+	client := netip.MustParseAddrPort("10.0.0.2:40001")
+	e, out := newNetstackExit(t, client.Addr())
+
+	e.netstack.inject(buildTCP(client, server, 1000, 0, tcpSYN, 65535, 1380, nil))
+	seg, _ := parseTCP(expectPacket(t, out, protoTCP).Payload)
+	if seg.Flags&tcpRST == 0 {
+		t.Fatalf("want a reset, got flags 0x%02x", seg.Flags)
+	}
+}
+
+func TestNetstackUDP(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], from)
+		}
+	}()
+	server := conn.LocalAddr().(*net.UDPAddr).AddrPort()
+	client := netip.MustParseAddrPort("10.0.0.2:40002")
+	e, out := newNetstackExit(t, client.Addr())
+
+	e.netstack.inject(buildUDP(client, server, []byte("ping")))
+	ip := expectPacket(t, out, protoUDP)
+	if ip.Src != server.Addr() || ip.Dst != client.Addr() {
+		t.Fatalf("reply from %s to %s", ip.Src, ip.Dst)
+	}
+	if got := ip.Payload[udpHeaderLen:]; string(got) != "ping" {
+		t.Fatalf("reply %q, want %q", got, "ping")
+	}
+}
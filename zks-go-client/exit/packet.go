@@ -0,0 +1,258 @@
+package exit
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"sync/atomic"
+)
+
+// IP protocol numbers handled by the exit peer
+const (
+	protoICMP byte = 1
+	protoTCP  byte = 6
+	protoUDP  byte = 17
+)
+
+const (
+	ipv4HeaderLen = 20
+	udpHeaderLen  = 8
+	tcpHeaderLen  = 20
+	icmpHeaderLen = 8
+	defaultTTL    = 64
+)
+
+// ipv4Packet is a parsed view over a raw IPv4 packet.
+// Payload aliases the original buffer.
+type ipv4Packet struct {
+	Proto   byte
+	TTL     byte
+	Src     netip.Addr
+	Dst     netip.Addr
+	Payload []byte
+}
+
+// parseIPv4 validates the IPv4 header and returns a view over the packet
+func parseIPv4(b []byte) (ipv4Packet, bool) {
+	if len(b) < ipv4HeaderLen || b[0]>>4 != 4 {
+		return ipv4Packet{}, false
+	}
+	ihl := int(b[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(b[2:4]))
+	if ihl < ipv4HeaderLen || total < ihl || total > len(b) {
+		return ipv4Packet{}, false
+	}
+	// Fragments are not supported (offset != 0 or MF set)
+	if binary.BigEndian.Uint16(b[6:8])&0x3fff != 0 {
+		return ipv4Packet{}, false
+	}
+	return ipv4Packet{
+		Proto:   b[9],
+		TTL:     b[8],
+		Src:     netip.AddrFrom4([4]byte(b[12:16])),
+		Dst:     netip.AddrFrom4([4]byte(b[16:20])),
+		Payload: b[ihl:total],
+	}, true
+}
+
+var ipID uint32
+
+// buildIPv4 wraps payload in a fresh IPv4 header (DF set, TTL 64)
+func buildIPv4(proto byte, src, dst netip.Addr, payload []byte) []byte {
+	pkt := make([]byte, ipv4HeaderLen+len(payload))
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	binary.BigEndian.PutUint16(pkt[4:6], uint16(atomic.AddUint32(&ipID, 1)))
+	binary.BigEndian.PutUint16(pkt[6:8], 0x4000) // Don't Fragment
+	pkt[8] = defaultTTL
+	pkt[9] = proto
+	s, d := src.As4(), dst.As4()
+	copy(pkt[12:16], s[:])
+	copy(pkt[16:20], d[:])
+	binary.BigEndian.PutUint16(pkt[10:12], checksum(pkt[:ipv4HeaderLen], 0))
+	copy(pkt[ipv4HeaderLen:], payload)
+	return pkt
+}
+
+// checksum computes the Internet checksum (RFC 1071) over b, seeded with initial
+func checksum(b []byte, initial uint32) uint16 {
+	sum := initial
+	for len(b) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
+
+// decrementTTL lowers the TTL of the IPv4 header in b by one, patching the
+// header checksum incrementally (RFC 1624) rather than recomputing it
+func decrementTTL(b []byte) byte {
+	old := binary.BigEndian.Uint16(b[8:10]) // TTL and protocol
+	b[8]--
+	sum := uint32(^binary.BigEndian.Uint16(b[10:12])) + uint32(^old) + uint32(binary.BigEndian.Uint16(b[8:10]))
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	binary.BigEndian.PutUint16(b[10:12], ^uint16(sum))
+	return b[8]
+}
+
+// pseudoHeaderSum returns the partial sum of the IPv4 pseudo-header used by TCP/UDP
+func pseudoHeaderSum(proto byte, src, dst netip.Addr, length int) uint32 {
+	s, d := src.As4(), dst.As4()
+	sum := uint32(binary.BigEndian.Uint16(s[0:2])) + uint32(binary.BigEndian.Uint16(s[2:4]))
+	sum += uint32(binary.BigEndian.Uint16(d[0:2])) + uint32(binary.BigEndian.Uint16(d[2:4]))
+	sum += uint32(proto) + uint32(length)
+	return sum
+}
+
+// buildUDP builds a complete IPv4/UDP packet
+func buildUDP(src, dst netip.AddrPort, payload []byte) []byte {
+	seg := make([]byte, udpHeaderLen+len(payload))
+	binary.BigEndian.PutUint16(seg[0:2], src.Port())
+	binary.BigEndian.PutUint16(seg[2:4], dst.Port())
+	binary.BigEndian.PutUint16(seg[4:6], uint16(len(seg)))
+	copy(seg[udpHeaderLen:], payload)
+	csum := checksum(seg, pseudoHeaderSum(protoUDP, src.Addr(), dst.Addr(), len(seg)))
+	if csum == 0 {
+		csum = 0xffff
+	}
+	binary.BigEndian.PutUint16(seg[6:8], csum)
+	return buildIPv4(protoUDP, src.Addr(), dst.Addr(), seg)
+}
+
+// TCP flags
+const (
+	tcpFIN byte = 0x01
+	tcpSYN byte = 0x02
+	tcpRST byte = 0x04
+	tcpPSH byte = 0x08
+	tcpACK byte = 0x10
+)
+
+// tcpSegment is a parsed view over a TCP segment
+type tcpSegment struct {
+	SrcPort uint16
+	DstPort uint16
+	Seq     uint32
+	Ack     uint32
+	Flags   byte
+	Window  uint16
+	MSS     uint16 // From the MSS option, 0 if absent
+	Payload []byte
+}
+
+func parseTCP(b []byte) (tcpSegment, bool) {
+	if len(b) < tcpHeaderLen {
+		return tcpSegment{}, false
+	}
+	off := int(b[12]>>4) * 4
+	if off < tcpHeaderLen || off > len(b) {
+		return tcpSegment{}, false
+	}
+	seg := tcpSegment{
+		SrcPort: binary.BigEndian.Uint16(b[0:2]),
+		DstPort: binary.BigEndian.Uint16(b[2:4]),
+		Seq:     binary.BigEndian.Uint32(b[4:8]),
+		Ack:     binary.BigEndian.Uint32(b[8:12]),
+		Flags:   b[13],
+		Window:  binary.BigEndian.Uint16(b[14:16]),
+		Payload: b[off:],
+	}
+	// Walk options looking for MSS (kind 2, len 4)
+	opts := b[tcpHeaderLen:off]
+	for len(opts) > 0 {
+		kind := opts[0]
+		if kind == 0 {
+			break
+		}
+		if kind == 1 {
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || int(opts[1]) < 2 || int(opts[1]) > len(opts) {
+			break
+		}
+		if kind == 2 && opts[1] == 4 {
+			seg.MSS = binary.BigEndian.Uint16(opts[2:4])
+		}
+		opts = opts[opts[1]:]
+	}
+	return seg, true
+}
+
+// buildTCP builds a complete IPv4/TCP packet. If mss is non-zero an MSS option is included.
+func buildTCP(src, dst netip.AddrPort, seq, ack uint32, flags byte, window uint16, mss uint16, payload []byte) []byte {
+	hdrLen := tcpHeaderLen
+	if mss != 0 {
+		hdrLen += 4
+	}
+	seg := make([]byte, hdrLen+len(payload))
+	binary.BigEndian.PutUint16(seg[0:2], src.Port())
+	binary.BigEndian.PutUint16(seg[2:4], dst.Port())
+	binary.BigEndian.PutUint32(seg[4:8], seq)
+	binary.BigEndian.PutUint32(seg[8:12], ack)
+	seg[12] = byte(hdrLen/4) << 4
+	seg[13] = flags
+	binary.BigEndian.PutUint16(seg[14:16], window)
+	if mss != 0 {
+		seg[20], seg[21] = 2, 4
+		binary.BigEndian.PutUint16(seg[22:24], mss)
+	}
+	copy(seg[hdrLen:], payload)
+	binary.BigEndian.PutUint16(seg[16:18], checksum(seg, pseudoHeaderSum(protoTCP, src.Addr(), dst.Addr(), len(seg))))
+	return buildIPv4(protoTCP, src.Addr(), dst.Addr(), seg)
+}
+
+// ICMP message types
+const (
+	icmpEchoReply    byte = 0
+	icmpUnreachable  byte = 3
+	icmpSourceQuench byte = 4
+	icmpRedirect     byte = 5
+	icmpEchoRequest  byte = 8
+	icmpTimeExceeded byte = 11
+	icmpParamProblem byte = 12
+)
+
+// icmpTTLExceeded is the time exceeded code for TTL expiry in transit
+const icmpTTLExceeded byte = 0
+
+// isICMPError reports whether ip is an ICMP error message, which must not
+// be answered with another one (RFC 1122 3.2.2)
+func isICMPError(ip ipv4Packet) bool {
+	if ip.Proto != protoICMP || len(ip.Payload) == 0 {
+		return false
+	}
+	switch ip.Payload[0] {
+	case icmpUnreachable, icmpSourceQuench, icmpRedirect, icmpTimeExceeded, icmpParamProblem:
+		return true
+	}
+	return false
+}
+
+// buildTimeExceeded builds the ICMP time exceeded message a router at src
+// sends back for pkt, quoting its IP header and first 8 payload bytes
+func buildTimeExceeded(src netip.Addr, pkt []byte, ip ipv4Packet) []byte {
+	ihl := int(pkt[0]&0x0f) * 4
+	quoted := pkt[:min(ihl+8, ihl+len(ip.Payload))]
+	msg := make([]byte, icmpHeaderLen+len(quoted))
+	msg[0] = icmpTimeExceeded
+	msg[1] = icmpTTLExceeded
+	copy(msg[icmpHeaderLen:], quoted)
+	return buildICMP(src, ip.Src, msg)
+}
+
+// buildICMP builds a complete IPv4/ICMP packet from an ICMP message, fixing its checksum
+func buildICMP(src, dst netip.Addr, msg []byte) []byte {
+	m := make([]byte, len(msg))
+	copy(m, msg)
+	m[2], m[3] = 0, 0
+	binary.BigEndian.PutUint16(m[2:4], checksum(m, 0))
+	return buildIPv4(protoICMP, src, dst, m)
+}
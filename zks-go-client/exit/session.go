@@ -0,0 +1,298 @@
+package exit
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zks-vpn/zks-go-client/metrics"
+	"github.com/zks-vpn/zks-go-client/protocol"
+	"github.com/zks-vpn/zks-go-client/relay"
+	"github.com/zks-vpn/zks-go-client/vpn"
+)
+
+// How clients are told apart
+//
+// The relay frames carry no sender identity: a room is a pipe, and whatever
+// one side writes comes out of the other side's WebSocket unchanged. So the
+// exit identifies a client by two things it can see:
+//
+//   - the link (relay connection, i.e. room) the packet arrived on, and
+//   - the packet's source IP, which is the client's TUN address.
+//
+// The first source IP seen on a link binds that address to the link, and
+// replies for it are routed back over that link only. Clients that support
+// FeatureLease are assigned a free address up front instead (see AddClient).
+// An address stays bound until the client has been silent for
+// ClientIdleTimeout or its link goes away; another link trying to use it
+// meanwhile is dropped with a hint to pick a free address from ClientSubnet
+// (10.0.85.2, .3, ...).
+//
+// If the relay fans several clients into one room, they all share the
+// exit's single link and are still demultiplexed by source IP. Otherwise
+// run one link per room (--room a,b,c).
+//
+// Clients also send a session token in their Hello, the same one on every
+// reconnect. A session remembers the token it was bound with, and:
+//
+//   - a link presenting that token may take the address over, flows and
+//     all, e.g. when the client comes back on another room;
+//   - when its link goes away the session is kept, detached, for
+//     SessionResumeTimeout so the client can come back to it;
+//   - a new token on the session's own link means the client restarted,
+//     and the flows of the old run are closed.
+//
+// Clients without a token get none of this and behave as before.
+
+const (
+	// DefaultClientIdleTimeout is how long a client may stay silent before its session is evicted
+	DefaultClientIdleTimeout = 10 * time.Minute
+	// DefaultSessionResumeTimeout is how long a session outlives its link
+	// waiting for the client to resume it
+	DefaultSessionResumeTimeout = 2 * time.Minute
+)
+
+// DefaultClientSubnet is the pool client TUN addresses are leased or suggested from
+var DefaultClientSubnet = netip.MustParsePrefix("10.0.85.0/24")
+
+// clientLink is one relay connection to the exit and everything tied to it
+type clientLink struct {
+	conn      *relay.Connection
+	transport vpn.Transport
+	assocs    *assocTable // SOCKS5 UDP ASSOCIATE stream IDs are only unique per link
+
+	out  chan []byte
+	done chan struct{}
+
+	conflictLogged atomic.Bool
+	hellos         uint64 // conn.PeerHellos() last seen by runLink
+}
+
+// peerSession is the session token the client on l announced last
+func (l *clientLink) peerSession() protocol.SessionToken {
+	return l.conn.Capabilities().PeerSession
+}
+
+// clientSession is one client TUN address bound to the link it talks on
+type clientSession struct {
+	addr     netip.Addr
+	link     atomic.Pointer[clientLink] // nil while detached
+	token    protocol.SessionToken      // Guarded by sessionTable.mu
+	detached atomic.Int64               // UnixNano the link went away
+	lastSeen atomic.Int64               // UnixNano of the last packet from the client
+	traffic  *metrics.PeerTraffic
+}
+
+func newClientSession(addr netip.Addr, link *clientLink, token protocol.SessionToken) *clientSession {
+	s := &clientSession{addr: addr, token: token, traffic: metrics.AddPeer(addr.String())}
+	s.link.Store(link)
+	s.touch()
+	return s
+}
+
+// resumableBy reports whether a client presenting token may take s over
+func (s *clientSession) resumableBy(token protocol.SessionToken) bool {
+	return !token.IsZero() && token == s.token
+}
+
+func (s *clientSession) touch() {
+	s.lastSeen.Store(time.Now().UnixNano())
+}
+
+// sessionTable maps client addresses to their sessions
+type sessionTable struct {
+	mu       sync.Mutex
+	sessions map[netip.Addr]*clientSession
+	subnet   netip.Prefix
+}
+
+func newSessionTable(subnet netip.Prefix) *sessionTable {
+	return &sessionTable{sessions: make(map[netip.Addr]*clientSession), subnet: subnet}
+}
+
+func (t *sessionTable) get(addr netip.Addr) *clientSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.sessions[addr]
+}
+
+// bindResult says how bind got its session
+type bindResult int
+
+const (
+	bindExisting bindResult = iota // Already on this link
+	bindNew                        // Created
+	bindResumed                    // Taken over with the session token
+)
+
+// bind returns the session for addr on link, creating it if the address is
+// free. A client presenting the session's token resumes it from another or
+// no link. Otherwise it fails if addr is in use by another link. A detached
+// session someone else claims is replaced and returned as evicted, for the
+// caller to close its flows.
+func (t *sessionTable) bind(addr netip.Addr, link *clientLink, token protocol.SessionToken) (s, evicted *clientSession, result bindResult, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if s, ok := t.sessions[addr]; ok {
+		switch current := s.link.Load(); {
+		case current == link:
+			return s, nil, bindExisting, nil
+		case s.resumableBy(token):
+			s.link.Store(link)
+			return s, nil, bindResumed, nil
+		case current == nil:
+			evicted = s
+			s.traffic.Remove()
+		default:
+			if free, ok := t.freeLocked(); ok {
+				return nil, nil, 0, fmt.Errorf("%s is already in use by another client (try --vpn-ip %s)", addr, free)
+			}
+			return nil, nil, 0, fmt.Errorf("%s is already in use by another client", addr)
+		}
+	}
+
+	s = newClientSession(addr, link, token)
+	t.sessions[addr] = s
+	return s, evicted, bindNew, nil
+}
+
+// resume moves the session with token, if there is one, to link
+func (t *sessionTable) resume(token protocol.SessionToken, link *clientLink) (*clientSession, bool) {
+	if token.IsZero() {
+		return nil, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, s := range t.sessions {
+		if s.token == token {
+			s.link.Store(link)
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// bindFree binds the first free address in the subnet to link
+func (t *sessionTable) bindFree(link *clientLink, token protocol.SessionToken) (netip.Addr, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	addr, ok := t.freeLocked()
+	if !ok {
+		return netip.Addr{}, fmt.Errorf("no free address in %s", t.subnet)
+	}
+	s := newClientSession(addr, link, token)
+	t.sessions[addr] = s
+	return addr, nil
+}
+
+// restarted handles a new token from the client on link: a session of
+// link's bound under another token belonged to the client's previous run.
+// It takes the new token and is returned so the caller can close the old
+// flows. A link shared by several clients can't tell whose Hello it was,
+// so nothing is done there.
+func (t *sessionTable) restarted(link *clientLink, token protocol.SessionToken) *clientSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var own *clientSession
+	for _, s := range t.sessions {
+		if s.link.Load() == link {
+			if own != nil {
+				return nil
+			}
+			own = s
+		}
+	}
+	if own == nil || token.IsZero() || own.token == token {
+		return nil
+	}
+	old := own.token
+	own.token = token
+	if old.IsZero() {
+		return nil // Nothing to compare with
+	}
+	return own
+}
+
+// freeLocked returns the first host address in the subnet with no session
+func (t *sessionTable) freeLocked() (netip.Addr, bool) {
+	if !t.subnet.IsValid() {
+		return netip.Addr{}, false
+	}
+	// Skip the network address and .1, which is the default client address
+	addr := t.subnet.Masked().Addr().Next().Next()
+	hop := hopAddr(t.subnet)
+	for ; t.subnet.Contains(addr); addr = addr.Next() {
+		if _, used := t.sessions[addr]; !used && addr != hop && t.subnet.Contains(addr.Next()) {
+			return addr, true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// hopAddr is the address the exit answers from as a router, e.g. with time
+// exceeded: the subnet's last host address (10.0.85.254), which isn't leased
+func hopAddr(subnet netip.Prefix) netip.Addr {
+	base := subnet.Masked().Addr().As4()
+	broadcast := binary.BigEndian.Uint32(base[:]) | (1<<(32-subnet.Bits()) - 1)
+	n := broadcast - 1
+	var addr [4]byte
+	binary.BigEndian.PutUint32(addr[:], n)
+	return netip.AddrFrom4(addr)
+}
+
+// expire removes sessions idle for longer than timeout, or detached for
+// longer than resumeTimeout, and returns them
+func (t *sessionTable) expire(timeout, resumeTimeout time.Duration) []*clientSession {
+	now := time.Now()
+	cutoff := now.Add(-timeout).UnixNano()
+	resumeCutoff := now.Add(-resumeTimeout).UnixNano()
+	var stale []*clientSession
+
+	t.mu.Lock()
+	for addr, s := range t.sessions {
+		abandoned := s.link.Load() == nil && s.detached.Load() < resumeCutoff
+		if s.lastSeen.Load() < cutoff || abandoned {
+			stale = append(stale, s)
+			delete(t.sessions, addr)
+			s.traffic.Remove()
+		}
+	}
+	t.mu.Unlock()
+	return stale
+}
+
+// dropLink removes every session bound to link and returns them, except
+// those with a session token, which are detached to wait for a resume
+func (t *sessionTable) dropLink(link *clientLink) (dropped []*clientSession, detached int) {
+	now := time.Now().UnixNano()
+
+	t.mu.Lock()
+	for addr, s := range t.sessions {
+		if s.link.Load() != link {
+			continue
+		}
+		if !s.token.IsZero() {
+			s.detached.Store(now)
+			s.link.Store(nil)
+			detached++
+			continue
+		}
+		dropped = append(dropped, s)
+		delete(t.sessions, addr)
+		s.traffic.Remove()
+	}
+	t.mu.Unlock()
+	return dropped, detached
+}
+
+func (t *sessionTable) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.sessions)
+}
@@ -0,0 +1,433 @@
+package exit
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	tcpDialTimeout = 10 * time.Second
+	tcpRTO         = time.Second
+	tcpMaxRetries  = 8
+	// tcpMaxPersist caps the backoff of zero-window probes, which go on for
+	// as long as the client keeps its window closed
+	tcpMaxPersist = time.Minute
+	tcpWindow     = 65535
+	// tcpMaxMSS leaves room for the IP and TCP headers inside the 1420 tunnel MTU
+	tcpMaxMSS     = 1380
+	tcpDefaultMSS = 536
+	tcpInQueue    = 256
+)
+
+type tcpState int
+
+const (
+	tcpSynReceived tcpState = iota
+	tcpEstablished
+)
+
+// tcpFlow terminates the client's TCP connection in userspace and splices
+// it onto a real TCP connection dialed by the host (userspace NAT).
+//
+// The client side is a minimal TCP: in-order receive only, go-back-N
+// retransmission on a fixed timeout, no window scaling or SACK. The relay
+// is a reliable stream so retransmission is rarely exercised.
+type tcpFlow struct {
+	ep     *ExitPeer
+	entry  *flowEntry
+	key    flowKey
+	client netip.AddrPort
+	remote netip.AddrPort
+	mss    int
+
+	in   chan ipv4Packet // Client segments, processed in order by run()
+	done chan struct{}
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	conn     net.Conn // nil until the outbound dial completes
+	state    tcpState
+	closed   bool
+	iss      uint32
+	rcvNxt   uint32 // Next sequence number expected from the client
+	sndUna   uint32 // Oldest unacknowledged sequence number
+	sndNxt   uint32 // Next sequence number to send
+	sndWnd   uint32 // Client's advertised receive window
+	unacked  []byte // Data sent but not yet acknowledged, starting at sndUna
+	finSent  bool
+	finAcked bool
+	finRcvd  bool
+	lastSend time.Time
+	retries  int
+	blocked  bool          // readUpstream holds data the client's window has no room for
+	persist  time.Duration // Current zero-window probe interval
+
+	closeOnce sync.Once
+}
+
+// newTCPFlow starts a flow for a client SYN. Any other segment without a
+// flow is answered with a RST so the client gives up on stale connections.
+func newTCPFlow(ep *ExitPeer, entry *flowEntry, key flowKey, ip ipv4Packet) (*tcpFlow, error) {
+	seg, ok := parseTCP(ip.Payload)
+	if !ok {
+		return nil, nil
+	}
+	if seg.Flags&tcpSYN == 0 || seg.Flags&tcpACK != 0 {
+		if seg.Flags&tcpRST == 0 {
+			ep.reply(buildReset(key, seg))
+		}
+		return nil, nil
+	}
+
+	var issBuf [4]byte
+	rand.Read(issBuf[:])
+	iss := binary.BigEndian.Uint32(issBuf[:])
+
+	mss := int(seg.MSS)
+	if mss == 0 {
+		mss = tcpDefaultMSS
+	}
+	if mss > tcpMaxMSS {
+		mss = tcpMaxMSS
+	}
+
+	f := &tcpFlow{
+		ep:     ep,
+		entry:  entry,
+		key:    key,
+		client: key.Src,
+		remote: key.Dst,
+		mss:    mss,
+		in:     make(chan ipv4Packet, tcpInQueue),
+		done:   make(chan struct{}),
+		iss:    iss,
+		rcvNxt: seg.Seq + 1,
+		sndUna: iss,
+		sndNxt: iss,
+		sndWnd: uint32(seg.Window),
+	}
+	f.cond = sync.NewCond(&f.mu)
+
+	go f.dial()
+	go f.run()
+	return f, nil
+}
+
+// buildReset answers seg with a RST as described in RFC 793 "Reset Generation"
+func buildReset(key flowKey, seg tcpSegment) []byte {
+	if seg.Flags&tcpACK != 0 {
+		return buildTCP(key.Dst, key.Src, seg.Ack, 0, tcpRST, 0, 0, nil)
+	}
+	ack := seg.Seq + uint32(len(seg.Payload))
+	if seg.Flags&tcpSYN != 0 {
+		ack++
+	}
+	if seg.Flags&tcpFIN != 0 {
+		ack++
+	}
+	return buildTCP(key.Dst, key.Src, 0, ack, tcpRST|tcpACK, 0, 0, nil)
+}
+
+// seqAfter reports whether sequence number a is after b (mod 2^32)
+func seqAfter(a, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+func (f *tcpFlow) handle(ip ipv4Packet) {
+	select {
+	case f.in <- ip:
+	default:
+		// Queue full: drop, the client will retransmit
+	}
+}
+
+// dial opens the outbound connection and completes the client handshake
+func (f *tcpFlow) dial() {
+	conn, err := net.DialTimeout("tcp4", f.remote.String(), tcpDialTimeout)
+
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		if conn != nil {
+			conn.Close()
+		}
+		return
+	}
+	if err != nil {
+		f.sendLocked(tcpRST|tcpACK, 0, nil)
+		f.mu.Unlock()
+		f.close()
+		return
+	}
+	f.conn = conn
+	f.sendSynAckLocked()
+	f.mu.Unlock()
+
+	go f.retransmitLoop()
+}
+
+// run processes client segments in arrival order
+func (f *tcpFlow) run() {
+	for {
+		select {
+		case ip := <-f.in:
+			f.segment(ip)
+		case <-f.done:
+			return
+		}
+	}
+}
+
+func (f *tcpFlow) segment(ip ipv4Packet) {
+	seg, ok := parseTCP(ip.Payload)
+	if !ok {
+		return
+	}
+
+	if seg.Flags&tcpRST != 0 {
+		f.close()
+		return
+	}
+
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return
+	}
+
+	if seg.Flags&tcpSYN != 0 {
+		// Retransmitted SYN: repeat our SYN-ACK once the dial has finished
+		if f.state == tcpSynReceived && f.conn != nil {
+			f.sendSynAckLocked()
+		}
+		f.mu.Unlock()
+		return
+	}
+
+	if seg.Flags&tcpACK != 0 {
+		f.ackLocked(seg)
+	}
+
+	if f.state != tcpEstablished {
+		f.mu.Unlock()
+		return
+	}
+
+	if len(seg.Payload) > 0 {
+		if seg.Seq != f.rcvNxt {
+			// Out of order or duplicate: re-announce what we expect
+			f.sendLocked(tcpACK, f.sndNxt, nil)
+			f.mu.Unlock()
+			return
+		}
+		conn := f.conn
+		f.mu.Unlock()
+
+		if _, err := conn.Write(seg.Payload); err != nil {
+			f.mu.Lock()
+			f.sendLocked(tcpRST|tcpACK, f.sndNxt, nil)
+			f.mu.Unlock()
+			f.close()
+			return
+		}
+
+		f.mu.Lock()
+		f.rcvNxt += uint32(len(seg.Payload))
+		if seg.Flags&tcpFIN == 0 {
+			f.sendLocked(tcpACK, f.sndNxt, nil)
+		}
+	}
+
+	if seg.Flags&tcpFIN != 0 && !f.finRcvd && seg.Seq+uint32(len(seg.Payload)) == f.rcvNxt {
+		f.rcvNxt++
+		f.finRcvd = true
+		f.sendLocked(tcpACK, f.sndNxt, nil)
+		if tc, ok := f.conn.(*net.TCPConn); ok {
+			tc.CloseWrite()
+		}
+	}
+
+	done := f.finRcvd && f.finAcked
+	f.mu.Unlock()
+
+	if done {
+		f.close()
+	}
+}
+
+// ackLocked processes the acknowledgment and window fields of a client segment
+func (f *tcpFlow) ackLocked(seg tcpSegment) {
+	if f.state == tcpSynReceived {
+		if f.conn == nil || seg.Ack != f.iss+1 {
+			return
+		}
+		f.state = tcpEstablished
+		f.sndUna = seg.Ack
+		f.sndWnd = uint32(seg.Window)
+		f.retries = 0
+		go f.readUpstream()
+		return
+	}
+
+	if seqAfter(seg.Ack, f.sndUna) && !seqAfter(seg.Ack, f.sndNxt) {
+		acked := int(seg.Ack - f.sndUna)
+		if acked > len(f.unacked) {
+			// The extra sequence number acknowledges our FIN
+			f.finAcked = f.finSent
+			acked = len(f.unacked)
+		}
+		f.unacked = f.unacked[acked:]
+		f.sndUna = seg.Ack
+		f.lastSend = time.Now()
+		f.retries = 0
+	}
+	f.sndWnd = uint32(seg.Window)
+	f.cond.Broadcast()
+}
+
+// readUpstream copies data from the remote host to the client, honoring the
+// client's window: what it has no room for yet waits in buf, and while the
+// window is closed retransmitLoop probes it
+func (f *tcpFlow) readUpstream() {
+	buf := make([]byte, f.mss)
+	for {
+		n, err := f.conn.Read(buf)
+		for off := 0; off < n; {
+			f.mu.Lock()
+			for !f.closed && f.sndNxt-f.sndUna >= f.sndWnd {
+				f.blocked = true
+				f.cond.Wait()
+			}
+			f.blocked = false
+			if f.closed {
+				f.mu.Unlock()
+				return
+			}
+			chunk := min(n-off, int(f.sndWnd-(f.sndNxt-f.sndUna)))
+			f.unacked = append(f.unacked, buf[off:off+chunk]...)
+			f.sendLocked(tcpACK|tcpPSH, f.sndNxt, buf[off:off+chunk])
+			f.sndNxt += uint32(chunk)
+			off += chunk
+			f.mu.Unlock()
+		}
+		if err != nil {
+			f.mu.Lock()
+			if !f.closed && !f.finSent {
+				f.sendLocked(tcpFIN|tcpACK, f.sndNxt, nil)
+				f.sndNxt++
+				f.finSent = true
+			}
+			f.mu.Unlock()
+			return
+		}
+	}
+}
+
+// retransmitLoop resends the SYN-ACK or unacknowledged data after tcpRTO of silence
+func (f *tcpFlow) retransmitLoop() {
+	ticker := time.NewTicker(tcpRTO / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-f.done:
+			return
+		}
+
+		f.mu.Lock()
+		pending := f.state == tcpSynReceived || len(f.unacked) > 0 || (f.finSent && !f.finAcked)
+		if !pending {
+			f.probeLocked()
+			f.mu.Unlock()
+			continue
+		}
+		if time.Since(f.lastSend) < tcpRTO {
+			f.mu.Unlock()
+			continue
+		}
+
+		f.retries++
+		if f.retries > tcpMaxRetries {
+			f.sendLocked(tcpRST|tcpACK, f.sndNxt, nil)
+			f.mu.Unlock()
+			f.close()
+			return
+		}
+
+		if f.state == tcpSynReceived {
+			f.sendSynAckLocked()
+			f.mu.Unlock()
+			continue
+		}
+
+		// Go-back-N: resend everything outstanding that fits in the window
+		seq := f.sndUna
+		for off := 0; off < len(f.unacked) && uint32(off) < f.sndWnd; off += f.mss {
+			end := off + f.mss
+			if end > len(f.unacked) {
+				end = len(f.unacked)
+			}
+			f.sendLocked(tcpACK|tcpPSH, seq, f.unacked[off:end])
+			seq += uint32(end - off)
+		}
+		if f.finSent && !f.finAcked {
+			f.sendLocked(tcpFIN|tcpACK, f.sndNxt-1, nil)
+		}
+		f.mu.Unlock()
+	}
+}
+
+// probeLocked sends a zero-window probe when data waits for a window the
+// client has closed and nothing is in flight, so no ACK would otherwise
+// bring its update. The probe repeats the last acknowledged sequence
+// number, which the client answers with an ACK carrying its window.
+func (f *tcpFlow) probeLocked() {
+	if !f.blocked || f.sndWnd > 0 {
+		f.persist = 0
+		return
+	}
+	if f.persist == 0 {
+		f.persist = tcpRTO
+	}
+	if time.Since(f.lastSend) < f.persist {
+		return
+	}
+	f.ep.reply(buildTCP(f.remote, f.client, f.sndNxt-1, f.rcvNxt, tcpACK, tcpWindow, 0, nil))
+	f.lastSend = time.Now()
+	f.persist = min(2*f.persist, tcpMaxPersist)
+}
+
+func (f *tcpFlow) sendSynAckLocked() {
+	f.ep.reply(buildTCP(f.remote, f.client, f.iss, f.rcvNxt, tcpSYN|tcpACK, tcpWindow, uint16(f.mss), nil))
+	f.sndNxt = f.iss + 1
+	f.lastSend = time.Now()
+}
+
+func (f *tcpFlow) sendLocked(flags byte, seq uint32, payload []byte) {
+	f.ep.reply(buildTCP(f.remote, f.client, seq, f.rcvNxt, flags, tcpWindow, 0, payload))
+	f.entry.touch()
+	if len(payload) > 0 || flags&tcpFIN != 0 {
+		f.lastSend = time.Now()
+	}
+}
+
+func (f *tcpFlow) close() {
+	f.closeOnce.Do(func() {
+		f.mu.Lock()
+		f.closed = true
+		conn := f.conn
+		f.cond.Broadcast()
+		f.mu.Unlock()
+
+		close(f.done)
+		if conn != nil {
+			conn.Close()
+		}
+		f.ep.flows.remove(f.key, f.entry)
+	})
+}
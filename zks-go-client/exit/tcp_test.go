@@ -0,0 +1,131 @@
+package exit
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// tcpHarness is one client TCP connection to a flow, with the exit's
+// replies captured instead of going over a relay
+type tcpHarness struct {
+	t      *testing.T
+	flow   *tcpFlow
+	key    flowKey
+	out    chan []byte
+	seq    uint32 // Next client sequence number
+	rcvNxt uint32 // Next exit sequence number expected
+}
+
+func newTCPHarness(t *testing.T, server netip.AddrPort, window uint16) *tcpHarness {
+	t.Helper()
+	client := netip.MustParseAddrPort("10.0.0.2:40000")
+	e := &ExitPeer{flows: newFlowTable(), sessions: newSessionTable(netip.MustParsePrefix("10.0.0.0/24"))}
+	l := &clientLink{out: make(chan []byte, 1024), done: make(chan struct{})}
+	if _, _, _, err := e.sessions.bind(client.Addr(), l, [16]byte{}); err != nil {
+		t.Fatal(err)
+	}
+
+	h := &tcpHarness{t: t, key: flowKey{Proto: protoTCP, Src: client, Dst: server}, out: l.out, seq: 1000}
+	syn, _ := parseIPv4(buildTCP(client, server, h.seq, 0, tcpSYN, window, 1380, nil))
+	f, err := newTCPFlow(e, newFlowEntry(), h.key, syn)
+	if err != nil || f == nil {
+		t.Fatalf("no flow: %v", err)
+	}
+	t.Cleanup(f.close)
+	h.flow = f
+	h.seq++
+
+	synAck := h.expect(func(seg tcpSegment) bool { return seg.Flags&tcpSYN != 0 })
+	h.rcvNxt = synAck.Seq + 1
+	h.ack(window)
+	return h
+}
+
+// ack acknowledges everything received so far, advertising window
+func (h *tcpHarness) ack(window uint16) {
+	pkt, _ := parseIPv4(buildTCP(h.key.Src, h.key.Dst, h.seq, h.rcvNxt, tcpACK, window, 0, nil))
+	h.flow.handle(pkt)
+}
+
+// expect returns the next segment from the exit that matches
+func (h *tcpHarness) expect(match func(tcpSegment) bool) tcpSegment {
+	h.t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case pkt := <-h.out:
+			ip, _ := parseIPv4(pkt)
+			seg, ok := parseTCP(ip.Payload)
+			if ok && match(seg) {
+				return seg
+			}
+		case <-timeout:
+			h.t.Fatal("timed out waiting for a segment")
+		}
+	}
+}
+
+// serveOnce accepts one connection and writes data to it
+func serveOnce(t *testing.T, data []byte) netip.AddrPort {
+	t.Helper()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write(data)
+		io.Copy(io.Discard, conn) // Until the flow closes
+	}()
+	return ln.Addr().(*net.TCPAddr).AddrPort()
+}
+
+func TestTCPFlowSmallWindow(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	h := newTCPHarness(t, serveOnce(t, data), 100)
+
+	// A window smaller than one read must not stall the flow
+	var got []byte
+	for len(got) < len(data) {
+		seg := h.expect(func(seg tcpSegment) bool { return len(seg.Payload) > 0 })
+		if len(seg.Payload) > 100 {
+			t.Fatalf("sent %d bytes into a 100 byte window", len(seg.Payload))
+		}
+		if seg.Seq != h.rcvNxt {
+			continue // Retransmission
+		}
+		got = append(got, seg.Payload...)
+		h.rcvNxt += uint32(len(seg.Payload))
+		h.ack(100)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("data mismatch")
+	}
+}
+
+func TestTCPFlowZeroWindowProbe(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 500)
+	h := newTCPHarness(t, serveOnce(t, data), 0)
+
+	// With the window closed from the start nothing is in flight, so only
+	// a probe can bring the window update
+	probe := h.expect(func(seg tcpSegment) bool { return seg.Flags&tcpACK != 0 })
+	if len(probe.Payload) != 0 || probe.Seq != h.rcvNxt-1 {
+		t.Fatalf("unexpected probe seq=%d len=%d", probe.Seq, len(probe.Payload))
+	}
+	h.ack(tcpWindow)
+
+	seg := h.expect(func(seg tcpSegment) bool { return len(seg.Payload) > 0 })
+	if seg.Seq != h.rcvNxt {
+		t.Fatalf("data at seq %d, want %d", seg.Seq, h.rcvNxt)
+	}
+}
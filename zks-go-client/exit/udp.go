@@ -0,0 +1,82 @@
+package exit
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+
+	"golang.org/x/net/ipv4"
+)
+
+// maxUDPPayload is the largest datagram that fits an IPv4 packet's 16-bit
+// total length once the IP and UDP headers are added
+const maxUDPPayload = 65535 - ipv4HeaderLen - udpHeaderLen
+
+// udpFlow forwards one client UDP 5-tuple through a connected host socket
+type udpFlow struct {
+	ep     *ExitPeer
+	entry  *flowEntry
+	client netip.AddrPort
+	remote netip.AddrPort
+	conn   *net.UDPConn
+	hops   hopLimit
+}
+
+func newUDPFlow(ep *ExitPeer, entry *flowEntry, key flowKey) (*udpFlow, error) {
+	conn, err := net.DialUDP("udp4", nil, net.UDPAddrFromAddrPort(key.Dst))
+	if err != nil {
+		return nil, err
+	}
+
+	f := &udpFlow{
+		ep:     ep,
+		entry:  entry,
+		client: key.Src,
+		remote: key.Dst,
+		conn:   conn,
+		hops:   hopLimit{set: ipv4.NewConn(conn).SetTTL},
+	}
+	go f.readLoop()
+	return f, nil
+}
+
+func (f *udpFlow) handle(ip ipv4Packet) {
+	p := ip.Payload
+	if len(p) < udpHeaderLen {
+		return
+	}
+	length := int(binary.BigEndian.Uint16(p[4:6]))
+	if length < udpHeaderLen || length > len(p) {
+		return
+	}
+	f.hops.apply(ip.TTL)
+	f.conn.Write(p[udpHeaderLen:length])
+}
+
+// readLoop turns datagrams from the remote host into IP packets for the
+// client. The buffer has one byte to spare, so a datagram too large for an
+// IP packet shows up as longer than maxUDPPayload and is dropped rather
+// than forwarded truncated.
+func (f *udpFlow) readLoop() {
+	buf := make([]byte, maxUDPPayload+1)
+	for {
+		n, err := f.conn.Read(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// e.g. ECONNREFUSED from an ICMP port unreachable; the socket is still usable
+			continue
+		}
+		if n > maxUDPPayload {
+			continue
+		}
+		f.entry.touch()
+		f.ep.reply(buildUDP(f.remote, f.client, buf[:n]))
+	}
+}
+
+func (f *udpFlow) close() {
+	f.conn.Close()
+}
@@ -0,0 +1,151 @@
+package exit
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zks-vpn/zks-go-client/protocol"
+)
+
+// udpAssociation forwards the datagrams of one SOCKS5 UDP ASSOCIATE stream.
+// Unlike udpFlow it uses a single unconnected socket, since one association
+// talks to any number of destinations.
+type udpAssociation struct {
+	link     *clientLink
+	streamID protocol.StreamID
+	conn     *net.UDPConn
+	lastSeen atomic.Int64 // UnixNano of last activity in either direction
+}
+
+// assocTable tracks UDP associations by stream ID
+type assocTable struct {
+	mu     sync.Mutex
+	assocs map[protocol.StreamID]*udpAssociation
+}
+
+func newAssocTable() *assocTable {
+	return &assocTable{assocs: make(map[protocol.StreamID]*udpAssociation)}
+}
+
+// forwardDatagram sends a client datagram to its destination, opening the
+// association's socket on first use
+func (e *ExitPeer) forwardDatagram(l *clientLink, m *protocol.UdpDatagram) {
+	a, err := l.assocs.getOrOpen(l, m.StreamID)
+	if err != nil {
+		log.Printf("⚠️ UDP association %d failed: %v", m.StreamID, err)
+		return
+	}
+	a.touch()
+
+	if addr, err := netip.ParseAddr(m.Host); err == nil {
+		a.conn.WriteToUDPAddrPort(m.Payload, netip.AddrPortFrom(addr.Unmap(), m.Port))
+		return
+	}
+
+	// Domain names are resolved off the receive loop so a slow lookup
+	// doesn't stall every other client packet
+	go func() {
+		addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(m.Host, strconv.Itoa(int(m.Port))))
+		if err != nil {
+			return
+		}
+		a.conn.WriteToUDP(m.Payload, addr)
+	}()
+}
+
+func (t *assocTable) getOrOpen(l *clientLink, id protocol.StreamID) (*udpAssociation, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if a, ok := t.assocs[id]; ok {
+		return a, nil
+	}
+
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	a := &udpAssociation{link: l, streamID: id, conn: conn}
+	a.touch()
+	t.assocs[id] = a
+	go a.readLoop()
+	return a, nil
+}
+
+// close drops and closes the association for id, if any
+func (t *assocTable) close(id protocol.StreamID) {
+	t.mu.Lock()
+	a, ok := t.assocs[id]
+	delete(t.assocs, id)
+	t.mu.Unlock()
+
+	if ok {
+		a.conn.Close()
+	}
+}
+
+// expire closes associations idle for longer than timeout
+func (t *assocTable) expire(timeout time.Duration) int {
+	cutoff := time.Now().Add(-timeout).UnixNano()
+	var stale []*udpAssociation
+
+	t.mu.Lock()
+	for id, a := range t.assocs {
+		if a.lastSeen.Load() < cutoff {
+			stale = append(stale, a)
+			delete(t.assocs, id)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, a := range stale {
+		a.conn.Close()
+	}
+	return len(stale)
+}
+
+// closeAll closes every association
+func (t *assocTable) closeAll() {
+	t.mu.Lock()
+	assocs := t.assocs
+	t.assocs = make(map[protocol.StreamID]*udpAssociation)
+	t.mu.Unlock()
+
+	for _, a := range assocs {
+		a.conn.Close()
+	}
+}
+
+func (a *udpAssociation) touch() {
+	a.lastSeen.Store(time.Now().UnixNano())
+}
+
+// readLoop returns replies to the client tagged with the address they came from
+func (a *udpAssociation) readLoop() {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := a.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		a.touch()
+
+		payload := make([]byte, n)
+		copy(payload, buf[:n])
+		a.link.conn.Send(&protocol.UdpDatagram{
+			StreamID: a.streamID,
+			Host:     from.Addr().Unmap().String(),
+			Port:     from.Port(),
+			Payload:  payload,
+		})
+	}
+}
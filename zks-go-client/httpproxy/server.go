@@ -0,0 +1,457 @@
+// Package httpproxy implements an HTTP proxy server for tools that don't
+// speak SOCKS5. CONNECT requests (HTTPS and anything else) become a raw
+// tunnel; plain HTTP requests with an absolute URI (GET http://host/path)
+// are forwarded one per connection. Streams are opened through a
+// socks5.Server, so both proxies share the relay connection, the stream IDs
+// and the destination rules.
+package httpproxy
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zks-vpn/zks-go-client/metrics"
+	"github.com/zks-vpn/zks-go-client/socks5"
+)
+
+// DefaultShutdownGrace is how long Stop lets in-flight connections finish
+const DefaultShutdownGrace = socks5.DefaultShutdownGrace
+
+// DefaultIdleTimeout is how long a proxied connection may carry no data
+const DefaultIdleTimeout = socks5.DefaultIdleTimeout
+
+// headerTimeout bounds how long a client may take to send its request
+const headerTimeout = 30 * time.Second
+
+// copyBufSize matches what one SOCKS5 Data message carries
+const copyBufSize = 32 * 1024
+
+// hopHeaders are meant for the proxy and not passed on (RFC 9110 7.6.1)
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Upgrade",
+}
+
+// Dialer opens streams through the tunnel; *socks5.Server is one
+type Dialer interface {
+	Dial(host string, port uint16) (net.Conn, error)
+}
+
+// Options configures an HTTP proxy Server
+type Options struct {
+	// Username and Password, when Username is set, require Basic
+	// Proxy-Authorization from every client (the SOCKS5 credentials)
+	Username string
+	Password string
+	// ShutdownGrace is how long Stop waits for open connections before
+	// force-closing them. Zero means DefaultShutdownGrace, negative means don't wait.
+	ShutdownGrace time.Duration
+	// IdleTimeout closes a proxied connection after this long without data
+	// in either direction. Zero means DefaultIdleTimeout, negative disables it.
+	IdleTimeout time.Duration
+}
+
+// Server is an HTTP proxy server that tunnels through Exit Peer
+type Server struct {
+	listener net.Listener
+	dialer   Dialer
+	opts     Options
+
+	// Shutdown: done stops accepting, kill force-closes what's left
+	mu       sync.Mutex
+	clients  map[net.Conn]struct{}
+	active   sync.WaitGroup
+	done     chan struct{}
+	kill     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewServer creates an HTTP proxy opening its streams with dialer
+func NewServer(dialer Dialer) *Server {
+	return NewServerWithOptions(dialer, Options{})
+}
+
+// NewServerWithOptions is NewServer with authentication settings
+func NewServerWithOptions(dialer Dialer, opts Options) *Server {
+	if opts.ShutdownGrace == 0 {
+		opts.ShutdownGrace = DefaultShutdownGrace
+	}
+	if opts.IdleTimeout == 0 {
+		opts.IdleTimeout = DefaultIdleTimeout
+	}
+	return &Server{
+		dialer:  dialer,
+		opts:    opts,
+		clients: make(map[net.Conn]struct{}),
+		done:    make(chan struct{}),
+		kill:    make(chan struct{}),
+	}
+}
+
+// Start starts the HTTP proxy on the given address, "host:port" or
+// "unix:/path/to.sock" (see socks5.Listen). It returns nil once Stop is called.
+func (s *Server) Start(listenAddr string) error {
+	listener, err := socks5.Listen(listenAddr, 0)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	s.mu.Lock()
+	s.listener = listener
+	s.mu.Unlock()
+	if s.stopping() {
+		listener.Close()
+		return nil
+	}
+
+	fmt.Printf("🌐 HTTP proxy listening on %s\n", listenAddr)
+	fmt.Println("   Configure your tools: http_proxy=http://"+listenAddr, "https_proxy=http://"+listenAddr)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.stopping() {
+				return nil
+			}
+			continue
+		}
+		if !s.track(conn) {
+			conn.Close()
+			return nil
+		}
+		go func() {
+			defer s.untrack(conn)
+			s.handleClient(conn)
+		}()
+	}
+}
+
+// track registers an accepted connection for draining. It refuses once Stop has begun.
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopping() {
+		return false
+	}
+	s.clients[conn] = struct{}{}
+	s.active.Add(1)
+	metrics.HTTPProxyConnections.Set(float64(len(s.clients)))
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.clients, conn)
+	metrics.HTTPProxyConnections.Set(float64(len(s.clients)))
+	s.mu.Unlock()
+	s.active.Done()
+}
+
+// ActiveConnections returns how many client connections are open
+func (s *Server) ActiveConnections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.clients)
+}
+
+func (s *Server) stopping() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// handleClient serves one request: a CONNECT tunnel or a single plain HTTP
+// request, after which the connection is closed
+func (s *Server) handleClient(conn net.Conn) {
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(headerTimeout))
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	if !s.authorized(req) {
+		fmt.Printf("🚫 HTTP proxy auth failed from %s\n", conn.RemoteAddr())
+		reply(conn, http.StatusProxyAuthRequired, "Proxy-Authenticate: Basic realm=\"zks\"\r\n")
+		return
+	}
+
+	if req.Method == http.MethodConnect {
+		s.handleConnect(conn, br, req)
+		return
+	}
+	s.handleRequest(conn, req)
+}
+
+// handleConnect tunnels the connection to the CONNECT target
+func (s *Server) handleConnect(conn net.Conn, br *bufio.Reader, req *http.Request) {
+	host, port, err := splitHostPort(req.Host, 443)
+	if err != nil {
+		reply(conn, http.StatusBadRequest, "")
+		return
+	}
+	fmt.Printf("HTTP CONNECT to %s:%d\n", host, port)
+
+	stream, ok := s.dial(conn, host, port)
+	if !ok {
+		return
+	}
+	defer stream.Close()
+
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+	// Whatever the client sent after the headers (a TLS ClientHello) is in br
+	s.pipe(conn, br, stream, req.Host)
+}
+
+// handleRequest forwards one plain HTTP request and streams the response back
+func (s *Server) handleRequest(conn net.Conn, req *http.Request) {
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		// https:// goes through CONNECT; anything else isn't a proxy request
+		reply(conn, http.StatusBadRequest, "")
+		return
+	}
+	host, port, err := splitHostPort(req.URL.Host, 80)
+	if err != nil {
+		reply(conn, http.StatusBadRequest, "")
+		return
+	}
+	fmt.Printf("HTTP %s %s\n", req.Method, req.URL.Redacted())
+
+	stream, ok := s.dial(conn, host, port)
+	if !ok {
+		return
+	}
+	defer stream.Close()
+
+	for _, h := range hopHeaders {
+		req.Header.Del(h)
+	}
+	// One request per connection keeps the response's end easy to find:
+	// the server closes the stream after it
+	req.Close = true
+
+	// Request.Write sends the origin form (GET /path) and the body as it
+	// arrives; the response can start before the body is done
+	go func() {
+		if err := req.Write(stream); err != nil {
+			stream.Close()
+		}
+	}()
+	s.pipe(conn, nil, stream, req.URL.Host)
+}
+
+// dial opens the stream, answering the client itself when that fails
+func (s *Server) dial(conn net.Conn, host string, port uint16) (net.Conn, bool) {
+	stream, err := s.dialer.Dial(host, port)
+	switch {
+	case err == nil:
+		return stream, true
+	case errors.Is(err, socks5.ErrRefused):
+		fmt.Printf("🚫 HTTP proxy request to %s:%d refused by ruleset\n", host, port)
+		reply(conn, http.StatusForbidden, "")
+	default:
+		reply(conn, http.StatusBadGateway, "")
+	}
+	return nil, false
+}
+
+// pipe copies between the client and the stream until either side ends or
+// the connection idles out. fromClient, if set, is read instead of the
+// client connection; nil means the client has nothing more to send.
+func (s *Server) pipe(conn net.Conn, fromClient io.Reader, stream net.Conn, target string) {
+	var wg sync.WaitGroup
+	var teardownOnce sync.Once
+	teardown := func() {
+		teardownOnce.Do(func() {
+			conn.Close()
+			stream.Close()
+		})
+	}
+	touch, stopIdle := s.idleTimer(func() {
+		fmt.Printf("⌛ HTTP proxy stream to %s idle for %s, closing\n", target, s.opts.IdleTimeout)
+		teardown()
+	})
+	defer stopIdle()
+
+	// Client -> Stream
+	if fromClient != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer teardown()
+			copyTouching(stream, fromClient, touch, nil)
+		}()
+	}
+
+	// Stream -> Client
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer teardown()
+		copyTouching(conn, stream, touch, func() {
+			if s.opts.IdleTimeout > 0 {
+				conn.SetWriteDeadline(time.Now().Add(s.opts.IdleTimeout))
+			}
+		})
+	}()
+
+	select {
+	case <-s.kill:
+		teardown()
+	case <-waitGroupDone(&wg):
+	}
+	wg.Wait()
+}
+
+// copyTouching copies src to dst, calling touch for every chunk and
+// beforeWrite, if set, before writing it
+func copyTouching(dst io.Writer, src io.Reader, touch, beforeWrite func()) {
+	buf := make([]byte, copyBufSize)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			touch()
+			if beforeWrite != nil {
+				beforeWrite()
+			}
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// waitGroupDone closes the returned channel once wg is done
+func waitGroupDone(wg *sync.WaitGroup) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	return done
+}
+
+// idleTimer calls expire once IdleTimeout passes without touch being called.
+// stop must be called when the connection ends.
+func (s *Server) idleTimer(expire func()) (touch func(), stop func()) {
+	if s.opts.IdleTimeout < 0 {
+		return func() {}, func() {}
+	}
+	t := time.AfterFunc(s.opts.IdleTimeout, expire)
+	return func() { t.Reset(s.opts.IdleTimeout) }, func() { t.Stop() }
+}
+
+// authorized checks the Basic Proxy-Authorization, when credentials are set
+func (s *Server) authorized(req *http.Request) bool {
+	if s.opts.Username == "" {
+		return true
+	}
+	encoded, ok := strings.CutPrefix(req.Header.Get("Proxy-Authorization"), "Basic ")
+	if !ok {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return false
+	}
+	user, pass, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return false
+	}
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(s.opts.Username)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(s.opts.Password)) == 1
+	return userOK && passOK
+}
+
+// reply sends an empty response with status code and closes the exchange.
+// header holds extra "Name: value\r\n" lines.
+func reply(conn net.Conn, code int, header string) {
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n%sContent-Length: 0\r\nConnection: close\r\n\r\n", code, http.StatusText(code), header)
+}
+
+// splitHostPort splits host[:port], with defaultPort when there's none
+func splitHostPort(hostport string, defaultPort uint16) (string, uint16, error) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		// No port, or a bare IPv6 address in brackets
+		host = strings.TrimSuffix(strings.TrimPrefix(hostport, "["), "]")
+		if host == "" {
+			return "", 0, fmt.Errorf("invalid host %q", hostport)
+		}
+		return host, defaultPort, nil
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 || host == "" {
+		return "", 0, fmt.Errorf("invalid host %q", hostport)
+	}
+	return host, uint16(port), nil
+}
+
+// Stop stops accepting connections, gives open ones ShutdownGrace to
+// finish, then force-closes the rest
+func (s *Server) Stop() error {
+	var err error
+	s.stopOnce.Do(func() {
+		s.mu.Lock()
+		close(s.done)
+		if s.listener != nil {
+			err = s.listener.Close()
+		}
+		n := len(s.clients)
+		s.mu.Unlock()
+
+		drained := make(chan struct{})
+		go func() {
+			s.active.Wait()
+			close(drained)
+		}()
+
+		if n > 0 && s.opts.ShutdownGrace > 0 {
+			fmt.Printf("⏳ Waiting up to %s for %d HTTP proxy connection(s) to finish...\n", s.opts.ShutdownGrace, n)
+			select {
+			case <-drained:
+				return
+			case <-time.After(s.opts.ShutdownGrace):
+			}
+		}
+
+		s.mu.Lock()
+		n = len(s.clients)
+		close(s.kill)
+		for conn := range s.clients {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		if n > 0 {
+			fmt.Printf("✂️  Closed %d HTTP proxy connection(s) still open\n", n)
+		}
+		<-drained
+	})
+	return err
+}
@@ -0,0 +1,359 @@
+// Package metrics keeps tunnel counters and serves them over HTTP.
+// Counters are plain atomics so the packet loops can bump them freely.
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counter is a monotonically increasing value exposed as a Prometheus counter
+type Counter struct {
+	name string
+	help string
+	v    atomic.Uint64
+}
+
+// Add increases the counter by n
+func (c *Counter) Add(n int) {
+	c.v.Add(uint64(n))
+}
+
+// Inc increases the counter by one
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+// Load returns the current value
+func (c *Counter) Load() uint64 {
+	return c.v.Load()
+}
+
+// Gauge is a value that can go up and down, e.g. the current RTT
+type Gauge struct {
+	name string
+	help string
+	bits atomic.Uint64
+}
+
+// Set replaces the value
+func (g *Gauge) Set(v float64) {
+	g.bits.Store(math.Float64bits(v))
+}
+
+// Load returns the current value
+func (g *Gauge) Load() float64 {
+	return math.Float64frombits(g.bits.Load())
+}
+
+// Info is a string value, such as the relay in use. Prometheus sees it as
+// an info metric: a constant 1 with the value as a label.
+type Info struct {
+	name  string
+	help  string
+	label string
+	v     atomic.Pointer[string]
+}
+
+// Set replaces the value
+func (i *Info) Set(v string) {
+	i.v.Store(&v)
+}
+
+// Load returns the current value, or "" if it was never set
+func (i *Info) Load() string {
+	if v := i.v.Load(); v != nil {
+		return *v
+	}
+	return ""
+}
+
+// Histogram counts observations into fixed buckets, exposed as a Prometheus
+// histogram. Each bucket holds values up to and including its bound; the
+// last, implicit bucket holds everything above the largest bound.
+type Histogram struct {
+	name    string
+	help    string
+	bounds  []float64
+	buckets []atomic.Uint64 // len(bounds)+1, not cumulative
+	count   atomic.Uint64
+	sum     atomic.Uint64 // Observations are whole numbers (sizes), so this stays exact
+}
+
+// Observe records one value
+func (h *Histogram) Observe(v int) {
+	i := 0
+	for i < len(h.bounds) && float64(v) > h.bounds[i] {
+		i++
+	}
+	h.buckets[i].Add(1)
+	h.count.Add(1)
+	h.sum.Add(uint64(v))
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []*Counter
+	gauges     []*Gauge
+	infos      []*Info
+	histograms []*Histogram
+	started    = time.Now()
+)
+
+// NewCounter creates and registers a counter. name should follow Prometheus
+// conventions, e.g. "zks_tun_read_packets_total".
+func NewCounter(name, help string) *Counter {
+	c := &Counter{name: name, help: help}
+	registryMu.Lock()
+	registry = append(registry, c)
+	registryMu.Unlock()
+	return c
+}
+
+// NewGauge creates and registers a gauge
+func NewGauge(name, help string) *Gauge {
+	g := &Gauge{name: name, help: help}
+	registryMu.Lock()
+	gauges = append(gauges, g)
+	registryMu.Unlock()
+	return g
+}
+
+// NewInfo creates and registers an info value exported as name{label="..."}
+func NewInfo(name, help, label string) *Info {
+	i := &Info{name: name, help: help, label: label}
+	registryMu.Lock()
+	infos = append(infos, i)
+	registryMu.Unlock()
+	return i
+}
+
+// NewHistogram creates and registers a histogram with the given upper
+// bucket bounds, which must be ascending
+func NewHistogram(name, help string, bounds ...float64) *Histogram {
+	h := &Histogram{name: name, help: help, bounds: bounds, buckets: make([]atomic.Uint64, len(bounds)+1)}
+	registryMu.Lock()
+	histograms = append(histograms, h)
+	registryMu.Unlock()
+	return h
+}
+
+// ActiveRelay is the relay URL the connection currently uses
+var ActiveRelay = NewInfo("zks_active_relay", "Relay the client is connected to", "url")
+
+// Latency probe results (--probe-interval); all zero while probing is off
+var (
+	PeerRTTSeconds  = NewGauge("zks_peer_rtt_seconds", "Round trip time of the last probe through the relay to the peer")
+	PeerLossRatio   = NewGauge("zks_peer_probe_loss_ratio", "Smoothed fraction of probes that got no reply")
+	PeerLastSeenSec = NewGauge("zks_peer_last_seen_timestamp_seconds", "Unix time of the last probe reply")
+)
+
+// Control messages (Hello, Lease, key rotation) sent again for lack of an
+// acknowledgment from the peer
+var (
+	ControlRetransmits = NewCounter("zks_control_retransmits_total", "Control messages sent again because the peer had not acknowledged them")
+	ControlTimeouts    = NewCounter("zks_control_timeouts_total", "Control messages given up on after the peer never acknowledged them")
+)
+
+// SocksConnections is how many SOCKS5 client connections are open
+var SocksConnections = NewGauge("zks_socks_connections", "Open SOCKS5 client connections")
+
+// HTTPProxyConnections is how many HTTP proxy client connections are open
+var HTTPProxyConnections = NewGauge("zks_http_proxy_connections", "Open HTTP proxy client connections")
+
+// Uplink shaping (--uplink-mbps); all zero while it is off
+var (
+	UplinkLimitBps   = NewGauge("zks_uplink_limit_bits_per_second", "Configured uplink rate limit")
+	UplinkRateBps    = NewGauge("zks_uplink_rate_bits_per_second", "Uplink rate observed by the limiter over the last second")
+	RateLimitDropped = NewCounter("zks_rate_limit_dropped_packets_total", "Packets dropped for exceeding the uplink rate limit")
+	RateLimitDelayed = NewCounter("zks_rate_limit_delayed_batches_total", "Batches held back to stay under the uplink rate limit")
+)
+
+// Send queue between the TUN reader and the transport (p2p-vpn)
+var (
+	SendQueuePackets = NewGauge("zks_send_queue_packets", "Packets read from the TUN and waiting to be sent")
+	SendQueueDropped = NewCounter("zks_send_queue_dropped_packets_total", "Packets dropped because the send queue was full")
+)
+
+// Batching of TUN reads (p2p-vpn). With --batch-adaptive these move with
+// the packet rate; otherwise they are the fixed settings and the rate is 0.
+var (
+	BatchFlushIntervalSec = NewGauge("zks_batch_flush_interval_seconds", "How long TUN reads are currently coalesced before a send")
+	BatchMaxPackets       = NewGauge("zks_batch_max_packets", "Packets a batch currently holds before it is sent early")
+	BatchPacketRate       = NewGauge("zks_batch_packet_rate", "Smoothed TUN read rate in packets per second the adaptive batcher follows")
+)
+
+// packetSizeBuckets are the upper bounds for packet size histograms. The top
+// ones bracket common tunnel and Ethernet MTUs.
+var packetSizeBuckets = []float64{64, 128, 256, 512, 1024, 1280, 1400, 1500}
+
+// Tunnel counters. TUN->relay is traffic leaving this machine through the
+// tunnel, relay->TUN is traffic coming back.
+var (
+	TunToRelayPackets = NewCounter("zks_tun_to_relay_packets_total", "IP packets read from the TUN and sent to the transport")
+	TunToRelayBytes   = NewCounter("zks_tun_to_relay_bytes_total", "Bytes of IP packets read from the TUN and sent to the transport")
+	RelayToTunPackets = NewCounter("zks_relay_to_tun_packets_total", "IP packets received from the transport and written to the TUN")
+	RelayToTunBytes   = NewCounter("zks_relay_to_tun_bytes_total", "Bytes of IP packets received from the transport and written to the TUN")
+
+	DroppedPackets     = NewCounter("zks_dropped_packets_total", "Packets dropped because they were malformed, oversized or could not be queued")
+	OversizedPackets   = NewCounter("zks_oversized_packets_total", "Packets dropped for not fitting the path MTU, or received truncated")
+	ReorderedPackets   = NewCounter("zks_reordered_packets_total", "Packets received after a later one (--sequence)")
+	DuplicatePackets   = NewCounter("zks_duplicate_packets_total", "Packets received more than once (--sequence)")
+	FragmentedPackets  = NewCounter("zks_fragmented_packets_total", "Packets split into tunnel fragments for not fitting --fragment-size")
+	ReassemblyTimeouts = NewCounter("zks_reassembly_timeouts_total", "Fragmented packets dropped because not all pieces arrived in time")
+	MalformedPackets   = NewCounter("zks_malformed_packets_total", "IP packets dropped for an inconsistent header (length, IHL or protocol)")
+	FilteredPackets    = NewCounter("zks_filtered_packets_total", "IP packets read from the TUN and dropped by --allow-proto/--allow-port")
+	MSSClampedPackets  = NewCounter("zks_mss_clamped_packets_total", "TCP SYNs whose MSS option --clamp-mss lowered")
+	ChecksumCompleted  = NewCounter("zks_checksum_completed_packets_total", "IP packets read from the TUN whose checksums offload had left unfinished")
+
+	// Sizes of the IP packets counted above, to see whether the tunnel moves
+	// mostly small ACKs or full-MTU segments
+	TunToRelayPacketSize = NewHistogram("zks_tun_to_relay_packet_size_bytes", "Sizes of IP packets read from the TUN", packetSizeBuckets...)
+	RelayToTunPacketSize = NewHistogram("zks_relay_to_tun_packet_size_bytes", "Sizes of IP packets written to the TUN", packetSizeBuckets...)
+
+	TunReadErrors       = NewCounter("zks_tun_read_errors_total", "Errors reading from the TUN device")
+	TunWriteErrors      = NewCounter("zks_tun_write_errors_total", "Errors writing to the TUN device")
+	TransportSendErrors = NewCounter("zks_transport_send_errors_total", "Errors sending to the transport")
+	TransportRecvErrors = NewCounter("zks_transport_recv_errors_total", "Errors receiving from the transport")
+	RelaySplitBatches   = NewCounter("zks_relay_split_batches_total", "Batches split into several relay messages to stay under --max-message-size")
+	TransportReconnects = NewCounter("zks_transport_reconnects_total", "Direct Entry Node transports redialed after failing")
+)
+
+// Uptime returns how long the client has been running
+func Uptime() time.Duration {
+	return time.Since(started)
+}
+
+// tunStats is the running TUN's own Stats, if one was registered
+var tunStats atomic.Pointer[func() any]
+
+// SetTUNStats makes /stats and `status` report what stats returns under
+// "tun" (the vpn package can't be imported here, it imports us)
+func SetTUNStats(stats func() any) {
+	tunStats.Store(&stats)
+}
+
+// TUNStats returns the registered TUN's stats, or nil
+func TUNStats() any {
+	if stats := tunStats.Load(); stats != nil {
+		return (*stats)()
+	}
+	return nil
+}
+
+// Snapshot returns every counter by name
+func Snapshot() map[string]uint64 {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	out := make(map[string]uint64, len(registry))
+	for _, c := range registry {
+		out[c.name] = c.Load()
+	}
+	return out
+}
+
+// GaugeSnapshot returns every gauge by name
+func GaugeSnapshot() map[string]float64 {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	out := make(map[string]float64, len(gauges))
+	for _, g := range gauges {
+		out[g.name] = g.Load()
+	}
+	return out
+}
+
+// InfoSnapshot returns every info value that has been set, by name
+func InfoSnapshot() map[string]string {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	out := make(map[string]string, len(infos))
+	for _, i := range infos {
+		if v := i.Load(); v != "" {
+			out[i.name] = v
+		}
+	}
+	return out
+}
+
+// Handler serves /metrics (Prometheus text format) and /stats (JSON)
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", servePrometheus)
+	mux.HandleFunc("/stats", serveJSON)
+	return mux
+}
+
+// Serve starts the metrics HTTP server on addr in the background.
+// The listen error, if any, is returned right away.
+func Serve(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("metrics listen failed: %w", err)
+	}
+	go http.Serve(ln, Handler())
+	return nil
+}
+
+func servePrometheus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	registryMu.Lock()
+	counters := append([]*Counter(nil), registry...)
+	gaugeList := append([]*Gauge(nil), gauges...)
+	infoList := append([]*Info(nil), infos...)
+	histList := append([]*Histogram(nil), histograms...)
+	registryMu.Unlock()
+
+	for _, c := range counters {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.Load())
+	}
+	for _, g := range gaugeList {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", g.name, g.help, g.name, g.name, g.Load())
+	}
+	for _, i := range infoList {
+		if v := i.Load(); v != "" {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s{%s=%q} 1\n", i.name, i.help, i.name, i.name, i.label, v)
+		}
+	}
+	for _, h := range histList {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+		// Prometheus buckets are cumulative
+		var cum uint64
+		for i, le := range h.bounds {
+			cum += h.buckets[i].Load()
+			fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", h.name, le, cum)
+		}
+		cum += h.buckets[len(h.bounds)].Load()
+		fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %d\n%s_count %d\n", h.name, cum, h.name, h.sum.Load(), h.name, h.count.Load())
+	}
+	fmt.Fprintf(w, "# HELP zks_uptime_seconds Seconds since the client started\n# TYPE zks_uptime_seconds gauge\nzks_uptime_seconds %.0f\n", time.Since(started).Seconds())
+}
+
+func serveJSON(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		UptimeSeconds int64                 `json:"uptime_seconds"`
+		Counters      map[string]uint64     `json:"counters"`
+		Gauges        map[string]float64    `json:"gauges"`
+		Info          map[string]string     `json:"info"`
+		Peers         map[string]PeerTotals `json:"peers,omitempty"`
+		TUN           any                   `json:"tun,omitempty"`
+	}{
+		UptimeSeconds: int64(time.Since(started).Seconds()),
+		Counters:      Snapshot(),
+		Gauges:        GaugeSnapshot(),
+		Info:          InfoSnapshot(),
+		Peers:         PeerSnapshot(),
+		TUN:           TUNStats(),
+	})
+}
@@ -0,0 +1,87 @@
+package metrics
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PeerTraffic counts one peer's traffic, e.g. an Exit Peer client keyed by
+// its tunnel address. "Received" is from the peer, "sent" is to it.
+type PeerTraffic struct {
+	id    string
+	since time.Time
+
+	packetsReceived atomic.Uint64
+	bytesReceived   atomic.Uint64
+	packetsSent     atomic.Uint64
+	bytesSent       atomic.Uint64
+}
+
+// PeerTotals is a PeerTraffic snapshot, as served in /stats and `status`
+type PeerTotals struct {
+	ConnectedSeconds int64  `json:"connected_seconds"`
+	PacketsReceived  uint64 `json:"packets_received"`
+	BytesReceived    uint64 `json:"bytes_received"`
+	PacketsSent      uint64 `json:"packets_sent"`
+	BytesSent        uint64 `json:"bytes_sent"`
+}
+
+var (
+	peersMu sync.Mutex
+	peers   = make(map[string]*PeerTraffic)
+)
+
+// AddPeer starts counting a peer from zero, replacing an earlier entry with
+// the same id. Call Remove when the peer goes away so the table stays small.
+func AddPeer(id string) *PeerTraffic {
+	p := &PeerTraffic{id: id, since: time.Now()}
+	peersMu.Lock()
+	peers[id] = p
+	peersMu.Unlock()
+	return p
+}
+
+// Remove drops p from the table, unless a newer peer has taken its id
+func (p *PeerTraffic) Remove() {
+	peersMu.Lock()
+	if peers[p.id] == p {
+		delete(peers, p.id)
+	}
+	peersMu.Unlock()
+}
+
+// Received counts a packet of n bytes from the peer
+func (p *PeerTraffic) Received(n int) {
+	p.packetsReceived.Add(1)
+	p.bytesReceived.Add(uint64(n))
+}
+
+// Sent counts a packet of n bytes to the peer
+func (p *PeerTraffic) Sent(n int) {
+	p.packetsSent.Add(1)
+	p.bytesSent.Add(uint64(n))
+}
+
+// Totals returns the counts so far
+func (p *PeerTraffic) Totals() PeerTotals {
+	return PeerTotals{
+		ConnectedSeconds: int64(time.Since(p.since).Seconds()),
+		PacketsReceived:  p.packetsReceived.Load(),
+		BytesReceived:    p.bytesReceived.Load(),
+		PacketsSent:      p.packetsSent.Load(),
+		BytesSent:        p.bytesSent.Load(),
+	}
+}
+
+// PeerSnapshot returns the totals of every peer by id
+func PeerSnapshot() map[string]PeerTotals {
+	peersMu.Lock()
+	defer peersMu.Unlock()
+
+	out := make(map[string]PeerTotals, len(peers))
+	for id, p := range peers {
+		out[id] = p.Totals()
+	}
+	return out
+}
@@ -0,0 +1,59 @@
+// Package mode lists the ways the client can run (--mode) and the relay
+// role each one joins a room as. Adding a mode starts here.
+package mode
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/zks-vpn/zks-go-client/relay"
+)
+
+// Mode is a validated --mode value
+type Mode string
+
+const (
+	Client   Mode = "p2p-client" // SOCKS5 proxy
+	VPN      Mode = "p2p-vpn"    // System-wide TUN
+	ExitPeer Mode = "exit-peer"  // Forwards clients' traffic to the internet
+	Entry    Mode = "entry-node" // UDP gateway for --transport udp clients
+	Probe    Mode = "probe"      // Pings the room's exit peer once
+	SelfTest Mode = "selftest"   // Loops test packets through an in-process exit peer
+)
+
+// All lists every mode, in the order help texts show them
+var All = []Mode{Client, VPN, ExitPeer, Entry, Probe, SelfTest}
+
+// roles maps each mode to the side of the room it joins
+var roles = map[Mode]relay.PeerRole{
+	Client:   relay.RoleClient,
+	VPN:      relay.RoleClient,
+	ExitPeer: relay.RoleExitPeer,
+	Entry:    relay.RoleClient, // Stands in for its clients
+	Probe:    relay.RoleClient,
+	SelfTest: relay.RoleClient, // Plays both sides on its own loopback relay
+}
+
+// ParseMode validates s and returns the mode with its relay role
+func ParseMode(s string) (Mode, relay.PeerRole, error) {
+	m := Mode(s)
+	role, ok := roles[m]
+	if !ok {
+		return "", "", fmt.Errorf("unknown mode %q (want one of %s)", s, strings.Join(Names(), ", "))
+	}
+	return m, role, nil
+}
+
+// Role is the relay role m joins a room as
+func (m Mode) Role() relay.PeerRole {
+	return roles[m]
+}
+
+// Names returns All as strings
+func Names() []string {
+	names := make([]string, len(All))
+	for i, m := range All {
+		names[i] = string(m)
+	}
+	return names
+}
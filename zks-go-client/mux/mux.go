@@ -0,0 +1,181 @@
+// Package mux runs the SOCKS5 proxy and the TUN over one relay connection.
+//
+// # How streams are told apart
+//
+// The wire format already tags every message with the stream it belongs
+// to, so sharing a room needs no extra framing:
+//
+//   - SOCKS5 traffic (Connect, ConnectSuccess, Data, Close, ErrorReply,
+//     UdpDatagram) carries the StreamID the SOCKS5 server allocated, and
+//   - IP packets (IpPacket, BatchIpPacket and its compressed form) carry no
+//     ID and make up the TUN's implicit stream.
+//
+// The exit peer dispatches on the message type the same way: IP packets go
+// to its NAT, the rest to the SOCKS5 stream they name. The Mux does the
+// client side of that, reading the connection once and handing each message
+// to the channel it belongs to.
+package mux
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+
+	"github.com/zks-vpn/zks-go-client/metrics"
+	"github.com/zks-vpn/zks-go-client/protocol"
+	"github.com/zks-vpn/zks-go-client/relay"
+)
+
+// queueSize is how many received messages a channel buffers for its reader
+const queueSize = 256
+
+// Mux splits one relay connection into a SOCKS5 channel and a TUN channel
+type Mux struct {
+	conn *relay.Connection
+
+	socks *Channel
+	tun   *Channel
+
+	mu     sync.Mutex
+	open   int // Channels not closed yet
+	closed chan struct{}
+	err    error // Why the connection stopped, once closed is
+}
+
+// New starts routing conn's messages. The Mux owns conn from here on and
+// closes it along with the last channel.
+func New(conn *relay.Connection) *Mux {
+	m := &Mux{conn: conn, open: 2, closed: make(chan struct{})}
+	m.socks = newChannel(m)
+	m.tun = newChannel(m)
+	go m.recvLoop()
+	return m
+}
+
+// SOCKS5 is the channel for socks5.NewServer
+func (m *Mux) SOCKS5() *Channel {
+	return m.socks
+}
+
+// TUN is the channel for vpn.NewRelayTransport
+func (m *Mux) TUN() *Channel {
+	return m.tun
+}
+
+// Close closes both channels and the connection
+func (m *Mux) Close() {
+	m.socks.Close()
+	m.tun.Close()
+}
+
+// recvLoop is the only reader of the connection
+func (m *Mux) recvLoop() {
+	for {
+		msg, err := m.conn.Recv()
+		if err != nil {
+			m.mu.Lock()
+			m.err = err
+			m.mu.Unlock()
+			close(m.closed)
+			return
+		}
+
+		switch msg.(type) {
+		case *protocol.IpPacket, *protocol.BatchIpPacket:
+			// Like any IP path, drop rather than stall SOCKS5 behind a busy TUN
+			select {
+			case m.tun.queue <- msg:
+			case <-m.tun.done:
+			default:
+				metrics.DroppedPackets.Inc()
+			}
+		default:
+			// Stream data must not be lost; the SOCKS5 server drains promptly
+			select {
+			case m.socks.queue <- msg:
+			case <-m.socks.done:
+			}
+		}
+	}
+}
+
+// channelClosed closes the connection once no channel uses it
+func (m *Mux) channelClosed() {
+	m.mu.Lock()
+	m.open--
+	last := m.open == 0
+	m.mu.Unlock()
+	if last {
+		m.conn.Close()
+	}
+}
+
+// Channel is one user's view of the shared connection. It implements
+// relay.Conn: sends go straight out, Recv returns only this user's messages.
+type Channel struct {
+	m     *Mux
+	queue chan protocol.TunnelMessage
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newChannel(m *Mux) *Channel {
+	return &Channel{m: m, queue: make(chan protocol.TunnelMessage, queueSize), done: make(chan struct{})}
+}
+
+// Send sends msg on the shared connection
+func (c *Channel) Send(msg protocol.TunnelMessage) error {
+	select {
+	case <-c.done:
+		return relay.ErrClosed
+	default:
+	}
+	return c.m.conn.Send(msg)
+}
+
+// Recv returns the next message routed to this channel
+func (c *Channel) Recv() (protocol.TunnelMessage, error) {
+	return c.RecvContext(context.Background())
+}
+
+// RecvContext is Recv, giving up with ctx.Err() once ctx is done
+func (c *Channel) RecvContext(ctx context.Context) (protocol.TunnelMessage, error) {
+	// Deliver what was queued before the connection went away
+	select {
+	case msg := <-c.queue:
+		return msg, nil
+	default:
+	}
+
+	select {
+	case msg := <-c.queue:
+		return msg, nil
+	case <-c.done:
+		return nil, relay.ErrClosed
+	case <-c.m.closed:
+		c.m.mu.Lock()
+		defer c.m.mu.Unlock()
+		return nil, c.m.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Capabilities reports what the shared connection negotiated
+func (c *Channel) Capabilities() relay.Capabilities {
+	return c.m.conn.Capabilities()
+}
+
+// Lease waits for the address the Exit Peer assigns on the shared connection
+func (c *Channel) Lease(ctx context.Context) (netip.Prefix, error) {
+	return c.m.conn.Lease(ctx)
+}
+
+// Close closes this channel. The connection is closed with the last one.
+func (c *Channel) Close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.m.channelClosed()
+	})
+}
@@ -0,0 +1,22 @@
+//go:build darwin
+
+package netbind
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+func supported() error {
+	return nil
+}
+
+// bind scopes the socket to the interface index with IP_BOUND_IF
+// (IPV6_BOUND_IF for IPv6 sockets)
+func bind(fd uintptr, network string, ifi *net.Interface) error {
+	if ipv6(network) {
+		return unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_BOUND_IF, ifi.Index)
+	}
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_BOUND_IF, ifi.Index)
+}
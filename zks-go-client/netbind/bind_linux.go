@@ -0,0 +1,19 @@
+//go:build linux
+
+package netbind
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+func supported() error {
+	return nil
+}
+
+// bind uses SO_BINDTODEVICE, which covers both address families. It needs
+// CAP_NET_RAW, which VPN mode runs with anyway.
+func bind(fd uintptr, network string, ifi *net.Interface) error {
+	return unix.BindToDevice(int(fd), ifi.Name)
+}
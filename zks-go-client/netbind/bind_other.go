@@ -0,0 +1,17 @@
+//go:build !linux && !darwin && !windows
+
+package netbind
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+func supported() error {
+	return fmt.Errorf("binding to an interface is not supported on %s", runtime.GOOS)
+}
+
+func bind(fd uintptr, network string, ifi *net.Interface) error {
+	return supported()
+}
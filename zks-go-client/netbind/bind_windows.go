@@ -0,0 +1,33 @@
+//go:build windows
+
+package netbind
+
+import (
+	"encoding/binary"
+	"net"
+
+	"golang.org/x/sys/windows"
+)
+
+// From ws2ipdef.h; x/sys/windows doesn't define them
+const (
+	ipUnicastIf   = 31
+	ipv6UnicastIf = 31
+)
+
+func supported() error {
+	return nil
+}
+
+// bind sets IP_UNICAST_IF (IPV6_UNICAST_IF), which makes Windows send
+// through the interface whatever its routes prefer
+func bind(fd uintptr, network string, ifi *net.Interface) error {
+	h := windows.Handle(fd)
+	if ipv6(network) {
+		return windows.SetsockoptInt(h, windows.IPPROTO_IPV6, ipv6UnicastIf, ifi.Index)
+	}
+	// The IPv4 option takes the index in network byte order
+	var idx [4]byte
+	binary.BigEndian.PutUint32(idx[:], uint32(ifi.Index))
+	return windows.SetsockoptInt(h, windows.IPPROTO_IP, ipUnicastIf, int(binary.LittleEndian.Uint32(idx[:])))
+}
@@ -0,0 +1,57 @@
+// Package netbind pins outgoing sockets to one network interface, so the
+// tunnel's own connections (relay WebSocket, Entry Node) keep leaving
+// through it when a multi-homed machine changes its preferred interface.
+//
+// Linux binds with SO_BINDTODEVICE, macOS with IP_BOUND_IF and Windows with
+// IP_UNICAST_IF; other platforms refuse.
+package netbind
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// Check reports whether name is an interface sockets can be bound to
+func Check(name string) error {
+	if _, err := net.InterfaceByName(name); err != nil {
+		return fmt.Errorf("interface %q: %w", name, err)
+	}
+	return supported()
+}
+
+// Control returns a net.Dialer Control function binding each socket to the
+// interface name. The interface is looked up on every dial, so a Wi-Fi
+// adapter that went away and came back gets its new index.
+func Control(name string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		ifi, err := net.InterfaceByName(name)
+		if err != nil {
+			return fmt.Errorf("bind to interface %q: %w", name, err)
+		}
+		var serr error
+		if err := c.Control(func(fd uintptr) {
+			serr = bind(fd, network, ifi)
+		}); err != nil {
+			return err
+		}
+		if serr != nil {
+			return fmt.Errorf("bind to interface %q: %w", name, serr)
+		}
+		return nil
+	}
+}
+
+// Dialer returns base with its sockets bound to the interface name. An
+// empty name returns base as is.
+func Dialer(base net.Dialer, name string) *net.Dialer {
+	if name != "" {
+		base.Control = Control(name)
+	}
+	return &base
+}
+
+// ipv6 reports whether network ("tcp6", "udp4", ...) is an IPv6 socket
+func ipv6(network string) bool {
+	return len(network) > 0 && network[len(network)-1] == '6'
+}
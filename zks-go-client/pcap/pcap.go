@@ -0,0 +1,147 @@
+// Package pcap writes tunnel packets to a capture file Wireshark and
+// tcpdump can read. TUN packets have no link layer, so each one gets a
+// Linux "cooked" (SLL) header, which also records its direction.
+package pcap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Direction says which way a packet crossed the TUN device
+type Direction uint16
+
+// SLL packet types
+const (
+	// Inbound packets came from the tunnel and were written to the device
+	Inbound Direction = 0 // LINUX_SLL_HOST
+	// Outbound packets were read from the device and sent into the tunnel
+	Outbound Direction = 4 // LINUX_SLL_OUTGOING
+)
+
+const (
+	linkTypeLinuxSLL = 113
+	sllHeaderLen     = 16
+	recordHeaderLen  = 16
+	fileHeaderLen    = 24
+	snapLen          = 65535
+	arphrdNone       = 0xFFFE // No hardware address
+)
+
+// Writer appends packets to a pcap file. With a size limit the file is
+// rotated: it becomes path.1, replacing the previous one, and a new file
+// starts, so at most about twice the limit is kept on disk.
+type Writer struct {
+	path     string
+	maxBytes int64
+
+	mu   sync.Mutex
+	f    *os.File
+	w    *bufio.Writer
+	size int64
+	err  error // First write error; capture stops after it
+}
+
+// Create starts a capture file at path, replacing any existing one.
+// maxBytes limits each file's size (0 = no limit).
+func Create(path string, maxBytes int64) (*Writer, error) {
+	w := &Writer{path: path, maxBytes: maxBytes}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Writer) open() error {
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("pcap: %w", err)
+	}
+	w.f, w.w = f, bufio.NewWriter(f)
+
+	var hdr [fileHeaderLen]byte
+	binary.LittleEndian.PutUint32(hdr[0:4], 0xa1b2c3d4) // Microsecond timestamps
+	binary.LittleEndian.PutUint16(hdr[4:6], 2)
+	binary.LittleEndian.PutUint16(hdr[6:8], 4)
+	binary.LittleEndian.PutUint32(hdr[16:20], snapLen)
+	binary.LittleEndian.PutUint32(hdr[20:24], linkTypeLinuxSLL)
+	_, err = w.w.Write(hdr[:])
+	w.size = fileHeaderLen
+	return err
+}
+
+// rotate moves the full file to path.1 and starts a new one
+func (w *Writer) rotate() error {
+	w.w.Flush()
+	w.f.Close()
+	if err := os.Rename(w.path, w.path+".1"); err != nil {
+		return fmt.Errorf("pcap: %w", err)
+	}
+	return w.open()
+}
+
+// WritePackets records IP packets that crossed the device in direction
+// dir, and flushes them to the file
+func (w *Writer) WritePackets(dir Direction, packets [][]byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+
+	now := time.Now()
+	for _, pkt := range packets {
+		if len(pkt) == 0 {
+			continue
+		}
+		caplen := min(len(pkt), snapLen-sllHeaderLen)
+		recLen := int64(recordHeaderLen + sllHeaderLen + caplen)
+		if w.maxBytes > 0 && w.size+recLen > w.maxBytes && w.size > fileHeaderLen {
+			if w.err = w.rotate(); w.err != nil {
+				return w.err
+			}
+		}
+
+		var hdr [recordHeaderLen + sllHeaderLen]byte
+		binary.LittleEndian.PutUint32(hdr[0:4], uint32(now.Unix()))
+		binary.LittleEndian.PutUint32(hdr[4:8], uint32(now.Nanosecond()/1000))
+		binary.LittleEndian.PutUint32(hdr[8:12], uint32(sllHeaderLen+caplen))
+		binary.LittleEndian.PutUint32(hdr[12:16], uint32(sllHeaderLen+len(pkt)))
+
+		// The SLL header is big-endian, like the wire
+		sll := hdr[recordHeaderLen:]
+		binary.BigEndian.PutUint16(sll[0:2], uint16(dir))
+		binary.BigEndian.PutUint16(sll[2:4], arphrdNone)
+		binary.BigEndian.PutUint16(sll[14:16], etherType(pkt))
+
+		w.w.Write(hdr[:])
+		w.w.Write(pkt[:caplen])
+		w.size += recLen
+	}
+	if w.err = w.w.Flush(); w.err != nil {
+		w.err = fmt.Errorf("pcap: %w", w.err)
+	}
+	return w.err
+}
+
+// Close flushes and closes the file
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.err = w.w.Flush()
+	}
+	return w.f.Close()
+}
+
+// etherType tells IPv4 from IPv6 by the version nibble
+func etherType(pkt []byte) uint16 {
+	if pkt[0]>>4 == 6 {
+		return 0x86DD
+	}
+	return 0x0800
+}
@@ -0,0 +1,52 @@
+// Package profiling serves net/http/pprof for a running client, so CPU,
+// heap and goroutine profiles can be taken from a live tunnel with
+// `go tool pprof`. It only listens on loopback: profiles expose memory
+// contents and a CPU profile costs throughput while it runs.
+package profiling
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+// CheckAddr accepts host:port addresses on loopback only
+func CheckAddr(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("%q is not a loopback address (use 127.0.0.1 or [::1])", host)
+	}
+	return nil
+}
+
+// Handler serves the pprof index and profiles under /debug/pprof/
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// Serve starts the pprof server on addr in the background.
+// The listen error, if any, is returned right away.
+func Serve(addr string) error {
+	if err := CheckAddr(addr); err != nil {
+		return fmt.Errorf("pprof: %w", err)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("pprof listen failed: %w", err)
+	}
+	go http.Serve(ln, Handler())
+	return nil
+}
@@ -0,0 +1,79 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"sync"
+)
+
+const (
+	// minCompressSize skips batches too small to gain anything
+	minCompressSize = 256
+	// maxDecompressedSize bounds what one CompressedBatch may inflate to
+	maxDecompressedSize = 16 << 20
+)
+
+// CompressedBatch is a BatchIpPacket encoding, DEFLATE-compressed. Decode
+// inflates it back into a *BatchIpPacket, so receivers never see this type.
+type CompressedBatch struct {
+	Data []byte
+}
+
+func (m *CompressedBatch) Type() byte { return CmdCompressedBatch }
+
+func (m *CompressedBatch) Encode() []byte {
+	buf := make([]byte, 1+len(m.Data))
+	buf[0] = CmdCompressedBatch
+	copy(buf[1:], m.Data)
+	return buf
+}
+
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+// CompressBatch compresses b, returning b itself when that doesn't make it
+// smaller (already encrypted traffic such as TLS, or tiny batches)
+func CompressBatch(b *BatchIpPacket) TunnelMessage {
+	plain := b.Encode()
+	if len(plain) < minCompressSize {
+		return b
+	}
+
+	var out bytes.Buffer
+	out.Grow(len(plain))
+	w := flateWriters.Get().(*flate.Writer)
+	w.Reset(&out)
+	w.Write(plain)
+	w.Close()
+	flateWriters.Put(w)
+
+	// The extra command byte is the only overhead
+	if out.Len()+1 >= len(plain) {
+		return b
+	}
+	return &CompressedBatch{Data: out.Bytes()}
+}
+
+// decompressBatch inflates a CompressedBatch payload and decodes the batch inside
+func decompressBatch(data []byte) (TunnelMessage, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+
+	plain, err := io.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(plain) > maxDecompressedSize {
+		return nil, errors.New("compressed batch too large")
+	}
+	if len(plain) == 0 || plain[0] != CmdBatchIpPacket {
+		return nil, errors.New("compressed batch does not hold a BatchIpPacket")
+	}
+	return Decode(plain)
+}
@@ -3,6 +3,7 @@
 package protocol
 
 import (
+	"bytes"
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha256"
@@ -247,6 +248,34 @@ func (ke *KeyExchange) ComputeSharedSecret(peerPubKeyBytes []byte) ([32]byte, er
 	return result, nil
 }
 
+// DerivePSK derives a 32-byte pre-shared key from a user passphrase,
+// salted with the room ID so the same passphrase yields different keys per room
+func DerivePSK(roomID, passphrase string) ([32]byte, error) {
+	var key [32]byte
+	hkdfReader := hkdf.New(sha256.New, []byte(passphrase), []byte(roomID), []byte("ZKS-VPN v1.0 transport PSK"))
+	if _, err := io.ReadFull(hkdfReader, key[:]); err != nil {
+		return [32]byte{}, err
+	}
+	return key, nil
+}
+
+// MixRoomSecret binds a link key to a room secret with HKDF-SHA256, salted
+// with both sides' public keys (sorted, so the two peers agree on the
+// order). Peers that don't share the secret end up with different keys.
+func MixRoomSecret(key [32]byte, secret string, pkA, pkB []byte) ([32]byte, error) {
+	if bytes.Compare(pkA, pkB) > 0 {
+		pkA, pkB = pkB, pkA
+	}
+	ikm := append(append([]byte(nil), key[:]...), secret...)
+	salt := append(append([]byte(nil), pkA...), pkB...)
+	var mixed [32]byte
+	hkdfReader := hkdf.New(sha256.New, ikm, salt, []byte("ZKS-VPN v1.0 room secret"))
+	if _, err := io.ReadFull(hkdfReader, mixed[:]); err != nil {
+		return [32]byte{}, err
+	}
+	return mixed, nil
+}
+
 // ParseHexPublicKey parses a hex-encoded public key
 func ParseHexPublicKey(hexStr string) ([]byte, error) {
 	if len(hexStr) != 64 {
@@ -0,0 +1,71 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// FragmentHeaderLen is the size of a Fragment before its payload:
+// [Cmd (1) | ID (4) | Offset (2) | Flags (1)]
+const FragmentHeaderLen = 8
+
+// fragmentMore is the more-fragments flag
+const fragmentMore = 0x01
+
+// Fragment is one piece of an IP packet too large for the tunnel path.
+// Pieces of the same packet share an ID; Offset is where Payload starts
+// in the original packet, and More is false on the last piece.
+//
+// Fragments travel in place of IP packets (inside IpPacket and
+// BatchIpPacket); their first byte can't be mistaken for an IPv4 or IPv6
+// header.
+type Fragment struct {
+	ID      uint32
+	Offset  uint16
+	More    bool
+	Payload []byte
+}
+
+func (m *Fragment) Type() byte { return CmdFragment }
+
+func (m *Fragment) Encode() []byte {
+	buf := make([]byte, FragmentHeaderLen+len(m.Payload))
+	m.EncodeTo(buf)
+	return buf
+}
+
+// EncodeTo encodes the Fragment into dst, which must hold
+// FragmentHeaderLen + len(Payload) bytes. Returns the number of bytes written.
+func (m *Fragment) EncodeTo(dst []byte) int {
+	needed := FragmentHeaderLen + len(m.Payload)
+	if len(dst) < needed {
+		return 0
+	}
+	dst[0] = CmdFragment
+	binary.BigEndian.PutUint32(dst[1:5], m.ID)
+	binary.BigEndian.PutUint16(dst[5:7], m.Offset)
+	dst[7] = 0
+	if m.More {
+		dst[7] = fragmentMore
+	}
+	copy(dst[FragmentHeaderLen:], m.Payload)
+	return needed
+}
+
+// IsFragment reports whether pkt, taken from an IpPacket, is a Fragment
+func IsFragment(pkt []byte) bool {
+	return len(pkt) > 0 && pkt[0] == CmdFragment
+}
+
+// DecodeFragment parses a Fragment. Payload aliases data.
+func DecodeFragment(data []byte) (*Fragment, error) {
+	if len(data) < FragmentHeaderLen || data[0] != CmdFragment {
+		return nil, errors.New("insufficient data for Fragment")
+	}
+	return &Fragment{
+		ID:      binary.BigEndian.Uint32(data[1:5]),
+		Offset:  binary.BigEndian.Uint16(data[5:7]),
+		More:    data[7]&fragmentMore != 0,
+		Payload: data[FragmentHeaderLen:],
+	}, nil
+}
@@ -6,28 +6,71 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"strings"
+
+	"github.com/zks-vpn/zks-go-client/bufpool"
 )
 
 // Command types for the tunnel protocol
 const (
-	CmdConnect        byte = 0x01
-	CmdData           byte = 0x02
-	CmdClose          byte = 0x03
-	CmdErrorReply     byte = 0x04
-	CmdPing           byte = 0x05
-	CmdPong           byte = 0x06
-	CmdUdpDatagram    byte = 0x07
-	CmdDnsQuery       byte = 0x08
-	CmdDnsResponse    byte = 0x09
-	CmdConnectSuccess byte = 0x0A
-	CmdHttpRequest    byte = 0x0B
-	CmdHttpResponse   byte = 0x0C
-	CmdChainForward   byte = 0x10
-	CmdChainAck       byte = 0x11
-	CmdIpPacket       byte = 0x20
-	CmdBatchIpPacket  byte = 0x21 // Multiple IP packets in one message
+	CmdConnect         byte = 0x01
+	CmdData            byte = 0x02
+	CmdClose           byte = 0x03
+	CmdErrorReply      byte = 0x04
+	CmdPing            byte = 0x05
+	CmdPong            byte = 0x06
+	CmdUdpDatagram     byte = 0x07
+	CmdDnsQuery        byte = 0x08
+	CmdDnsResponse     byte = 0x09
+	CmdConnectSuccess  byte = 0x0A
+	CmdHttpRequest     byte = 0x0B
+	CmdHttpResponse    byte = 0x0C
+	CmdChainForward    byte = 0x10
+	CmdChainAck        byte = 0x11
+	CmdIpPacket        byte = 0x20
+	CmdBatchIpPacket   byte = 0x21 // Multiple IP packets in one message
+	CmdCompressedBatch byte = 0x22 // DEFLATE-compressed BatchIpPacket
+	CmdFragment        byte = 0x23 // Piece of an IP packet too large for the path
+	CmdHello           byte = 0x30 // Version/feature handshake, first message on a link
+	CmdLease           byte = 0x31 // Exit Peer assigns the client its tunnel address
+	CmdControl         byte = 0x32 // Control message that is acknowledged and retransmitted
+	CmdControlAck      byte = 0x33 // Acknowledges a Control
 )
 
+// ProtocolVersion is the version this client speaks. Peers that never send
+// a Hello are treated as version 0 with only FeatureBatching.
+const ProtocolVersion uint16 = 1
+
+// Features is a bit set of optional protocol capabilities
+type Features uint32
+
+const (
+	FeatureBatching        Features = 1 << iota // Understands BatchIpPacket
+	FeatureCompression                          // Understands compressed batches
+	FeatureIPv6                                 // Forwards IPv6 packets
+	FeatureLease                                // Assigns (exit) or accepts (client) a Lease
+	FeatureReliableControl                      // Acknowledges Control messages
+)
+
+// Has reports whether every feature in want is set
+func (f Features) Has(want Features) bool { return f&want == want }
+
+func (f Features) String() string {
+	var names []string
+	for _, feat := range []struct {
+		bit  Features
+		name string
+	}{{FeatureBatching, "batching"}, {FeatureCompression, "compression"}, {FeatureIPv6, "ipv6"}, {FeatureLease, "lease"}, {FeatureReliableControl, "reliable-control"}} {
+		if f.Has(feat.bit) {
+			names = append(names, feat.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
 // StreamID is the identifier for multiplexed connections
 type StreamID = uint32
 
@@ -37,6 +80,13 @@ type TunnelMessage interface {
 	Type() byte
 }
 
+// EncoderTo is implemented by the hot-path messages (IpPacket, Data), which
+// can encode into a pooled buffer instead of allocating one. EncodeTo
+// returns 0 when dst is too small.
+type EncoderTo interface {
+	EncodeTo(dst []byte) int
+}
+
 // Connect requests a TCP connection to a target
 type Connect struct {
 	StreamID StreamID
@@ -67,13 +117,24 @@ func (m *Data) Type() byte { return CmdData }
 
 func (m *Data) Encode() []byte {
 	buf := make([]byte, 1+4+4+len(m.Payload))
-	buf[0] = CmdData
-	binary.BigEndian.PutUint32(buf[1:5], m.StreamID)
-	binary.BigEndian.PutUint32(buf[5:9], uint32(len(m.Payload)))
-	copy(buf[9:], m.Payload)
+	m.EncodeTo(buf)
 	return buf
 }
 
+// EncodeTo encodes the Data into dst, which must hold 1 + 4 + 4 +
+// len(Payload) bytes. Returns the number of bytes written.
+func (m *Data) EncodeTo(dst []byte) int {
+	needed := 1 + 4 + 4 + len(m.Payload)
+	if len(dst) < needed {
+		return 0
+	}
+	dst[0] = CmdData
+	binary.BigEndian.PutUint32(dst[1:5], m.StreamID)
+	binary.BigEndian.PutUint32(dst[5:9], uint32(len(m.Payload)))
+	copy(dst[9:], m.Payload)
+	return needed
+}
+
 // Close closes a stream
 type Close struct {
 	StreamID StreamID
@@ -108,20 +169,68 @@ func (m *ErrorReply) Encode() []byte {
 	return buf
 }
 
-// Ping keepalive
-type Ping struct{}
+// Ping is a latency probe. Seq and Timestamp (the sender's UnixNano) are
+// echoed back in the Pong; older peers send a bare command byte.
+type Ping struct {
+	Seq       uint32
+	Timestamp int64
+}
 
 func (m *Ping) Type() byte { return CmdPing }
 func (m *Ping) Encode() []byte {
-	return []byte{CmdPing}
+	return encodeProbe(CmdPing, m.Seq, m.Timestamp)
 }
 
-// Pong response
-type Pong struct{}
+// Pong answers a Ping with its Seq and Timestamp
+type Pong struct {
+	Seq       uint32
+	Timestamp int64
+}
 
 func (m *Pong) Type() byte { return CmdPong }
 func (m *Pong) Encode() []byte {
-	return []byte{CmdPong}
+	return encodeProbe(CmdPong, m.Seq, m.Timestamp)
+}
+
+func encodeProbe(cmd byte, seq uint32, ts int64) []byte {
+	buf := make([]byte, 1+4+8)
+	buf[0] = cmd
+	binary.BigEndian.PutUint32(buf[1:5], seq)
+	binary.BigEndian.PutUint64(buf[5:13], uint64(ts))
+	return buf
+}
+
+// decodeProbe reads Seq and Timestamp, which are zero in a bare Ping/Pong
+func decodeProbe(data []byte) (uint32, int64) {
+	if len(data) < 13 {
+		return 0, 0
+	}
+	return binary.BigEndian.Uint32(data[1:5]), int64(binary.BigEndian.Uint64(data[5:13]))
+}
+
+// UdpDatagram carries one UDP payload for a UDP association (SOCKS5 UDP ASSOCIATE).
+// Client -> Exit: Host/Port is the destination. Exit -> Client: the source.
+type UdpDatagram struct {
+	StreamID StreamID
+	Host     string
+	Port     uint16
+	Payload  []byte
+}
+
+func (m *UdpDatagram) Type() byte { return CmdUdpDatagram }
+
+func (m *UdpDatagram) Encode() []byte {
+	hostBytes := []byte(m.Host)
+	buf := make([]byte, 1+4+2+2+len(hostBytes)+4+len(m.Payload))
+	buf[0] = CmdUdpDatagram
+	binary.BigEndian.PutUint32(buf[1:5], m.StreamID)
+	binary.BigEndian.PutUint16(buf[5:7], m.Port)
+	binary.BigEndian.PutUint16(buf[7:9], uint16(len(hostBytes)))
+	copy(buf[9:], hostBytes)
+	offset := 9 + len(hostBytes)
+	binary.BigEndian.PutUint32(buf[offset:offset+4], uint32(len(m.Payload)))
+	copy(buf[offset+4:], m.Payload)
+	return buf
 }
 
 // ConnectSuccess indicates successful connection
@@ -195,6 +304,100 @@ func (m *BatchIpPacket) Encode() []byte {
 	return buf
 }
 
+// Hello announces a peer's protocol version, the features it supports and
+// its tunnel IP (empty if it has none, e.g. the Exit Peer). A client's
+// Session token follows the IP, then a flags byte; older peers ignore the
+// extra bytes.
+type Hello struct {
+	Version    uint16
+	Features   Features
+	AssignedIP string
+	Session    SessionToken
+	// Reply marks a Hello sent in answer to the peer's, which is never
+	// answered itself. A repeated Hello without it means the peer is still
+	// waiting for ours.
+	Reply bool
+}
+
+// helloFlagReply is Hello.Reply in the flags byte
+const helloFlagReply byte = 1 << 0
+
+func (m *Hello) Type() byte { return CmdHello }
+
+func (m *Hello) Encode() []byte {
+	ipBytes := []byte(m.AssignedIP)
+	buf := make([]byte, 1+2+4+1+len(ipBytes))
+	buf[0] = CmdHello
+	binary.BigEndian.PutUint16(buf[1:3], m.Version)
+	binary.BigEndian.PutUint32(buf[3:7], uint32(m.Features))
+	buf[7] = byte(len(ipBytes))
+	copy(buf[8:], ipBytes)
+	if !m.Session.IsZero() || m.Reply {
+		buf = append(buf, m.Session[:]...)
+	}
+	if m.Reply {
+		buf = append(buf, helloFlagReply)
+	}
+	return buf
+}
+
+// Negotiate returns the version and features both m and peer support
+func (m *Hello) Negotiate(peer *Hello) (uint16, Features) {
+	return min(m.Version, peer.Version), m.Features & peer.Features
+}
+
+// Lease is the tunnel address the Exit Peer assigns to a client, sent after
+// the Hello handshake to peers that announced FeatureLease
+type Lease struct {
+	IP        string
+	PrefixLen uint8
+}
+
+func (m *Lease) Type() byte { return CmdLease }
+
+func (m *Lease) Encode() []byte {
+	ipBytes := []byte(m.IP)
+	buf := make([]byte, 1+1+1+len(ipBytes))
+	buf[0] = CmdLease
+	buf[1] = m.PrefixLen
+	buf[2] = byte(len(ipBytes))
+	copy(buf[3:], ipBytes)
+	return buf
+}
+
+// Control carries a control message (e.g. a Lease) that the peer
+// acknowledges with a ControlAck carrying the same Seq, and that is sent
+// again until it does. Only peers with FeatureReliableControl get one.
+type Control struct {
+	Seq uint32
+	Msg TunnelMessage
+}
+
+func (m *Control) Type() byte { return CmdControl }
+
+func (m *Control) Encode() []byte {
+	inner := m.Msg.Encode()
+	buf := make([]byte, 1+4+len(inner))
+	buf[0] = CmdControl
+	binary.BigEndian.PutUint32(buf[1:5], m.Seq)
+	copy(buf[5:], inner)
+	return buf
+}
+
+// ControlAck acknowledges the Control with sequence number Seq
+type ControlAck struct {
+	Seq uint32
+}
+
+func (m *ControlAck) Type() byte { return CmdControlAck }
+
+func (m *ControlAck) Encode() []byte {
+	buf := make([]byte, 5)
+	buf[0] = CmdControlAck
+	binary.BigEndian.PutUint32(buf[1:5], m.Seq)
+	return buf
+}
+
 // Decode parses a binary message into a TunnelMessage
 func Decode(data []byte) (TunnelMessage, error) {
 	if len(data) < 1 {
@@ -250,10 +453,33 @@ func Decode(data []byte) (TunnelMessage, error) {
 		return &ErrorReply{StreamID: streamID, Code: code, Message: msg}, nil
 
 	case CmdPing:
-		return &Ping{}, nil
+		seq, ts := decodeProbe(data)
+		return &Ping{Seq: seq, Timestamp: ts}, nil
 
 	case CmdPong:
-		return &Pong{}, nil
+		seq, ts := decodeProbe(data)
+		return &Pong{Seq: seq, Timestamp: ts}, nil
+
+	case CmdUdpDatagram:
+		if len(data) < 9 {
+			return nil, errors.New("insufficient data for UdpDatagram")
+		}
+		streamID := binary.BigEndian.Uint32(data[1:5])
+		port := binary.BigEndian.Uint16(data[5:7])
+		hostLen := int(binary.BigEndian.Uint16(data[7:9]))
+		offset := 9 + hostLen
+		if len(data) < offset+4 {
+			return nil, errors.New("insufficient data for UdpDatagram host")
+		}
+		host := string(data[9:offset])
+		payloadLen := binary.BigEndian.Uint32(data[offset : offset+4])
+		offset += 4
+		if len(data) < offset+int(payloadLen) {
+			return nil, errors.New("insufficient data for UdpDatagram payload")
+		}
+		payload := make([]byte, payloadLen)
+		copy(payload, data[offset:offset+int(payloadLen)])
+		return &UdpDatagram{StreamID: streamID, Host: host, Port: port, Payload: payload}, nil
 
 	case CmdConnectSuccess:
 		if len(data) < 5 {
@@ -270,8 +496,8 @@ func Decode(data []byte) (TunnelMessage, error) {
 		if len(data) < 5+int(payloadLen) {
 			return nil, errors.New("insufficient data for IpPacket payload")
 		}
-		payload := make([]byte, payloadLen)
-		copy(payload, data[5:5+payloadLen])
+		// Pooled, so the receiver can recycle it after writing it to the TUN
+		payload := bufpool.Copy(data[5 : 5+payloadLen])
 		return &IpPacket{Payload: payload}, nil
 
 	case CmdBatchIpPacket:
@@ -292,14 +518,73 @@ func Decode(data []byte) (TunnelMessage, error) {
 			if offset+int(payloadLen) > len(data) {
 				return nil, errors.New("insufficient data for BatchIpPacket payload")
 			}
-			payload := make([]byte, payloadLen)
-			copy(payload, data[offset:offset+int(payloadLen)])
-			packets[i] = payload
+			packets[i] = bufpool.Copy(data[offset : offset+int(payloadLen)])
 			offset += int(payloadLen)
 		}
 		
 		return &BatchIpPacket{Packets: packets}, nil
 
+	case CmdCompressedBatch:
+		return decompressBatch(data[1:])
+
+	case CmdFragment:
+		f, err := DecodeFragment(data)
+		if err != nil {
+			return nil, err
+		}
+		f.Payload = append([]byte(nil), f.Payload...)
+		return f, nil
+
+	case CmdHello:
+		if len(data) < 8 {
+			return nil, errors.New("insufficient data for Hello")
+		}
+		ipLen := int(data[7])
+		if len(data) < 8+ipLen {
+			return nil, errors.New("insufficient data for Hello IP")
+		}
+		hello := &Hello{
+			Version:    binary.BigEndian.Uint16(data[1:3]),
+			Features:   Features(binary.BigEndian.Uint32(data[3:7])),
+			AssignedIP: string(data[8 : 8+ipLen]),
+		}
+		if rest := data[8+ipLen:]; len(rest) >= len(hello.Session) {
+			copy(hello.Session[:], rest)
+			if len(rest) > len(hello.Session) {
+				hello.Reply = rest[len(hello.Session)]&helloFlagReply != 0
+			}
+		}
+		return hello, nil
+
+	case CmdLease:
+		if len(data) < 3 {
+			return nil, errors.New("insufficient data for Lease")
+		}
+		ipLen := int(data[2])
+		if len(data) < 3+ipLen {
+			return nil, errors.New("insufficient data for Lease IP")
+		}
+		return &Lease{IP: string(data[3 : 3+ipLen]), PrefixLen: data[1]}, nil
+
+	case CmdControl:
+		if len(data) < 6 {
+			return nil, errors.New("insufficient data for Control")
+		}
+		if data[5] == CmdControl || data[5] == CmdControlAck {
+			return nil, errors.New("nested Control")
+		}
+		inner, err := Decode(data[5:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid Control: %w", err)
+		}
+		return &Control{Seq: binary.BigEndian.Uint32(data[1:5]), Msg: inner}, nil
+
+	case CmdControlAck:
+		if len(data) < 5 {
+			return nil, errors.New("insufficient data for ControlAck")
+		}
+		return &ControlAck{Seq: binary.BigEndian.Uint32(data[1:5])}, nil
+
 	default:
 		return nil, fmt.Errorf("invalid command byte: %d", cmd)
 	}
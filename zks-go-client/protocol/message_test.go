@@ -0,0 +1,39 @@
+package protocol
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestControlRoundTrip(t *testing.T) {
+	for _, m := range []TunnelMessage{
+		&Control{Seq: 0xdeadbeef, Msg: &Lease{IP: "10.0.85.2", PrefixLen: 24}},
+		&Control{Seq: 1, Msg: &ErrorReply{StreamID: 3, Message: "no"}},
+		&ControlAck{Seq: 0xdeadbeef},
+	} {
+		got, err := Decode(m.Encode())
+		if err != nil {
+			t.Fatalf("%T: %v", m, err)
+		}
+		if !reflect.DeepEqual(got, m) {
+			t.Fatalf("decoded %#v, want %#v", got, m)
+		}
+	}
+}
+
+func TestControlDecodeRejects(t *testing.T) {
+	lease := (&Lease{IP: "10.0.85.2", PrefixLen: 24}).Encode()
+	nested := (&Control{Seq: 1, Msg: &Control{Seq: 2, Msg: &Lease{IP: "10.0.85.2", PrefixLen: 24}}}).Encode()
+	ackInside := (&Control{Seq: 1, Msg: &ControlAck{Seq: 2}}).Encode()
+	for name, data := range map[string][]byte{
+		"nested Control":    nested,
+		"ControlAck inside": ackInside,
+		"no inner message":  (&Control{Seq: 1, Msg: &ControlAck{}}).Encode()[:5],
+		"bad inner message": append([]byte{CmdControl, 0, 0, 0, 1}, lease[:2]...),
+		"short ControlAck":  {CmdControlAck, 0, 0, 0},
+	} {
+		if m, err := Decode(data); err == nil {
+			t.Errorf("%s: decoded %#v", name, m)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// SessionToken identifies one run of a client across relay reconnects. It
+// rides in every Hello, so the Exit Peer can tell a client that comes back
+// (same token: keep its flows) from one that restarted or is new.
+type SessionToken [16]byte
+
+// NewSessionToken returns a random token
+func NewSessionToken() (SessionToken, error) {
+	var t SessionToken
+	_, err := rand.Read(t[:])
+	return t, err
+}
+
+// IsZero reports whether t is unset, as it is for peers that don't send one
+func (t SessionToken) IsZero() bool {
+	return t == SessionToken{}
+}
+
+// String is a short prefix for logs
+func (t SessionToken) String() string {
+	return hex.EncodeToString(t[:4])
+}
@@ -0,0 +1,62 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gorilla/websocket"
+	"github.com/zks-vpn/zks-go-client/events"
+)
+
+// CloseError is the close frame the relay ended a WebSocket with, e.g.
+// when the room is full or the client isn't allowed in
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("relay closed the connection (code %d)", e.Code)
+	}
+	return fmt.Sprintf("relay closed the connection (code %d: %s)", e.Code, e.Reason)
+}
+
+// Retryable reports whether reconnecting may help: the relay going away or
+// restarting (1001, 1012), the link dropping (1006), a server error. The
+// application codes relays send to refuse a client (4000-4999: room full,
+// unauthorized, ...) and policy violations (1008) are final.
+func (e *CloseError) Retryable() bool {
+	switch {
+	case e.Code >= 4000 && e.Code <= 4999:
+		return false
+	case e.Code == websocket.ClosePolicyViolation:
+		return false
+	}
+	return true
+}
+
+// IsTerminal reports whether err carries a close code that reconnecting
+// won't get past
+func IsTerminal(err error) bool {
+	var ce *CloseError
+	return errors.As(err, &ce) && !ce.Retryable()
+}
+
+// readMessage is ws.ReadMessage, turning a close frame into a CloseError
+func readMessage(ws *websocket.Conn) (int, []byte, error) {
+	msgType, msg, err := ws.ReadMessage()
+	var wsErr *websocket.CloseError
+	if errors.As(err, &wsErr) {
+		err = &CloseError{Code: wsErr.Code, Reason: wsErr.Text}
+	}
+	return msgType, msg, err
+}
+
+// refused reports a terminal close, after which the connection gives up
+func (c *Connection) refused(err error) {
+	var ce *CloseError
+	errors.As(err, &ce)
+	fmt.Printf("❌ Relay refused room %s: %v (not retrying)\n", c.roomID, ce)
+	events.Emit("relay_refused", events.Fields{"room": c.roomID, "code": ce.Code, "reason": ce.Reason})
+}
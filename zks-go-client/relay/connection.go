@@ -2,13 +2,24 @@
 package relay
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/netip"
 	"net/url"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/zks-vpn/zks-go-client/events"
+	"github.com/zks-vpn/zks-go-client/metrics"
+	"github.com/zks-vpn/zks-go-client/netbind"
 	"github.com/zks-vpn/zks-go-client/protocol"
 )
 
@@ -25,29 +36,341 @@ type KeyExchangeMessage struct {
 	Type      string `json:"type"`
 	PublicKey string `json:"public_key,omitempty"`
 	Success   bool   `json:"success,omitempty"`
+	// Reply marks a key sent in answer to the peer's, which is never
+	// answered itself
+	Reply bool `json:"reply,omitempty"`
+}
+
+const (
+	// Reconnect backoff doubles from initialBackoff up to maxBackoff
+	initialBackoff = 500 * time.Millisecond
+	maxBackoff     = 30 * time.Second
+
+	// DefaultConnectTimeout bounds one WebSocket dial, TLS and upgrade included
+	DefaultConnectTimeout = 20 * time.Second
+
+	// DefaultKeepaliveInterval stays well under Cloudflare's ~100s idle cutoff
+	DefaultKeepaliveInterval = 30 * time.Second
+	// DefaultKeepaliveTimeout declares the link dead after three missed pongs
+	DefaultKeepaliveTimeout = 3 * DefaultKeepaliveInterval
+
+	pingWriteTimeout = 10 * time.Second
+)
+
+// ErrClosed is returned by Send and Recv after Close
+var ErrClosed = errors.New("relay connection closed")
+
+// errKeepaliveTimeout marks a link whose pongs stopped arriving
+var errKeepaliveTimeout = errors.New("keepalive timeout: no pong from relay")
+
+// errHeartbeatTimeout marks a link whose peer stopped answering pings
+var errHeartbeatTimeout = errors.New("heartbeat timeout: no reply from peer")
+
+// errSendBufferFull is returned by Send when it drops a message
+var errSendBufferFull = errors.New("send buffer full, dropping packet")
+
+// Options configures a relay Connection
+type Options struct {
+	// Reconnect redials the same room with the same role when the WebSocket
+	// drops, instead of failing Send/Recv. They block until the link is back.
+	Reconnect bool
+	// MaxReconnectAttempts gives up after this many failed dials in a row (0 = retry forever)
+	MaxReconnectAttempts int
+	// ConnectRetries retries the first connect this many more times, with
+	// the reconnect backoff, before Connect fails (0 = one try). Each try
+	// goes through every relay.
+	ConnectRetries int
+	// ConnectTimeout bounds each WebSocket dial (0 = DefaultConnectTimeout).
+	// Waiting for the peer to join the room isn't limited by it.
+	ConnectTimeout time.Duration
+	// KeepaliveInterval is how often a WebSocket ping is sent
+	// (0 = DefaultKeepaliveInterval, negative disables keepalive)
+	KeepaliveInterval time.Duration
+	// KeepaliveTimeout is how long without a pong before the link is
+	// treated as dead (0 = DefaultKeepaliveTimeout)
+	KeepaliveTimeout time.Duration
+	// Addrs pins relay hostnames to IPs instead of resolving them on every
+	// dial, so a reconnect works while DNS is only reachable through the
+	// (down) tunnel. The IPs are tried in order; other hosts resolve normally.
+	Addrs map[string][]string
+	// Interface binds every WebSocket dial to this network interface (see
+	// netbind), whatever the system's default route. Empty uses the default.
+	Interface string
+	// Proxy routes the WebSocket dials through an upstream HTTP CONNECT or
+	// SOCKS5 proxy (see ParseProxy). Empty honors HTTPS_PROXY/HTTP_PROXY.
+	Proxy string
+
+	// ProbeInterval sends a latency probe to the peer this often
+	// (0 = off). Results are in ProbeStats and the metrics endpoint.
+	ProbeInterval time.Duration
+
+	// HeartbeatInterval pings the peer itself this often and treats the
+	// link as dead (reconnecting, if Reconnect is set) when no reply came
+	// within HeartbeatTimeout (0 = 3 * HeartbeatInterval). Unlike the
+	// WebSocket keepalive, which only reaches the relay, this notices a
+	// peer whose process is gone. 0 = off.
+	HeartbeatInterval time.Duration
+	HeartbeatTimeout  time.Duration
+
+	// PinSHA256 requires the relay's TLS chain to contain a certificate or
+	// public key with one of these SHA-256 hashes (see ParsePin). Empty
+	// means the usual CA verification only.
+	PinSHA256 []string
+
+	// Features and LocalIP are announced to the peer in the Hello handshake
+	Features protocol.Features
+	LocalIP  string
+	// SessionToken, if set, is announced in every Hello, also after a
+	// reconnect, so the Exit Peer can resume this client's session
+	SessionToken protocol.SessionToken
+
+	// RoomSecret, when set, is mixed into every link key, so only peers
+	// that know it can talk: one that doesn't can't decrypt our Hello nor
+	// send one we can, and the link is refused. Both sides must match.
+	RoomSecret string
+	// RekeyInterval, when positive, rotates the link key this often with a
+	// fresh X25519 exchange over the live WebSocket (0 = only on reconnect)
+	RekeyInterval time.Duration
+}
+
+// link is one WebSocket session plus the key negotiated on it.
+// It is replaced as a whole on reconnect or when the peer re-keys.
+type link struct {
+	ws     *websocket.Conn
+	cipher *protocol.WasifVernam
+	peerPK []byte
+	// publicKey is our public key (hex) the link's key was agreed with
+	publicKey string
+	// prevCipher is the key before the latest rotation, for messages
+	// that were already in flight
+	prevCipher *protocol.WasifVernam
+	// lastPong is the UnixNano time of the last pong (or of the dial)
+	lastPong *atomic.Int64
+	// lastPeer is the UnixNano time of the last Pong from the peer itself
+	// (or of the dial), for the heartbeat
+	lastPeer *atomic.Int64
+
+	// Hello handshake state, only touched by dial and then Recv
+	helloSent   bool
+	peerHello   *protocol.Hello // First Hello the peer sent on the link
+	pendingRead chan readResult // A read the handshake gave up waiting on
+	pending     []byte          // Decrypted message read during the handshake
+}
+
+// outgoing is an encrypted message waiting for the write pump
+type outgoing struct {
+	buf  []byte
+	link *link // Ciphertext is only valid on the link whose key produced it
+}
+
+// Conn is the message pipe to the peer that the SOCKS5 server and the TUN
+// run over: a *Connection of their own, or their channel of a shared one
+// (see package mux)
+type Conn interface {
+	Send(msg protocol.TunnelMessage) error
+	Recv() (protocol.TunnelMessage, error)
+	RecvContext(ctx context.Context) (protocol.TunnelMessage, error)
+	Capabilities() Capabilities
+	Lease(ctx context.Context) (netip.Prefix, error)
+	Close()
 }
 
 // Connection represents a connection to the ZKS relay
 type Connection struct {
-	ws       *websocket.Conn
-	cipher   *protocol.WasifVernam
-	role     PeerRole
-	roomID   string
-	mu       sync.Mutex
-	recvMu   sync.Mutex
-	
+	relays []string // As passed in, for logs and stats
+	urls   []string // WebSocket URLs of the room on each relay
+	role   PeerRole
+	roomID string
+	opts   Options
+	tls    *tls.Config // Pinning config from Options.PinSHA256, or nil
+	mu     sync.Mutex  // Serializes WebSocket writes
+	recvMu sync.Mutex
+
+	// A Recv started by RecvContext whose caller gave up; the next
+	// RecvContext picks up its result so no message is lost
+	inflightMu sync.Mutex
+	inflight   chan recvResult
+
+	// stateMu guards the current link and the reconnect state
+	stateMu      sync.Mutex
+	link         *link
+	active       int           // Index into relays/urls of the current link
+	reconnecting chan struct{} // Closed when the running reconnect finishes
+	failed       error         // Set once the connection is unusable for good
+	caps         Capabilities  // From the latest Hello handshake
+	peerHellos   atomic.Uint64 // Hellos the peer sent mid-stream
+
+	probe    probeState
+	lease    leaseState
+	rotation rotationState
+	control  controlState
+
 	// Write pump
-	sendChan chan []byte
-	done     chan struct{}
+	sendChan  chan outgoing
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 // Connect establishes a connection to the relay and performs key exchange
 func Connect(relayURL, roomID string, role PeerRole) (*Connection, error) {
-	// Parse and build WebSocket URL
+	return ConnectWithOptions(relayURL, roomID, role, Options{})
+}
+
+// ConnectWithOptions is Connect with reconnection settings
+func ConnectWithOptions(relayURL, roomID string, role PeerRole, opts Options) (*Connection, error) {
+	return ConnectMultiWithOptions([]string{relayURL}, roomID, role, opts)
+}
+
+// ConnectMulti connects to the first relay in urls that works. When the
+// link drops, reconnecting moves on to the next relay in the list.
+func ConnectMulti(urls []string, roomID string, role PeerRole) (*Connection, error) {
+	return ConnectMultiWithOptions(urls, roomID, role, Options{})
+}
+
+// ConnectMultiWithOptions is ConnectMulti with reconnection settings
+func ConnectMultiWithOptions(relayURLs []string, roomID string, role PeerRole, opts Options) (*Connection, error) {
+	if len(relayURLs) == 0 {
+		return nil, errors.New("no relay URL")
+	}
+	if opts.KeepaliveInterval == 0 {
+		opts.KeepaliveInterval = DefaultKeepaliveInterval
+	}
+	if opts.KeepaliveTimeout <= 0 {
+		opts.KeepaliveTimeout = DefaultKeepaliveTimeout
+	}
+	if opts.HeartbeatTimeout <= 0 {
+		opts.HeartbeatTimeout = 3 * opts.HeartbeatInterval
+	}
+	if opts.ConnectTimeout <= 0 {
+		opts.ConnectTimeout = DefaultConnectTimeout
+	}
+	tlsConfig, err := pinTLSConfig(opts.PinSHA256)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := ParseProxy(opts.Proxy); err != nil {
+		return nil, err
+	}
+
+	conn := &Connection{
+		relays:   relayURLs,
+		role:     role,
+		roomID:   roomID,
+		opts:     opts,
+		tls:      tlsConfig,
+		sendChan: make(chan outgoing, 256), // Buffered channel for async writes
+		done:     make(chan struct{}),
+		lease:    leaseState{ready: make(chan struct{})},
+		control:  controlState{nextSeq: rand.Uint32(), pending: make(map[uint32]chan struct{})},
+	}
+	for _, relayURL := range relayURLs {
+		u, err := roomURL(relayURL, roomID, role)
+		if err != nil {
+			return nil, err
+		}
+		conn.urls = append(conn.urls, u)
+	}
+
+	// Try the relays in order, and the whole list again on failure
+	attempts := opts.ConnectRetries + 1
+	backoff := initialBackoff
+	for attempt := 1; ; attempt++ {
+		err := conn.dialFirst()
+		if err == nil {
+			break
+		}
+		if IsTerminal(err) {
+			conn.refused(err)
+			return nil, err
+		}
+		if attempt >= attempts {
+			return nil, err
+		}
+		delay := jitter(backoff)
+		fmt.Printf("⚠️ Connect failed: %v\n", err)
+		fmt.Printf("⏳ Connecting... attempt %d/%d in %v\n", attempt+1, attempts, delay.Round(time.Millisecond))
+		time.Sleep(delay)
+		backoff = min(backoff*2, maxBackoff)
+	}
+
+	// Start write pump
+	go conn.writePump()
+	if opts.KeepaliveInterval > 0 {
+		go conn.keepalive()
+	}
+	if opts.ProbeInterval > 0 {
+		go conn.probeLoop()
+	}
+	if opts.HeartbeatInterval > 0 {
+		go conn.heartbeat()
+	}
+	if opts.RekeyInterval > 0 {
+		go conn.rekeyLoop()
+	}
+
+	return conn, nil
+}
+
+// dialFirst connects to the first relay in the list that works
+func (c *Connection) dialFirst() error {
+	var errs []error
+	for i := range c.urls {
+		l, caps, err := c.dial(i)
+		if err == nil {
+			c.link, c.caps, c.active = l, caps, i
+			return nil
+		}
+		if len(c.urls) > 1 {
+			fmt.Printf("⚠️ Relay %s failed: %v\n", c.relays[i], err)
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	return fmt.Errorf("all %d relays failed: %w", len(errs), errors.Join(errs...))
+}
+
+// jitter picks a wait between 50% and 100% of backoff, so clients don't
+// (re)connect in lockstep
+func jitter(backoff time.Duration) time.Duration {
+	return backoff/2 + rand.N(backoff/2+1)
+}
+
+// Host returns the host name or IP of a relay URL, without the port. The
+// bypass routes and pinned addresses must use exactly the host that is dialed.
+func Host(relayURL string) (string, error) {
+	u, err := parseRelayURL(relayURL)
+	if err != nil {
+		return "", err
+	}
+	return u.Hostname(), nil
+}
+
+// parseRelayURL parses a ws://, wss://, http:// or https:// relay URL
+func parseRelayURL(relayURL string) (*url.URL, error) {
 	u, err := url.Parse(relayURL)
 	if err != nil {
 		return nil, fmt.Errorf("invalid relay URL: %w", err)
 	}
+	switch u.Scheme {
+	case "ws", "wss", "http", "https":
+	default:
+		return nil, fmt.Errorf("invalid relay URL %q: scheme must be ws, wss, http or https", relayURL)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid relay URL %q: no host", relayURL)
+	}
+	return u, nil
+}
+
+// roomURL builds the WebSocket URL of a room: /room/{roomID}?role={role}
+func roomURL(relayURL, roomID string, role PeerRole) (string, error) {
+	// Parse and build WebSocket URL
+	u, err := parseRelayURL(relayURL)
+	if err != nil {
+		return "", err
+	}
 
 	// Convert http(s) to ws(s)
 	switch u.Scheme {
@@ -60,38 +383,126 @@ func Connect(relayURL, roomID string, role PeerRole) (*Connection, error) {
 	// Build final URL: /room/{roomID}?role={role}
 	u.Path = fmt.Sprintf("/room/%s", roomID)
 	u.RawQuery = fmt.Sprintf("role=%s", role)
+	return u.String(), nil
+}
 
-	fmt.Printf("🔌 Connecting to relay: %s\n", u.String())
+// CheckReachable opens and closes a WebSocket to a throwaway room on the
+// relay, without a peer or key exchange. It returns the handshake time.
+func CheckReachable(relayURL string, timeout time.Duration) (time.Duration, error) {
+	return CheckReachableWithOptions(relayURL, timeout, Options{})
+}
+
+// CheckReachableWithOptions is CheckReachable, enforcing opts.PinSHA256 and
+// dialing like a Connection would (opts.Interface, opts.Proxy)
+func CheckReachableWithOptions(relayURL string, timeout time.Duration, opts Options) (time.Duration, error) {
+	tlsConfig, err := pinTLSConfig(opts.PinSHA256)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := ParseProxy(opts.Proxy); err != nil {
+		return 0, err
+	}
+	var id [8]byte
+	for i := range id {
+		id[i] = "abcdefghijklmnopqrstuvwxyz0123456789"[rand.IntN(36)]
+	}
+	u, err := roomURL(relayURL, "zks-check-"+string(id[:]), RoleClient)
+	if err != nil {
+		return 0, err
+	}
+
+	dialer := *websocket.DefaultDialer
+	dialer.HandshakeTimeout = timeout
+	dialer.TLSClientConfig = tlsConfig
+	dialer.Proxy = proxyFunc(opts.Proxy)
+	if opts.Interface != "" {
+		dialer.NetDialContext = netbind.Dialer(net.Dialer{}, opts.Interface).DialContext
+	}
+	start := time.Now()
+	ws, _, err := dialer.Dial(u, nil)
+	if err != nil {
+		return 0, err
+	}
+	elapsed := time.Since(start)
+	ws.Close()
+	return elapsed, nil
+}
+
+// dial opens a WebSocket to the room on relay i, negotiates a fresh key on
+// it and exchanges Hellos with the peer
+func (c *Connection) dial(i int) (*link, Capabilities, error) {
+	fmt.Printf("🔌 Connecting to relay: %s\n", c.urls[i])
+	events.Emit("connecting", events.Fields{"relay": c.relays[i], "room": c.roomID})
 
 	// Connect via WebSocket
-	ws, resp, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	dialer := *websocket.DefaultDialer
+	if len(c.opts.Addrs) > 0 || c.opts.Interface != "" {
+		dialer.NetDialContext = c.dialPinned
+	}
+	dialer.TLSClientConfig = c.tls
+	dialer.HandshakeTimeout = c.opts.ConnectTimeout
+	dialer.Proxy = proxyFunc(c.opts.Proxy)
+	ws, resp, err := dialer.Dial(c.urls[i], nil)
 	if err != nil {
-		return nil, fmt.Errorf("websocket dial failed: %w", err)
+		return nil, Capabilities{}, fmt.Errorf("websocket dial failed: %w", err)
 	}
 	fmt.Printf("✅ Connected to relay (status: %d)\n", resp.StatusCode)
 
-	conn := &Connection{
-		ws:       ws,
-		role:     role,
-		roomID:   roomID,
-		sendChan: make(chan []byte, 256), // Buffered channel for async writes
-		done:     make(chan struct{}),
-	}
+	// Pong frames are handled inside ReadMessage, so this needs Recv running
+	l := &link{ws: ws, lastPong: new(atomic.Int64), lastPeer: new(atomic.Int64)}
+	l.lastPong.Store(time.Now().UnixNano())
+	l.lastPeer.Store(time.Now().UnixNano())
+	ws.SetPongHandler(func(string) error {
+		l.lastPong.Store(time.Now().UnixNano())
+		return nil
+	})
 
 	// Perform key exchange
-	if err := conn.performKeyExchange(); err != nil {
+	if err := c.performKeyExchange(l); err != nil {
 		ws.Close()
-		return nil, fmt.Errorf("key exchange failed: %w", err)
+		return nil, Capabilities{}, fmt.Errorf("key exchange failed: %w", err)
 	}
 
-	// Start write pump
-	go conn.writePump()
+	caps, err := c.exchangeHello(l)
+	if err != nil {
+		ws.Close()
+		return nil, Capabilities{}, err
+	}
+	metrics.ActiveRelay.Set(c.relays[i])
+	events.Emit("connected", events.Fields{
+		"relay":    c.relays[i],
+		"room":     c.roomID,
+		"version":  caps.Version,
+		"features": caps.Features.String(),
+	})
+	return l, caps, nil
+}
 
-	return conn, nil
+// dialPinned connects to the first reachable Options.Addrs entry for the
+// host of addr, on its port, through Options.Interface if set. TLS still
+// verifies against the URL's hostname.
+func (c *Connection) dialPinned(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	d := netbind.Dialer(net.Dialer{}, c.opts.Interface)
+	ips, ok := c.opts.Addrs[host]
+	if !ok {
+		return d.DialContext(ctx, network, addr)
+	}
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = d.DialContext(ctx, network, net.JoinHostPort(ip, port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
 }
 
 // performKeyExchange implements X25519 key exchange with the peer
-func (c *Connection) performKeyExchange() error {
+func (c *Connection) performKeyExchange(l *link) error {
 	fmt.Println("🔑 Initiating X25519 key exchange...")
 
 	// Generate our keypair
@@ -106,14 +517,14 @@ func (c *Connection) performKeyExchange() error {
 		PublicKey: ke.GetPublicKeyHex(),
 	}
 	ourPKJSON, _ := json.Marshal(ourPKMsg)
-	if err := c.ws.WriteMessage(websocket.TextMessage, ourPKJSON); err != nil {
+	if err := l.ws.WriteMessage(websocket.TextMessage, ourPKJSON); err != nil {
 		return fmt.Errorf("failed to send public key: %w", err)
 	}
 
 	// Wait for peer's public key
 	var peerPK []byte
 	for {
-		_, msg, err := c.ws.ReadMessage()
+		_, msg, err := readMessage(l.ws)
 		if err != nil {
 			return fmt.Errorf("failed to read message: %w", err)
 		}
@@ -140,16 +551,19 @@ func (c *Connection) performKeyExchange() error {
 		return errors.New("key exchange completed without peer public key")
 	}
 
-	encKey, err := ke.ComputeSharedSecret(peerPK)
+	encKey, err := c.linkKey(ke, peerPK)
 	if err != nil {
 		return fmt.Errorf("failed to compute shared secret: %w", err)
 	}
 
-	c.cipher, err = protocol.NewWasifVernam(encKey)
+	l.cipher, err = protocol.NewWasifVernam(encKey)
 	if err != nil {
 		return fmt.Errorf("failed to create cipher: %w", err)
 	}
 
+	l.peerPK = peerPK
+	l.publicKey = ourPKMsg.PublicKey
+
 	fmt.Println("🔐 Key exchange complete! Encryption key derived.")
 	return nil
 }
@@ -158,22 +572,36 @@ func (c *Connection) performKeyExchange() error {
 func (c *Connection) writePump() {
 	for {
 		select {
-		case msg, ok := <-c.sendChan:
+		case out, ok := <-c.sendChan:
 			if !ok {
 				// Channel closed
-				c.ws.WriteMessage(websocket.CloseMessage, []byte{})
+				if l, err := c.current(); err == nil {
+					l.ws.WriteMessage(websocket.CloseMessage, []byte{})
+				}
 				return
 			}
 
-			c.mu.Lock()
-			err := c.ws.WriteMessage(websocket.BinaryMessage, msg)
-			c.mu.Unlock()
-			
+			// A rotation keeps the WebSocket, and the peer still
+			// decrypts under the previous key
+			l, err := c.current()
+			if err == nil && out.link.ws == l.ws {
+				c.mu.Lock()
+				err = l.ws.WriteMessage(websocket.BinaryMessage, out.buf)
+				c.mu.Unlock()
+				if err != nil {
+					err = c.linkFailed(l, err)
+				}
+			}
+
 			// Zero-Copy Optimization:
 			// The msg buffer came from the pool (in Send).
 			// We must return it now that we are done with it.
-			protocol.PutBuffer(msg)
+			// Messages encrypted for a previous link are dropped here too.
+			protocol.PutBuffer(out.buf)
 
+			if errors.Is(err, ErrClosed) {
+				return // Messages still queued at Close are dropped
+			}
 			if err != nil {
 				fmt.Printf("❌ Write error: %v\n", err)
 				return
@@ -184,8 +612,26 @@ func (c *Connection) writePump() {
 	}
 }
 
-// Send encrypts and queues a TunnelMessage
+// Send encrypts and queues a TunnelMessage. It drops the message when the
+// send queue is full.
 func (c *Connection) Send(msg protocol.TunnelMessage) error {
+	return c.send(context.Background(), msg, false)
+}
+
+// SendContext is Send, but waits for room in the send queue instead of
+// dropping. It gives up with ctx.Err() when ctx is done first, including
+// while a reconnect is in progress.
+func (c *Connection) SendContext(ctx context.Context, msg protocol.TunnelMessage) error {
+	return c.send(ctx, msg, true)
+}
+
+func (c *Connection) send(ctx context.Context, msg protocol.TunnelMessage, wait bool) error {
+	// Blocks while a reconnect is in progress
+	l, err := c.currentContext(ctx)
+	if err != nil {
+		return err
+	}
+
 	// Zero-Copy Optimization:
 	// 1. Get a buffer for the ciphertext from the pool
 	ciphertextBuf := protocol.GetBuffer()
@@ -195,26 +641,34 @@ func (c *Connection) Send(msg protocol.TunnelMessage) error {
 	var plaintext []byte
 	var encodedBuf []byte // Keep track to return if needed
 
-	if ipPkt, ok := msg.(*protocol.IpPacket); ok {
-		// Fast path for IP packets (Zero-Copy Encode)
+	if enc, ok := msg.(protocol.EncoderTo); ok {
+		// Fast path for IP packets and stream data (Zero-Copy Encode),
+		// leaving room for the ciphertext to fit its pooled buffer too
 		encodedBuf = protocol.GetBuffer()
-		n := ipPkt.EncodeTo(encodedBuf)
-		if n == 0 {
-			// Buffer too small? Should not happen with MTU=1420 and Pool=2048
+		if n := enc.EncodeTo(encodedBuf[:len(encodedBuf)-12-16]); n > 0 {
+			plaintext = encodedBuf[:n]
+		} else {
+			// A large SOCKS5 read; IP packets always fit
 			protocol.PutBuffer(encodedBuf)
-			protocol.PutBuffer(ciphertextBuf)
-			return errors.New("encoding buffer too small")
+			encodedBuf = nil
 		}
-		plaintext = encodedBuf[:n]
-	} else {
+	}
+	if plaintext == nil {
 		// Slow path for other messages (Allocating Encode)
 		plaintext = msg.Encode()
+
+		// Large batches don't fit in a pooled buffer; allocate one that does.
+		// PutBuffer ignores it later because of the capacity mismatch.
+		if needed := len(plaintext) + 12 + 16; needed > len(ciphertextBuf) {
+			protocol.PutBuffer(ciphertextBuf)
+			ciphertextBuf = make([]byte, needed)
+		}
 	}
 
 	// 3. Encrypt directly into the ciphertext buffer
 	// EncryptTo appends to dst[:0] (or similar), so we pass ciphertextBuf
 	// The result is a slice of ciphertextBuf
-	encrypted, err := c.cipher.EncryptTo(ciphertextBuf, plaintext)
+	encrypted, err := l.cipher.EncryptTo(ciphertextBuf, plaintext)
 	
 	// If we used a pooled buffer for encoding, return it now
 	if encodedBuf != nil {
@@ -227,13 +681,26 @@ func (c *Connection) Send(msg protocol.TunnelMessage) error {
 	}
 
 	// 4. Queue for sending
+	out := outgoing{buf: encrypted, link: l}
 	select {
-	case c.sendChan <- encrypted:
+	case c.sendChan <- out:
 		return nil
 	default:
+	}
+	if !wait {
 		// If buffer full, we must drop the packet and return the buffer
 		protocol.PutBuffer(ciphertextBuf) // Return unused ciphertext buffer
-		return errors.New("send buffer full, dropping packet")
+		return errSendBufferFull
+	}
+	select {
+	case c.sendChan <- out:
+		return nil
+	case <-ctx.Done():
+		protocol.PutBuffer(ciphertextBuf)
+		return ctx.Err()
+	case <-c.done:
+		protocol.PutBuffer(ciphertextBuf)
+		return ErrClosed
 	}
 }
 
@@ -243,12 +710,38 @@ func (c *Connection) Recv() (protocol.TunnelMessage, error) {
 	defer c.recvMu.Unlock()
 
 	for {
-		msgType, msg, err := c.ws.ReadMessage()
+		// Blocks while a reconnect is in progress
+		l, err := c.current()
 		if err != nil {
 			return nil, err
 		}
 
+		// Left over from the Hello handshake
+		if l.pending != nil {
+			plaintext := l.pending
+			l.pending = nil
+			return protocol.Decode(plaintext)
+		}
+		var msgType int
+		var msg []byte
+		if l.pendingRead != nil {
+			r := <-l.pendingRead
+			l.pendingRead = nil
+			msgType, msg, err = r.msgType, r.msg, r.err
+		} else {
+			msgType, msg, err = readMessage(l.ws)
+		}
+		if err != nil {
+			if err := c.linkFailed(l, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
 		if msgType == websocket.TextMessage {
+			if c.handlePeerKeyExchange(l, msg) {
+				continue
+			}
 			fmt.Printf("⚠️ Received text message from relay: %s\n", string(msg))
 			continue // Skip text messages (likely errors or debug info)
 		}
@@ -258,18 +751,354 @@ func (c *Connection) Recv() (protocol.TunnelMessage, error) {
 		}
 
 		// Decrypt
-		plaintext, err := c.cipher.Decrypt(msg)
+		plaintext, err := l.cipher.Decrypt(msg)
+		if err != nil && l.prevCipher != nil {
+			plaintext, err = l.prevCipher.Decrypt(msg)
+		}
 		if err != nil {
+			if c.opts.Reconnect {
+				// Stragglers under the old key right after either side reconnects
+				continue
+			}
 			return nil, fmt.Errorf("decryption failed: %w", err)
 		}
 
 		// Decode
-		return protocol.Decode(plaintext)
+		m, err := protocol.Decode(plaintext)
+		switch ctl := m.(type) {
+		case *protocol.ControlAck:
+			c.handleControlAck(ctl)
+			continue
+		case *protocol.Control:
+			if m = c.handleControl(ctl); m == nil {
+				continue
+			}
+		}
+		if hello, ok := m.(*protocol.Hello); ok {
+			c.handlePeerHello(l, hello)
+			continue
+		}
+		if c.handleProbe(l, m) {
+			continue
+		}
+		if lease, ok := m.(*protocol.Lease); ok {
+			c.handleLease(lease)
+			continue
+		}
+		return m, err
+	}
+}
+
+// recvResult is the outcome of a Recv run on behalf of RecvContext
+type recvResult struct {
+	msg protocol.TunnelMessage
+	err error
+}
+
+// RecvContext is Recv, but returns ctx.Err() as soon as ctx is done.
+// A message that arrives after that is kept for the next RecvContext call,
+// so a caller that cancels should keep using RecvContext rather than Recv.
+func (c *Connection) RecvContext(ctx context.Context) (protocol.TunnelMessage, error) {
+	c.inflightMu.Lock()
+	ch := c.inflight
+	if ch == nil {
+		ch = make(chan recvResult, 1)
+		c.inflight = ch
+		go func() {
+			msg, err := c.Recv()
+			ch <- recvResult{msg, err}
+		}()
+	}
+	c.inflightMu.Unlock()
+
+	select {
+	case r := <-ch:
+		c.inflightMu.Lock()
+		c.inflight = nil
+		c.inflightMu.Unlock()
+		return r.msg, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// handlePeerKeyExchange answers a key exchange the peer starts after it
+// reconnected, switching l to the new key. Reports whether msg was one.
+func (c *Connection) handlePeerKeyExchange(l *link, msg []byte) bool {
+	var keMsg KeyExchangeMessage
+	if err := json.Unmarshal(msg, &keMsg); err != nil || keMsg.Type != "key_exchange" || keMsg.PublicKey == "" {
+		return false
+	}
+
+	peerPK, err := protocol.ParseHexPublicKey(keMsg.PublicKey)
+	if err != nil {
+		return true
+	}
+	if bytes.Equal(peerPK, l.peerPK) {
+		// Nothing new to negotiate. The peer repeating its key means our
+		// answer was lost (see control.go).
+		if !keMsg.Reply && l.publicKey != "" {
+			if err := c.sendPublicKey(l, l.publicKey, true); err != nil {
+				c.linkFailed(l, err)
+			}
+		}
+		return true
+	}
+	// The answer to a rotation we started, or the peer's own rotation
+	// crossing ours: either way both sides now hold each other's new key
+	if c.finishRotation(l, peerPK) {
+		return true
+	}
+
+	fmt.Println("🔑 Peer re-keying (reconnect or rotation), renegotiating key...")
+	ke, err := protocol.NewKeyExchange(c.roomID)
+	if err != nil {
+		fmt.Printf("❌ Re-key failed: %v\n", err)
+		return true
+	}
+	encKey, err := c.linkKey(ke, peerPK)
+	if err != nil {
+		fmt.Printf("❌ Re-key failed: %v\n", err)
+		return true
+	}
+
+	publicKey := ke.GetPublicKeyHex()
+	if err := c.sendPublicKey(l, publicKey, true); err != nil {
+		c.linkFailed(l, err)
+		return true
+	}
+	if err := c.switchKey(l, encKey, peerPK, publicKey); err != nil {
+		fmt.Printf("❌ Re-key failed: %v\n", err)
+		return true
+	}
+
+	fmt.Println("🔐 Key exchange complete! Encryption key derived.")
+	return true
+}
+
+// current returns the live link, waiting out any reconnect in progress
+func (c *Connection) current() (*link, error) {
+	return c.currentContext(context.Background())
+}
+
+// currentContext is current, but stops waiting when ctx is done
+func (c *Connection) currentContext(ctx context.Context) (*link, error) {
+	for {
+		c.stateMu.Lock()
+		l, wait, failed := c.link, c.reconnecting, c.failed
+		c.stateMu.Unlock()
+
+		if failed != nil {
+			return nil, failed
+		}
+		if wait == nil {
+			return l, nil
+		}
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-c.done:
+			return nil, ErrClosed
+		}
+	}
+}
+
+// linkFailed handles an I/O error on l. It returns nil when the caller should
+// retry with current() (a reconnect has started or already replaced l), or
+// the error to surface when reconnecting is disabled or has given up.
+func (c *Connection) linkFailed(l *link, err error) error {
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
+	}
+
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	if c.failed != nil {
+		return c.failed
+	}
+	if c.link != l || c.reconnecting != nil {
+		return nil
+	}
+	// A relay that refused us won't take us back on reconnect
+	terminal := IsTerminal(err)
+	if terminal {
+		c.refused(err)
+	}
+	if !c.opts.Reconnect || terminal {
+		c.failed = err
+		l.ws.Close() // Wake up the other loop still using it
+		return err
 	}
+
+	c.reconnecting = make(chan struct{})
+	go c.reconnect(l, err)
+	return nil
+}
+
+// keepalive pings the relay every KeepaliveInterval so idle tunnels aren't
+// cut, and fails the link when no pong has arrived within KeepaliveTimeout.
+// Control frames go through WriteControl, which gorilla/websocket allows
+// alongside the write pump without splitting a data frame.
+func (c *Connection) keepalive() {
+	ticker := time.NewTicker(c.opts.KeepaliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			return
+		}
+
+		c.stateMu.Lock()
+		l, busy := c.link, c.reconnecting != nil || c.failed != nil
+		c.stateMu.Unlock()
+		if busy {
+			continue
+		}
+
+		if since := time.Since(time.Unix(0, l.lastPong.Load())); since > c.opts.KeepaliveTimeout {
+			fmt.Printf("💔 No pong from relay for %v\n", since.Round(time.Second))
+			if err := c.linkFailed(l, errKeepaliveTimeout); err != nil {
+				return
+			}
+			continue
+		}
+
+		deadline := time.Now().Add(pingWriteTimeout)
+		if err := l.ws.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+			if err := c.linkFailed(l, err); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// reconnect redials the room with exponential backoff and jitter until it
+// succeeds, the attempt limit is hit, the relay refuses us for good (see
+// CloseError.Retryable), or the connection is closed.
+// With several relays each attempt moves on to the next one, and the
+// backoff only applies between full rounds through the list.
+func (c *Connection) reconnect(old *link, cause error) {
+	old.ws.Close() // Unblock whichever loop is still using the dead socket
+	fmt.Printf("🔄 Relay connection lost (%v), reconnecting...\n", cause)
+	events.Emit("reconnecting", events.Fields{"error": cause.Error()})
+
+	var result *link
+	var resultCaps Capabilities
+	var failErr error
+
+	c.stateMu.Lock()
+	index := c.active
+	c.stateMu.Unlock()
+	n := len(c.urls)
+
+	backoff := initialBackoff
+	for attempt := 1; ; attempt++ {
+		if n > 1 {
+			index = (index + 1) % n
+		}
+
+		if (attempt-1)%n == 0 {
+			delay := jitter(backoff)
+			fmt.Printf("⏳ Reconnect attempt %d in %v\n", attempt, delay.Round(time.Millisecond))
+
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-c.done:
+				timer.Stop()
+				failErr = ErrClosed
+			}
+			if failErr != nil {
+				break
+			}
+		}
+
+		l, caps, err := c.dial(index)
+		if err == nil {
+			fmt.Printf("✅ Relay reconnected after %d attempt(s)\n", attempt)
+			result, resultCaps = l, caps
+			break
+		}
+		fmt.Printf("⚠️ Reconnect attempt %d failed: %v\n", attempt, err)
+		if IsTerminal(err) {
+			c.refused(err)
+			failErr = err
+			break
+		}
+
+		if c.opts.MaxReconnectAttempts > 0 && attempt >= c.opts.MaxReconnectAttempts {
+			failErr = fmt.Errorf("relay reconnect gave up after %d attempts: %w", attempt, err)
+			fmt.Printf("❌ %v\n", failErr)
+			break
+		}
+
+		if attempt%n == 0 {
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+	}
+
+	c.stateMu.Lock()
+	if result != nil {
+		select {
+		case <-c.done:
+			// Closed while the dial was in flight
+			result.ws.Close()
+			c.failed = ErrClosed
+		default:
+			c.link = result
+			c.caps = resultCaps
+			c.active = index
+		}
+	} else {
+		c.failed = failErr
+	}
+	close(c.reconnecting)
+	c.reconnecting = nil
+	c.stateMu.Unlock()
+}
+
+// Connected reports whether a link is up right now, i.e. not reconnecting
+// and not failed for good
+func (c *Connection) Connected() bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.reconnecting == nil && c.failed == nil
+}
+
+// RelayURL returns the relay the connection is currently using
+func (c *Connection) RelayURL() string {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.relays[c.active]
+}
+
+// RoomID returns the room this connection joined
+func (c *Connection) RoomID() string {
+	return c.roomID
 }
 
 // Close closes the connection
 func (c *Connection) Close() {
-	close(c.done)
-	c.ws.Close()
+	c.closeOnce.Do(func() {
+		close(c.done)
+
+		c.stateMu.Lock()
+		l := c.link
+		c.stateMu.Unlock()
+		l.ws.Close()
+	})
 }
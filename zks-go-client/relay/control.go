@@ -0,0 +1,160 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/zks-vpn/zks-go-client/metrics"
+	"github.com/zks-vpn/zks-go-client/protocol"
+)
+
+// Reliable control messages
+//
+// Data packets may be lost: the relay drops what arrives while the peer is
+// reconnecting, and Send drops when the queue is full, which TCP inside the
+// tunnel recovers from. A lost control message isn't recovered by anyone
+// and leaves the tunnel half set up, e.g. a client waiting for a Lease. So
+// control messages are sent again until the peer acknowledges them:
+//
+//   - SendControl wraps a message in a protocol.Control with a sequence
+//     number, which the peer answers with a ControlAck (see handleControl)
+//   - the handshake Hello, which can't be wrapped because it is what tells
+//     whether the peer understands Control, is repeated until the peer's
+//     Hello arrives, and answered with a Reply Hello (see exchangeHello)
+//   - a key rotation's public key is repeated until the peer's answer
+//     arrives (see startRotation)
+
+// Variables rather than constants so tests can shorten them
+var (
+	// controlRetransmit is how long to wait for an acknowledgment before
+	// the first retransmission; each further one waits twice as long, up to
+	// controlMaxRetransmit
+	controlRetransmit    = time.Second
+	controlMaxRetransmit = 8 * time.Second
+	// controlTimeout is how long a control message is retransmitted before
+	// giving up on the peer
+	controlTimeout = 30 * time.Second
+)
+
+// controlWindow is how many of the peer's latest sequence numbers are
+// remembered to drop retransmissions of messages already handled
+const controlWindow = 64
+
+// controlState tracks our unacknowledged Control messages and the peer's
+// latest ones
+type controlState struct {
+	mu sync.Mutex
+	// nextSeq starts out random, so a restarted peer doesn't take our new
+	// messages for retransmissions of those it saw from before
+	nextSeq uint32
+	pending map[uint32]chan struct{} // Closed when acknowledged
+
+	seen     [controlWindow]uint32
+	seenNext int
+	seenLen  int
+}
+
+// SendControl sends msg to the peer and keeps sending it again until the
+// peer acknowledges it or controlTimeout passes. Peers without
+// FeatureReliableControl get msg once, as Send would. The error is that of
+// the first attempt, which waits for room in the send queue until ctx is done.
+func (c *Connection) SendControl(ctx context.Context, msg protocol.TunnelMessage) error {
+	if !c.Capabilities().Features.Has(protocol.FeatureReliableControl) {
+		return c.SendContext(ctx, msg)
+	}
+
+	s := &c.control
+	acked := make(chan struct{})
+	s.mu.Lock()
+	seq := s.nextSeq
+	s.nextSeq++
+	s.pending[seq] = acked
+	s.mu.Unlock()
+
+	wrapped := &protocol.Control{Seq: seq, Msg: msg}
+	if err := c.SendContext(ctx, wrapped); err != nil {
+		s.mu.Lock()
+		delete(s.pending, seq)
+		s.mu.Unlock()
+		return err
+	}
+	go func() {
+		c.retransmit(fmt.Sprintf("control message 0x%02x", msg.Type()), acked, func() error {
+			// Lost to a full queue is lost like any other time
+			if err := c.Send(wrapped); err != nil && !errors.Is(err, errSendBufferFull) {
+				return err
+			}
+			return nil
+		})
+		s.mu.Lock()
+		delete(s.pending, seq)
+		s.mu.Unlock()
+	}()
+	return nil
+}
+
+// handleControl acknowledges a Control from the peer and returns the
+// message it carries, or nil if it is a retransmission of one already
+// handled (our acknowledgment was lost)
+func (c *Connection) handleControl(m *protocol.Control) protocol.TunnelMessage {
+	// Lost to a full queue, the peer sends m again and gets another
+	c.Send(&protocol.ControlAck{Seq: m.Seq})
+
+	s := &c.control
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.seenLen {
+		if s.seen[i] == m.Seq {
+			return nil
+		}
+	}
+	s.seen[s.seenNext] = m.Seq
+	s.seenNext = (s.seenNext + 1) % controlWindow
+	s.seenLen = min(s.seenLen+1, controlWindow)
+	return m.Msg
+}
+
+// handleControlAck stops the retransmission of the acknowledged Control
+func (c *Connection) handleControlAck(m *protocol.ControlAck) {
+	s := &c.control
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if acked, ok := s.pending[m.Seq]; ok {
+		delete(s.pending, m.Seq)
+		close(acked)
+	}
+}
+
+// retransmit calls send, with exponential backoff from controlRetransmit,
+// until acked is closed, send fails, the connection closes or
+// controlTimeout passes. The first transmission is the caller's.
+func (c *Connection) retransmit(what string, acked <-chan struct{}, send func() error) {
+	delay := controlRetransmit
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	deadline := time.Now().Add(controlTimeout)
+
+	for {
+		select {
+		case <-timer.C:
+		case <-acked:
+			return
+		case <-c.done:
+			return
+		}
+		if !time.Now().Before(deadline) {
+			fmt.Printf("⚠️ No acknowledgment for %s after %s, giving up\n", what, controlTimeout)
+			metrics.ControlTimeouts.Inc()
+			return
+		}
+		metrics.ControlRetransmits.Inc()
+		if err := send(); err != nil {
+			return
+		}
+		delay = min(2*delay, controlMaxRetransmit)
+		timer.Reset(delay)
+	}
+}
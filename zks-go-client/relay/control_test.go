@@ -0,0 +1,181 @@
+package relay
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/zks-vpn/zks-go-client/metrics"
+	"github.com/zks-vpn/zks-go-client/protocol"
+)
+
+// controlConn is a Connection with a link but no WebSocket: what it sends
+// stays in its send queue, where sent picks it up
+type controlConn struct {
+	*Connection
+	t      *testing.T
+	cipher *protocol.WasifVernam
+}
+
+func newControlConn(t *testing.T, features protocol.Features) *controlConn {
+	t.Helper()
+	cipher, err := protocol.NewWasifVernam([32]byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Connection{
+		link:     &link{cipher: cipher},
+		caps:     Capabilities{Features: features},
+		sendChan: make(chan outgoing, 256),
+		done:     make(chan struct{}),
+		control:  controlState{nextSeq: 100, pending: make(map[uint32]chan struct{})},
+	}
+	t.Cleanup(func() { close(c.done) })
+	return &controlConn{Connection: c, t: t, cipher: cipher}
+}
+
+// sent returns the next message queued for the peer, or nil if there is
+// none within wait
+func (c *controlConn) sent(wait time.Duration) protocol.TunnelMessage {
+	c.t.Helper()
+	select {
+	case out := <-c.sendChan:
+		plaintext, err := c.cipher.Decrypt(out.buf)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		m, err := protocol.Decode(plaintext)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		return m
+	case <-time.After(wait):
+		return nil
+	}
+}
+
+// pending returns how many Control messages await an acknowledgment
+func (c *controlConn) pending() int {
+	c.control.mu.Lock()
+	defer c.control.mu.Unlock()
+	return len(c.control.pending)
+}
+
+var testLease = &protocol.Lease{IP: "10.0.85.2", PrefixLen: 24}
+
+// Runs first: it shortens the retransmission intervals, and waits for its
+// retransmissions to stop before restoring them
+func TestSendControlRetransmits(t *testing.T) {
+	defer func(retransmit, maxRetransmit, timeout time.Duration) {
+		controlRetransmit, controlMaxRetransmit, controlTimeout = retransmit, maxRetransmit, timeout
+	}(controlRetransmit, controlMaxRetransmit, controlTimeout)
+	controlRetransmit, controlMaxRetransmit, controlTimeout = 20*time.Millisecond, 80*time.Millisecond, 400*time.Millisecond
+
+	c := newControlConn(t, protocol.FeatureReliableControl)
+	timeouts := metrics.ControlTimeouts.Load()
+	start := time.Now()
+	if err := c.SendControl(context.Background(), testLease); err != nil {
+		t.Fatal(err)
+	}
+
+	// Never acknowledged: sent again after 20, 40 and then every 80ms,
+	// until 400ms have passed
+	var at []time.Duration
+	for {
+		m := c.sent(time.Second)
+		if m == nil {
+			break
+		}
+		ctl, ok := m.(*protocol.Control)
+		if !ok || ctl.Seq != 100 || ctl.Msg.Type() != protocol.CmdLease {
+			t.Fatalf("sent %#v, want the Lease as Control 100", m)
+		}
+		at = append(at, time.Since(start))
+	}
+	want := []time.Duration{0, 20, 60, 140, 220, 300, 380}
+	if len(at) != len(want) {
+		t.Fatalf("sent at %v, want %d sends", at, len(want))
+	}
+	for i := 1; i < len(at); i++ {
+		gap, wantGap := at[i]-at[i-1], (want[i]-want[i-1])*time.Millisecond
+		if gap < wantGap-5*time.Millisecond || gap > wantGap+60*time.Millisecond {
+			t.Fatalf("retransmission %d after %v, want %v (sent at %v)", i, gap, wantGap, at)
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for c.pending() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("still retransmitting after the timeout")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if metrics.ControlTimeouts.Load() != timeouts+1 {
+		t.Fatal("the timeout was not counted")
+	}
+
+	// Acknowledged after the first retransmission: nothing more
+	if err := c.SendControl(context.Background(), testLease); err != nil {
+		t.Fatal(err)
+	}
+	c.sent(time.Second)
+	ctl, ok := c.sent(time.Second).(*protocol.Control)
+	if !ok || ctl.Seq != 101 {
+		t.Fatalf("no retransmission of Control 101")
+	}
+	c.handleControlAck(&protocol.ControlAck{Seq: 101})
+	if m := c.sent(200 * time.Millisecond); m != nil {
+		t.Fatalf("sent %#v after the acknowledgment", m)
+	}
+	if c.pending() != 0 {
+		t.Fatal("an acknowledged Control is still pending")
+	}
+}
+
+func TestSendControlWithoutFeature(t *testing.T) {
+	// A peer without FeatureReliableControl gets the message as is, once
+	c := newControlConn(t, 0)
+	if err := c.SendControl(context.Background(), testLease); err != nil {
+		t.Fatal(err)
+	}
+	if m := c.sent(time.Second); m == nil || m.Type() != protocol.CmdLease {
+		t.Fatalf("sent %#v, want the bare Lease", m)
+	}
+	if c.pending() != 0 {
+		t.Fatal("waiting for an acknowledgment the peer won't send")
+	}
+}
+
+func TestHandleControlDedupe(t *testing.T) {
+	c := newControlConn(t, protocol.FeatureReliableControl)
+	handle := func(seq uint32) protocol.TunnelMessage {
+		t.Helper()
+		m := c.handleControl(&protocol.Control{Seq: seq, Msg: testLease})
+		// Every copy is acknowledged, in case the last ack was lost
+		ack, ok := c.sent(time.Second).(*protocol.ControlAck)
+		if !ok || ack.Seq != seq {
+			t.Fatalf("Control %d not acknowledged", seq)
+		}
+		return m
+	}
+
+	if handle(7) != testLease {
+		t.Fatal("first copy not delivered")
+	}
+	if handle(7) != nil {
+		t.Fatal("retransmission delivered again")
+	}
+	if handle(8) != testLease {
+		t.Fatal("next message not delivered")
+	}
+
+	// Only the latest controlWindow are remembered
+	for seq := uint32(1000); seq < 1000+controlWindow; seq++ {
+		handle(seq)
+	}
+	if handle(7) != testLease {
+		t.Fatal("a sequence number older than the window is still remembered")
+	}
+	if handle(1000+controlWindow-1) != nil {
+		t.Fatal("a sequence number inside the window was forgotten")
+	}
+}
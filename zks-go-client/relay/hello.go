@@ -0,0 +1,181 @@
+package relay
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/zks-vpn/zks-go-client/metrics"
+	"github.com/zks-vpn/zks-go-client/protocol"
+)
+
+// helloTimeout is how long to wait for the peer's Hello before assuming it
+// predates the handshake. Ours is repeated meanwhile in case it was lost
+// (see control.go).
+const helloTimeout = 5 * time.Second
+
+// legacyCapabilities is what a peer that never sends a Hello supports
+var legacyCapabilities = Capabilities{Version: 0, Features: protocol.FeatureBatching}
+
+// Capabilities is the outcome of the Hello handshake: what both sides support
+type Capabilities struct {
+	Version  uint16
+	Features protocol.Features
+	// PeerIP is the tunnel IP the peer announced, if any
+	PeerIP string
+	// PeerSession is the peer's session token, zero if it sent none
+	PeerSession protocol.SessionToken
+}
+
+// readResult is one ws.ReadMessage outcome
+type readResult struct {
+	msgType int
+	msg     []byte
+	err     error
+}
+
+// hello is the Hello we announce. Every Connection acknowledges Control
+// messages, whatever Options.Features says.
+func (c *Connection) hello() *protocol.Hello {
+	return &protocol.Hello{
+		Version:    protocol.ProtocolVersion,
+		Features:   c.opts.Features | protocol.FeatureReliableControl,
+		AssignedIP: c.opts.LocalIP,
+		Session:    c.opts.SessionToken,
+	}
+}
+
+// sendHello writes our Hello on l, as a Reply to the peer's if reply is
+// set. The caller serializes writes.
+func (c *Connection) sendHello(l *link, reply bool) error {
+	hello := c.hello()
+	hello.Reply = reply
+	encrypted, err := l.cipher.Encrypt(hello.Encode())
+	if err != nil {
+		return err
+	}
+	l.helloSent = true
+	return l.ws.WriteMessage(websocket.BinaryMessage, encrypted)
+}
+
+// exchangeHello sends our Hello on a freshly keyed link and waits for the
+// peer's, sending ours again every controlRetransmit in case it was lost.
+// A peer that sends data first, or nothing within helloTimeout, is treated
+// as a legacy peer; whatever was read is left for Recv.
+func (c *Connection) exchangeHello(l *link) (Capabilities, error) {
+	if err := c.sendHello(l, false); err != nil {
+		return Capabilities{}, fmt.Errorf("failed to send hello: %w", err)
+	}
+
+	timer := time.NewTimer(helloTimeout)
+	defer timer.Stop()
+	retransmit := time.NewTicker(controlRetransmit)
+	defer retransmit.Stop()
+
+	var ch chan readResult
+	for {
+		// Reads can't be cancelled without killing the socket, so a read
+		// still running at the timeout is handed over to Recv
+		if ch == nil {
+			ch = make(chan readResult, 1)
+			go func() {
+				msgType, msg, err := readMessage(l.ws)
+				ch <- readResult{msgType, msg, err}
+			}()
+		}
+
+		var r readResult
+		select {
+		case r = <-ch:
+			ch = nil
+		case <-retransmit.C:
+			metrics.ControlRetransmits.Inc()
+			if err := c.sendHello(l, false); err != nil {
+				return Capabilities{}, fmt.Errorf("failed to send hello: %w", err)
+			}
+			continue
+		case <-timer.C:
+			l.pendingRead = ch
+			if c.opts.RoomSecret != "" {
+				// A peer with the secret would have said hello by now
+				return Capabilities{}, errRoomSecret
+			}
+			fmt.Println("⚠️ No hello from peer, assuming an older version")
+			return legacyCapabilities, nil
+		}
+		if r.err != nil {
+			return Capabilities{}, fmt.Errorf("failed to read hello: %w", r.err)
+		}
+		if r.msgType != websocket.BinaryMessage {
+			continue // e.g. a repeated key_exchange
+		}
+
+		plaintext, err := l.cipher.Decrypt(r.msg)
+		if err != nil {
+			continue // Straggler under an old key
+		}
+		if m, err := protocol.Decode(plaintext); err == nil {
+			if peer, ok := m.(*protocol.Hello); ok {
+				l.peerHello = peer
+				return c.negotiate(peer), nil
+			}
+		}
+
+		// Data before any Hello: an older peer
+		l.pending = plaintext
+		fmt.Println("⚠️ Peer sent data without a hello, assuming an older version")
+		return legacyCapabilities, nil
+	}
+}
+
+// negotiate combines the peer's Hello with ours
+func (c *Connection) negotiate(peer *protocol.Hello) Capabilities {
+	version, features := c.hello().Negotiate(peer)
+	fmt.Printf("🤝 Peer speaks protocol v%d (%s), using v%d with %s\n", peer.Version, peer.Features, version, features)
+	return Capabilities{Version: version, Features: features, PeerIP: peer.AssignedIP, PeerSession: peer.Session}
+}
+
+// handlePeerHello records a Hello that arrives mid-stream, which happens
+// when the peer reconnected, and answers it if we haven't said hello on l.
+// The peer repeating the Hello it already sent on l means ours was lost:
+// that is answered again, but not recorded again. Replies are never answered,
+// so two peers can't keep answering each other.
+func (c *Connection) handlePeerHello(l *link, peer *protocol.Hello) {
+	repeated := l.peerHello != nil && sameHello(l.peerHello, peer)
+	if !repeated {
+		l.peerHello = peer
+		caps := c.negotiate(peer)
+		c.stateMu.Lock()
+		c.caps = caps
+		c.stateMu.Unlock()
+		c.peerHellos.Add(1)
+	}
+
+	if peer.Reply || (l.helloSent && !repeated) {
+		return
+	}
+	c.mu.Lock()
+	err := c.sendHello(l, true)
+	c.mu.Unlock()
+	if err != nil {
+		c.linkFailed(l, err)
+	}
+}
+
+// sameHello reports whether a and b announce the same, Reply aside
+func sameHello(a, b *protocol.Hello) bool {
+	return a.Version == b.Version && a.Features == b.Features && a.AssignedIP == b.AssignedIP && a.Session == b.Session
+}
+
+// PeerHellos counts the Hellos the peer sent after the handshake, one per
+// reconnect on its side. A change means Capabilities may have too.
+func (c *Connection) PeerHellos() uint64 {
+	return c.peerHellos.Load()
+}
+
+// Capabilities returns what was negotiated with the peer on the current link
+func (c *Connection) Capabilities() Capabilities {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.caps
+}
@@ -0,0 +1,55 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sync"
+
+	"github.com/zks-vpn/zks-go-client/protocol"
+)
+
+// leaseState holds the tunnel address the Exit Peer assigned us
+type leaseState struct {
+	mu     sync.Mutex
+	prefix netip.Prefix
+	ready  chan struct{} // Closed on the first Lease
+	once   sync.Once
+}
+
+// handleLease records a Lease from the peer. Later ones (after the peer
+// reconnected) replace it, but the TUN keeps the address it came up with.
+func (c *Connection) handleLease(m *protocol.Lease) {
+	addr, err := netip.ParseAddr(m.IP)
+	if err != nil || int(m.PrefixLen) > addr.BitLen() {
+		fmt.Printf("⚠️ Ignoring invalid lease %s/%d\n", m.IP, m.PrefixLen)
+		return
+	}
+	prefix := netip.PrefixFrom(addr, int(m.PrefixLen))
+
+	c.lease.mu.Lock()
+	changed := c.lease.prefix != prefix
+	c.lease.prefix = prefix
+	c.lease.mu.Unlock()
+	c.lease.once.Do(func() { close(c.lease.ready) })
+
+	if changed {
+		fmt.Printf("📇 Exit Peer assigned tunnel address %s\n", prefix)
+	}
+}
+
+// Lease waits for the tunnel address the Exit Peer assigns. Recv must be
+// running for it to arrive. It returns ctx.Err() if none came in time,
+// e.g. because the peer doesn't support FeatureLease.
+func (c *Connection) Lease(ctx context.Context) (netip.Prefix, error) {
+	select {
+	case <-c.lease.ready:
+	case <-ctx.Done():
+		return netip.Prefix{}, ctx.Err()
+	case <-c.done:
+		return netip.Prefix{}, ErrClosed
+	}
+	c.lease.mu.Lock()
+	defer c.lease.mu.Unlock()
+	return c.lease.prefix, nil
+}
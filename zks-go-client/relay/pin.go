@@ -0,0 +1,72 @@
+package relay
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// ParsePin decodes a pinned SHA-256 hash. It accepts "sha256/<base64>" (the
+// form curl's --pinnedpubkey and HPKP use), bare base64, or hex with optional
+// colons as printed by openssl.
+func ParsePin(s string) ([sha256.Size]byte, error) {
+	var pin [sha256.Size]byte
+	v := strings.TrimPrefix(strings.TrimSpace(s), "sha256/")
+
+	var raw []byte
+	if h, err := hex.DecodeString(strings.ReplaceAll(v, ":", "")); err == nil && len(h) == sha256.Size {
+		raw = h
+	} else if b, err := base64.StdEncoding.DecodeString(v); err == nil && len(b) == sha256.Size {
+		raw = b
+	} else {
+		return pin, fmt.Errorf("invalid pin %q: want sha256/<base64> or 64 hex digits", s)
+	}
+	copy(pin[:], raw)
+	return pin, nil
+}
+
+// pinTLSConfig returns a TLS config that, on top of the usual chain
+// verification, requires a certificate in the presented chain whose public
+// key (SPKI) or whole DER encoding hashes to one of pins. A mismatch fails
+// the TLS handshake, before the WebSocket upgrade is sent. No pins means
+// no extra config (nil).
+func pinTLSConfig(pins []string) (*tls.Config, error) {
+	if len(pins) == 0 {
+		return nil, nil
+	}
+	want := make([][sha256.Size]byte, 0, len(pins))
+	for _, s := range pins {
+		pin, err := ParsePin(s)
+		if err != nil {
+			return nil, err
+		}
+		want = append(want, pin)
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			var seen []string
+			for _, der := range rawCerts {
+				cert, err := x509.ParseCertificate(der)
+				if err != nil {
+					return err
+				}
+				spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				whole := sha256.Sum256(der)
+				for _, pin := range want {
+					if pin == spki || pin == whole {
+						return nil
+					}
+				}
+				seen = append(seen, "sha256/"+base64.StdEncoding.EncodeToString(spki[:]))
+			}
+			// List the chain's key pins so a rotated pin is easy to update
+			return fmt.Errorf("no certificate in the relay's chain matches a pinned SHA-256 (chain keys: %s)", strings.Join(seen, ", "))
+		},
+	}, nil
+}
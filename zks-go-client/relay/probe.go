@@ -0,0 +1,203 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/zks-vpn/zks-go-client/metrics"
+	"github.com/zks-vpn/zks-go-client/protocol"
+)
+
+// probeLossWeight is how much each probe moves the smoothed loss estimate
+const probeLossWeight = 0.1
+
+// ProbeStats is what the latency probe has measured so far
+type ProbeStats struct {
+	// RTT is the round trip of the latest answered probe, relay hops included
+	RTT time.Duration
+	// LastSeen is when the latest probe reply arrived (zero if none yet)
+	LastSeen time.Time
+	// Loss is a smoothed estimate (0..1) of probes that got no reply
+	// before the next one was sent
+	Loss float64
+}
+
+// probeState is the latency probe bookkeeping of a Connection
+type probeState struct {
+	mu    sync.Mutex
+	sent  uint32 // Seq of the last probe sent
+	acked uint32 // Highest Seq answered
+	stats ProbeStats
+
+	waiters map[uint32]chan time.Duration // Ping calls waiting for their Pong
+}
+
+// probeLoop sends a Ping every ProbeInterval. The peer's relay.Connection
+// answers it in Recv, so any Recv loop (Exit Peer, TUN, SOCKS5) echoes.
+func (c *Connection) probeLoop() {
+	ticker := time.NewTicker(c.opts.ProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			return
+		}
+
+		// Peers from before the Hello handshake would just log the Ping
+		if c.Capabilities().Version < 1 {
+			continue
+		}
+
+		p := &c.probe
+		p.mu.Lock()
+		if p.sent > 0 {
+			missed := 0.0
+			if p.acked < p.sent {
+				missed = 1
+			}
+			p.stats.Loss += probeLossWeight * (missed - p.stats.Loss)
+			metrics.PeerLossRatio.Set(p.stats.Loss)
+		}
+		p.sent++
+		ping := &protocol.Ping{Seq: p.sent, Timestamp: time.Now().UnixNano()}
+		p.mu.Unlock()
+
+		if err := c.Send(ping); err != nil && err != ErrClosed {
+			fmt.Printf("⚠️ Probe send failed: %v\n", err)
+		}
+	}
+}
+
+// handleProbe answers a Ping or records a Pong that arrived on l. Reports
+// whether msg was one.
+func (c *Connection) handleProbe(l *link, msg protocol.TunnelMessage) bool {
+	switch m := msg.(type) {
+	case *protocol.Ping:
+		c.Send(&protocol.Pong{Seq: m.Seq, Timestamp: m.Timestamp})
+		return true
+
+	case *protocol.Pong:
+		if m.Seq == 0 {
+			return true // Bare Pong from an older peer, nothing to measure
+		}
+		now := time.Now()
+		rtt := now.Sub(time.Unix(0, m.Timestamp))
+
+		p := &c.probe
+		p.mu.Lock()
+		if m.Seq > p.acked {
+			p.acked = m.Seq
+		}
+		p.stats.RTT = rtt
+		p.stats.LastSeen = now
+		if ch, ok := p.waiters[m.Seq]; ok {
+			ch <- rtt
+			delete(p.waiters, m.Seq)
+		}
+		p.mu.Unlock()
+
+		l.lastPeer.Store(now.UnixNano())
+
+		metrics.PeerRTTSeconds.Set(rtt.Seconds())
+		metrics.PeerLastSeenSec.Set(float64(now.Unix()))
+		return true
+	}
+	return false
+}
+
+// heartbeat sends a Ping every HeartbeatInterval and fails the link when
+// the peer hasn't answered one within HeartbeatTimeout. The timer starts
+// over with every new link, so a reconnect gets the full timeout.
+func (c *Connection) heartbeat() {
+	ticker := time.NewTicker(c.opts.HeartbeatInterval)
+	defer ticker.Stop()
+	warned := false
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			return
+		}
+
+		c.stateMu.Lock()
+		l, busy := c.link, c.reconnecting != nil || c.failed != nil
+		c.stateMu.Unlock()
+		if busy {
+			continue
+		}
+		if c.Capabilities().Version < 1 {
+			if !warned {
+				fmt.Println("⚠️ Peer predates the hello handshake and doesn't answer pings, heartbeat disabled")
+				warned = true
+			}
+			continue
+		}
+
+		if since := time.Since(time.Unix(0, l.lastPeer.Load())); since > c.opts.HeartbeatTimeout {
+			fmt.Printf("💔 No heartbeat reply from the peer for %v\n", since.Round(time.Second))
+			if err := c.linkFailed(l, errHeartbeatTimeout); err != nil {
+				return
+			}
+			continue
+		}
+
+		p := &c.probe
+		p.mu.Lock()
+		p.sent++
+		ping := &protocol.Ping{Seq: p.sent, Timestamp: time.Now().UnixNano()}
+		p.mu.Unlock()
+		if err := c.Send(ping); err != nil && err != ErrClosed {
+			fmt.Printf("⚠️ Heartbeat send failed: %v\n", err)
+		}
+	}
+}
+
+// Ping sends one probe to the peer and returns its round trip time. The
+// Pong is picked up by Recv, so a Recv loop must be running meanwhile.
+func (c *Connection) Ping(ctx context.Context) (time.Duration, error) {
+	if c.Capabilities().Version < 1 {
+		return 0, errors.New("peer predates the hello handshake and doesn't answer pings")
+	}
+
+	p := &c.probe
+	ch := make(chan time.Duration, 1)
+	p.mu.Lock()
+	p.sent++
+	seq := p.sent
+	if p.waiters == nil {
+		p.waiters = make(map[uint32]chan time.Duration)
+	}
+	p.waiters[seq] = ch
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.waiters, seq)
+		p.mu.Unlock()
+	}()
+
+	if err := c.SendContext(ctx, &protocol.Ping{Seq: seq, Timestamp: time.Now().UnixNano()}); err != nil {
+		return 0, err
+	}
+	select {
+	case rtt := <-ch:
+		return rtt, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-c.done:
+		return 0, ErrClosed
+	}
+}
+
+// ProbeStats returns the latest latency probe results. They stay zero
+// unless Options.ProbeInterval is set.
+func (c *Connection) ProbeStats() ProbeStats {
+	c.probe.mu.Lock()
+	defer c.probe.mu.Unlock()
+	return c.probe.stats
+}
@@ -0,0 +1,155 @@
+package relay
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/zks-vpn/zks-go-client/protocol"
+)
+
+// errRoomSecret marks a peer whose Hello never decrypted under the
+// room-secret key
+var errRoomSecret = errors.New("peer did not prove knowledge of the room secret")
+
+// rotationState is a key rotation this side started and the peer hasn't
+// answered yet
+type rotationState struct {
+	mu       sync.Mutex
+	ke       *protocol.KeyExchange
+	link     *link
+	answered chan struct{} // Closed when the rotation ends, to stop retransmitting
+}
+
+// end clears the pending rotation. The caller holds mu.
+func (r *rotationState) end() {
+	if r.answered != nil {
+		close(r.answered)
+	}
+	r.ke, r.link, r.answered = nil, nil, nil
+}
+
+// linkKey derives the key for a link from the X25519 exchange, bound to
+// Options.RoomSecret when there is one
+func (c *Connection) linkKey(ke *protocol.KeyExchange, peerPK []byte) ([32]byte, error) {
+	key, err := ke.ComputeSharedSecret(peerPK)
+	if err != nil || c.opts.RoomSecret == "" {
+		return key, err
+	}
+	return protocol.MixRoomSecret(key, c.opts.RoomSecret, ke.PublicKey[:], peerPK)
+}
+
+// rekeyLoop starts a fresh key exchange on the live link every
+// RekeyInterval. The peer answers it in handlePeerKeyExchange, the same
+// way it answers a reconnected peer, and the WebSocket stays up.
+func (c *Connection) rekeyLoop() {
+	ticker := time.NewTicker(c.opts.RekeyInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			return
+		}
+
+		c.stateMu.Lock()
+		l, busy := c.link, c.reconnecting != nil || c.failed != nil
+		c.stateMu.Unlock()
+		// Peers from before the Hello handshake don't re-key mid-stream
+		if busy || c.Capabilities().Version < 1 {
+			continue
+		}
+		if err := c.startRotation(l); err != nil {
+			fmt.Printf("⚠️ Key rotation failed: %v\n", err)
+		}
+	}
+}
+
+// startRotation sends a new public key on l, and again until the peer
+// answers, replacing a rotation still waiting for its answer
+func (c *Connection) startRotation(l *link) error {
+	ke, err := protocol.NewKeyExchange(c.roomID)
+	if err != nil {
+		return err
+	}
+	answered := make(chan struct{})
+	r := &c.rotation
+	r.mu.Lock()
+	r.end()
+	r.ke, r.link, r.answered = ke, l, answered
+	r.mu.Unlock()
+
+	publicKey := ke.GetPublicKeyHex()
+	if err := c.sendPublicKey(l, publicKey, false); err != nil {
+		return err
+	}
+	go c.retransmit("key rotation", answered, func() error {
+		return c.sendPublicKey(l, publicKey, false)
+	})
+	return nil
+}
+
+// finishRotation completes our pending rotation on l with the peer's
+// answer. Reports whether there was one to complete.
+func (c *Connection) finishRotation(l *link, peerPK []byte) bool {
+	r := &c.rotation
+	r.mu.Lock()
+	ke := r.ke
+	if ke == nil || r.link != l {
+		r.mu.Unlock()
+		return false
+	}
+	r.end()
+	r.mu.Unlock()
+
+	publicKey := ke.GetPublicKeyHex()
+	key, err := c.linkKey(ke, peerPK)
+	if err == nil {
+		err = c.switchKey(l, key, peerPK, publicKey)
+	}
+	if err != nil {
+		fmt.Printf("❌ Key rotation failed: %v\n", err)
+		return true
+	}
+	// Sent again in case the answer was really a reconnected peer's
+	// opening key, which waits for ours; an answering peer ignores it
+	if err := c.sendPublicKey(l, publicKey, true); err != nil {
+		c.linkFailed(l, err)
+		return true
+	}
+	fmt.Println("🔄 Link key rotated")
+	return true
+}
+
+// switchKey replaces l with a link under key, agreed from our publicKey and
+// the peer's peerPK, on the same WebSocket. The old key still decrypts
+// messages that were already in flight.
+func (c *Connection) switchKey(l *link, key [32]byte, peerPK []byte, publicKey string) error {
+	cipher, err := protocol.NewWasifVernam(key)
+	if err != nil {
+		return err
+	}
+	c.stateMu.Lock()
+	if c.link == l {
+		c.link = &link{ws: l.ws, cipher: cipher, prevCipher: l.cipher, peerPK: peerPK, publicKey: publicKey, lastPong: l.lastPong, lastPeer: l.lastPeer}
+	}
+	c.stateMu.Unlock()
+	return nil
+}
+
+// sendPublicKey writes a key_exchange message with publicKey on l, marked
+// as the answer to the peer's if reply is set
+func (c *Connection) sendPublicKey(l *link, publicKey string, reply bool) error {
+	msg, _ := json.Marshal(KeyExchangeMessage{
+		Type:      "key_exchange",
+		PublicKey: publicKey,
+		Reply:     reply,
+	})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return l.ws.WriteMessage(websocket.TextMessage, msg)
+}
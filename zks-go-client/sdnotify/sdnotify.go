@@ -0,0 +1,84 @@
+// Package sdnotify is the client side of systemd's sd_notify protocol, for
+// running under a unit like:
+//
+//	[Service]
+//	Type=notify
+//	ExecStart=/usr/local/bin/zks-vpn --config /etc/zks-vpn.conf
+//	WatchdogSec=30
+//
+// Everything is a no-op when the process wasn't started by systemd.
+package sdnotify
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Notify sends state (e.g. "READY=1") to systemd. It reports false when
+// there is no NOTIFY_SOCKET to send to.
+func Notify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	// A leading @ is an abstract socket
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Ready tells systemd the service is up
+func Ready() {
+	Notify("READY=1")
+}
+
+// Stopping tells systemd the service is shutting down
+func Stopping() {
+	Notify("STOPPING=1")
+}
+
+// Managed reports whether systemd is listening for notifications, or
+// capturing output into the journal
+func Managed() bool {
+	return os.Getenv("NOTIFY_SOCKET") != "" || os.Getenv("JOURNAL_STREAM") != ""
+}
+
+// WatchdogInterval is the WatchdogSec= of the unit, or 0 when the
+// watchdog is off or meant for another process
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// StartWatchdog pings the watchdog at half its interval until the process
+// exits. It does nothing when the watchdog is off.
+func StartWatchdog() {
+	interval := WatchdogInterval()
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		for range ticker.C {
+			Notify("WATCHDOG=1")
+		}
+	}()
+}
@@ -0,0 +1,157 @@
+package selftest
+
+import (
+	"encoding/binary"
+	"net/netip"
+)
+
+const (
+	protoICMP byte = 1
+	protoTCP  byte = 6
+	protoUDP  byte = 17
+
+	icmpEchoReply   = 0
+	icmpEchoRequest = 8
+
+	tcpSYN byte = 0x02
+	tcpRST byte = 0x04
+	tcpPSH byte = 0x08
+	tcpACK byte = 0x10
+)
+
+// packet is what the test needs to know about a reply from the exit
+type packet struct {
+	proto    byte
+	src, dst netip.AddrPort // Ports are 0 for ICMP
+	payload  []byte         // Of the transport protocol
+
+	// TCP only
+	flags    byte
+	seq, ack uint32
+
+	// ICMP only
+	icmpType byte
+	echoID   uint16
+}
+
+// parsePacket reads an IPv4 reply. Anything else is reported as not ok.
+func parsePacket(b []byte) (packet, bool) {
+	if len(b) < 20 || b[0]>>4 != 4 {
+		return packet{}, false
+	}
+	ihl := int(b[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(b[2:4]))
+	if ihl < 20 || total < ihl || total > len(b) {
+		return packet{}, false
+	}
+	p := packet{proto: b[9]}
+	src := netip.AddrFrom4([4]byte(b[12:16]))
+	dst := netip.AddrFrom4([4]byte(b[16:20]))
+	l4 := b[ihl:total]
+
+	switch p.proto {
+	case protoUDP:
+		if len(l4) < 8 {
+			return packet{}, false
+		}
+		p.payload = l4[8:]
+	case protoTCP:
+		if len(l4) < 20 || int(l4[12]>>4)*4 > len(l4) {
+			return packet{}, false
+		}
+		p.seq = binary.BigEndian.Uint32(l4[4:8])
+		p.ack = binary.BigEndian.Uint32(l4[8:12])
+		p.flags = l4[13]
+		p.payload = l4[int(l4[12]>>4)*4:]
+	case protoICMP:
+		if len(l4) < 8 {
+			return packet{}, false
+		}
+		p.icmpType = l4[0]
+		p.echoID = binary.BigEndian.Uint16(l4[4:6])
+		p.payload = l4[8:]
+		p.src, p.dst = netip.AddrPortFrom(src, 0), netip.AddrPortFrom(dst, 0)
+		return p, true
+	default:
+		return packet{}, false
+	}
+	p.src = netip.AddrPortFrom(src, binary.BigEndian.Uint16(l4[0:2]))
+	p.dst = netip.AddrPortFrom(dst, binary.BigEndian.Uint16(l4[2:4]))
+	return p, true
+}
+
+// buildIPv4 wraps payload in an IPv4 header
+func buildIPv4(proto byte, src, dst netip.Addr, payload []byte) []byte {
+	pkt := make([]byte, 20+len(payload))
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	pkt[8] = 64
+	pkt[9] = proto
+	copy(pkt[12:16], src.AsSlice())
+	copy(pkt[16:20], dst.AsSlice())
+	binary.BigEndian.PutUint16(pkt[10:12], checksum(pkt[:20], 0))
+	copy(pkt[20:], payload)
+	return pkt
+}
+
+// buildUDP builds a complete IPv4/UDP packet
+func buildUDP(src, dst netip.AddrPort, payload []byte) []byte {
+	udp := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint16(udp[0:2], src.Port())
+	binary.BigEndian.PutUint16(udp[2:4], dst.Port())
+	binary.BigEndian.PutUint16(udp[4:6], uint16(len(udp)))
+	copy(udp[8:], payload)
+	binary.BigEndian.PutUint16(udp[6:8], checksum(udp, pseudoHeaderSum(protoUDP, src.Addr(), dst.Addr(), len(udp))))
+	return buildIPv4(protoUDP, src.Addr(), dst.Addr(), udp)
+}
+
+// buildTCP builds an IPv4/TCP segment without options
+func buildTCP(src, dst netip.AddrPort, seq, ack uint32, flags byte, payload []byte) []byte {
+	tcp := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:2], src.Port())
+	binary.BigEndian.PutUint16(tcp[2:4], dst.Port())
+	binary.BigEndian.PutUint32(tcp[4:8], seq)
+	binary.BigEndian.PutUint32(tcp[8:12], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:16], 65535)
+	copy(tcp[20:], payload)
+	binary.BigEndian.PutUint16(tcp[16:18], checksum(tcp, pseudoHeaderSum(protoTCP, src.Addr(), dst.Addr(), len(tcp))))
+	return buildIPv4(protoTCP, src.Addr(), dst.Addr(), tcp)
+}
+
+// buildEchoRequest builds an IPv4 ICMP echo request
+func buildEchoRequest(src, dst netip.Addr, id, seq uint16, payload []byte) []byte {
+	msg := make([]byte, 8+len(payload))
+	msg[0] = icmpEchoRequest
+	binary.BigEndian.PutUint16(msg[4:6], id)
+	binary.BigEndian.PutUint16(msg[6:8], seq)
+	copy(msg[8:], payload)
+	binary.BigEndian.PutUint16(msg[2:4], checksum(msg, 0))
+	return buildIPv4(protoICMP, src, dst, msg)
+}
+
+// checksum computes the Internet checksum (RFC 1071) over b, seeded with initial
+func checksum(b []byte, initial uint32) uint16 {
+	sum := initial
+	for len(b) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
+
+// pseudoHeaderSum returns the partial sum of the IPv4 pseudo-header used by TCP/UDP
+func pseudoHeaderSum(proto byte, src, dst netip.Addr, length int) uint32 {
+	s, d := src.As4(), dst.As4()
+	sum := uint32(binary.BigEndian.Uint16(s[0:2])) + uint32(binary.BigEndian.Uint16(s[2:4]))
+	sum += uint32(binary.BigEndian.Uint16(d[0:2])) + uint32(binary.BigEndian.Uint16(d[2:4]))
+	sum += uint32(proto) + uint32(length)
+	return sum
+}
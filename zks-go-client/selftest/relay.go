@@ -0,0 +1,130 @@
+package selftest
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/zks-vpn/zks-go-client/relay"
+)
+
+// loopRelay is a minimal stand-in for the ZKS relay on 127.0.0.1: it pairs
+// the client and the exit of a room and copies every WebSocket message
+// between them, holding messages until the other side has joined
+type loopRelay struct {
+	ln       net.Listener
+	upgrader websocket.Upgrader
+
+	mu    sync.Mutex
+	rooms map[string]*loopRoom
+}
+
+type loopRoom struct {
+	peers   map[string]*loopPeer // By role
+	pending map[string][]loopMessage
+}
+
+type loopPeer struct {
+	ws *websocket.Conn
+	mu sync.Mutex // Serializes writes
+}
+
+type loopMessage struct {
+	kind int
+	data []byte
+}
+
+// startRelay listens on a free loopback port and serves rooms until close
+func startRelay() (*loopRelay, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	r := &loopRelay{ln: ln, rooms: make(map[string]*loopRoom)}
+	go http.Serve(ln, r)
+	return r, nil
+}
+
+// URL is the relay's address in --relay form
+func (r *loopRelay) URL() string {
+	return "ws://" + r.ln.Addr().String()
+}
+
+func (r *loopRelay) close() {
+	r.ln.Close()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, room := range r.rooms {
+		for _, p := range room.peers {
+			p.ws.Close()
+		}
+	}
+}
+
+func (r *loopRelay) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	roomID, ok := strings.CutPrefix(req.URL.Path, "/room/")
+	role := req.URL.Query().Get("role")
+	if !ok || roomID == "" || role == "" {
+		http.NotFound(w, req)
+		return
+	}
+	ws, err := r.upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		return
+	}
+	peer := &loopPeer{ws: ws}
+
+	// Deliver what the other side sent before we joined
+	r.mu.Lock()
+	room := r.rooms[roomID]
+	if room == nil {
+		room = &loopRoom{peers: make(map[string]*loopPeer), pending: make(map[string][]loopMessage)}
+		r.rooms[roomID] = room
+	}
+	room.peers[role] = peer
+	backlog := room.pending[role]
+	delete(room.pending, role)
+	peer.mu.Lock()
+	r.mu.Unlock()
+	for _, m := range backlog {
+		ws.WriteMessage(m.kind, m.data)
+	}
+	peer.mu.Unlock()
+
+	for {
+		kind, data, err := ws.ReadMessage()
+		if err != nil {
+			break
+		}
+		r.forward(room, role, loopMessage{kind, data})
+	}
+
+	r.mu.Lock()
+	if room.peers[role] == peer {
+		delete(room.peers, role)
+	}
+	r.mu.Unlock()
+	ws.Close()
+}
+
+// forward sends m from the peer with role from to the other side of room
+func (r *loopRelay) forward(room *loopRoom, from string, m loopMessage) {
+	to := string(relay.RoleClient)
+	if from == to {
+		to = string(relay.RoleExitPeer)
+	}
+
+	r.mu.Lock()
+	peer := room.peers[to]
+	if peer == nil {
+		room.pending[to] = append(room.pending[to], m)
+		r.mu.Unlock()
+		return
+	}
+	peer.mu.Lock()
+	r.mu.Unlock()
+	peer.ws.WriteMessage(m.kind, m.data)
+	peer.mu.Unlock()
+}
@@ -0,0 +1,413 @@
+// Package selftest runs the whole packet path inside one process
+// (--mode selftest), for CI and for checking a build before deploying it.
+// A loopback relay joins an in-process Exit Peer and a client transport
+// stack like p2p-vpn's (compression, fragmentation, PSK encryption,
+// sequencing); crafted packets then go through it to echo servers on
+// 127.0.0.1 and their replies are checked. No TUN is opened, so it needs
+// no Administrator/root rights.
+package selftest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/zks-vpn/zks-go-client/exit"
+	"github.com/zks-vpn/zks-go-client/metrics"
+	"github.com/zks-vpn/zks-go-client/protocol"
+	"github.com/zks-vpn/zks-go-client/relay"
+	"github.com/zks-vpn/zks-go-client/vpn"
+	"golang.org/x/net/icmp"
+)
+
+const (
+	roomID = "zks-selftest"
+	psk    = "zks-selftest"
+
+	// fragmentSize is small enough that the large UDP stage is split and
+	// reassembled in both directions
+	fragmentSize = 512
+
+	connectTimeout = 10 * time.Second
+	stageTimeout   = 5 * time.Second
+)
+
+var (
+	clientIP  = netip.MustParseAddr(vpn.DefaultIP)
+	localhost = netip.MustParseAddr("127.0.0.1")
+)
+
+// errSkipped marks a stage the host can't run; it doesn't fail the test
+type errSkipped struct{ reason string }
+
+func (e errSkipped) Error() string { return e.reason }
+
+// harness is the client end of the tunnel plus the echo servers behind the exit
+type harness struct {
+	transport vpn.Transport
+	replies   chan []byte
+
+	tcpEcho netip.AddrPort
+	udpEcho netip.AddrPort
+
+	// TCP state handed from the handshake stage to the data stage
+	tcpClient      netip.AddrPort
+	tcpSeq, tcpAck uint32
+}
+
+type stage struct {
+	name string
+	run  func(h *harness) error
+}
+
+var stages = []stage{
+	{"UDP echo, batched", (*harness).udpBatch},
+	{"UDP echo, fragmented", (*harness).udpFragmented},
+	{"ICMP echo", (*harness).icmpEcho},
+	{"TCP handshake", (*harness).tcpHandshake},
+	{"TCP data", (*harness).tcpData},
+}
+
+// Run runs every stage and reports each one. It returns the exit code:
+// 0 if none failed.
+func Run() int {
+	fmt.Println("\n🧪 Self-test: loopback relay, in-process Exit Peer, no TUN")
+
+	h, stop, err := start()
+	if err != nil {
+		fmt.Printf("   ❌ Setup: %v\n", err)
+		fmt.Println("❌ Self-test failed")
+		return 1
+	}
+	defer stop()
+	fmt.Println("   ✅ Relay handshake and Exit Peer")
+
+	failed, skipped := 0, 0
+	for _, s := range stages {
+		began := time.Now()
+		err := s.run(h)
+		var skip errSkipped
+		switch {
+		case err == nil:
+			fmt.Printf("   ✅ %s (%s)\n", s.name, time.Since(began).Round(time.Millisecond))
+		case errors.As(err, &skip):
+			fmt.Printf("   ⏭️  %s: skipped, %v\n", s.name, err)
+			skipped++
+		default:
+			fmt.Printf("   ❌ %s: %v\n", s.name, err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		fmt.Printf("❌ Self-test failed: %d of %d stages\n", failed, len(stages))
+		return 1
+	}
+	fmt.Printf("✅ Self-test passed (%d stages, %d skipped)\n", len(stages)-skipped, skipped)
+	return 0
+}
+
+// start brings up the relay, the echo servers, the Exit Peer and the
+// client transport. stop tears them all down.
+func start() (*harness, func(), error) {
+	var cleanup []func()
+	stop := func() {
+		for i := len(cleanup) - 1; i >= 0; i-- {
+			cleanup[i]()
+		}
+	}
+	fail := func(err error) (*harness, func(), error) {
+		stop()
+		return nil, nil, err
+	}
+
+	h := &harness{replies: make(chan []byte, 256)}
+	tcpLn, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		return fail(err)
+	}
+	cleanup = append(cleanup, func() { tcpLn.Close() })
+	udpConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		return fail(err)
+	}
+	cleanup = append(cleanup, func() { udpConn.Close() })
+	go serveTCPEcho(tcpLn)
+	go serveUDPEcho(udpConn)
+	h.tcpEcho = tcpLn.Addr().(*net.TCPAddr).AddrPort()
+	h.udpEcho = udpConn.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	r, err := startRelay()
+	if err != nil {
+		return fail(err)
+	}
+	cleanup = append(cleanup, r.close)
+
+	// Each side's key exchange waits for the other, so both dial at once
+	opts := relay.Options{
+		KeepaliveInterval: -1,
+		Features:          protocol.FeatureBatching | protocol.FeatureCompression,
+	}
+	exitOpts := opts
+	exitOpts.Features |= protocol.FeatureLease
+	clientOpts := opts
+	clientOpts.LocalIP = clientIP.String()
+
+	type dialResult struct {
+		conn *relay.Connection
+		err  error
+	}
+	exitDialed := make(chan dialResult, 1)
+	go func() {
+		conn, err := relay.ConnectWithOptions(r.URL(), roomID, relay.RoleExitPeer, exitOpts)
+		exitDialed <- dialResult{conn, err}
+	}()
+	clientDialed := make(chan dialResult, 1)
+	go func() {
+		conn, err := relay.ConnectWithOptions(r.URL(), roomID, relay.RoleClient, clientOpts)
+		clientDialed <- dialResult{conn, err}
+	}()
+
+	var exitConn, clientConn *relay.Connection
+	timeout := time.After(connectTimeout)
+	for exitConn == nil || clientConn == nil {
+		var res dialResult
+		var side string
+		select {
+		case res = <-exitDialed:
+			side = "exit"
+			exitConn = res.conn
+		case res = <-clientDialed:
+			side = "client"
+			clientConn = res.conn
+		case <-timeout:
+			return fail(fmt.Errorf("relay handshake took longer than %s", connectTimeout))
+		}
+		if res.err != nil {
+			return fail(fmt.Errorf("%s relay connect: %w", side, res.err))
+		}
+		cleanup = append(cleanup, res.conn.Close)
+	}
+
+	exitPeer, err := exit.NewExitPeer(exitConn, exit.Options{
+		PSK:          psk,
+		FragmentSize: fragmentSize,
+		Compress:     true,
+		Sequence:     true,
+	})
+	if err != nil {
+		return fail(fmt.Errorf("exit peer: %w", err))
+	}
+	go exitPeer.Start()
+	cleanup = append(cleanup, exitPeer.Stop)
+
+	// The same stack runP2PVPN builds
+	var transport vpn.Transport = vpn.NewRelayTransportWithOptions(clientConn, vpn.RelayTransportOptions{Compress: true})
+	transport, err = vpn.NewFragmentingTransport(transport, vpn.FragmentOptions{MaxPacket: fragmentSize})
+	if err != nil {
+		return fail(err)
+	}
+	transport, err = vpn.NewEncryptedTransport(transport, roomID, psk)
+	if err != nil {
+		return fail(err)
+	}
+	h.transport = vpn.NewSequencedTransport(transport, vpn.SequencedTransportOptions{})
+	go h.recvLoop()
+	return h, stop, nil
+}
+
+// recvLoop hands every packet from the exit to expect
+func (h *harness) recvLoop() {
+	for {
+		packets, err := h.transport.RecvBatch()
+		if err != nil {
+			return
+		}
+		for _, pkt := range packets {
+			select {
+			case h.replies <- pkt:
+			default: // Nobody is waiting for this many
+			}
+		}
+	}
+}
+
+// expect waits for a reply that match accepts, discarding the others
+func (h *harness) expect(what string, match func(p packet) bool) (packet, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), stageTimeout)
+	defer cancel()
+	for {
+		select {
+		case raw := <-h.replies:
+			if p, ok := parsePacket(raw); ok && match(p) {
+				return p, nil
+			}
+		case <-ctx.Done():
+			return packet{}, fmt.Errorf("no %s within %s", what, stageTimeout)
+		}
+	}
+}
+
+func (h *harness) send(packets ...[]byte) error {
+	if err := h.transport.SendBatch(packets); err != nil {
+		return fmt.Errorf("send: %w", err)
+	}
+	return nil
+}
+
+// udpBatch sends several datagrams in one batch and wants every echo back
+func (h *harness) udpBatch() error {
+	const n = 8
+	src := netip.AddrPortFrom(clientIP, 40000)
+	want := make(map[string]bool, n)
+	var batch [][]byte
+	for i := range n {
+		payload := fmt.Sprintf("zks-selftest-%d", i)
+		want[payload] = true
+		batch = append(batch, buildUDP(src, h.udpEcho, []byte(payload)))
+	}
+	if err := h.send(batch...); err != nil {
+		return err
+	}
+	for len(want) > 0 {
+		p, err := h.expect("UDP echo", func(p packet) bool {
+			return p.proto == protoUDP && p.src == h.udpEcho && p.dst == src && want[string(p.payload)]
+		})
+		if err != nil {
+			return fmt.Errorf("%w (%d of %d came back)", err, n-len(want), n)
+		}
+		delete(want, string(p.payload))
+	}
+	return nil
+}
+
+// udpFragmented echoes a datagram larger than fragmentSize, so it is split
+// into tunnel fragments and reassembled on the way out and back
+func (h *harness) udpFragmented() error {
+	src := netip.AddrPortFrom(clientIP, 40001)
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 80)
+	before := metrics.FragmentedPackets.Load()
+	if err := h.send(buildUDP(src, h.udpEcho, payload)); err != nil {
+		return err
+	}
+	_, err := h.expect("reassembled UDP echo", func(p packet) bool {
+		return p.proto == protoUDP && p.src == h.udpEcho && p.dst == src && bytes.Equal(p.payload, payload)
+	})
+	if err != nil {
+		return err
+	}
+	if n := metrics.FragmentedPackets.Load() - before; n < 2 {
+		return fmt.Errorf("expected the datagram to be fragmented both ways, got %d fragmented packets", n)
+	}
+	return nil
+}
+
+// icmpEcho pings 127.0.0.1 through the exit's ping socket
+func (h *harness) icmpEcho() error {
+	if !pingAvailable() {
+		return errSkipped{"this host has no ping socket (sysctl net.ipv4.ping_group_range) and no raw ICMP access"}
+	}
+	const id = 0x5a4b
+	payload := []byte("zks-selftest-ping")
+	if err := h.send(buildEchoRequest(clientIP, localhost, id, 1, payload)); err != nil {
+		return err
+	}
+	_, err := h.expect("echo reply", func(p packet) bool {
+		return p.proto == protoICMP && p.icmpType == icmpEchoReply && p.echoID == id &&
+			p.src.Addr() == localhost && p.dst.Addr() == clientIP && bytes.Equal(p.payload, payload)
+	})
+	return err
+}
+
+// pingAvailable reports whether the exit can open an ICMP socket here
+func pingAvailable() bool {
+	for _, network := range []string{"udp4", "ip4:icmp"} {
+		if conn, err := icmp.ListenPacket(network, "127.0.0.1"); err == nil {
+			conn.Close()
+			return true
+		}
+	}
+	return false
+}
+
+// tcpHandshake sends a SYN to the TCP echo server and wants the SYN-ACK
+func (h *harness) tcpHandshake() error {
+	h.tcpClient = netip.AddrPortFrom(clientIP, 40002)
+	const iss = 1000
+	if err := h.send(buildTCP(h.tcpClient, h.tcpEcho, iss, 0, tcpSYN, nil)); err != nil {
+		return err
+	}
+	p, err := h.expect("SYN-ACK", func(p packet) bool {
+		return p.proto == protoTCP && p.src == h.tcpEcho && p.dst == h.tcpClient && p.flags&(tcpSYN|tcpRST) != 0
+	})
+	if err != nil {
+		return err
+	}
+	if p.flags&tcpRST != 0 {
+		return errors.New("connection refused (RST)")
+	}
+	if p.flags&tcpACK == 0 || p.ack != iss+1 {
+		return fmt.Errorf("bad SYN-ACK: flags 0x%02x, ack %d (want %d)", p.flags, p.ack, iss+1)
+	}
+	h.tcpSeq, h.tcpAck = iss+1, p.seq+1
+	return nil
+}
+
+// tcpData sends data on the handshaken connection and wants it echoed
+func (h *harness) tcpData() error {
+	if h.tcpAck == 0 {
+		return errors.New("needs the TCP handshake")
+	}
+	payload := []byte("zks-selftest-tcp")
+	if err := h.send(buildTCP(h.tcpClient, h.tcpEcho, h.tcpSeq, h.tcpAck, tcpACK|tcpPSH, payload)); err != nil {
+		return err
+	}
+	defer h.send(buildTCP(h.tcpClient, h.tcpEcho, h.tcpSeq+uint32(len(payload)), 0, tcpRST, nil))
+
+	var echoed []byte
+	for len(echoed) < len(payload) {
+		p, err := h.expect("TCP echo", func(p packet) bool {
+			return p.proto == protoTCP && p.src == h.tcpEcho && p.dst == h.tcpClient && (len(p.payload) > 0 || p.flags&tcpRST != 0)
+		})
+		if err != nil {
+			return err
+		}
+		if p.flags&tcpRST != 0 {
+			return errors.New("connection reset by the exit")
+		}
+		echoed = append(echoed, p.payload...)
+	}
+	if !bytes.Equal(echoed, payload) {
+		return fmt.Errorf("echo mismatch: got %q, want %q", echoed, payload)
+	}
+	return nil
+}
+
+func serveTCPEcho(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}()
+	}
+}
+
+func serveUDPEcho(conn net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		conn.WriteTo(buf[:n], addr)
+	}
+}
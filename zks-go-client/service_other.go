@@ -0,0 +1,25 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/zks-vpn/zks-go-client/config"
+)
+
+// Elsewhere a unit file or launchd plist runs the client as a daemon; the
+// client stops cleanly on the SIGTERM they send
+
+func installService(configPath string) int {
+	fmt.Println("❌ --service is only supported on Windows; use systemd, launchd or similar")
+	return 1
+}
+
+func uninstallService() int {
+	return installService("")
+}
+
+func runService(cfg *config.Config) int {
+	return installService("")
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zks-vpn/zks-go-client/config"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const (
+	serviceName        = "zks-vpn"
+	serviceDisplayName = "ZKS-VPN Client"
+	// serviceStopTimeout is how long routes and DNS get to be restored
+	// before the service gives up waiting and reports itself stopped
+	serviceStopTimeout = 20 * time.Second
+)
+
+// installService registers the current command line (minus --service) as
+// an auto-start service, logging to the event log under serviceName
+func installService(configPath string) int {
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		return 1
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		fmt.Printf("❌ Can't reach the Service Control Manager (run as Administrator): %v\n", err)
+		return 1
+	}
+	defer m.Disconnect()
+
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		fmt.Printf("❌ Service %s is already installed; run --service uninstall first\n", serviceName)
+		return 1
+	}
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: serviceDisplayName,
+		Description: "Zero Knowledge Swarm VPN tunnel",
+		StartType:   mgr.StartAutomatic,
+	}, serviceArgs(configPath)...)
+	if err != nil {
+		fmt.Printf("❌ Failed to create service: %v\n", err)
+		return 1
+	}
+	defer s.Close()
+
+	// Restart after a crash or a fatal error, but not after a stop
+	s.SetRecoveryActions([]mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: 10 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: 30 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: time.Minute},
+	}, uint32((24 * time.Hour).Seconds()))
+
+	if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		// Usually left over from an earlier install; the service still logs
+		fmt.Printf("⚠️ Event log source not registered: %v\n", err)
+	}
+	fmt.Printf("✅ Service %s installed; it starts at boot, or now with: sc start %s\n", serviceName, serviceName)
+	return 0
+}
+
+// uninstallService stops and removes the service
+func uninstallService() int {
+	m, err := mgr.Connect()
+	if err != nil {
+		fmt.Printf("❌ Can't reach the Service Control Manager (run as Administrator): %v\n", err)
+		return 1
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		fmt.Printf("❌ Service %s is not installed\n", serviceName)
+		return 1
+	}
+	defer s.Close()
+
+	// A running service has routes to restore, so let it stop cleanly first
+	if status, err := s.Control(svc.Stop); err == nil {
+		deadline := time.Now().Add(serviceStopTimeout)
+		for status.State != svc.Stopped && time.Now().Before(deadline) {
+			time.Sleep(300 * time.Millisecond)
+			if status, err = s.Query(); err != nil {
+				break
+			}
+		}
+	}
+	if err := s.Delete(); err != nil {
+		fmt.Printf("❌ Failed to remove service: %v\n", err)
+		return 1
+	}
+	eventlog.Remove(serviceName)
+	fmt.Printf("✅ Service %s removed\n", serviceName)
+	return 0
+}
+
+// serviceArgs is the command line the service starts with: the flags given
+// explicitly here, with --config made absolute since services start in System32
+func serviceArgs(configPath string) []string {
+	var args []string
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "service", "check":
+		case "config":
+			if abs, err := filepath.Abs(configPath); err == nil {
+				configPath = abs
+			}
+			args = append(args, "--config="+configPath)
+		default:
+			args = append(args, "--"+f.Name+"="+f.Value.String())
+		}
+	})
+	return append(args, "--service=run")
+}
+
+// runService runs cfg's mode under the Service Control Manager
+func runService(cfg *config.Config) int {
+	if ok, err := svc.IsWindowsService(); err != nil || !ok {
+		fmt.Println("❌ --service run is for the Service Control Manager; start the service with: sc start " + serviceName)
+		return 1
+	}
+	elog, err := eventlog.Open(serviceName)
+	if err == nil {
+		defer elog.Close()
+		logToEventLog(elog)
+	}
+	if err := svc.Run(serviceName, &service{cfg: cfg}); err != nil {
+		if elog != nil {
+			elog.Error(1, fmt.Sprintf("Service failed: %v", err))
+		}
+		return 1
+	}
+	return 0
+}
+
+// logToEventLog sends everything the client prints to the event log, one
+// entry per line. A service has no console to print to.
+func logToEventLog(elog *eventlog.Log) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return
+	}
+	os.Stdout, os.Stderr = w, w
+	log.SetOutput(w)
+
+	go func() {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			switch {
+			case line == "":
+			case strings.HasPrefix(line, "❌"):
+				elog.Error(1, line)
+			case strings.HasPrefix(line, "⚠️"):
+				elog.Warning(1, line)
+			default:
+				elog.Info(1, line)
+			}
+		}
+	}()
+}
+
+// service is the svc.Handler running one mode
+type service struct {
+	cfg *config.Config
+}
+
+func (s *service) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+
+	// The mode is done when run returns or its shutdown has cleaned up
+	done := make(chan struct{})
+	var once sync.Once
+	finished := func() { once.Do(func() { close(done) }) }
+	exitOnShutdown = func() {
+		finished()
+		select {} // The process ends when Execute returns
+	}
+	go func() {
+		run(s.cfg)
+		finished()
+	}()
+
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				changes <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				fmt.Println("⏹️  Service stop requested")
+				changes <- svc.Status{State: svc.StopPending, WaitHint: uint32(serviceStopTimeout / time.Millisecond)}
+				if requestShutdown() {
+					select {
+					case <-done:
+					case <-time.After(serviceStopTimeout):
+						fmt.Println("⚠️ Shutdown timed out; stopping anyway")
+					}
+				}
+				return false, 0
+			}
+		case <-done:
+			return false, 0
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// unixPrefix marks a listen address as a Unix domain socket path
+const unixPrefix = "unix:"
+
+// DefaultSocketMode leaves a Unix socket usable by its owner only
+const DefaultSocketMode os.FileMode = 0o600
+
+// Listen listens on addr: "host:port" for TCP, or "unix:/path" for a Unix
+// domain socket created with mode (0 = DefaultSocketMode). A socket file
+// left behind by a crashed run is replaced; one still in use is not.
+// Closing the listener removes the socket file.
+func Listen(addr string, mode os.FileMode) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, unixPrefix)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if path == "" {
+		return nil, fmt.Errorf("empty Unix socket path in %q", addr)
+	}
+	if mode == 0 {
+		mode = DefaultSocketMode
+	}
+
+	ln, err := net.Listen("unix", path)
+	if errors.Is(err, syscall.EADDRINUSE) && staleSocket(path) {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+		ln, err = net.Listen("unix", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("failed to set mode %o on %s: %w", mode, path, err)
+	}
+	return ln, nil
+}
+
+// staleSocket reports whether path is a socket nobody accepts on
+func staleSocket(path string) bool {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return false
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		return true
+	}
+	conn.Close()
+	return false
+}
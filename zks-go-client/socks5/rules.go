@@ -0,0 +1,108 @@
+package socks5
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Rules restricts the destinations clients may reach. Entries are IPs,
+// CIDRs ("10.0.0.0/8"), domains ("example.com") or wildcard domains
+// ("*.example.com", which matches any subdomain but not example.com itself).
+//
+// A destination is refused if it matches a deny entry, or if there are
+// allow entries and it matches none of them. Destinations are matched as
+// the client sent them: names are not resolved here (that happens at the
+// Exit Peer), so IP and CIDR entries only apply to requests by address.
+type Rules struct {
+	allow, deny ruleList
+}
+
+type ruleList struct {
+	prefixes []netip.Prefix
+	domains  []string // Exact, lower case
+	suffixes []string // From wildcards, with the leading dot: ".example.com"
+}
+
+// ParseRules builds Rules from allow and deny entries. Both empty gives nil,
+// which permits everything.
+func ParseRules(allow, deny []string) (*Rules, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	r := &Rules{}
+	if err := r.allow.add(allow); err != nil {
+		return nil, err
+	}
+	if err := r.deny.add(deny); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (l *ruleList) add(entries []string) error {
+	for _, e := range entries {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if prefix, err := netip.ParsePrefix(e); err == nil {
+			l.prefixes = append(l.prefixes, prefix.Masked())
+			continue
+		}
+		if addr, err := netip.ParseAddr(e); err == nil {
+			l.prefixes = append(l.prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		domain := strings.TrimSuffix(e, ".")
+		wildcard := strings.HasPrefix(domain, "*.")
+		domain = strings.TrimPrefix(domain, "*.")
+		if domain == "" || strings.ContainsAny(domain, "*/: ") {
+			return fmt.Errorf("invalid destination rule %q: want an IP, CIDR, domain or *.domain", e)
+		}
+		if wildcard {
+			l.suffixes = append(l.suffixes, "."+domain)
+		} else {
+			l.domains = append(l.domains, domain)
+		}
+	}
+	return nil
+}
+
+func (l *ruleList) empty() bool {
+	return len(l.prefixes) == 0 && len(l.domains) == 0 && len(l.suffixes) == 0
+}
+
+func (l *ruleList) match(host string) bool {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addr = addr.Unmap()
+		for _, p := range l.prefixes {
+			if p.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, d := range l.domains {
+		if host == d {
+			return true
+		}
+	}
+	for _, s := range l.suffixes {
+		if strings.HasSuffix(host, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Permits reports whether clients may reach host. A nil Rules permits everything.
+func (r *Rules) Permits(host string) bool {
+	if r == nil {
+		return true
+	}
+	if r.deny.match(host) {
+		return false
+	}
+	return r.allow.empty() || r.allow.match(host)
+}
@@ -2,72 +2,236 @@
 package socks5
 
 import (
+	"crypto/subtle"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/zks-vpn/zks-go-client/metrics"
 	"github.com/zks-vpn/zks-go-client/protocol"
 	"github.com/zks-vpn/zks-go-client/relay"
 )
 
+// SOCKS5 commands this server supports
+const (
+	cmdConnect      = 0x01
+	cmdUDPAssociate = 0x03
+)
+
+// SOCKS5 authentication methods (RFC 1928) and the RFC 1929 sub-negotiation
+const (
+	methodNoAuth       = 0x00
+	methodUserPass     = 0x02
+	methodNoAcceptable = 0xFF
+
+	userPassVersion = 0x01
+	authSuccess     = 0x00
+	authFailure     = 0x01
+)
+
+// DefaultShutdownGrace is how long Stop lets in-flight connections finish
+const DefaultShutdownGrace = 5 * time.Second
+
+// DefaultIdleTimeout is how long a proxied connection may carry no data
+const DefaultIdleTimeout = 5 * time.Minute
+
+// connectTimeout is how long the Exit Peer has to accept a CONNECT
+const connectTimeout = 30 * time.Second
+
+// errStopped means Stop force-closed the connection while it was connecting
+var errStopped = errors.New("SOCKS5 server stopped")
+
+// copyBufSize is the most of a client's stream one Data message carries.
+// Every byte is copied three times on its way into the tunnel: socket to
+// this buffer, into the Data framing, and encrypted into the WebSocket
+// message. splice(2) can't skip any of them since the relay encrypts in
+// user space, but reads up to ~2 KB frame and encrypt into pooled buffers
+// (see protocol.EncoderTo), and the read buffers themselves are pooled.
+const copyBufSize = 32 * 1024
+
+// copyBufs recycles the client read buffers across connections
+var copyBufs = sync.Pool{
+	New: func() any { return new([copyBufSize]byte) },
+}
+
+// Options configures a SOCKS5 Server
+type Options struct {
+	// Username and Password, when Username is set, require RFC 1929
+	// username/password auth from every client. Otherwise no auth is asked for.
+	Username string
+	Password string
+	// ShutdownGrace is how long Stop waits for open connections before
+	// force-closing them. Zero means DefaultShutdownGrace, negative means don't wait.
+	ShutdownGrace time.Duration
+	// IdleTimeout closes a proxied connection after this long without data
+	// in either direction, and bounds each write to the client. Zero means
+	// DefaultIdleTimeout, negative disables it.
+	IdleTimeout time.Duration
+	// SocketMode is the file mode of a "unix:" listen socket
+	// (0 = DefaultSocketMode)
+	SocketMode os.FileMode
+	// Rules, if set, limits the destinations clients may reach. Refused
+	// CONNECTs get reply 0x02, refused UDP datagrams are dropped.
+	Rules *Rules
+}
+
 // Server is a SOCKS5 proxy server that tunnels through Exit Peer
 type Server struct {
 	listener     net.Listener
-	conn         *relay.Connection
+	conn         relay.Conn
+	opts         Options
 	streams      map[protocol.StreamID]chan protocol.TunnelMessage
 	streamsMu    sync.RWMutex
 	nextStreamID uint32
-	running      bool
+	receiverOnce sync.Once
+
+	// Shutdown: done stops accepting, kill force-closes what's left
+	mu       sync.Mutex
+	clients  map[net.Conn]struct{}
+	active   sync.WaitGroup
+	done     chan struct{}
+	kill     chan struct{}
+	stopOnce sync.Once
 }
 
 // NewServer creates a new SOCKS5 server
-func NewServer(conn *relay.Connection) *Server {
+func NewServer(conn relay.Conn) *Server {
+	return NewServerWithOptions(conn, Options{})
+}
+
+// NewServerWithOptions is NewServer with authentication settings
+func NewServerWithOptions(conn relay.Conn, opts Options) *Server {
+	if opts.ShutdownGrace == 0 {
+		opts.ShutdownGrace = DefaultShutdownGrace
+	}
+	if opts.IdleTimeout == 0 {
+		opts.IdleTimeout = DefaultIdleTimeout
+	}
 	return &Server{
 		conn:         conn,
+		opts:         opts,
 		streams:      make(map[protocol.StreamID]chan protocol.TunnelMessage),
 		nextStreamID: 1,
+		clients:      make(map[net.Conn]struct{}),
+		done:         make(chan struct{}),
+		kill:         make(chan struct{}),
 	}
 }
 
-// Start starts the SOCKS5 server on the given address
+// Start starts the SOCKS5 server on the given address, "host:port" or
+// "unix:/path/to.sock" (see Listen). It returns nil once Stop is called.
 func (s *Server) Start(listenAddr string) error {
-	listener, err := net.Listen("tcp", listenAddr)
+	listener, err := Listen(listenAddr, s.opts.SocketMode)
 	if err != nil {
 		return fmt.Errorf("failed to listen: %w", err)
 	}
+	s.mu.Lock()
 	s.listener = listener
-	s.running = true
+	s.mu.Unlock()
+	if s.stopping() {
+		listener.Close()
+		return nil
+	}
 
 	fmt.Printf("🚀 SOCKS5 proxy listening on %s\n", listenAddr)
 	fmt.Println("   Configure your browser: SOCKS5 proxy =", listenAddr)
 
 	// Start relay receiver goroutine
 	fmt.Println("[DEBUG] Start: Launching relayReceiver goroutine...")
-	go s.relayReceiver()
+	s.startReceiver()
 
 	// Accept connections
-	for s.running {
+	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			if !s.running {
-				break
+			if s.stopping() {
+				return nil
 			}
 			continue
 		}
-		go s.handleClient(conn)
+		if !s.track(conn) {
+			conn.Close()
+			return nil
+		}
+		go func() {
+			defer s.untrack(conn)
+			s.handleClient(conn)
+		}()
+	}
+}
+
+// track registers an accepted connection for draining. It refuses once Stop has begun.
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopping() {
+		return false
+	}
+	s.clients[conn] = struct{}{}
+	s.active.Add(1)
+	metrics.SocksConnections.Set(float64(len(s.clients)))
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.clients, conn)
+	metrics.SocksConnections.Set(float64(len(s.clients)))
+	s.mu.Unlock()
+	s.active.Done()
+}
+
+// ActiveConnections returns how many client connections are open
+func (s *Server) ActiveConnections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.clients)
+}
+
+// idleTimer calls expire once IdleTimeout passes without touch being called.
+// stop must be called when the connection ends.
+func (s *Server) idleTimer(expire func()) (touch func(), stop func()) {
+	if s.opts.IdleTimeout < 0 {
+		return func() {}, func() {}
+	}
+	t := time.AfterFunc(s.opts.IdleTimeout, expire)
+	return func() { t.Reset(s.opts.IdleTimeout) }, func() { t.Stop() }
+}
+
+// writeClient writes to the client, giving up after IdleTimeout so a client
+// that stopped reading can't block the stream forever
+func (s *Server) writeClient(conn net.Conn, b []byte) error {
+	if s.opts.IdleTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(s.opts.IdleTimeout))
+	}
+	_, err := conn.Write(b)
+	return err
+}
+
+func (s *Server) stopping() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
 	}
+}
 
-	return nil
+// startReceiver runs relayReceiver, once, for Start and Dial
+func (s *Server) startReceiver() {
+	s.receiverOnce.Do(func() { go s.relayReceiver() })
 }
 
 // relayReceiver receives messages from relay and dispatches to streams
 func (s *Server) relayReceiver() {
 	fmt.Println("[DEBUG] relayReceiver: Started")
-	for s.running {
+	for !s.stopping() {
 		fmt.Println("[DEBUG] relayReceiver: Waiting for message...")
 		msg, err := s.conn.Recv()
 		if err != nil {
@@ -88,6 +252,8 @@ func (s *Server) relayReceiver() {
 		case *protocol.Close:
 			streamID = m.StreamID
 			fmt.Printf("[DEBUG] relayReceiver: Close for stream %d\n", streamID)
+		case *protocol.UdpDatagram:
+			streamID = m.StreamID
 		case *protocol.ErrorReply:
 			streamID = m.StreamID
 			fmt.Printf("[DEBUG] relayReceiver: ErrorReply for stream %d: %s\n", streamID, m.Message)
@@ -123,21 +289,27 @@ func (s *Server) handleClient(conn net.Conn) {
 
 	// Read greeting
 	n, err := conn.Read(buf)
-	if err != nil || n < 2 || buf[0] != 0x05 {
+	if err != nil || n < 2 || buf[0] != 0x05 || n < 2+int(buf[1]) {
+		return
+	}
+	if !s.authenticate(conn, buf[2:2+int(buf[1])]) {
 		return
 	}
-
-	// Send no-auth response
-	conn.Write([]byte{0x05, 0x00})
 
 	// Read request
 	n, err = conn.Read(buf)
-	if err != nil || n < 7 || buf[0] != 0x05 || buf[1] != 0x01 {
-		// Only CONNECT supported
+	if err != nil || n < 7 || buf[0] != 0x05 || (buf[1] != cmdConnect && buf[1] != cmdUDPAssociate) {
+		// Only CONNECT and UDP ASSOCIATE supported
 		conn.Write([]byte{0x05, 0x07, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
 		return
 	}
 
+	if buf[1] == cmdUDPAssociate {
+		// DST.ADDR/PORT is where the client will send from; usually zeros, so it's ignored
+		s.handleUDPAssociate(conn)
+		return
+	}
+
 	// Parse destination
 	var host string
 	var port uint16
@@ -158,73 +330,57 @@ func (s *Server) handleClient(conn net.Conn) {
 		return
 	}
 
-	fmt.Printf("SOCKS5 CONNECT to %s:%d\n", host, port)
-
-	// Get stream ID
-	streamID := protocol.StreamID(atomic.AddUint32(&s.nextStreamID, 1))
-
-	// Register stream
-	ch := make(chan protocol.TunnelMessage, 100)
-	s.streamsMu.Lock()
-	s.streams[streamID] = ch
-	s.streamsMu.Unlock()
-
-	defer func() {
-		s.streamsMu.Lock()
-		delete(s.streams, streamID)
-		s.streamsMu.Unlock()
-		close(ch)
-	}()
-
-	// Send CONNECT request to Exit Peer
-	connectMsg := &protocol.Connect{
-		StreamID: streamID,
-		Host:     host,
-		Port:     port,
-	}
-	if err := s.conn.Send(connectMsg); err != nil {
-		conn.Write([]byte{0x05, 0x04, 0x00, 0x01, 0, 0, 0, 0, 0, 0}) // Host unreachable
+	if !s.opts.Rules.Permits(host) {
+		fmt.Printf("🚫 SOCKS5 CONNECT to %s:%d refused by ruleset\n", host, port)
+		conn.Write([]byte{0x05, 0x02, 0x00, 0x01, 0, 0, 0, 0, 0, 0}) // Connection not allowed by ruleset
 		return
 	}
 
-	// Wait for ConnectSuccess or Error (with timeout)
-	select {
-	case msg := <-ch:
-		switch m := msg.(type) {
-		case *protocol.ConnectSuccess:
-			// Success - send SOCKS5 success response
-			conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
-		case *protocol.ErrorReply:
-			fmt.Printf("Connect error: %s\n", m.Message)
-			conn.Write([]byte{0x05, 0x04, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
-			return
-		default:
-			conn.Write([]byte{0x05, 0x04, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
-			return
+	fmt.Printf("SOCKS5 CONNECT to %s:%d\n", host, port)
+
+	streamID, ch, unregister, err := s.connect(host, port)
+	if err != nil {
+		if err != errStopped {
+			conn.Write([]byte{0x05, 0x04, 0x00, 0x01, 0, 0, 0, 0, 0, 0}) // Host unreachable
 		}
-	case <-time.After(30 * time.Second):
-		fmt.Printf("Connect timeout for %s:%d\n", host, port)
-		conn.Write([]byte{0x05, 0x04, 0x00, 0x01, 0, 0, 0, 0, 0, 0}) // Host unreachable
 		return
 	}
+	defer unregister()
+	conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
 
-	// Start bidirectional forwarding
+	// Start bidirectional forwarding. When either direction ends, or the
+	// stream idles out, both are torn down so neither goroutine lingers.
 	var wg sync.WaitGroup
 	wg.Add(2)
+	streamDone := make(chan struct{})
+	var teardownOnce sync.Once
+	teardown := func() {
+		teardownOnce.Do(func() {
+			close(streamDone)
+			conn.Close()
+		})
+	}
+	touch, stopIdle := s.idleTimer(func() {
+		fmt.Printf("⌛ SOCKS5 stream to %s:%d idle for %s, closing\n", host, port, s.opts.IdleTimeout)
+		teardown()
+	})
+	defer stopIdle()
 
 	// Client -> Relay
 	go func() {
 		defer wg.Done()
-		buf := make([]byte, 32*1024)
+		defer teardown()
+		pooled := copyBufs.Get().(*[copyBufSize]byte)
+		defer copyBufs.Put(pooled)
+		buf := pooled[:]
 		for {
 			n, err := conn.Read(buf)
 			if err != nil {
-				if err != io.EOF {
-					// Connection closed, send Close message
-				}
+				// Client closed, or teardown did: tell the Exit Peer either way
 				s.conn.Send(&protocol.Close{StreamID: streamID})
 				return
 			}
+			touch()
 
 			dataMsg := &protocol.Data{
 				StreamID: streamID,
@@ -239,10 +395,24 @@ func (s *Server) handleClient(conn net.Conn) {
 	// Relay -> Client
 	go func() {
 		defer wg.Done()
-		for msg := range ch {
+		defer teardown()
+		for {
+			var msg protocol.TunnelMessage
+			var ok bool
+			select {
+			case msg, ok = <-ch:
+				if !ok {
+					return
+				}
+			case <-streamDone:
+				return
+			case <-s.kill:
+				return
+			}
 			switch m := msg.(type) {
 			case *protocol.Data:
-				if _, err := conn.Write(m.Payload); err != nil {
+				touch()
+				if err := s.writeClient(conn, m.Payload); err != nil {
 					return
 				}
 			case *protocol.Close:
@@ -256,11 +426,160 @@ func (s *Server) handleClient(conn net.Conn) {
 	wg.Wait()
 }
 
-// Stop stops the SOCKS5 server
-func (s *Server) Stop() error {
-	s.running = false
-	if s.listener != nil {
-		return s.listener.Close()
+// connect opens a stream to host:port through the Exit Peer and waits for
+// the Exit Peer to accept it. unregister must be called when the stream ends.
+func (s *Server) connect(host string, port uint16) (protocol.StreamID, chan protocol.TunnelMessage, func(), error) {
+	streamID, ch, unregister := s.registerStream()
+
+	// Send CONNECT request to Exit Peer
+	connectMsg := &protocol.Connect{
+		StreamID: streamID,
+		Host:     host,
+		Port:     port,
+	}
+	if err := s.conn.Send(connectMsg); err != nil {
+		unregister()
+		return 0, nil, nil, err
+	}
+
+	// Wait for ConnectSuccess or Error (with timeout)
+	var err error
+	select {
+	case msg := <-ch:
+		switch m := msg.(type) {
+		case *protocol.ConnectSuccess:
+			return streamID, ch, unregister, nil
+		case *protocol.ErrorReply:
+			fmt.Printf("Connect error: %s\n", m.Message)
+			err = fmt.Errorf("exit peer: %s", m.Message)
+		default:
+			err = fmt.Errorf("unexpected %T instead of a connect reply", msg)
+		}
+	case <-s.kill:
+		err = errStopped
+	case <-time.After(connectTimeout):
+		fmt.Printf("Connect timeout for %s:%d\n", host, port)
+		err = fmt.Errorf("connect to %s:%d timed out", host, port)
 	}
-	return nil
+	unregister()
+	return 0, nil, nil, err
+}
+
+// registerStream allocates a stream ID and the channel relayReceiver
+// dispatches its messages to. unregister must be called when the stream ends.
+func (s *Server) registerStream() (protocol.StreamID, chan protocol.TunnelMessage, func()) {
+	// Get stream ID
+	streamID := protocol.StreamID(atomic.AddUint32(&s.nextStreamID, 1))
+
+	// Register stream
+	ch := make(chan protocol.TunnelMessage, 100)
+	s.streamsMu.Lock()
+	s.streams[streamID] = ch
+	s.streamsMu.Unlock()
+
+	return streamID, ch, func() {
+		s.streamsMu.Lock()
+		delete(s.streams, streamID)
+		s.streamsMu.Unlock()
+		close(ch)
+	}
+}
+
+// authenticate picks an auth method from the client's offered methods and
+// runs it. Without credentials configured it accepts "no auth" as before;
+// with them only username/password (RFC 1929) is accepted.
+func (s *Server) authenticate(conn net.Conn, methods []byte) bool {
+	want := byte(methodNoAuth)
+	if s.opts.Username != "" {
+		want = methodUserPass
+	}
+
+	offered := false
+	for _, m := range methods {
+		if m == want {
+			offered = true
+			break
+		}
+	}
+	if !offered {
+		conn.Write([]byte{0x05, methodNoAcceptable})
+		return false
+	}
+	conn.Write([]byte{0x05, want})
+
+	if want == methodNoAuth {
+		return true
+	}
+
+	// +----+------+----------+------+----------+
+	// |VER | ULEN |  UNAME   | PLEN |  PASSWD  |
+	// +----+------+----------+------+----------+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil || header[0] != userPassVersion {
+		return false
+	}
+	user := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return false
+	}
+	if _, err := io.ReadFull(conn, header[:1]); err != nil {
+		return false
+	}
+	pass := make([]byte, header[0])
+	if _, err := io.ReadFull(conn, pass); err != nil {
+		return false
+	}
+
+	userOK := subtle.ConstantTimeCompare(user, []byte(s.opts.Username)) == 1
+	passOK := subtle.ConstantTimeCompare(pass, []byte(s.opts.Password)) == 1
+	if !userOK || !passOK {
+		fmt.Printf("🚫 SOCKS5 auth failed from %s\n", conn.RemoteAddr())
+		conn.Write([]byte{userPassVersion, authFailure})
+		return false
+	}
+	conn.Write([]byte{userPassVersion, authSuccess})
+	return true
+}
+
+// Stop stops accepting connections, gives open ones ShutdownGrace to
+// finish, then force-closes the rest
+func (s *Server) Stop() error {
+	var err error
+	s.stopOnce.Do(func() {
+		s.mu.Lock()
+		close(s.done)
+		if s.listener != nil {
+			err = s.listener.Close()
+		}
+		n := len(s.clients)
+		s.mu.Unlock()
+
+		drained := make(chan struct{})
+		go func() {
+			s.active.Wait()
+			close(drained)
+		}()
+
+		if n > 0 && s.opts.ShutdownGrace > 0 {
+			fmt.Printf("⏳ Waiting up to %s for %d SOCKS5 connection(s) to finish...\n", s.opts.ShutdownGrace, n)
+			select {
+			case <-drained:
+				return
+			case <-time.After(s.opts.ShutdownGrace):
+			}
+		}
+
+		s.mu.Lock()
+		n = len(s.clients)
+		close(s.kill)
+		for conn := range s.clients {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		if n > 0 {
+			fmt.Printf("✂️  Closed %d SOCKS5 connection(s) still open\n", n)
+		}
+		<-drained
+	})
+	return err
 }
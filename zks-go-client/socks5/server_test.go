@@ -0,0 +1,115 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+
+	"github.com/zks-vpn/zks-go-client/bufpool"
+	"github.com/zks-vpn/zks-go-client/protocol"
+	"github.com/zks-vpn/zks-go-client/relay"
+)
+
+// benchRelay is a relay.Conn that accepts every CONNECT and frames Data the
+// way relay.Connection does before encrypting it: into a pooled buffer
+// when it fits, an allocated one when it doesn't
+type benchRelay struct {
+	recv     chan protocol.TunnelMessage
+	received atomic.Int64 // Payload bytes
+	want     int64
+	done     chan struct{}
+}
+
+func (r *benchRelay) Send(msg protocol.TunnelMessage) error {
+	switch m := msg.(type) {
+	case *protocol.Connect:
+		r.recv <- &protocol.ConnectSuccess{StreamID: m.StreamID}
+	case *protocol.Data:
+		buf := bufpool.Get()
+		if m.EncodeTo(buf[:len(buf)-12-16]) == 0 {
+			m.Encode()
+		}
+		bufpool.Put(buf)
+		if r.received.Add(int64(len(m.Payload))) == r.want {
+			close(r.done)
+		}
+	}
+	return nil
+}
+
+func (r *benchRelay) Recv() (protocol.TunnelMessage, error) {
+	return r.RecvContext(context.Background())
+}
+
+func (r *benchRelay) RecvContext(ctx context.Context) (protocol.TunnelMessage, error) {
+	select {
+	case msg := <-r.recv:
+		return msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (r *benchRelay) Capabilities() relay.Capabilities { return relay.Capabilities{} }
+
+func (r *benchRelay) Lease(context.Context) (netip.Prefix, error) {
+	return netip.Prefix{}, errors.New("no lease")
+}
+
+func (r *benchRelay) Close() {}
+
+// BenchmarkClientToRelay measures the copy cost of a proxied stream, from
+// the client's socket into framed Data messages. Writes of up to ~2 KB are
+// framed in pooled buffers; larger ones allocate their framing, which the
+// allocs/op show.
+func BenchmarkClientToRelay(b *testing.B) {
+	for _, size := range []int{1024, copyBufSize} {
+		b.Run(fmt.Sprintf("%d", size), func(b *testing.B) {
+			r := &benchRelay{recv: make(chan protocol.TunnelMessage, 1), want: int64(b.N * size), done: make(chan struct{})}
+			s := NewServer(r)
+			s.startReceiver()
+
+			ln, err := net.Listen("tcp4", "127.0.0.1:0")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer ln.Close()
+			go func() {
+				if conn, err := ln.Accept(); err == nil {
+					s.handleClient(conn)
+				}
+			}()
+
+			conn, err := net.Dial("tcp4", ln.Addr().String())
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+			reply := make([]byte, 10)
+			conn.Write([]byte{0x05, 0x01, 0x00})
+			if _, err := io.ReadFull(conn, reply[:2]); err != nil {
+				b.Fatal(err)
+			}
+			conn.Write([]byte{0x05, cmdConnect, 0x00, 0x01, 192, 0, 2, 1, 0, 80})
+			if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != 0x00 {
+				b.Fatalf("CONNECT failed: %v %x", err, reply)
+			}
+
+			chunk := make([]byte, size)
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+			for range b.N {
+				if _, err := conn.Write(chunk); err != nil {
+					b.Fatal(err)
+				}
+			}
+			<-r.done
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package socks5
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zks-vpn/zks-go-client/protocol"
+)
+
+// ErrRefused is returned by Dial for a destination the Rules don't permit
+var ErrRefused = errors.New("destination refused by ruleset")
+
+// errNoDeadlines is returned by the deadline setters of a tunneled stream
+var errNoDeadlines = errors.New("tunneled streams don't support deadlines")
+
+// Dial opens a TCP stream to host:port through the Exit Peer, for other
+// proxies (httpproxy) to share this server's relay connection, stream IDs
+// and Rules. Closing the returned connection closes the stream.
+func (s *Server) Dial(host string, port uint16) (net.Conn, error) {
+	if !s.opts.Rules.Permits(host) {
+		return nil, ErrRefused
+	}
+	if s.stopping() {
+		return nil, errStopped
+	}
+	s.startReceiver()
+
+	streamID, ch, unregister, err := s.connect(host, port)
+	if err != nil {
+		return nil, err
+	}
+	return &streamConn{
+		s:          s,
+		id:         streamID,
+		ch:         ch,
+		unregister: unregister,
+		remote:     streamAddr(net.JoinHostPort(host, strconv.Itoa(int(port)))),
+		done:       make(chan struct{}),
+	}, nil
+}
+
+// streamConn is a stream from Dial as a net.Conn. Close unblocks a Read;
+// deadlines aren't supported.
+type streamConn struct {
+	s          *Server
+	id         protocol.StreamID
+	ch         chan protocol.TunnelMessage
+	unregister func()
+	remote     streamAddr
+
+	// Reads are serialized by the caller, like on any net.Conn
+	rest []byte // Unread part of the last Data message
+	eof  bool   // The Exit Peer closed the stream
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	for len(c.rest) == 0 {
+		if c.eof {
+			return 0, io.EOF
+		}
+		select {
+		case msg, ok := <-c.ch:
+			if !ok {
+				return 0, net.ErrClosed
+			}
+			switch m := msg.(type) {
+			case *protocol.Data:
+				c.rest = m.Payload
+			case *protocol.Close, *protocol.ErrorReply:
+				c.eof = true
+			}
+		case <-c.done:
+			return 0, net.ErrClosed
+		case <-c.s.kill:
+			return 0, errStopped
+		}
+	}
+	n := copy(p, c.rest)
+	c.rest = c.rest[n:]
+	return n, nil
+}
+
+// Write sends p as Data messages of at most copyBufSize bytes
+func (c *streamConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		select {
+		case <-c.done:
+			return written, net.ErrClosed
+		default:
+		}
+		n := min(len(p), copyBufSize)
+		if err := c.s.conn.Send(&protocol.Data{StreamID: c.id, Payload: p[:n]}); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close tells the Exit Peer the stream is done and releases its ID
+func (c *streamConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.s.conn.Send(&protocol.Close{StreamID: c.id})
+		c.unregister()
+	})
+	return nil
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return streamAddr("") }
+func (c *streamConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *streamConn) SetDeadline(time.Time) error      { return errNoDeadlines }
+func (c *streamConn) SetReadDeadline(time.Time) error  { return errNoDeadlines }
+func (c *streamConn) SetWriteDeadline(time.Time) error { return errNoDeadlines }
+
+// streamAddr is the host:port a tunneled stream goes to
+type streamAddr string
+
+func (a streamAddr) Network() string { return "zks" }
+func (a streamAddr) String() string  { return string(a) }
+
+var _ net.Conn = (*streamConn)(nil)
@@ -0,0 +1,162 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+
+	"github.com/zks-vpn/zks-go-client/protocol"
+)
+
+// handleUDPAssociate serves a UDP ASSOCIATE request (RFC 1928 section 7).
+// Datagrams the client sends to the relay socket are unwrapped and sent to
+// the Exit Peer as UdpDatagram messages on a stream of their own; replies
+// come back on the same stream and are wrapped for the client. The
+// association lives as long as the TCP control connection.
+func (s *Server) handleUDPAssociate(conn net.Conn) {
+	// Bind on the address the client reached us on so the reply is routable
+	// for it. Clients of a Unix socket are on this host: use loopback.
+	localIP, clientIP := net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 1)
+	if tcp, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		localIP, clientIP = tcp.IP, conn.RemoteAddr().(*net.TCPAddr).IP
+	}
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		fmt.Printf("UDP ASSOCIATE failed: %v\n", err)
+		conn.Write([]byte{0x05, 0x01, 0x00, 0x01, 0, 0, 0, 0, 0, 0}) // General failure
+		return
+	}
+	defer udpConn.Close()
+
+	streamID, ch, unregister := s.registerStream()
+	defer unregister()
+
+	bound := udpConn.LocalAddr().(*net.UDPAddr)
+	reply := append([]byte{0x05, 0x00, 0x00}, encodeAddr(bound.IP.String(), uint16(bound.Port))...)
+	if _, err := conn.Write(reply); err != nil {
+		return
+	}
+	fmt.Printf("SOCKS5 UDP ASSOCIATE on %s (stream %d)\n", bound, streamID)
+
+	// Only the client that opened the association may use it
+	var clientAddr atomic.Pointer[net.UDPAddr]
+
+	// Closing the control connection ends the association below
+	touch, stopIdle := s.idleTimer(func() {
+		fmt.Printf("⌛ SOCKS5 UDP association %d idle for %s, closing\n", streamID, s.opts.IdleTimeout)
+		conn.Close()
+	})
+	defer stopIdle()
+
+	// Client -> Relay
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := udpConn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if !from.IP.Equal(clientIP) {
+				continue
+			}
+			clientAddr.Store(from)
+			touch()
+
+			host, port, payload, ok := parseUDPRequest(buf[:n])
+			if !ok {
+				continue // Malformed, or fragmented (FRAG != 0), which we don't reassemble
+			}
+			if !s.opts.Rules.Permits(host) {
+				continue // UDP has no way to say no; drop it like a firewall would
+			}
+			s.conn.Send(&protocol.UdpDatagram{
+				StreamID: streamID,
+				Host:     host,
+				Port:     port,
+				Payload:  payload,
+			})
+		}
+	}()
+
+	// Relay -> Client
+	go func() {
+		for msg := range ch {
+			switch m := msg.(type) {
+			case *protocol.UdpDatagram:
+				to := clientAddr.Load()
+				if to == nil {
+					continue
+				}
+				touch()
+				udpConn.WriteToUDP(append(encodeUDPHeader(m.Host, m.Port), m.Payload...), to)
+			case *protocol.Close, *protocol.ErrorReply:
+				// Exit Peer gave up on the association; dropping the control
+				// connection tells the client
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	// The association ends when the client closes the TCP connection
+	io.Copy(io.Discard, conn)
+	s.conn.Send(&protocol.Close{StreamID: streamID})
+}
+
+// parseUDPRequest unwraps a SOCKS5 UDP request header:
+// RSV(2) FRAG(1) ATYP(1) DST.ADDR DST.PORT(2) DATA
+func parseUDPRequest(b []byte) (host string, port uint16, payload []byte, ok bool) {
+	if len(b) < 4 || b[2] != 0 {
+		return "", 0, nil, false
+	}
+
+	var addrEnd int
+	switch b[3] {
+	case 0x01: // IPv4
+		addrEnd = 4 + net.IPv4len
+		if len(b) < addrEnd+2 {
+			return "", 0, nil, false
+		}
+		host = net.IP(b[4:addrEnd]).String()
+	case 0x03: // Domain
+		if len(b) < 5 {
+			return "", 0, nil, false
+		}
+		addrEnd = 5 + int(b[4])
+		if len(b) < addrEnd+2 {
+			return "", 0, nil, false
+		}
+		host = string(b[5:addrEnd])
+	case 0x04: // IPv6
+		addrEnd = 4 + net.IPv6len
+		if len(b) < addrEnd+2 {
+			return "", 0, nil, false
+		}
+		host = net.IP(b[4:addrEnd]).String()
+	default:
+		return "", 0, nil, false
+	}
+
+	port = binary.BigEndian.Uint16(b[addrEnd : addrEnd+2])
+	return host, port, b[addrEnd+2:], true
+}
+
+// encodeUDPHeader builds the SOCKS5 UDP header for a datagram from host:port
+func encodeUDPHeader(host string, port uint16) []byte {
+	return append([]byte{0, 0, 0}, encodeAddr(host, port)...)
+}
+
+// encodeAddr encodes ATYP, ADDR and PORT as used in replies and UDP headers
+func encodeAddr(host string, port uint16) []byte {
+	var b []byte
+	if ip := net.ParseIP(host); ip == nil {
+		b = append([]byte{0x03, byte(len(host))}, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append([]byte{0x01}, ip4...)
+	} else {
+		b = append([]byte{0x04}, ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(b, port)
+}
@@ -0,0 +1,196 @@
+package vpn
+
+import (
+	"time"
+
+	"github.com/zks-vpn/zks-go-client/bufpool"
+	"github.com/zks-vpn/zks-go-client/metrics"
+)
+
+const (
+	// DefaultBatchFlushInterval is how long a burst may be held to fill a BatchIpPacket
+	DefaultBatchFlushInterval = time.Millisecond
+	// DefaultBatchMaxPackets flushes a batch once it holds this many packets
+	DefaultBatchMaxPackets = 256
+	// DefaultBatchMaxBytes flushes a batch once its packets add up to this many bytes
+	DefaultBatchMaxBytes = 64 * 1024
+
+	// DefaultBatchMinFlushInterval and DefaultBatchMinPackets are where an
+	// adaptive batcher starts, and what it shrinks back to when traffic is sparse
+	DefaultBatchMinFlushInterval = 100 * time.Microsecond
+	DefaultBatchMinPackets       = 16
+
+	// An adaptive batcher re-measures the packet rate every adaptWindow.
+	// At adaptLowRate packets/s and below it uses the minimum limits, at
+	// adaptHighRate and above the maximum ones, and in between it scales.
+	adaptWindow   = 100 * time.Millisecond
+	adaptLowRate  = 1000
+	adaptHighRate = 20000
+)
+
+// readBatch is one device read's worth of packets
+type readBatch struct {
+	packets [][]byte
+	bytes   int
+}
+
+// batcher coalesces TUN reads into fewer, larger SendBatch calls.
+//
+// A read that arrives after the link has been idle for a flush interval
+// goes out immediately, so a lone DNS query or keystroke isn't delayed.
+// Reads that follow closely behind are held for up to the flush interval,
+// or until the batch limits are hit, and sent as one BatchIpPacket.
+//
+// With BatchAdaptive the flush interval and packet limit follow the packet
+// rate instead (see adapt): small while traffic is sparse, growing up to
+// BatchFlushInterval and BatchMaxPackets under load, where a little more
+// latency buys fewer, larger sends.
+type batcher struct {
+	transport  Transport
+	interval   time.Duration
+	maxPackets int
+	maxBytes   int
+
+	adaptive    bool
+	minInterval time.Duration
+	maxInterval time.Duration
+	minPackets  int
+	topPackets  int
+	rate        float64 // Smoothed packets/s
+	windowStart time.Time
+	windowCount int
+
+	queue *sendQueue
+	stats *tunCounters
+	done  chan struct{}
+}
+
+func newBatcher(transport Transport, opts Options, queue *sendQueue, stats *tunCounters, done chan struct{}) *batcher {
+	b := &batcher{
+		transport:   transport,
+		interval:    opts.BatchFlushInterval,
+		maxPackets:  opts.BatchMaxPackets,
+		maxBytes:    opts.BatchMaxBytes,
+		adaptive:    opts.BatchAdaptive,
+		minInterval: opts.BatchMinFlushInterval,
+		maxInterval: opts.BatchFlushInterval,
+		minPackets:  opts.BatchMinPackets,
+		topPackets:  opts.BatchMaxPackets,
+		windowStart: time.Now(),
+		queue:       queue,
+		stats:       stats,
+		done:        done,
+	}
+	if b.adaptive {
+		b.interval, b.maxPackets = b.minInterval, b.minPackets
+	}
+	b.publish()
+	return b
+}
+
+// adapt counts n more packets and, once per adaptWindow, updates the
+// smoothed rate and moves the limits with it. Idle time counts too: the
+// first window after a pause measures a low rate.
+func (b *batcher) adapt(n int) {
+	if !b.adaptive {
+		return
+	}
+	b.windowCount += n
+	elapsed := time.Since(b.windowStart)
+	if elapsed < adaptWindow {
+		return
+	}
+	b.rate = (b.rate + float64(b.windowCount)/elapsed.Seconds()) / 2
+	b.windowStart, b.windowCount = time.Now(), 0
+
+	load := (b.rate - adaptLowRate) / (adaptHighRate - adaptLowRate)
+	load = min(max(load, 0), 1)
+	b.interval = b.minInterval + time.Duration(load*float64(b.maxInterval-b.minInterval))
+	b.maxPackets = b.minPackets + int(load*float64(b.topPackets-b.minPackets))
+	b.publish()
+}
+
+// publish exports the current limits
+func (b *batcher) publish() {
+	metrics.BatchFlushIntervalSec.Set(b.interval.Seconds())
+	metrics.BatchMaxPackets.Set(float64(b.maxPackets))
+	metrics.BatchPacketRate.Set(b.rate)
+}
+
+// run owns the pending batch and sends it to the transport
+func (b *batcher) run() {
+	var pending [][]byte
+	var pendingBytes int
+	var lastFlush time.Time
+
+	flush := func() {
+		if len(pending) > 0 {
+			sendCounted(b.transport, b.stats, pending, pendingBytes)
+		}
+		pending, pendingBytes = nil, 0
+		lastFlush = time.Now()
+	}
+	full := func() bool {
+		return len(pending) >= b.maxPackets || pendingBytes >= b.maxBytes
+	}
+
+	for {
+		select {
+		case <-b.queue.ready:
+			rb, ok := b.queue.take()
+			if !ok {
+				continue
+			}
+			pending = append(pending, rb.packets...)
+			pendingBytes += rb.bytes
+			b.adapt(len(rb.packets))
+		case <-b.done:
+			return
+		}
+
+		// Idle link: don't make the first packet wait for company
+		if full() || time.Since(lastFlush) >= b.interval {
+			flush()
+			continue
+		}
+
+		timer := time.NewTimer(b.interval)
+	collect:
+		for !full() {
+			select {
+			case <-b.queue.ready:
+				if rb, ok := b.queue.take(); ok {
+					pending = append(pending, rb.packets...)
+					pendingBytes += rb.bytes
+					b.adapt(len(rb.packets))
+				}
+			case <-timer.C:
+				break collect
+			case <-b.done:
+				timer.Stop()
+				return
+			}
+		}
+		timer.Stop()
+		flush()
+	}
+}
+
+// sendCounted hands one batch to the transport and updates the metrics and
+// stats. SendBatch doesn't retain packets, so the pooled buffers go back
+// either way.
+func sendCounted(transport Transport, stats *tunCounters, batch [][]byte, bytes int) {
+	err := transport.SendBatch(batch)
+	for _, pkt := range batch {
+		bufpool.Put(pkt)
+	}
+	if err != nil {
+		metrics.DroppedPackets.Add(len(batch))
+		stats.dropped.Add(uint64(len(batch)))
+		return
+	}
+	metrics.TunToRelayPackets.Add(len(batch))
+	metrics.TunToRelayBytes.Add(bytes)
+	stats.packetsOut.Add(uint64(len(batch)))
+	stats.bytesOut.Add(uint64(bytes))
+}
@@ -0,0 +1,90 @@
+package vpn
+
+import "encoding/binary"
+
+// completeChecksums finishes the checksums of a packet read from the
+// device, in place, and reports whether it had to.
+//
+// With checksum offload the stack leaves a TCP or UDP checksum to the
+// "hardware" (CHECKSUM_PARTIAL): the field only holds the pseudo-header
+// sum. wireguard-go completes those when it reads the virtio-net header on
+// Linux, but a device or driver that doesn't hands them over unfinished,
+// and the exit and the destination drop them. Spotting one costs a few
+// additions, so every packet is checked; only those get the full sum. A
+// finished checksum that happens to look the same is recomputed to itself.
+// The IPv4 header checksum is verified and redone if wrong, for the same
+// reason. pkt must have passed checkPacket.
+func completeChecksums(pkt []byte) bool {
+	fixed := false
+	var proto byte
+	var segment []byte
+	switch pkt[0] >> 4 {
+	case 4:
+		ihl := int(pkt[0]&0x0f) * 4
+		if fold(sum16(pkt[:ihl])) != 0xffff {
+			pkt[10], pkt[11] = 0, 0
+			binary.BigEndian.PutUint16(pkt[10:12], ^fold(sum16(pkt[:ihl])))
+			fixed = true
+		}
+		// A fragment's checksum covers the whole datagram; the stack
+		// finishes it before fragmenting anyway
+		if binary.BigEndian.Uint16(pkt[6:8])&0x3fff != 0 {
+			return fixed
+		}
+		proto, segment = pkt[9], pkt[ihl:]
+	case 6:
+		proto, segment = pkt[6], pkt[ipv6HeaderLen:]
+	default:
+		return false
+	}
+
+	var at int
+	switch proto {
+	case protoTCP:
+		at = 16
+	case protoUDP:
+		at = 6
+	default:
+		return fixed
+	}
+	stored := binary.BigEndian.Uint16(segment[at : at+2])
+	if proto == protoUDP && stored == 0 && pkt[0]>>4 == 4 {
+		return fixed // No checksum, which IPv4 allows for UDP
+	}
+	if stored != fold(pseudoHeaderSum(pkt, proto, len(segment))) {
+		return fixed
+	}
+	setL4Checksum(pkt, segment, proto, at)
+	return true
+}
+
+// setL4Checksum computes the checksum of segment, the TCP or UDP part of
+// pkt, and stores it at offset at
+func setL4Checksum(pkt, segment []byte, proto byte, at int) {
+	segment[at], segment[at+1] = 0, 0
+	sum := ^fold(pseudoHeaderSum(pkt, proto, len(segment)) + sum16(segment))
+	if sum == 0 && proto == protoUDP {
+		sum = 0xffff // 0 means "no checksum" for UDP
+	}
+	binary.BigEndian.PutUint16(segment[at:at+2], sum)
+}
+
+// pseudoHeaderSum is the unfolded sum of the IPv4 or IPv6 pseudo-header
+// for a segment of length bytes
+func pseudoHeaderSum(pkt []byte, proto byte, length int) uint32 {
+	var sum uint32
+	if pkt[0]>>4 == 4 {
+		sum = sum16(pkt[12:20]) // Source and destination
+	} else {
+		sum = sum16(pkt[8:40])
+	}
+	return sum + uint32(proto) + uint32(length)
+}
+
+// fold reduces a one's complement sum to 16 bits
+func fold(sum uint32) uint16 {
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return uint16(sum)
+}
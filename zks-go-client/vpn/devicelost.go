@@ -0,0 +1,150 @@
+package vpn
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/zks-vpn/zks-go-client/events"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// DeviceLostPolicy picks what a TUN does when its device goes away
+type DeviceLostPolicy string
+
+const (
+	// DeviceLostExit stops the TUN, restoring routes and DNS, and Start
+	// fails with an error matching ErrDeviceGone
+	DeviceLostExit DeviceLostPolicy = "exit"
+	// DeviceLostRecreate creates the device again and reapplies its
+	// address, DNS and routes, failing like DeviceLostExit if it can't
+	DeviceLostRecreate DeviceLostPolicy = "recreate"
+)
+
+const (
+	// deviceWatchInterval is how often watchDevice checks on the interface
+	deviceWatchInterval = 2 * time.Second
+	// deviceWatchMisses is how many checks in a row must find the
+	// interface gone or down, so a brief flap doesn't count
+	deviceWatchMisses = 2
+	// deviceRecreateAttempts and deviceRecreateDelay bound recreateDevice;
+	// a driver being updated can take a few seconds to come back
+	deviceRecreateAttempts = 5
+	deviceRecreateDelay    = 2 * time.Second
+)
+
+// ErrDeviceGone matches the error Start returns when the TUN device
+// disappeared (adapter disabled or removed, driver reset) and wasn't replaced
+var ErrDeviceGone = errors.New("TUN device is gone")
+
+// deviceGoneError is a failure of dev matching ErrDeviceGone
+type deviceGoneError struct {
+	dev tun.Device
+	err error
+}
+
+func (e deviceGoneError) Error() string        { return "device is gone: " + e.err.Error() }
+func (e deviceGoneError) Unwrap() error        { return e.err }
+func (e deviceGoneError) Is(target error) bool { return target == ErrDeviceGone }
+
+// report hands err to Start, unless the TUN is stopping and Start has
+// stopped listening
+func (t *TUN) report(errChan chan<- error, err error) {
+	select {
+	case errChan <- err:
+	case <-t.done:
+	}
+}
+
+// watchDevice reports dev as gone once the interface name has disappeared
+// or stayed down for deviceWatchMisses checks. A Wintun session that is
+// torn down can leave reads blocked instead of failing, so this is what
+// notices on Windows. It ends when dev is replaced or the TUN stops.
+func (t *TUN) watchDevice(dev tun.Device, name string, errChan chan<- error) {
+	ticker := time.NewTicker(deviceWatchInterval)
+	defer ticker.Stop()
+
+	misses := 0
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.done:
+			return
+		}
+		if t.currentDevice() != dev {
+			return
+		}
+
+		ifi, err := net.InterfaceByName(name)
+		if err == nil && ifi.Flags&net.FlagUp == 0 {
+			err = fmt.Errorf("interface %s is down", name)
+		}
+		if err == nil {
+			misses = 0
+			continue
+		}
+		if misses++; misses >= deviceWatchMisses {
+			t.report(errChan, deviceGoneError{dev: dev, err: err})
+			return
+		}
+	}
+}
+
+// recreateDevice replaces old, which went away, with a new device
+// configured the same way. The routes and DNS recorded since mark belong to
+// the old one and are undone first; the kill switch, if on, stays up and
+// keeps blocking meanwhile.
+func (t *TUN) recreateDevice(old tun.Device, mark int) (tun.Device, string, error) {
+	t.mu.Lock()
+	t.device = nil
+	t.mu.Unlock()
+	old.Close()
+	restoreSince(mark)
+
+	var err error
+	for attempt := 1; attempt <= deviceRecreateAttempts; attempt++ {
+		select {
+		case <-time.After(deviceRecreateDelay):
+		case <-t.done:
+			return nil, "", ErrDeviceGone
+		}
+		log.Printf("🔄 Recreating TUN device %s (attempt %d/%d)...", t.opts.InterfaceName, attempt, deviceRecreateAttempts)
+
+		var dev tun.Device
+		dev, err = t.createDevice()
+		if err != nil {
+			log.Printf("   ⚠️ %v", err)
+			continue
+		}
+		if dev == nil {
+			return nil, "", ErrDeviceGone // Stopped meanwhile
+		}
+		name, cerr := t.configure(dev)
+		if cerr != nil {
+			err = cerr
+			log.Printf("   ⚠️ %v", err)
+			t.mu.Lock()
+			t.device = nil
+			t.mu.Unlock()
+			dev.Close()
+			restoreSince(mark)
+			continue
+		}
+
+		select {
+		case <-t.done:
+			// Stop restored the network while we were configuring it
+			RestoreNetwork()
+			return nil, "", ErrDeviceGone
+		default:
+		}
+
+		log.Printf("✅ TUN device %s recreated, traffic flows again", name)
+		events.Emit("tunnel_up", events.Fields{"interface": name, "ip": t.opts.IP})
+		return dev, name, nil
+	}
+	log.Printf("❌ Could not recreate the TUN device after %d attempts: %v", deviceRecreateAttempts, err)
+	return nil, "", fmt.Errorf("%w: recreating it failed: %v", ErrDeviceGone, err)
+}
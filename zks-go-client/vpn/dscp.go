@@ -0,0 +1,38 @@
+package vpn
+
+// dscpSender is a transport that can copy each packet's DSCP onto the outer
+// header it sends the packet in. Wrappers that hide the inner IP header
+// (EncryptedTransport) read the marks before encrypting and hand them down
+// with sendBatchDSCP; any other wrapper in between loses them.
+type dscpSender interface {
+	// marksDSCP reports whether marks passed to sendBatchDSCP are used
+	marksDSCP() bool
+	// sendBatchDSCP is SendBatch with the outer ToS byte of each packet
+	sendBatchDSCP(packets [][]byte, tos []byte) error
+}
+
+// packetTOS returns the outer ToS (traffic class on IPv6) byte for an IP
+// packet: its DSCP, with the ECN bits left clear since they belong to the
+// inner path. Anything that isn't an IP packet gets 0, the default.
+func packetTOS(pkt []byte) byte {
+	if len(pkt) < 2 {
+		return 0
+	}
+	switch pkt[0] >> 4 {
+	case 4:
+		return pkt[1] &^ 0x03
+	case 6:
+		// The traffic class straddles the first two bytes
+		return (pkt[0]<<4 | pkt[1]>>4) &^ 0x03
+	}
+	return 0
+}
+
+// packetTOSes returns packetTOS for each of packets
+func packetTOSes(packets [][]byte) []byte {
+	tos := make([]byte, len(packets))
+	for i, pkt := range packets {
+		tos[i] = packetTOS(pkt)
+	}
+	return tos
+}
@@ -0,0 +1,119 @@
+package vpn
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/zks-vpn/zks-go-client/metrics"
+)
+
+// PacketFilter limits what readLoop forwards by IP protocol and TCP/UDP
+// destination port (--allow-proto, --allow-port). A packet is forwarded if
+// its protocol is allowed and, for TCP and UDP, its destination port is
+// too. Ports alone allow TCP and UDP to those ports; protocols alone allow
+// any port.
+//
+// The filter only sees what the routes send into the TUN, and a packet read
+// from the device can't be handed back to the local stack, so everything
+// else the routes capture is dropped. Routes can't select by port: to keep
+// the rest of the traffic working, pair the filter with --include-routes so
+// only the destinations it is meant for reach the tunnel, and allow UDP
+// port 53 if --dns points at a resolver behind it.
+type PacketFilter struct {
+	protos map[byte]bool
+	ports  []portRange // Empty allows every port
+}
+
+type portRange struct{ lo, hi uint16 }
+
+// protoNames are the names --allow-proto takes besides protocol numbers
+var protoNames = map[string]byte{
+	"icmp":   protoICMP,
+	"tcp":    protoTCP,
+	"udp":    protoUDP,
+	"icmpv6": protoICMPv6,
+}
+
+// ParseFilter builds a PacketFilter from protocol names or numbers ("tcp",
+// "47") and ports or ranges ("443", "8000-8100"). Both empty gives nil,
+// which forwards everything.
+func ParseFilter(protos, ports []string) (*PacketFilter, error) {
+	if len(protos) == 0 && len(ports) == 0 {
+		return nil, nil
+	}
+	f := &PacketFilter{protos: make(map[byte]bool)}
+	for _, p := range protos {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if n, ok := protoNames[p]; ok {
+			f.protos[n] = true
+			continue
+		}
+		n, err := strconv.ParseUint(p, 10, 8)
+		if err != nil || byte(n) == protoRsvd {
+			return nil, fmt.Errorf("invalid protocol %q: want tcp, udp, icmp, icmpv6 or a number 0-254", p)
+		}
+		f.protos[byte(n)] = true
+	}
+	if len(f.protos) == 0 {
+		f.protos[protoTCP] = true
+		f.protos[protoUDP] = true
+	}
+
+	for _, p := range ports {
+		p = strings.TrimSpace(p)
+		lo, hi, isRange := strings.Cut(p, "-")
+		if !isRange {
+			hi = lo
+		}
+		l, err1 := strconv.ParseUint(lo, 10, 16)
+		h, err2 := strconv.ParseUint(hi, 10, 16)
+		if err1 != nil || err2 != nil || l == 0 || l > h {
+			return nil, fmt.Errorf("invalid port %q: want a port or a range like 8000-8100", p)
+		}
+		f.ports = append(f.ports, portRange{uint16(l), uint16(h)})
+	}
+	return f, nil
+}
+
+// Allow reports whether pkt, already checked by checkPacket, passes the
+// filter, counting it when it doesn't
+func (f *PacketFilter) Allow(pkt []byte) bool {
+	if f.allow(pkt) {
+		return true
+	}
+	metrics.FilteredPackets.Inc()
+	return false
+}
+
+func (f *PacketFilter) allow(pkt []byte) bool {
+	var proto byte
+	var payload []byte
+	switch pkt[0] >> 4 {
+	case 4:
+		proto = pkt[9]
+		// Later fragments carry no ports; the first one was checked
+		if binary.BigEndian.Uint16(pkt[6:8])&0x1fff != 0 {
+			return f.protos[proto]
+		}
+		payload = pkt[int(pkt[0]&0x0f)*4:]
+	case 6:
+		// Extension headers aren't walked: they must be allowed by number
+		proto = pkt[6]
+		payload = pkt[ipv6HeaderLen:]
+	}
+	if !f.protos[proto] {
+		return false
+	}
+	if len(f.ports) == 0 || (proto != protoTCP && proto != protoUDP) {
+		return true
+	}
+	port := binary.BigEndian.Uint16(payload[2:4])
+	for _, r := range f.ports {
+		if port >= r.lo && port <= r.hi {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,279 @@
+package vpn
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zks-vpn/zks-go-client/bufpool"
+	"github.com/zks-vpn/zks-go-client/metrics"
+	"github.com/zks-vpn/zks-go-client/protocol"
+)
+
+const (
+	// DefaultReassemblyTimeout is how long the pieces of a packet wait for the rest
+	DefaultReassemblyTimeout = 5 * time.Second
+	// maxReassemblies bounds the packets being put back together at once
+	maxReassemblies = 256
+	// MinFragmentSize is the smallest usable FragmentOptions.MaxPacket
+	MinFragmentSize = protocol.FragmentHeaderLen + 64
+)
+
+// FragmentingTransport wraps another Transport and splits packets larger
+// than MaxPacket into protocol.Fragments, putting them back together on the
+// receiving side. It is for paths that carry less than the TUN MTU, when
+// lowering --mtu isn't an option (apps that ignore PMTU discovery).
+// Packets that fit pass through unchanged, unless they start like a
+// Fragment (as 1 in 256 ciphertexts do, their first byte being random):
+// those go as a single-piece Fragment so the receiver can tell them apart.
+//
+// Both peers must use it. Wrap it directly around the base transport,
+// inside any encryption: the pieces are then sized for the path, and a
+// reassembled packet is authenticated as a whole.
+type FragmentingTransport struct {
+	inner  Transport
+	opts   FragmentOptions
+	nextID atomic.Uint32
+
+	mu      sync.Mutex
+	partial map[uint32]*reassembly
+}
+
+// FragmentOptions configures a FragmentingTransport
+type FragmentOptions struct {
+	// MaxPacket is the largest packet, fragment header included, sent in one piece
+	MaxPacket int
+	// ReassemblyTimeout drops a packet whose pieces haven't all arrived in
+	// time (0 = DefaultReassemblyTimeout)
+	ReassemblyTimeout time.Duration
+}
+
+// reassembly is a packet whose pieces are still arriving
+type reassembly struct {
+	buf      []byte
+	size     int // Known once the last piece arrives; -1 before
+	received int
+	pieces   []span // Byte ranges received, none overlapping another
+	deadline time.Time
+}
+
+// span is the bytes [start, end) of a packet
+type span struct{ start, end int }
+
+// NewFragmentingTransport splits packets sent over inner to fit opts.MaxPacket
+func NewFragmentingTransport(inner Transport, opts FragmentOptions) (*FragmentingTransport, error) {
+	if opts.MaxPacket < MinFragmentSize {
+		return nil, fmt.Errorf("fragment size %d is too small (minimum %d)", opts.MaxPacket, MinFragmentSize)
+	}
+	if opts.ReassemblyTimeout <= 0 {
+		opts.ReassemblyTimeout = DefaultReassemblyTimeout
+	}
+	return &FragmentingTransport{inner: inner, opts: opts, partial: make(map[uint32]*reassembly)}, nil
+}
+
+func (t *FragmentingTransport) SendBatch(packets [][]byte) error {
+	out := packets // Rebuilt only once a packet needs splitting
+	split := false
+	var pieces [][]byte
+	// The inner transport is done with the pieces once SendBatch returns
+	defer func() {
+		for _, p := range pieces {
+			bufpool.Put(p)
+		}
+	}()
+
+	for i, pkt := range packets {
+		if len(pkt) <= t.opts.MaxPacket && !protocol.IsFragment(pkt) {
+			if split {
+				out = append(out, pkt)
+			}
+			continue
+		}
+		if !split {
+			out, split = append([][]byte(nil), packets[:i]...), true
+		}
+		if len(pkt) > 0xFFFF {
+			metrics.DroppedPackets.Inc() // Offsets are 16 bits, like IP's
+			continue
+		}
+
+		id := t.nextID.Add(1)
+		chunk := t.opts.MaxPacket - protocol.FragmentHeaderLen
+		for off := 0; off < len(pkt); off += chunk {
+			end := min(off+chunk, len(pkt))
+			f := protocol.Fragment{ID: id, Offset: uint16(off), More: end < len(pkt), Payload: pkt[off:end]}
+			var buf []byte
+			if protocol.FragmentHeaderLen+len(f.Payload) <= bufpool.Size {
+				buf = bufpool.Get()
+			} else {
+				buf = make([]byte, protocol.FragmentHeaderLen+len(f.Payload))
+			}
+			piece := buf[:f.EncodeTo(buf)]
+			pieces = append(pieces, piece)
+			out = append(out, piece)
+		}
+		if len(pkt) > t.opts.MaxPacket {
+			metrics.FragmentedPackets.Inc()
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return t.inner.SendBatch(out)
+}
+
+// Recv returns the next message with fragmented packets put back together
+func (t *FragmentingTransport) Recv() (protocol.TunnelMessage, error) {
+	for {
+		msg, err := t.inner.Recv()
+		if err != nil {
+			return nil, err
+		}
+
+		switch m := msg.(type) {
+		case *protocol.IpPacket:
+			pkt, ok := t.accept(m.Payload)
+			if !ok {
+				continue
+			}
+			return &protocol.IpPacket{Payload: pkt}, nil
+
+		case *protocol.BatchIpPacket:
+			if packets := t.acceptAll(m.Packets); len(packets) > 0 {
+				return &protocol.BatchIpPacket{Packets: packets}, nil
+			}
+
+		default:
+			return msg, nil
+		}
+	}
+}
+
+// RecvBatch returns the next group of packets, fragmented ones put back together
+func (t *FragmentingTransport) RecvBatch() ([][]byte, error) {
+	return t.RecvBatchContext(context.Background())
+}
+
+// RecvBatchContext is RecvBatch, cancellable if the inner transport is
+func (t *FragmentingTransport) RecvBatchContext(ctx context.Context) ([][]byte, error) {
+	for {
+		packets, err := recvBatchContext(ctx, t.inner)
+		if err != nil {
+			return nil, err
+		}
+		if packets = t.acceptAll(packets); len(packets) > 0 {
+			return packets, nil
+		}
+	}
+}
+
+// Lease passes through to the inner transport
+func (t *FragmentingTransport) Lease(ctx context.Context) (netip.Prefix, error) {
+	return leaseFrom(ctx, t.inner)
+}
+
+func (t *FragmentingTransport) Close() {
+	t.inner.Close()
+}
+
+// acceptAll filters packets in place, holding back fragments until their
+// packet is complete
+func (t *FragmentingTransport) acceptAll(packets [][]byte) [][]byte {
+	kept := packets[:0]
+	for _, pkt := range packets {
+		if pkt, ok := t.accept(pkt); ok {
+			kept = append(kept, pkt)
+		}
+	}
+	return kept
+}
+
+// accept passes a whole packet through, or adds a fragment to its
+// reassembly and returns the packet once the last piece is in
+func (t *FragmentingTransport) accept(pkt []byte) ([]byte, bool) {
+	if !protocol.IsFragment(pkt) {
+		return pkt, true
+	}
+	defer bufpool.Put(pkt) // Copied into the reassembly buffer
+	f, err := protocol.DecodeFragment(pkt)
+	if err != nil || int(f.Offset)+len(f.Payload) > 0xFFFF {
+		metrics.DroppedPackets.Inc()
+		return nil, false
+	}
+	end := int(f.Offset) + len(f.Payload)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	t.expire(now)
+
+	r := t.partial[f.ID]
+	if r == nil {
+		if len(t.partial) >= maxReassemblies {
+			metrics.DroppedPackets.Inc()
+			return nil, false
+		}
+		r = &reassembly{buf: bufpool.Get()[:0], size: -1, deadline: now.Add(t.opts.ReassemblyTimeout)}
+		t.partial[f.ID] = r
+	}
+
+	// Counting bytes only adds up if every byte comes once. We never send
+	// pieces that overlap, or that disagree on where the packet ends, so
+	// those aren't a packet of ours; a piece seen before was duplicated on
+	// the way.
+	start := int(f.Offset)
+	valid := (r.size < 0 || end <= r.size) && (f.More || (r.size < 0 && end >= len(r.buf)))
+	for _, p := range r.pieces {
+		if p.start == start && p.end == end {
+			return nil, false // Duplicate
+		}
+		if start < p.end && p.start < end {
+			valid = false
+		}
+	}
+	if !valid {
+		delete(t.partial, f.ID)
+		bufpool.Put(r.buf)
+		metrics.DroppedPackets.Inc()
+		return nil, false
+	}
+	r.pieces = append(r.pieces, span{start, end})
+
+	if end > cap(r.buf) {
+		grown := make([]byte, len(r.buf), end)
+		copy(grown, r.buf)
+		bufpool.Put(r.buf)
+		r.buf = grown
+	}
+	if end > len(r.buf) {
+		r.buf = r.buf[:end]
+	}
+	copy(r.buf[f.Offset:], f.Payload)
+	r.received += len(f.Payload)
+	if !f.More {
+		r.size = end
+	}
+
+	// With no overlaps and nothing past the end, all bytes are in
+	if r.size < 0 || r.received < r.size {
+		return nil, false
+	}
+	delete(t.partial, f.ID)
+	return r.buf, true
+}
+
+// expire drops reassemblies past their deadline. It runs as fragments
+// arrive; the caller holds t.mu.
+func (t *FragmentingTransport) expire(now time.Time) {
+	for id, r := range t.partial {
+		if now.After(r.deadline) {
+			delete(t.partial, id)
+			bufpool.Put(r.buf)
+			metrics.ReassemblyTimeouts.Inc()
+			metrics.DroppedPackets.Inc()
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package vpn
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/zks-vpn/zks-go-client/protocol"
+)
+
+// piece encodes the bytes [off, end) of pkt as a fragment of packet 1
+func piece(pkt []byte, off, end int, more bool) []byte {
+	f := protocol.Fragment{ID: 1, Offset: uint16(off), More: more, Payload: pkt[off:end]}
+	return f.Encode()
+}
+
+func TestFragmentReassembly(t *testing.T) {
+	pkt := udpPacket(300, 7)
+	tests := []struct {
+		name   string
+		pieces [][]byte
+		whole  bool
+	}{
+		{"in order", [][]byte{piece(pkt, 0, 100, true), piece(pkt, 100, 200, true), piece(pkt, 200, 300, false)}, true},
+		{"reordered and duplicated", [][]byte{piece(pkt, 200, 300, false), piece(pkt, 0, 100, true), piece(pkt, 0, 100, true), piece(pkt, 100, 200, true)}, true},
+		// 250 bytes arrive for a 250 byte packet, but 150-200 never did
+		{"overlap and gap", [][]byte{piece(pkt, 0, 100, true), piece(pkt, 50, 150, true), piece(pkt, 200, 250, false)}, false},
+		{"past the end", [][]byte{piece(pkt, 200, 250, false), piece(pkt, 0, 100, true), piece(pkt, 100, 300, true)}, false},
+		{"two ends", [][]byte{piece(pkt, 200, 300, false), piece(pkt, 0, 100, true), piece(pkt, 100, 200, false)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ft, err := NewFragmentingTransport(NewMemTransport(), FragmentOptions{MaxPacket: 576})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got [][]byte
+			for _, p := range tt.pieces {
+				if out, ok := ft.accept(p); ok {
+					got = append(got, out)
+				}
+			}
+			switch {
+			case !tt.whole && len(got) > 0:
+				t.Fatalf("reassembled %d bytes from bad pieces", len(got[0]))
+			case tt.whole && (len(got) != 1 || !bytes.Equal(got[0], pkt)):
+				t.Fatalf("got %d packets, want the original", len(got))
+			}
+		})
+	}
+}
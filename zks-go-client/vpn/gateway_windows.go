@@ -0,0 +1,195 @@
+//go:build windows
+
+package vpn
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// mibIPForwardRow is MIB_IPFORWARDROW from iphlpapi
+type mibIPForwardRow struct {
+	Dest      uint32
+	Mask      uint32
+	Policy    uint32
+	NextHop   uint32
+	IfIndex   uint32
+	Type      uint32
+	Proto     uint32
+	Age       uint32
+	NextHopAS uint32
+	Metric1   uint32
+	Metric2   uint32
+	Metric3   uint32
+	Metric4   uint32
+	Metric5   uint32
+}
+
+// getDefaultGateway tries, in order: the IP Helper API, Get-NetRoute, and
+// parsing `route print`. The API needs no output parsing, so it works
+// regardless of the Windows display language.
+func getDefaultGateway() (string, error) {
+	var errs []string
+	for _, detect := range []struct {
+		name string
+		fn   func() (string, error)
+	}{
+		{"GetBestRoute", gatewayFromBestRoute},
+		{"Get-NetRoute", gatewayFromNetRoute},
+		{"route print", gatewayFromRoutePrint},
+	} {
+		gw, err := detect.fn()
+		if err == nil {
+			return gw, nil
+		}
+		log.Printf("   ⚠️ Gateway detection via %s failed: %v", detect.name, err)
+		errs = append(errs, fmt.Sprintf("%s: %v", detect.name, err))
+	}
+	return "", fmt.Errorf("no default gateway found (%s)", strings.Join(errs, "; "))
+}
+
+// gatewayFromBestRoute asks Windows which route it would use for a public
+// address. Only meaningful before our split routes are installed.
+func gatewayFromBestRoute() (string, error) {
+	if err := procGetBestRoute.Find(); err != nil {
+		return "", err
+	}
+
+	var row mibIPForwardRow
+	// DWORD addresses are in network byte order in memory
+	dest := binary.LittleEndian.Uint32(net.IPv4(1, 1, 1, 1).To4())
+	r, _, _ := procGetBestRoute.Call(uintptr(dest), 0, uintptr(unsafe.Pointer(&row)))
+	if r != 0 {
+		return "", windows.Errno(r)
+	}
+
+	var hop [4]byte
+	binary.LittleEndian.PutUint32(hop[:], row.NextHop)
+	gw := net.IP(hop[:])
+	if gw.IsUnspecified() {
+		return "", fmt.Errorf("best route (interface %d) is on-link, no gateway", row.IfIndex)
+	}
+	return gw.String(), nil
+}
+
+// gatewayFromNetRoute returns the next hop of the 0.0.0.0/0 route.
+// We get all NextHops and filter in Go to avoid PowerShell syntax issues.
+func gatewayFromNetRoute() (string, error) {
+	cmd := exec.Command("powershell", "-Command", "Get-NetRoute -DestinationPrefix '0.0.0.0/0' | Select-Object -ExpandProperty NextHop")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("Get-NetRoute failed: %v", err)
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\r\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && line != "0.0.0.0" && line != "::" {
+			return line, nil
+		}
+	}
+	return "", fmt.Errorf("no default route")
+}
+
+// gatewayFromRoutePrint parses `route print 0.0.0.0`. Only the numeric
+// columns are used (destination, mask, gateway, interface, metric), so
+// localized headers don't matter; with several adapters the lowest metric wins.
+func gatewayFromRoutePrint() (string, error) {
+	out, err := exec.Command("route", "print", "0.0.0.0").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("route print failed: %v", err)
+	}
+
+	best, bestMetric := "", -1
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 || fields[0] != "0.0.0.0" || fields[1] != "0.0.0.0" {
+			continue
+		}
+		gw := net.ParseIP(fields[2]).To4()
+		metric, err := strconv.Atoi(fields[4])
+		if gw == nil || gw.IsUnspecified() || err != nil {
+			continue // "On-link" (in whatever language) or garbage
+		}
+		if bestMetric < 0 || metric < bestMetric {
+			best, bestMetric = gw.String(), metric
+		}
+	}
+	if best == "" {
+		return "", fmt.Errorf("no 0.0.0.0 route with a gateway")
+	}
+	return best, nil
+}
+
+// getDefaultGateway6 returns the next hop of the lowest-metric ::/0 route
+// with a gateway, zoned with its interface index ("fe80::1%12")
+func getDefaultGateway6() (string, error) {
+	cmd := exec.Command("powershell", "-Command", "Get-NetRoute -AddressFamily IPv6 -DestinationPrefix '::/0' | ForEach-Object { \"$($_.NextHop) $($_.ifIndex) $($_.RouteMetric + $_.InterfaceMetric)\" }")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("Get-NetRoute failed: %v", err)
+	}
+
+	best, bestMetric := "", -1
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\r\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		gw := net.ParseIP(fields[0])
+		metric, err := strconv.Atoi(fields[2])
+		if gw == nil || gw.IsUnspecified() || err != nil {
+			continue
+		}
+		if bestMetric < 0 || metric < bestMetric {
+			best, bestMetric = fields[0]+"%"+fields[1], metric
+		}
+	}
+	if best == "" {
+		return "", fmt.Errorf("no ::/0 route with a gateway")
+	}
+	return best, nil
+}
+
+// getInterfaceGateway returns the next hop of the 0.0.0.0/0 route on the
+// adapter named name (its alias, as net.Interface reports it)
+func getInterfaceGateway(name string) (string, error) {
+	cmd := exec.Command("powershell", "-NoProfile", "-Command", fmt.Sprintf("Get-NetRoute -InterfaceAlias '%s' -DestinationPrefix '0.0.0.0/0' | Select-Object -ExpandProperty NextHop", strings.ReplaceAll(name, "'", "''")))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("Get-NetRoute failed: %v", err)
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\r\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && line != "0.0.0.0" {
+			return line, nil
+		}
+	}
+	return "", fmt.Errorf("no default route on %s", name)
+}
+
+// getInterfaceGateway6 returns the next hop of the ::/0 route on the
+// adapter named name, zoned with its interface index
+func getInterfaceGateway6(name string) (string, error) {
+	cmd := exec.Command("powershell", "-NoProfile", "-Command", fmt.Sprintf("Get-NetRoute -AddressFamily IPv6 -InterfaceAlias '%s' -DestinationPrefix '::/0' | ForEach-Object { \"$($_.NextHop) $($_.ifIndex)\" }", strings.ReplaceAll(name, "'", "''")))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("Get-NetRoute failed: %v", err)
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\r\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] != "::" && net.ParseIP(fields[0]) != nil {
+			return fields[0] + "%" + fields[1], nil
+		}
+	}
+	return "", fmt.Errorf("no IPv6 default route on %s", name)
+}
@@ -0,0 +1,177 @@
+//go:build windows
+
+package vpn
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// IP Helper entry points not wrapped by x/sys/windows
+var (
+	modiphlpapi = windows.NewLazySystemDLL("iphlpapi.dll")
+
+	procGetBestRoute                    = modiphlpapi.NewProc("GetBestRoute")
+	procConvertInterfaceAliasToLuid     = modiphlpapi.NewProc("ConvertInterfaceAliasToLuid")
+	procConvertInterfaceIndexToLuid     = modiphlpapi.NewProc("ConvertInterfaceIndexToLuid")
+	procInitializeUnicastIpAddressEntry = modiphlpapi.NewProc("InitializeUnicastIpAddressEntry")
+	procCreateUnicastIpAddressEntry     = modiphlpapi.NewProc("CreateUnicastIpAddressEntry")
+	procInitializeIpForwardEntry        = modiphlpapi.NewProc("InitializeIpForwardEntry")
+	procCreateIpForwardEntry2           = modiphlpapi.NewProc("CreateIpForwardEntry2")
+	procDeleteIpForwardEntry2           = modiphlpapi.NewProc("DeleteIpForwardEntry2")
+	procInitializeIpInterfaceEntry      = modiphlpapi.NewProc("InitializeIpInterfaceEntry")
+	procGetIpInterfaceEntry             = modiphlpapi.NewProc("GetIpInterfaceEntry")
+	procSetIpInterfaceEntry             = modiphlpapi.NewProc("SetIpInterfaceEntry")
+)
+
+const (
+	ipDadStatePreferred = 4 // IP_DAD_STATE IpDadStatePreferred
+	mibIPProtoNetMgmt   = 3 // MIB_IPPROTO_NETMGMT: a static route
+)
+
+// ipAddressPrefix is IP_ADDRESS_PREFIX
+type ipAddressPrefix struct {
+	Prefix       windows.RawSockaddrInet6 // SOCKADDR_INET union
+	PrefixLength uint8
+	_            [3]byte
+}
+
+// mibIPForwardRow2 is MIB_IPFORWARD_ROW2
+type mibIPForwardRow2 struct {
+	InterfaceLuid        uint64
+	InterfaceIndex       uint32
+	DestinationPrefix    ipAddressPrefix
+	NextHop              windows.RawSockaddrInet6 // SOCKADDR_INET union
+	SitePrefixLength     uint8
+	ValidLifetime        uint32
+	PreferredLifetime    uint32
+	Metric               uint32
+	Protocol             uint32
+	Loopback             uint8
+	AutoconfigureAddress uint8
+	Publish              uint8
+	Immortal             uint8
+	Age                  uint32
+	Origin               uint32
+}
+
+// callIPHelper calls an IP Helper function that returns a Win32 error code
+func callIPHelper(proc *windows.LazyProc, args ...uintptr) error {
+	if err := proc.Find(); err != nil {
+		return err
+	}
+	if r, _, _ := proc.Call(args...); r != 0 {
+		return fmt.Errorf("%s: %w", proc.Name, windows.Errno(r))
+	}
+	return nil
+}
+
+// ignoreExists treats "already exists" as success, like `ip route replace`,
+// so a leftover entry from a crashed run doesn't fail bring-up
+func ignoreExists(err error) error {
+	if errors.Is(err, windows.ERROR_OBJECT_ALREADY_EXISTS) {
+		return nil
+	}
+	return err
+}
+
+// sockaddrInet fills a SOCKADDR_INET for addr
+func sockaddrInet(addr netip.Addr) windows.RawSockaddrInet6 {
+	var sa windows.RawSockaddrInet6
+	if addr.Is4() {
+		sa4 := (*windows.RawSockaddrInet4)(unsafe.Pointer(&sa))
+		sa4.Family = windows.AF_INET
+		sa4.Addr = addr.As4()
+	} else {
+		sa.Family = windows.AF_INET6
+		sa.Addr = addr.As16()
+	}
+	return sa
+}
+
+// interfaceLUID resolves an adapter alias such as "zks-tun0" to its LUID
+func interfaceLUID(alias string) (uint64, error) {
+	name, err := windows.UTF16PtrFromString(alias)
+	if err != nil {
+		return 0, err
+	}
+	var luid uint64
+	if err := callIPHelper(procConvertInterfaceAliasToLuid, uintptr(unsafe.Pointer(name)), uintptr(unsafe.Pointer(&luid))); err != nil {
+		return 0, fmt.Errorf("interface %q: %w", alias, err)
+	}
+	return luid, nil
+}
+
+// interfaceLUIDFromIndex resolves an interface index to its LUID
+func interfaceLUIDFromIndex(ifIndex uint32) (uint64, error) {
+	var luid uint64
+	if err := callIPHelper(procConvertInterfaceIndexToLuid, uintptr(ifIndex), uintptr(unsafe.Pointer(&luid))); err != nil {
+		return 0, fmt.Errorf("interface %d: %w", ifIndex, err)
+	}
+	return luid, nil
+}
+
+// addUnicastAddress assigns prefix.Addr() with prefix.Bits() on-link to the interface
+func addUnicastAddress(luid uint64, prefix netip.Prefix) error {
+	var row windows.MibUnicastIpAddressRow
+	procInitializeUnicastIpAddressEntry.Call(uintptr(unsafe.Pointer(&row)))
+	row.InterfaceLuid = luid
+	row.Address = sockaddrInet(prefix.Addr())
+	row.OnLinkPrefixLength = uint8(prefix.Bits())
+	row.DadState = ipDadStatePreferred
+	return ignoreExists(callIPHelper(procCreateUnicastIpAddressEntry, uintptr(unsafe.Pointer(&row))))
+}
+
+// routeRow builds the MIB_IPFORWARD_ROW2 for dest via nextHop on an interface.
+// An invalid nextHop makes the route on-link (no gateway).
+func routeRow(luid uint64, ifIndex uint32, dest netip.Prefix, nextHop netip.Addr, metric uint32) *mibIPForwardRow2 {
+	var row mibIPForwardRow2
+	procInitializeIpForwardEntry.Call(uintptr(unsafe.Pointer(&row)))
+	row.InterfaceLuid = luid
+	row.InterfaceIndex = ifIndex
+	row.DestinationPrefix.Prefix = sockaddrInet(dest.Addr())
+	row.DestinationPrefix.PrefixLength = uint8(dest.Bits())
+	if !nextHop.IsValid() {
+		nextHop = netip.IPv4Unspecified()
+		if dest.Addr().Is6() {
+			nextHop = netip.IPv6Unspecified()
+		}
+	}
+	row.NextHop = sockaddrInet(nextHop)
+	row.Metric = metric
+	row.Protocol = mibIPProtoNetMgmt
+	return &row
+}
+
+// addRoute installs a route and returns a function that removes it again
+func addRoute(luid uint64, ifIndex uint32, dest netip.Prefix, nextHop netip.Addr, metric uint32) (func() error, error) {
+	row := routeRow(luid, ifIndex, dest, nextHop, metric)
+	if err := ignoreExists(callIPHelper(procCreateIpForwardEntry2, uintptr(unsafe.Pointer(row)))); err != nil {
+		return nil, err
+	}
+	return func() error {
+		return callIPHelper(procDeleteIpForwardEntry2, uintptr(unsafe.Pointer(routeRow(luid, ifIndex, dest, nextHop, metric))))
+	}, nil
+}
+
+// updateInterface reads the interface's per-family settings, lets fn change
+// them and writes them back
+func updateInterface(luid uint64, family uint16, fn func(row *windows.MibIpInterfaceRow)) error {
+	var row windows.MibIpInterfaceRow
+	procInitializeIpInterfaceEntry.Call(uintptr(unsafe.Pointer(&row)))
+	row.Family = family
+	row.InterfaceLuid = luid
+	if err := callIPHelper(procGetIpInterfaceEntry, uintptr(unsafe.Pointer(&row))); err != nil {
+		return err
+	}
+
+	fn(&row)
+	if family == windows.AF_INET {
+		row.SitePrefixLength = 0 // SetIpInterfaceEntry rejects anything else for IPv4
+	}
+	return callIPHelper(procSetIpInterfaceEntry, uintptr(unsafe.Pointer(&row)))
+}
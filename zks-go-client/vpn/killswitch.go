@@ -0,0 +1,27 @@
+package vpn
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+// killSwitchOn is set while the kill switch rules are installed
+var killSwitchOn atomic.Bool
+
+// KillSwitchActive reports whether the kill switch rules are installed
+func KillSwitchActive() bool {
+	return killSwitchOn.Load()
+}
+
+// DisableKillSwitch removes the kill switch firewall rules. It is not part
+// of RestoreNetwork on purpose: when the tunnel dies the rules stay, so
+// nothing leaks until the user shuts the client down. It is safe to call
+// when the kill switch was never enabled.
+func DisableKillSwitch() {
+	killSwitchOn.Store(false)
+	if err := disableKillSwitch(); err != nil {
+		log.Printf("⚠️ Failed to remove kill switch: %v", err)
+		return
+	}
+	log.Printf("🔓 Kill switch removed")
+}
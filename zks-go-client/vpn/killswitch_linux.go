@@ -0,0 +1,62 @@
+//go:build linux
+
+package vpn
+
+import (
+	"fmt"
+	"net/netip"
+	"os/exec"
+	"strings"
+)
+
+const killSwitchTable = "zks_killswitch"
+
+// enableKillSwitch drops every outbound packet that isn't going into the
+// TUN, to loopback, or to one of allow (the relay / Entry Node). DHCP and
+// IPv6 neighbour discovery stay open so the physical link keeps working.
+func enableKillSwitch(ifaceName string, allow []string) error {
+	var v4, v6 []string
+	for _, ip := range allow {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			return fmt.Errorf("invalid kill switch address %q", ip)
+		}
+		if addr.Is4() {
+			v4 = append(v4, addr.String())
+		} else {
+			v6 = append(v6, addr.String())
+		}
+	}
+
+	// Declaring then deleting the table replaces a leftover one atomically
+	var b strings.Builder
+	fmt.Fprintf(&b, "table inet %s\ndelete table inet %s\n", killSwitchTable, killSwitchTable)
+	fmt.Fprintf(&b, "table inet %s {\n\tchain output {\n", killSwitchTable)
+	b.WriteString("\t\ttype filter hook output priority 0; policy drop;\n")
+	b.WriteString("\t\toifname \"lo\" accept\n")
+	fmt.Fprintf(&b, "\t\toifname %q accept\n", ifaceName)
+	if len(v4) > 0 {
+		fmt.Fprintf(&b, "\t\tip daddr { %s } accept\n", strings.Join(v4, ", "))
+	}
+	if len(v6) > 0 {
+		fmt.Fprintf(&b, "\t\tip6 daddr { %s } accept\n", strings.Join(v6, ", "))
+	}
+	b.WriteString("\t\tudp sport 68 udp dport 67 accept\n")
+	b.WriteString("\t\ticmpv6 type { nd-router-solicit, nd-neighbor-solicit, nd-neighbor-advert } accept\n")
+	b.WriteString("\t}\n}\n")
+
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(b.String())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("nft failed: %v, output: %s", err, out)
+	}
+	return nil
+}
+
+func disableKillSwitch() error {
+	out, err := exec.Command("nft", "delete", "table", "inet", killSwitchTable).CombinedOutput()
+	if err != nil && !strings.Contains(string(out), "No such file or directory") {
+		return fmt.Errorf("nft failed: %v, output: %s", err, out)
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux && !windows
+
+package vpn
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func enableKillSwitch(ifaceName string, allow []string) error {
+	return fmt.Errorf("kill switch is not supported on %s", runtime.GOOS)
+}
+
+func disableKillSwitch() error {
+	return nil
+}
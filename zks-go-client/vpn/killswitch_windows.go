@@ -0,0 +1,91 @@
+//go:build windows
+
+package vpn
+
+import (
+	"fmt"
+	"net/netip"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+const killSwitchGroup = "ZKS-VPN Kill Switch"
+
+var (
+	killSwitchMu sync.Mutex
+	// killSwitchPrev holds each firewall profile's DefaultOutboundAction
+	// from before the kill switch, e.g. "Domain" -> "NotConfigured"
+	killSwitchPrev map[string]string
+)
+
+// enableKillSwitch flips the firewall's default outbound action to Block and
+// allows only the TUN adapter and allow (the relay / Entry Node). Windows
+// keeps loopback and its built-in Core Networking rules (DHCP) working.
+func enableKillSwitch(ifaceName string, allow []string) error {
+	quoted := make([]string, len(allow))
+	for i, ip := range allow {
+		if _, err := netip.ParseAddr(ip); err != nil {
+			return fmt.Errorf("invalid kill switch address %q", ip)
+		}
+		quoted[i] = "'" + ip + "'"
+	}
+
+	// A leftover group means a crashed run already set Block, so the real
+	// previous action is the Windows default
+	script := fmt.Sprintf(`
+		$ErrorActionPreference = 'Stop'
+		$stale = Get-NetFirewallRule -Group '%[1]s' -ErrorAction SilentlyContinue
+		Get-NetFirewallProfile | ForEach-Object {
+			$prev = if ($stale) { 'NotConfigured' } else { $_.DefaultOutboundAction }
+			"$($_.Name)=$prev"
+		}
+		Remove-NetFirewallRule -Group '%[1]s' -ErrorAction SilentlyContinue
+		New-NetFirewallRule -DisplayName '%[1]s (tunnel)' -Group '%[1]s' -Direction Outbound -Action Allow -InterfaceAlias '%[2]s' | Out-Null
+		New-NetFirewallRule -DisplayName '%[1]s (endpoints)' -Group '%[1]s' -Direction Outbound -Action Allow -RemoteAddress %[3]s | Out-Null
+		Set-NetFirewallProfile -All -DefaultOutboundAction Block
+	`, killSwitchGroup, ifaceName, strings.Join(quoted, ","))
+
+	out, err := exec.Command("powershell", "-NoProfile", "-Command", script).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v, output: %s", err, out)
+	}
+
+	prev := make(map[string]string)
+	for _, line := range strings.Split(string(out), "\n") {
+		if name, action, ok := strings.Cut(strings.TrimSpace(line), "="); ok {
+			prev[name] = action
+		}
+	}
+	killSwitchMu.Lock()
+	killSwitchPrev = prev
+	killSwitchMu.Unlock()
+	return nil
+}
+
+func disableKillSwitch() error {
+	killSwitchMu.Lock()
+	prev := killSwitchPrev
+	killSwitchPrev = nil
+	killSwitchMu.Unlock()
+
+	// Without a record (e.g. after a crash) fall back to the Windows default
+	restore := "Set-NetFirewallProfile -All -DefaultOutboundAction NotConfigured"
+	if len(prev) > 0 {
+		var cmds []string
+		for name, action := range prev {
+			cmds = append(cmds, fmt.Sprintf("Set-NetFirewallProfile -Name '%s' -DefaultOutboundAction %s", name, action))
+		}
+		restore = strings.Join(cmds, "\n")
+	}
+
+	script := fmt.Sprintf(`
+		if (-not (Get-NetFirewallRule -Group '%s' -ErrorAction SilentlyContinue)) { return }
+		%s
+		Remove-NetFirewallRule -Group '%s'
+	`, killSwitchGroup, restore, killSwitchGroup)
+	if out, err := exec.Command("powershell", "-NoProfile", "-Command", script).CombinedOutput(); err != nil {
+		return fmt.Errorf("%v, output: %s", err, out)
+	}
+	return nil
+}
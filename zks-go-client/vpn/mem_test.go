@@ -0,0 +1,187 @@
+package vpn
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/zks-vpn/zks-go-client/bufpool"
+)
+
+// memDevice is a packetDevice in memory: Read returns the batches queued on
+// in, Write hands what is written to out
+type memDevice struct {
+	in   chan [][]byte
+	out  chan [][]byte
+	done chan struct{}
+}
+
+func newMemDevice() *memDevice {
+	return &memDevice{in: make(chan [][]byte, 16), out: make(chan [][]byte, 16), done: make(chan struct{})}
+}
+
+func (d *memDevice) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	select {
+	case batch := <-d.in:
+		for i, pkt := range batch {
+			sizes[i] = copy(bufs[i][offset:], pkt)
+		}
+		return len(batch), nil
+	case <-d.done:
+		return 0, os.ErrClosed
+	}
+}
+
+func (d *memDevice) Write(bufs [][]byte, offset int) (int, error) {
+	batch := make([][]byte, len(bufs))
+	for i, buf := range bufs {
+		batch[i] = append([]byte(nil), buf[offset:]...)
+	}
+	select {
+	case d.out <- batch:
+		return len(bufs), nil
+	case <-d.done:
+		return 0, os.ErrClosed
+	}
+}
+
+func (d *memDevice) BatchSize() int { return readBatchSize }
+
+// udpPacket is an IPv4 UDP packet of size bytes, its payload filled with seq
+func udpPacket(size int, seq byte) []byte {
+	pkt := make([]byte, size)
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(size))
+	pkt[8] = 64
+	pkt[9] = protoUDP
+	copy(pkt[12:16], []byte{10, 0, 0, 2})
+	copy(pkt[16:20], []byte{10, 0, 0, 1})
+	binary.BigEndian.PutUint16(pkt[10:12], ^fold(sum16(pkt[:ipv4HeaderLen])))
+	binary.BigEndian.PutUint16(pkt[20:22], 40000)
+	binary.BigEndian.PutUint16(pkt[22:24], 53)
+	binary.BigEndian.PutUint16(pkt[24:26], uint16(size-ipv4HeaderLen)) // Checksum 0: none
+	for i := ipv4HeaderLen + 8; i < size; i++ {
+		pkt[i] = seq
+	}
+	return pkt
+}
+
+// stackedTransport is the wrapping main.go does with --fragment-size, --psk
+// and sequencing all on, over mem
+func stackedTransport(tb testing.TB, mem Transport) Transport {
+	tb.Helper()
+	fragmenting, err := NewFragmentingTransport(mem, FragmentOptions{MaxPacket: 576})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	encrypted, err := NewEncryptedTransport(fragmenting, "mem-room", "mem-pass")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return NewSequencedTransport(encrypted, SequencedTransportOptions{DropDuplicates: true})
+}
+
+// TestMemRoundTrip runs packets read from a device through readQueue, the
+// wrappers and a looped back MemTransport, and writes them back to the
+// device as the TUN's write side does
+func TestMemRoundTrip(t *testing.T) {
+	mem := NewMemTransport()
+	transport := stackedTransport(t, mem)
+	defer transport.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tn := &TUN{transport: transport, opts: Options{MTU: 1400}, done: make(chan struct{}), ctx: ctx, cancel: cancel}
+	defer close(tn.done)
+	dev := newMemDevice()
+	defer close(dev.done)
+
+	errChan := make(chan error, 2)
+	queue := newSendQueue(DefaultSendQueuePackets, DropOldest, &tn.stats)
+	go tn.readQueue(nil, dev, queue, errChan)
+	go tn.sendLoop(queue)
+	go func() {
+		for {
+			packets, err := tn.recv(errChan)
+			if err != nil {
+				return
+			}
+			if err := tn.writeDevice(dev, packets); err != nil {
+				errChan <- err
+			}
+			for _, pkt := range packets {
+				bufpool.Put(pkt)
+			}
+		}
+	}()
+
+	// Sizes around the fragment size, and the largest the MTU allows
+	var want [][]byte
+	for i, size := range []int{28, 575, 576, 577, 1200, 1400} {
+		want = append(want, udpPacket(size, byte(i)))
+	}
+	dev.in <- want[:3]
+	dev.in <- want[3:]
+
+	var got [][]byte
+	timeout := time.After(5 * time.Second)
+	for len(got) < len(want) {
+		select {
+		case batch := <-dev.out:
+			got = append(got, batch...)
+		case err := <-errChan:
+			t.Fatal(err)
+		case <-timeout:
+			t.Fatalf("got %d of %d packets", len(got), len(want))
+		}
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Fatalf("packet %d (%d bytes) came back as %d different bytes", i, len(want[i]), len(got[i]))
+		}
+	}
+}
+
+// BenchmarkMemTransport measures the packet path without a network: a
+// MemTransport alone, and wrapped as in stackedTransport
+func BenchmarkMemTransport(b *testing.B) {
+	for _, stacked := range []bool{false, true} {
+		name := "plain"
+		if stacked {
+			name = "stacked"
+		}
+		for _, size := range []int{1, 64} {
+			b.Run(fmt.Sprintf("%s/%d", name, size), func(b *testing.B) {
+				var transport Transport = NewMemTransport()
+				if stacked {
+					transport = stackedTransport(b, transport)
+				}
+				defer transport.Close()
+				packets := make([][]byte, size)
+				for i := range packets {
+					packets[i] = udpPacket(1280, byte(i))
+				}
+
+				b.ReportAllocs()
+				b.SetBytes(int64(size * 1280))
+				for range b.N {
+					if err := transport.SendBatch(packets); err != nil {
+						b.Fatal(err)
+					}
+					got, err := transport.RecvBatch()
+					if err != nil {
+						b.Fatal(err)
+					}
+					for _, pkt := range got {
+						bufpool.Put(pkt)
+					}
+				}
+				b.ReportMetric(float64(b.N*size)/b.Elapsed().Seconds(), "pkts/s")
+			})
+		}
+	}
+}
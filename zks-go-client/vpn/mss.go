@@ -0,0 +1,104 @@
+package vpn
+
+import (
+	"encoding/binary"
+
+	"github.com/zks-vpn/zks-go-client/metrics"
+)
+
+const (
+	tcpHeaderLen = 20
+	tcpFlagSYN   = 0x02
+	tcpOptEnd    = 0
+	tcpOptNOP    = 1
+	tcpOptMSS    = 2
+)
+
+// mssClamp rewrites the MSS option of TCP SYN and SYN-ACK segments down to
+// what fits the tunnel, so neither end sends segments that only fit a 1500
+// byte path. Without it a 1460 MSS plus DF stalls large transfers when path
+// MTU discovery is broken ("SSH connects but scp hangs").
+type mssClamp struct {
+	mss4 uint16 // For TCP over IPv4
+	mss6 uint16 // IPv6 has a 20 byte larger header
+}
+
+// newMSSClamp derives the MSS from the MTU unless mss overrides it (the
+// IPv4 value; IPv6 gets 20 bytes less)
+func newMSSClamp(mtu, mss int) *mssClamp {
+	if mss == 0 {
+		mss = mtu - ipv4HeaderLen - tcpHeaderLen
+	}
+	return &mssClamp{mss4: uint16(mss), mss6: uint16(mss - (ipv6HeaderLen - ipv4HeaderLen))}
+}
+
+// apply clamps pkt in place if it's a SYN with a larger MSS, fixing the TCP
+// checksum. pkt must have passed checkPacket.
+func (c *mssClamp) apply(pkt []byte) {
+	var segment []byte
+	var limit uint16
+	switch pkt[0] >> 4 {
+	case 4:
+		// Later fragments carry no TCP header
+		if pkt[9] != protoTCP || binary.BigEndian.Uint16(pkt[6:8])&0x1fff != 0 {
+			return
+		}
+		segment, limit = pkt[int(pkt[0]&0x0f)*4:], c.mss4
+	case 6:
+		// Extension headers aren't walked, like in PacketFilter
+		if pkt[6] != protoTCP {
+			return
+		}
+		segment, limit = pkt[ipv6HeaderLen:], c.mss6
+	default:
+		return
+	}
+	if segment[13]&tcpFlagSYN == 0 {
+		return
+	}
+	dataOff := int(segment[12]>>4) * 4
+	if dataOff < tcpHeaderLen || dataOff > len(segment) {
+		return
+	}
+
+	opts := segment[tcpHeaderLen:dataOff]
+	for i := 0; i < len(opts); {
+		switch opts[i] {
+		case tcpOptEnd:
+			return
+		case tcpOptNOP:
+			i++
+			continue
+		}
+		if i+1 >= len(opts) || opts[i+1] < 2 || i+int(opts[i+1]) > len(opts) {
+			return // Malformed options
+		}
+		if opts[i] == tcpOptMSS && opts[i+1] == 4 {
+			if binary.BigEndian.Uint16(opts[i+2:i+4]) > limit {
+				binary.BigEndian.PutUint16(opts[i+2:i+4], limit)
+				fixTCPChecksum(pkt, segment)
+				metrics.MSSClampedPackets.Inc()
+			}
+			return
+		}
+		i += int(opts[i+1])
+	}
+}
+
+// fixTCPChecksum recomputes the checksum of segment, the TCP part of pkt
+func fixTCPChecksum(pkt, segment []byte) {
+	setL4Checksum(pkt, segment, protoTCP, 16)
+}
+
+// sum16 adds up b as big-endian 16-bit words, padding an odd last byte
+func sum16(b []byte) uint32 {
+	var sum uint32
+	for len(b) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
@@ -0,0 +1,85 @@
+package vpn
+
+import (
+	"encoding/binary"
+
+	"github.com/zks-vpn/zks-go-client/metrics"
+)
+
+const (
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+)
+
+// IP protocol numbers with a minimum header checked by checkPacket
+const (
+	protoICMP   byte = 1
+	protoTCP    byte = 6
+	protoUDP    byte = 17
+	protoICMPv6 byte = 58
+	protoRsvd   byte = 255 // Reserved, never valid on the wire
+)
+
+// checkPacket validates the IP header of pkt against the bytes actually
+// read: version, IHL, total (or payload) length, and that the protocol's
+// own header fits. It returns the packet's length according to its header,
+// which drops any trailing bytes, or false if the packet must be dropped.
+func checkPacket(pkt []byte) (int, bool) {
+	if len(pkt) == 0 {
+		return 0, false
+	}
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < ipv4HeaderLen {
+			return 0, false
+		}
+		ihl := int(pkt[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(pkt[2:4]))
+		if ihl < ipv4HeaderLen || total < ihl || total > len(pkt) {
+			return 0, false
+		}
+		// Only the first fragment carries the protocol header
+		if binary.BigEndian.Uint16(pkt[6:8])&0x1fff != 0 {
+			return total, pkt[9] != protoRsvd
+		}
+		return total, protocolHeaderFits(pkt[9], total-ihl)
+
+	case 6:
+		if len(pkt) < ipv6HeaderLen {
+			return 0, false
+		}
+		// Payload length 0 means a jumbogram, which no MTU we use allows
+		total := ipv6HeaderLen + int(binary.BigEndian.Uint16(pkt[4:6]))
+		if total == ipv6HeaderLen || total > len(pkt) {
+			return 0, false
+		}
+		return total, protocolHeaderFits(pkt[6], total-ipv6HeaderLen)
+	}
+	return 0, false
+}
+
+// protocolHeaderFits checks that a payload of n bytes can hold the header
+// of proto. Protocols we don't know only need to not be reserved.
+func protocolHeaderFits(proto byte, n int) bool {
+	switch proto {
+	case protoTCP:
+		return n >= 20
+	case protoUDP, protoICMP, protoICMPv6:
+		return n >= 8
+	case protoRsvd:
+		return false
+	}
+	return true
+}
+
+// validPacket returns pkt trimmed to its header's length, or false after
+// counting it as malformed
+func validPacket(pkt []byte) ([]byte, bool) {
+	n, ok := checkPacket(pkt)
+	if !ok {
+		metrics.MalformedPackets.Inc()
+		metrics.DroppedPackets.Inc()
+		return nil, false
+	}
+	return pkt[:n], true
+}
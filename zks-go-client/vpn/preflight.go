@@ -0,0 +1,59 @@
+package vpn
+
+import (
+	"fmt"
+	"net"
+)
+
+// Preflight checks for --check. Each returns nil when the host is ready and
+// has no side effects.
+
+// CheckPrivileges reports whether we may create the TUN device and change routes
+func CheckPrivileges() error {
+	return checkPrivileges()
+}
+
+// CheckTUNDriver reports whether the platform TUN driver is available
+func CheckTUNDriver() error {
+	return checkTUNDriver()
+}
+
+// CheckAddressConflict reports an existing interface whose subnet overlaps
+// the tunnel subnet described by ip and netmask, such as a LAN that already
+// uses 10.0.85.0/24. An earlier tunnel of ours named ifaceName left behind
+// is ignored.
+func CheckAddressConflict(ip, netmask, ifaceName string) error {
+	opts := Options{IP: ip, Netmask: netmask, InterfaceName: ifaceName}
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	tunnel := &net.IPNet{
+		IP:   net.ParseIP(opts.IP).To4(),
+		Mask: net.IPMask(net.ParseIP(opts.Netmask).To4()),
+	}
+	tunnel.IP = tunnel.IP.Mask(tunnel.Mask)
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return fmt.Errorf("failed to list interfaces: %w", err)
+	}
+	for _, iface := range ifaces {
+		if iface.Name == opts.InterfaceName {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.To4() == nil {
+				continue
+			}
+			if tunnel.Contains(ipNet.IP) || ipNet.Contains(tunnel.IP) {
+				return fmt.Errorf("%s on %s overlaps the tunnel subnet %s", ipNet, iface.Name, tunnel)
+			}
+		}
+	}
+	return nil
+}
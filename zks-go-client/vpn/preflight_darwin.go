@@ -0,0 +1,18 @@
+package vpn
+
+import (
+	"fmt"
+	"os"
+)
+
+func checkPrivileges() error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("not running as root (try sudo)")
+	}
+	return nil
+}
+
+// checkTUNDriver has nothing to look for: utun is part of the kernel
+func checkTUNDriver() error {
+	return nil
+}
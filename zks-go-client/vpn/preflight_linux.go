@@ -0,0 +1,20 @@
+package vpn
+
+import (
+	"fmt"
+	"os"
+)
+
+func checkPrivileges() error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("not running as root (try sudo)")
+	}
+	return nil
+}
+
+func checkTUNDriver() error {
+	if _, err := os.Stat("/dev/net/tun"); err != nil {
+		return fmt.Errorf("/dev/net/tun is missing (modprobe tun): %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package vpn
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/windows"
+)
+
+func checkPrivileges() error {
+	if !windows.GetCurrentProcessToken().IsElevated() {
+		return fmt.Errorf("not running as Administrator")
+	}
+	return nil
+}
+
+// checkTUNDriver loads wintun.dll without extracting the bundled copy.
+// A build that bundles one passes, since Start extracts it.
+func checkTUNDriver() error {
+	err := loadWintun()
+	if err == nil || len(bundledWintun) > 0 {
+		return nil
+	}
+	path, pathErr := wintunPath()
+	if pathErr != nil {
+		return fmt.Errorf("wintun.dll can't be loaded: %w", err)
+	}
+	return wintunError(path, err)
+}
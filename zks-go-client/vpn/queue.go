@@ -0,0 +1,126 @@
+package vpn
+
+import (
+	"sync"
+
+	"github.com/zks-vpn/zks-go-client/bufpool"
+	"github.com/zks-vpn/zks-go-client/metrics"
+)
+
+// DefaultSendQueuePackets is how many packets may wait between the TUN
+// reader and the transport before the queue starts dropping
+const DefaultSendQueuePackets = 4096
+
+// QueuePolicy picks which packets a full send queue drops
+type QueuePolicy string
+
+const (
+	// DropOldest makes room by dropping the packets that have waited
+	// longest, which are the most likely to be retransmitted anyway
+	DropOldest QueuePolicy = "drop-oldest"
+	// DropNewest drops arriving packets, like a kernel tail drop
+	DropNewest QueuePolicy = "drop-newest"
+)
+
+// sendQueue sits between readLoop and the goroutine sending to the
+// transport. readLoop never blocks on a slow relay: once limit packets are
+// waiting, the policy decides what goes, and the drop is counted in
+// zks_send_queue_dropped_packets_total instead of vanishing in the kernel.
+type sendQueue struct {
+	limit  int
+	policy QueuePolicy
+	stats  *tunCounters
+
+	mu      sync.Mutex
+	reads   []readBatch
+	packets int
+
+	// ready holds a token while reads is non-empty
+	ready chan struct{}
+}
+
+func newSendQueue(limit int, policy QueuePolicy, stats *tunCounters) *sendQueue {
+	return &sendQueue{limit: limit, policy: policy, stats: stats, ready: make(chan struct{}, 1)}
+}
+
+// push queues one device read, dropping packets per the policy if it doesn't fit
+func (q *sendQueue) push(rb readBatch) {
+	q.mu.Lock()
+	dropped := 0
+	if q.policy == DropNewest {
+		if room := q.limit - q.packets; len(rb.packets) > room {
+			dropped += dropPackets(rb.packets[max(room, 0):])
+			rb.packets = rb.packets[:max(room, 0)]
+			rb.bytes = packetBytes(rb.packets)
+		}
+	}
+	if len(rb.packets) > 0 {
+		q.reads = append(q.reads, rb)
+		q.packets += len(rb.packets)
+	}
+	for q.packets > q.limit {
+		head := &q.reads[0]
+		n := min(q.packets-q.limit, len(head.packets))
+		dropped += dropPackets(head.packets[:n])
+		head.packets = head.packets[n:]
+		head.bytes = packetBytes(head.packets)
+		q.packets -= n
+		if len(head.packets) == 0 {
+			q.reads = q.reads[1:]
+		}
+	}
+	depth := q.packets
+	q.mu.Unlock()
+
+	metrics.SendQueuePackets.Set(float64(depth))
+	if dropped > 0 {
+		metrics.SendQueueDropped.Add(dropped)
+		metrics.DroppedPackets.Add(dropped)
+		q.stats.dropped.Add(uint64(dropped))
+	}
+	if depth > 0 {
+		q.signal()
+	}
+}
+
+// take pops the oldest read; ok is false if the queue turned out empty
+func (q *sendQueue) take() (rb readBatch, ok bool) {
+	q.mu.Lock()
+	if len(q.reads) > 0 {
+		rb, ok = q.reads[0], true
+		q.reads[0] = readBatch{}
+		q.reads = q.reads[1:]
+		q.packets -= len(rb.packets)
+	}
+	depth := q.packets
+	q.mu.Unlock()
+
+	metrics.SendQueuePackets.Set(float64(depth))
+	if depth > 0 {
+		q.signal() // More for the next receive on ready
+	}
+	return rb, ok
+}
+
+func (q *sendQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// dropPackets returns packets to the pool and counts them
+func dropPackets(packets [][]byte) int {
+	for _, pkt := range packets {
+		bufpool.Put(pkt)
+	}
+	return len(packets)
+}
+
+func packetBytes(packets [][]byte) int {
+	n := 0
+	for _, pkt := range packets {
+		n += len(pkt)
+	}
+	return n
+}
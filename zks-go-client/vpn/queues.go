@@ -0,0 +1,96 @@
+package vpn
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/maphash"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// MaxQueues caps Options.Queues at the kernel's limit per TUN device
+// (MAX_TAP_QUEUES)
+const MaxQueues = 256
+
+// multiQueueDevice is a TUN device opened with several queues (--queues),
+// each a file descriptor of its own that can be read and written in
+// parallel. As a tun.Device it is its first queue, except that Close closes
+// them all; readLoop reads every queue and writePackets spreads writes over
+// them.
+//
+// The kernel hands each outgoing flow to one queue by its own flow hash,
+// so a flow is only ever read by one readLoop and stays in order. Writes
+// are spread the same way by flowQueue, so a flow's packets from the
+// transport reach the stack in order too.
+type multiQueueDevice struct {
+	tun.Device
+	queues []tun.Device
+}
+
+// Close closes every queue; the interface goes away with the last one
+func (d *multiQueueDevice) Close() error {
+	var errs []error
+	for _, q := range d.queues {
+		errs = append(errs, q.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// write writes buffs, each holding a packet at offset, in one call per
+// queue, the queues in parallel so the stack processes them on several cores
+func (d *multiQueueDevice) write(buffs [][]byte, offset int) error {
+	groups := make([][][]byte, len(d.queues))
+	for _, buf := range buffs {
+		i := flowQueue(buf[offset:], len(d.queues))
+		groups[i] = append(groups[i], buf)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(d.queues))
+	for i, group := range groups {
+		if len(group) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = d.queues[i].Write(group, offset)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// flowSeed keys flowQueue, so the spread can't be steered from outside
+var flowSeed = maphash.MakeSeed()
+
+// flowQueue picks one of n queues for pkt by its flow: the addresses,
+// protocol and, for TCP and UDP, ports. Packets of one flow always get the
+// same queue. pkt must have passed validPacket.
+func flowQueue(pkt []byte, n int) int {
+	var key []byte
+	var proto byte
+	var transport []byte
+	switch pkt[0] >> 4 {
+	case 4:
+		key = pkt[12:20]
+		proto = pkt[9]
+		// Later fragments carry no ports; keep all of a datagram together
+		if binary.BigEndian.Uint16(pkt[6:8])&0x3fff == 0 {
+			transport = pkt[int(pkt[0]&0x0f)*4:]
+		}
+	case 6:
+		key = pkt[8:40]
+		proto = pkt[6]
+		transport = pkt[ipv6HeaderLen:]
+	}
+	var h maphash.Hash
+	h.SetSeed(flowSeed)
+	h.Write(key)
+	h.WriteByte(proto)
+	if (proto == protoTCP || proto == protoUDP) && len(transport) >= 4 {
+		h.Write(transport[:4])
+	}
+	return int(h.Sum64() % uint64(n))
+}
@@ -0,0 +1,81 @@
+//go:build linux
+
+package vpn
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// multiQueueSupported: IFF_MULTI_QUEUE is Linux only
+const multiQueueSupported = true
+
+// createMultiQueueTUN creates the TUN device name with n queues. Like
+// tun.CreateTUN it asks for the virtio-net header, so each queue keeps the
+// GSO/GRO offloads. Only the first queue watches the link for events.
+func createMultiQueueTUN(name string, mtu, n int) (tun.Device, error) {
+	d := &multiQueueDevice{}
+	for i := 0; i < n; i++ {
+		fd, err := openQueue(name)
+		if err != nil {
+			d.Close()
+			if i > 0 {
+				err = fmt.Errorf("queue %d: %w", i+1, err)
+			}
+			return nil, err
+		}
+		var q tun.Device
+		if i == 0 {
+			file := os.NewFile(uintptr(fd), "/dev/net/tun")
+			if q, err = tun.CreateTUNFromFile(file, mtu); err != nil {
+				file.Close()
+				d.Close()
+				return nil, err
+			}
+			// A name with %d was numbered by the kernel; attach to that one
+			if name, err = q.Name(); err != nil {
+				q.Close()
+				d.Close()
+				return nil, err
+			}
+		} else if q, _, err = tun.CreateUnmonitoredTUNFromFD(fd); err != nil {
+			unix.Close(fd)
+			d.Close()
+			return nil, fmt.Errorf("queue %d: %w", i+1, err)
+		}
+		d.queues = append(d.queues, q)
+	}
+	d.Device = d.queues[0]
+	return d, nil
+}
+
+// openQueue attaches a new file descriptor to the multi-queue TUN device
+// name, creating the device on the first call
+func openQueue(name string) (int, error) {
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, err
+	}
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	ifr.SetUint16(unix.IFF_TUN | unix.IFF_NO_PI | unix.IFF_VNET_HDR | unix.IFF_MULTI_QUEUE)
+	if err := unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		unix.Close(fd)
+		if err == unix.EINVAL {
+			// The flags must match an existing device's
+			return -1, fmt.Errorf("%s exists without multiple queues (delete it, or drop --queues): %w", name, err)
+		}
+		return -1, err
+	}
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package vpn
+
+import (
+	"fmt"
+	"runtime"
+
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// multiQueueSupported: IFF_MULTI_QUEUE is Linux only; Options.Validate
+// refuses Queues above 1 elsewhere
+const multiQueueSupported = false
+
+func createMultiQueueTUN(name string, mtu, n int) (tun.Device, error) {
+	return nil, fmt.Errorf("multiple TUN queues are not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,66 @@
+package vpn
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// benchQueues is a multiQueueDevice of n benchDevices sharing out left
+// packets to read
+func benchQueues(n, left int) (*multiQueueDevice, []*benchDevice) {
+	mq := &multiQueueDevice{}
+	devs := make([]*benchDevice, n)
+	for i := range devs {
+		devs[i] = &benchDevice{pkt: udpPacket(1280, 0), batch: readBatchSize, left: left / n}
+		mq.queues = append(mq.queues, tun.Device(devs[i]))
+	}
+	devs[0].left += left % n
+	mq.Device = mq.queues[0]
+	return mq, devs
+}
+
+// BenchmarkQueues compares one queue with several, reading b.N packets
+// through readLoop and writing batches of 64 packets from different flows.
+// The devices are in memory, so this measures the per-packet work the
+// queues spread over cores, not the kernel's.
+func BenchmarkQueues(b *testing.B) {
+	for _, n := range []int{1, 2, 4} {
+		b.Run(fmt.Sprintf("read/%d", n), func(b *testing.B) {
+			t := benchTUN()
+			defer close(t.done)
+			mq, _ := benchQueues(n, b.N)
+			queue := newSendQueue(DefaultSendQueuePackets, DropOldest, &t.stats)
+			go drain(queue, t.done)
+
+			b.SetBytes(1280)
+			errChan := make(chan error, n)
+			t.readLoop(mq, queue, errChan)
+			for range n {
+				<-errChan // Each queue ran out of packets
+			}
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "pkts/s")
+		})
+
+		b.Run(fmt.Sprintf("write/%d", n), func(b *testing.B) {
+			t := benchTUN()
+			mq, _ := benchQueues(n, 0)
+			t.device = mq
+			packets := make([][]byte, 64)
+			for i := range packets {
+				packets[i] = udpPacket(1280, 0)
+				binary.BigEndian.PutUint16(packets[i][20:22], uint16(40000+i))
+			}
+
+			b.SetBytes(64 * 1280)
+			for range b.N {
+				if err := t.writePackets(packets); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(b.N*64)/b.Elapsed().Seconds(), "pkts/s")
+		})
+	}
+}
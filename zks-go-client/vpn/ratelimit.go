@@ -0,0 +1,131 @@
+package vpn
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/zks-vpn/zks-go-client/metrics"
+)
+
+const (
+	// rateLimitBurst is how much idle time the bucket can save up, so short
+	// bursts (a web page load) go out at full speed
+	rateLimitBurst = 50 * time.Millisecond
+	// rateLimitMinBurst keeps a few full-size packets in the bucket at low rates
+	rateLimitMinBurst = 4 * MaxMTU
+	// rateLimitMaxDelay is how far behind the budget a batch may be before its
+	// packets are dropped instead of paced. Pacing blocks the TUN reader, so
+	// this is also the extra queueing latency the limiter can add.
+	rateLimitMaxDelay = 100 * time.Millisecond
+)
+
+// RateLimitedTransport wraps another Transport and shapes its outbound
+// traffic with a token bucket. Batches over budget are delayed; packets that
+// would put the bucket more than rateLimitMaxDelay in debt are dropped.
+// Receiving is passed straight through.
+type RateLimitedTransport struct {
+	Transport
+
+	rate  float64 // Bytes per second
+	burst float64 // Bucket size in bytes
+
+	mu     sync.Mutex
+	tokens float64 // May go negative: the debt the sender sleeps off
+	last   time.Time
+
+	// Observed rate, published once a second
+	windowStart time.Time
+	windowBytes int
+}
+
+// NewRateLimitedTransport limits inner's uplink to mbps megabits per second
+func NewRateLimitedTransport(inner Transport, mbps float64) *RateLimitedTransport {
+	rate := mbps * 1e6 / 8
+	burst := rate * rateLimitBurst.Seconds()
+	if burst < rateLimitMinBurst {
+		burst = rateLimitMinBurst
+	}
+	metrics.UplinkLimitBps.Set(mbps * 1e6)
+
+	now := time.Now()
+	return &RateLimitedTransport{
+		Transport:   inner,
+		rate:        rate,
+		burst:       burst,
+		tokens:      burst,
+		last:        now,
+		windowStart: now,
+	}
+}
+
+// SendBatch sends what the budget allows, sleeping off any debt afterwards
+func (t *RateLimitedTransport) SendBatch(packets [][]byte) error {
+	if len(packets) == 0 {
+		return nil
+	}
+
+	t.mu.Lock()
+	now := time.Now()
+	t.tokens += now.Sub(t.last).Seconds() * t.rate
+	if t.tokens > t.burst {
+		t.tokens = t.burst
+	}
+	t.last = now
+
+	floor := -t.rate * rateLimitMaxDelay.Seconds()
+	allowed := packets
+	dropped := 0
+	for i, pkt := range packets {
+		if t.tokens-float64(len(pkt)) < floor {
+			if dropped == 0 {
+				allowed = append([][]byte(nil), packets[:i]...)
+			}
+			dropped++
+			continue
+		}
+		t.tokens -= float64(len(pkt))
+		t.windowBytes += len(pkt)
+		if dropped > 0 {
+			allowed = append(allowed, pkt)
+		}
+	}
+
+	if elapsed := now.Sub(t.windowStart); elapsed >= time.Second {
+		metrics.UplinkRateBps.Set(float64(t.windowBytes) * 8 / elapsed.Seconds())
+		t.windowStart, t.windowBytes = now, 0
+	}
+
+	var wait time.Duration
+	if t.tokens < 0 {
+		wait = time.Duration(-t.tokens / t.rate * float64(time.Second))
+	}
+	t.mu.Unlock()
+
+	if dropped > 0 {
+		metrics.RateLimitDropped.Add(dropped)
+		metrics.DroppedPackets.Add(dropped)
+	}
+	if len(allowed) == 0 {
+		return nil
+	}
+
+	err := t.Transport.SendBatch(allowed)
+	if wait > 0 {
+		// Pace the caller so the next batch starts within budget
+		metrics.RateLimitDelayed.Inc()
+		time.Sleep(wait)
+	}
+	return err
+}
+
+// RecvBatchContext passes through to the wrapped transport
+func (t *RateLimitedTransport) RecvBatchContext(ctx context.Context) ([][]byte, error) {
+	return recvBatchContext(ctx, t.Transport)
+}
+
+// Lease passes through to the wrapped transport
+func (t *RateLimitedTransport) Lease(ctx context.Context) (netip.Prefix, error) {
+	return leaseFrom(ctx, t.Transport)
+}
@@ -0,0 +1,285 @@
+package vpn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/zks-vpn/zks-go-client/metrics"
+	"github.com/zks-vpn/zks-go-client/protocol"
+)
+
+const (
+	// DefaultReconnectMinBackoff and DefaultReconnectMaxBackoff bound the
+	// wait between failed dials, like the relay's own reconnect
+	DefaultReconnectMinBackoff = 500 * time.Millisecond
+	DefaultReconnectMaxBackoff = 30 * time.Second
+)
+
+// ErrReconnecting is returned by ReconnectingTransport.SendBatch while the
+// transport underneath is being replaced. The batch is dropped, like any
+// packet lost on the way; later batches go out once the redial succeeds.
+var ErrReconnecting = errors.New("transport reconnecting")
+
+// errTransportClosed is returned by a ReconnectingTransport after Close
+var errTransportClosed = errors.New("transport closed")
+
+// TransportFactory dials a fresh transport. ctx is cancelled when the
+// ReconnectingTransport is closed, so a slow dial can give up early.
+type TransportFactory func(ctx context.Context) (Transport, error)
+
+// ReconnectingTransport wraps transports made by a TransportFactory and
+// replaces the current one whenever it fails, so the layers above
+// (EncryptedTransport, SequencedTransport, RateLimitedTransport) and the TUN
+// never see the connection drop. Any error from the inner transport is taken
+// as a dead connection: it is closed and redialed with exponential backoff.
+//
+// In-flight operations across a reconnect:
+//   - SendBatch never waits. While redialing it fails with ErrReconnecting
+//     (errors.Is), and the batch that hit the failure is dropped too;
+//     blocking the TUN reader would only pile up stale packets.
+//   - Recv, RecvBatch and RecvBatchContext block until the new transport is
+//     up and receive from it, so the TUN's receive loop carries on.
+//
+// Once MaxAttempts dials in a row fail every call returns the last dial
+// error. The relay.Connection reconnects by itself; this is for the direct
+// Entry Node transports (UDP, TLS), which don't.
+type ReconnectingTransport struct {
+	dial   TransportFactory
+	opts   ReconnectingTransportOptions
+	ctx    context.Context // Cancelled by Close
+	cancel context.CancelFunc
+
+	mu    sync.Mutex
+	cur   Transport     // nil while redialing
+	ready chan struct{} // Closed when the redial is over, either way
+	err   error         // Set once closed or given up
+}
+
+// ReconnectingTransportOptions configures a ReconnectingTransport
+type ReconnectingTransportOptions struct {
+	// MinBackoff is the wait after the first failed dial, doubling up to
+	// MaxBackoff (0 = DefaultReconnectMinBackoff, DefaultReconnectMaxBackoff).
+	// The first redial after a failure goes out at once.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// MaxAttempts gives up after this many failed dials in a row (0 = never)
+	MaxAttempts int
+}
+
+// NewReconnectingTransport dials the first transport, failing if that does
+func NewReconnectingTransport(dial TransportFactory, opts ReconnectingTransportOptions) (*ReconnectingTransport, error) {
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = DefaultReconnectMinBackoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = DefaultReconnectMaxBackoff
+	}
+	opts.MaxBackoff = max(opts.MaxBackoff, opts.MinBackoff)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first, err := dial(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &ReconnectingTransport{dial: dial, opts: opts, ctx: ctx, cancel: cancel, cur: first}, nil
+}
+
+// SendBatch sends on the current transport, or fails with ErrReconnecting
+func (t *ReconnectingTransport) SendBatch(packets [][]byte) error {
+	return t.send(func(tr Transport) error {
+		return tr.SendBatch(packets)
+	})
+}
+
+// marksDSCP passes through to the current transport
+func (t *ReconnectingTransport) marksDSCP() bool {
+	t.mu.Lock()
+	tr := t.cur
+	t.mu.Unlock()
+	ds, ok := tr.(dscpSender)
+	return ok && ds.marksDSCP()
+}
+
+// sendBatchDSCP is SendBatch, keeping the marks if the current transport takes them
+func (t *ReconnectingTransport) sendBatchDSCP(packets [][]byte, tos []byte) error {
+	return t.send(func(tr Transport) error {
+		if ds, ok := tr.(dscpSender); ok {
+			return ds.sendBatchDSCP(packets, tos)
+		}
+		return tr.SendBatch(packets)
+	})
+}
+
+// send runs fn on the current transport, redialing if it fails
+func (t *ReconnectingTransport) send(fn func(Transport) error) error {
+	t.mu.Lock()
+	tr, err := t.cur, t.err
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if tr == nil {
+		return ErrReconnecting
+	}
+	if err := fn(tr); err != nil {
+		if t.ctx.Err() != nil {
+			return errTransportClosed
+		}
+		t.fail(tr, err)
+		return fmt.Errorf("%w: %v", ErrReconnecting, err)
+	}
+	return nil
+}
+
+// Recv receives from the current transport, waiting out reconnects
+func (t *ReconnectingTransport) Recv() (protocol.TunnelMessage, error) {
+	var msg protocol.TunnelMessage
+	err := t.retry(context.Background(), func(tr Transport) (err error) {
+		msg, err = tr.Recv()
+		return err
+	})
+	return msg, err
+}
+
+// RecvBatch receives from the current transport, waiting out reconnects
+func (t *ReconnectingTransport) RecvBatch() ([][]byte, error) {
+	return t.RecvBatchContext(context.Background())
+}
+
+// RecvBatchContext is RecvBatch, cancellable if the inner transports are
+func (t *ReconnectingTransport) RecvBatchContext(ctx context.Context) ([][]byte, error) {
+	var packets [][]byte
+	err := t.retry(ctx, func(tr Transport) (err error) {
+		packets, err = recvBatchContext(ctx, tr)
+		return err
+	})
+	return packets, err
+}
+
+// Lease passes through to the current transport
+func (t *ReconnectingTransport) Lease(ctx context.Context) (netip.Prefix, error) {
+	tr, err := t.wait(ctx)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return leaseFrom(ctx, tr)
+}
+
+func (t *ReconnectingTransport) Close() {
+	t.cancel()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err == nil {
+		t.err = errTransportClosed
+	}
+	if t.cur != nil {
+		t.cur.Close()
+		t.cur = nil
+	}
+}
+
+// retry runs fn on the current transport until it succeeds, redialing
+// whenever it fails
+func (t *ReconnectingTransport) retry(ctx context.Context, fn func(Transport) error) error {
+	for {
+		tr, err := t.wait(ctx)
+		if err != nil {
+			return err
+		}
+		err = fn(tr)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		t.fail(tr, err)
+	}
+}
+
+// wait returns the current transport, waiting for a redial in progress
+func (t *ReconnectingTransport) wait(ctx context.Context) (Transport, error) {
+	for {
+		t.mu.Lock()
+		tr, ready, err := t.cur, t.ready, t.err
+		t.mu.Unlock()
+		if err != nil || tr != nil {
+			return tr, err
+		}
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-t.ctx.Done():
+			return nil, errTransportClosed
+		}
+	}
+}
+
+// fail retires tr after err and starts redialing, unless a sender or
+// receiver already noticed
+func (t *ReconnectingTransport) fail(tr Transport, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.cur != tr || t.err != nil {
+		return
+	}
+	log.Printf("🔄 Transport failed (%v), reconnecting...", err)
+	tr.Close()
+	t.cur = nil
+	t.ready = make(chan struct{})
+	go t.redial(t.ready)
+}
+
+// redial dials until it gets a transport, gives up or the transport is closed
+func (t *ReconnectingTransport) redial(ready chan struct{}) {
+	defer close(ready)
+
+	backoff := t.opts.MinBackoff
+	for attempt := 1; ; attempt++ {
+		tr, err := t.dial(t.ctx)
+		if err == nil {
+			t.mu.Lock()
+			if t.err != nil {
+				// Closed while dialing
+				t.mu.Unlock()
+				tr.Close()
+				return
+			}
+			t.cur = tr
+			t.mu.Unlock()
+			metrics.TransportReconnects.Inc()
+			log.Printf("✅ Transport reconnected (attempt %d)", attempt)
+			return
+		}
+		if t.ctx.Err() != nil {
+			return
+		}
+		if t.opts.MaxAttempts > 0 && attempt >= t.opts.MaxAttempts {
+			t.mu.Lock()
+			if t.err == nil {
+				t.err = fmt.Errorf("reconnect failed after %d attempts: %w", attempt, err)
+			}
+			t.mu.Unlock()
+			log.Printf("❌ Giving up reconnecting after %d attempts: %v", attempt, err)
+			return
+		}
+
+		// Jittered, between 50% and 100% of backoff
+		delay := backoff/2 + rand.N(backoff/2+1)
+		log.Printf("⚠️ Reconnect attempt %d failed: %v (retrying in %v)", attempt, err, delay.Round(time.Millisecond))
+		select {
+		case <-time.After(delay):
+		case <-t.ctx.Done():
+			return
+		}
+		backoff = min(backoff*2, t.opts.MaxBackoff)
+	}
+}
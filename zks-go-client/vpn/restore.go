@@ -0,0 +1,65 @@
+package vpn
+
+import (
+	"log"
+	"sync"
+)
+
+// undoStep reverses one change this process made to the system network configuration
+type undoStep struct {
+	desc string
+	undo func() error
+}
+
+var (
+	journalMu sync.Mutex
+	journal   []undoStep
+)
+
+// recordUndo remembers how to reverse a route or DNS change so RestoreNetwork can undo it
+func recordUndo(desc string, undo func() error) {
+	journalMu.Lock()
+	journal = append(journal, undoStep{desc: desc, undo: undo})
+	journalMu.Unlock()
+}
+
+// RestoreNetwork reverses every recorded route and DNS change, newest first.
+// TUN.Stop calls it; callers that add host routes but never start a TUN
+// (e.g. the relay connect fails) should call it before exiting.
+// It is safe to call more than once.
+func RestoreNetwork() {
+	restoreSince(0)
+}
+
+// journalMark returns the current end of the journal, for restoreSince
+func journalMark() int {
+	journalMu.Lock()
+	defer journalMu.Unlock()
+	return len(journal)
+}
+
+// restoreSince reverses the changes recorded after mark, newest first,
+// keeping the ones before it (e.g. the relay bypass routes while a lost
+// TUN device is replaced)
+func restoreSince(mark int) {
+	journalMu.Lock()
+	var steps []undoStep
+	if mark < len(journal) {
+		steps = journal[mark:]
+		journal = journal[:mark:mark]
+	}
+	journalMu.Unlock()
+
+	if len(steps) == 0 {
+		return
+	}
+
+	log.Printf("🧹 Restoring network configuration...")
+	for i := len(steps) - 1; i >= 0; i-- {
+		if err := steps[i].undo(); err != nil {
+			log.Printf("   ⚠️ Failed to undo %s: %v", steps[i].desc, err)
+		} else {
+			log.Printf("   ↩️ Undid %s", steps[i].desc)
+		}
+	}
+}
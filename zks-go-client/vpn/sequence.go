@@ -0,0 +1,251 @@
+package vpn
+
+import (
+	"context"
+	"encoding/binary"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/zks-vpn/zks-go-client/bufpool"
+	"github.com/zks-vpn/zks-go-client/metrics"
+	"github.com/zks-vpn/zks-go-client/protocol"
+)
+
+const (
+	// seqHeaderLen is the [Epoch (4 bytes) | Seq (8 bytes)] prefix
+	seqHeaderLen = 12
+	// seqWindowSize is how far behind the newest packet a late one can be
+	// and still be told apart from a duplicate
+	seqWindowSize = 1024
+)
+
+// SequencedTransport wraps another Transport and numbers every IP packet,
+// so the receiving side can count packets that arrive out of order or twice
+// (zks_reordered_packets_total, zks_duplicate_packets_total). Each packet is
+// sent as [Epoch (4 bytes) | Seq (8 bytes, big-endian) | Packet]; the epoch
+// is the sender's start time, so a restarted peer starts a new window
+// instead of looking like a flood of duplicates. The numbering lives above
+// the relay connection, so it carries on across reconnects.
+//
+// Both peers must use it. Wrap it outside an EncryptedTransport so the
+// numbers are authenticated too.
+type SequencedTransport struct {
+	inner Transport
+	opts  SequencedTransportOptions
+	epoch uint32
+
+	sendMu sync.Mutex
+	seq    uint64
+
+	recvMu sync.Mutex
+	window seqWindow
+}
+
+// SequencedTransportOptions configures a SequencedTransport
+type SequencedTransportOptions struct {
+	// DropDuplicates drops packets already received, and ones too late to
+	// tell (more than 1024 packets behind), instead of only counting them.
+	// Worth it over UDP, where the network may duplicate packets.
+	DropDuplicates bool
+}
+
+// NewSequencedTransport numbers the packets sent over inner
+func NewSequencedTransport(inner Transport, opts SequencedTransportOptions) *SequencedTransport {
+	return &SequencedTransport{inner: inner, opts: opts, epoch: uint32(time.Now().Unix())}
+}
+
+func (t *SequencedTransport) SendBatch(packets [][]byte) error {
+	framed := make([][]byte, 0, len(packets))
+	// The inner transport is done with the frames once SendBatch returns
+	defer func() {
+		for _, f := range framed {
+			bufpool.Put(f)
+		}
+	}()
+
+	t.sendMu.Lock()
+	first := t.seq + 1
+	t.seq += uint64(len(packets))
+	t.sendMu.Unlock()
+
+	for i, pkt := range packets {
+		var f []byte
+		if seqHeaderLen+len(pkt) <= bufpool.Size {
+			f = bufpool.Get()[:seqHeaderLen+len(pkt)]
+		} else {
+			f = make([]byte, seqHeaderLen+len(pkt))
+		}
+		binary.BigEndian.PutUint32(f[0:4], t.epoch)
+		binary.BigEndian.PutUint64(f[4:12], first+uint64(i))
+		copy(f[seqHeaderLen:], pkt)
+		framed = append(framed, f)
+	}
+	return t.inner.SendBatch(framed)
+}
+
+// Recv returns the next message with the sequence numbers stripped
+func (t *SequencedTransport) Recv() (protocol.TunnelMessage, error) {
+	for {
+		msg, err := t.inner.Recv()
+		if err != nil {
+			return nil, err
+		}
+
+		switch m := msg.(type) {
+		case *protocol.IpPacket:
+			pkt, ok := t.accept(m.Payload)
+			if !ok {
+				continue
+			}
+			return &protocol.IpPacket{Payload: pkt}, nil
+
+		case *protocol.BatchIpPacket:
+			if packets := t.acceptAll(m.Packets); len(packets) > 0 {
+				return &protocol.BatchIpPacket{Packets: packets}, nil
+			}
+
+		default:
+			return msg, nil
+		}
+	}
+}
+
+// RecvBatch returns the next group of packets with the sequence numbers stripped
+func (t *SequencedTransport) RecvBatch() ([][]byte, error) {
+	return t.RecvBatchContext(context.Background())
+}
+
+// RecvBatchContext is RecvBatch, cancellable if the inner transport is
+func (t *SequencedTransport) RecvBatchContext(ctx context.Context) ([][]byte, error) {
+	for {
+		packets, err := recvBatchContext(ctx, t.inner)
+		if err != nil {
+			return nil, err
+		}
+		if packets = t.acceptAll(packets); len(packets) > 0 {
+			return packets, nil
+		}
+	}
+}
+
+// Lease passes through to the inner transport
+func (t *SequencedTransport) Lease(ctx context.Context) (netip.Prefix, error) {
+	return leaseFrom(ctx, t.inner)
+}
+
+func (t *SequencedTransport) Close() {
+	t.inner.Close()
+}
+
+// acceptAll filters packets in place, dropping the ones accept rejects
+func (t *SequencedTransport) acceptAll(packets [][]byte) [][]byte {
+	kept := packets[:0]
+	for _, pkt := range packets {
+		if pkt, ok := t.accept(pkt); ok {
+			kept = append(kept, pkt)
+		}
+	}
+	return kept
+}
+
+// accept checks frame's sequence number and returns the packet inside,
+// moved to the start of the buffer so it can still go back to bufpool
+func (t *SequencedTransport) accept(frame []byte) ([]byte, bool) {
+	if len(frame) < seqHeaderLen {
+		metrics.DroppedPackets.Inc()
+		bufpool.Put(frame)
+		return nil, false
+	}
+	epoch := binary.BigEndian.Uint32(frame[0:4])
+	seq := binary.BigEndian.Uint64(frame[4:12])
+
+	t.recvMu.Lock()
+	verdict := t.window.check(epoch, seq)
+	t.recvMu.Unlock()
+
+	switch verdict {
+	case seqReordered:
+		metrics.ReorderedPackets.Inc()
+	case seqLate:
+		metrics.ReorderedPackets.Inc()
+		if t.opts.DropDuplicates {
+			metrics.DroppedPackets.Inc()
+			bufpool.Put(frame)
+			return nil, false
+		}
+	case seqDuplicate:
+		metrics.DuplicatePackets.Inc()
+		if t.opts.DropDuplicates {
+			metrics.DroppedPackets.Inc()
+			bufpool.Put(frame)
+			return nil, false
+		}
+	}
+
+	n := copy(frame, frame[seqHeaderLen:])
+	return frame[:n], true
+}
+
+type seqVerdict int
+
+const (
+	seqInOrder   seqVerdict = iota // Newer than anything before
+	seqReordered                   // Late, but first time seen
+	seqLate                        // Too far behind to tell
+	seqDuplicate                   // Seen before
+)
+
+// seqWindow remembers which of the last seqWindowSize sequence numbers
+// arrived, like the replay window of IPsec or WireGuard
+type seqWindow struct {
+	epoch uint32
+	top   uint64 // Highest Seq seen; 0 before the first packet
+	seen  [seqWindowSize / 64]uint64
+}
+
+func (w *seqWindow) check(epoch uint32, seq uint64) seqVerdict {
+	switch {
+	case epoch > w.epoch:
+		// The peer restarted: start over
+		*w = seqWindow{epoch: epoch}
+	case epoch < w.epoch:
+		return seqLate // From before the restart
+	}
+
+	if seq > w.top {
+		if seq-w.top >= seqWindowSize {
+			w.seen = [seqWindowSize / 64]uint64{}
+		} else {
+			for s := w.top + 1; s < seq; s++ {
+				w.clear(s)
+			}
+		}
+		w.top = seq
+		w.set(seq)
+		return seqInOrder
+	}
+	if w.top-seq >= seqWindowSize {
+		return seqLate
+	}
+	if w.has(seq) {
+		return seqDuplicate
+	}
+	w.set(seq)
+	return seqReordered
+}
+
+func (w *seqWindow) set(seq uint64) {
+	i := seq % seqWindowSize
+	w.seen[i/64] |= 1 << (i % 64)
+}
+
+func (w *seqWindow) clear(seq uint64) {
+	i := seq % seqWindowSize
+	w.seen[i/64] &^= 1 << (i % 64)
+}
+
+func (w *seqWindow) has(seq uint64) bool {
+	i := seq % seqWindowSize
+	return w.seen[i/64]&(1<<(i%64)) != 0
+}
@@ -0,0 +1,31 @@
+//go:build linux || windows
+
+package vpn
+
+import (
+	"fmt"
+	"log"
+	"net"
+)
+
+// prepareInterface deals with an interface named name that's still there
+// from an earlier run, before Start creates the device. Its split default
+// routes go first, so nothing points at a dead tunnel while we start; then
+// the interface is cleared for reuse or deleted.
+func prepareInterface(name string, reuse bool) error {
+	if _, err := net.InterfaceByName(name); err != nil {
+		return nil
+	}
+	log.Printf("⚠️ Interface %s already exists, probably left over from a crashed run", name)
+	removeStaleRoutes(name, append(append([]string(nil), splitDefaultRoutes...), splitDefaultRoutes6...))
+
+	if reuse {
+		log.Printf("♻️ Reusing %s and re-applying its configuration", name)
+		return clearInterface(name)
+	}
+	log.Printf("🗑️ Removing %s to create it again", name)
+	if err := deleteInterface(name); err != nil {
+		return fmt.Errorf("stale interface %s could not be removed (is another instance using it?): %v", name, err)
+	}
+	return nil
+}
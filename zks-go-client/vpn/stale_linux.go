@@ -0,0 +1,31 @@
+//go:build linux
+
+package vpn
+
+import (
+	"log"
+	"strings"
+)
+
+// removeStaleRoutes deletes routes through name, ignoring ones that are gone
+func removeStaleRoutes(name string, routes []string) {
+	for _, route := range routes {
+		family := "-4"
+		if strings.Contains(route, ":") {
+			family = "-6"
+		}
+		if runCmd("ip", family, "route", "del", route, "dev", name) == nil {
+			log.Printf("   ↩️ Removed stale route %s", route)
+		}
+	}
+}
+
+// clearInterface drops the old addresses, and the routes that go with
+// them, so configureInterface can add ours again
+func clearInterface(name string) error {
+	return runCmd("ip", "addr", "flush", "dev", name)
+}
+
+func deleteInterface(name string) error {
+	return runCmd("ip", "link", "delete", "dev", name)
+}
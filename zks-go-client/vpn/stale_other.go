@@ -0,0 +1,9 @@
+//go:build !linux && !windows
+
+package vpn
+
+// prepareInterface has nothing to clean up: utun devices are numbered by
+// the kernel and disappear with the process that opened them
+func prepareInterface(name string, reuse bool) error {
+	return nil
+}
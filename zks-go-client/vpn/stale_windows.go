@@ -0,0 +1,43 @@
+//go:build windows
+
+package vpn
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+	"os/exec"
+	"unsafe"
+)
+
+// removeStaleRoutes deletes on-link routes through name, ignoring ones that are gone
+func removeStaleRoutes(name string, routes []string) {
+	luid, err := interfaceLUID(name)
+	if err != nil {
+		return
+	}
+	for _, route := range routes {
+		row := routeRow(luid, 0, netip.MustParsePrefix(route), netip.Addr{}, 1)
+		if callIPHelper(procDeleteIpForwardEntry2, uintptr(unsafe.Pointer(row))) == nil {
+			log.Printf("   ↩️ Removed stale route %s", route)
+		}
+	}
+}
+
+// clearInterface has nothing to do: adding our address and routes again
+// already treats existing ones as success
+func clearInterface(name string) error {
+	return nil
+}
+
+// deleteInterface removes the adapter's device, as Device Manager's
+// "Uninstall device" does. Wintun creates a new one in CreateTUN.
+func deleteInterface(name string) error {
+	script := fmt.Sprintf(`$a = Get-NetAdapter -Name '%s' -ErrorAction Stop
+		pnputil /remove-device $a.PnPDeviceID | Out-Null
+		if ($LASTEXITCODE -ne 0) { throw "pnputil exited with $LASTEXITCODE" }`, name)
+	if out, err := exec.Command("powershell", "-NoProfile", "-Command", script).CombinedOutput(); err != nil {
+		return fmt.Errorf("%v, output: %s", err, out)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package vpn
+
+import "sync/atomic"
+
+// TunStats is a snapshot of one TUN's traffic. "Out" is device to
+// transport, "In" transport to device. The metrics package's counters
+// cover the whole process; these only this TUN.
+type TunStats struct {
+	PacketsOut uint64 `json:"packets_out"`
+	BytesOut   uint64 `json:"bytes_out"`
+	PacketsIn  uint64 `json:"packets_in"`
+	BytesIn    uint64 `json:"bytes_in"`
+
+	// Dropped counts malformed and oversized packets, send queue overflow
+	// and batches the transport failed to send
+	Dropped uint64 `json:"dropped"`
+	// Filtered counts packets --allow-proto/--allow-port kept back
+	Filtered uint64 `json:"filtered"`
+
+	ReadErrors  uint64 `json:"read_errors"`  // Device reads
+	WriteErrors uint64 `json:"write_errors"` // Device writes
+}
+
+// tunCounters are the live values behind TunStats, bumped by the loops
+type tunCounters struct {
+	packetsOut, bytesOut atomic.Uint64
+	packetsIn, bytesIn   atomic.Uint64
+	dropped, filtered    atomic.Uint64
+	readErrors           atomic.Uint64
+	writeErrors          atomic.Uint64
+}
+
+func (c *tunCounters) snapshot() TunStats {
+	return TunStats{
+		PacketsOut:  c.packetsOut.Load(),
+		BytesOut:    c.bytesOut.Load(),
+		PacketsIn:   c.packetsIn.Load(),
+		BytesIn:     c.bytesIn.Load(),
+		Dropped:     c.dropped.Load(),
+		Filtered:    c.filtered.Load(),
+		ReadErrors:  c.readErrors.Load(),
+		WriteErrors: c.writeErrors.Load(),
+	}
+}
+
+// Stats returns the TUN's counters so far. It can be called at any time,
+// also before Start and after Stop.
+func (t *TUN) Stats() TunStats {
+	return t.stats.snapshot()
+}
@@ -0,0 +1,189 @@
+package vpn
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/zks-vpn/zks-go-client/bufpool"
+	"github.com/zks-vpn/zks-go-client/metrics"
+	"github.com/zks-vpn/zks-go-client/netbind"
+	"github.com/zks-vpn/zks-go-client/protocol"
+)
+
+const (
+	// tcpDialTimeout bounds the TCP connect plus TLS handshake
+	tcpDialTimeout = 10 * time.Second
+	// tcpMaxFrame is the largest packet a 2-byte length prefix can carry
+	tcpMaxFrame = 0xFFFF
+	// tcpRecvBatch caps how many already-buffered frames one RecvBatch returns
+	tcpRecvBatch = 64
+)
+
+// TCPTransport tunnels IP packets to an Entry Node over a single TLS
+// connection, for networks that block UDP. Each packet is one frame:
+// [Length (2 bytes, big-endian) | Packet]. Like UDPTransport it carries raw
+// IP packets; wrap it in an EncryptedTransport (--psk) for end-to-end
+// encryption beyond the TLS hop.
+type TCPTransport struct {
+	conn net.Conn
+	r    *bufio.Reader
+
+	// sendMu keeps concurrent batches from interleaving their frames
+	sendMu sync.Mutex
+}
+
+// TCPTransportOptions configures a TCPTransport
+type TCPTransportOptions struct {
+	// Interface binds the connection to this network interface (see netbind)
+	Interface string
+}
+
+// NewTCPTransport dials the Entry Node at addr (host:port) over TLS.
+// The server certificate is verified against the system roots for host.
+func NewTCPTransport(addr string) (*TCPTransport, error) {
+	return NewTCPTransportWithOptions(addr, TCPTransportOptions{})
+}
+
+// NewTCPTransportWithOptions is NewTCPTransport bound to an interface
+func NewTCPTransportWithOptions(addr string, opts TCPTransportOptions) (*TCPTransport, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q: %w", addr, err)
+	}
+
+	dialer := netbind.Dialer(net.Dialer{Timeout: tcpDialTimeout, KeepAlive: 15 * time.Second}, opts.Interface)
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{
+		ServerName: host,
+		MinVersion: tls.VersionTLS12,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("dial failed: %w", err)
+	}
+
+	return &TCPTransport{conn: conn, r: bufio.NewReaderSize(conn, 64*1024)}, nil
+}
+
+// SendBatch writes every packet as a length-prefixed frame in one write
+func (t *TCPTransport) SendBatch(packets [][]byte) error {
+	if len(packets) == 0 {
+		return nil
+	}
+
+	headers := make([]byte, 2*len(packets))
+	frames := make(net.Buffers, 0, 2*len(packets))
+	for i, pkt := range packets {
+		if len(pkt) > tcpMaxFrame {
+			metrics.DroppedPackets.Inc()
+			continue // Can't be framed; never larger than the MTU in practice
+		}
+		hdr := headers[2*i : 2*i+2]
+		binary.BigEndian.PutUint16(hdr, uint16(len(pkt)))
+		frames = append(frames, hdr, pkt)
+	}
+
+	t.sendMu.Lock()
+	_, err := frames.WriteTo(t.conn)
+	t.sendMu.Unlock()
+	if err != nil {
+		metrics.TransportSendErrors.Inc()
+		return err
+	}
+	return nil
+}
+
+// Recv reads the next frame, skipping empty ones (keepalives)
+func (t *TCPTransport) Recv() (protocol.TunnelMessage, error) {
+	for {
+		pkt, err := t.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		if len(pkt) > 0 {
+			return &protocol.IpPacket{Payload: pkt}, nil
+		}
+	}
+}
+
+// readFrame reads one length-prefixed frame into a pooled buffer when it fits
+func (t *TCPTransport) readFrame() ([]byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(t.r, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(hdr[:]))
+
+	var buf []byte
+	if n <= bufpool.Size {
+		buf = bufpool.Get()[:n]
+	} else {
+		buf = make([]byte, n)
+	}
+	if _, err := io.ReadFull(t.r, buf); err != nil {
+		bufpool.Put(buf)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF // The stream ended mid-frame
+		}
+		return nil, err
+	}
+	return buf, nil
+}
+
+// RecvBatch blocks for one packet, then adds any whole frames already buffered
+func (t *TCPTransport) RecvBatch() ([][]byte, error) {
+	msg, err := t.Recv()
+	if err != nil {
+		return nil, err
+	}
+	packets := [][]byte{msg.(*protocol.IpPacket).Payload}
+
+	for len(packets) < tcpRecvBatch && t.frameBuffered() {
+		pkt, err := t.readFrame()
+		if err != nil {
+			break // Can't happen for a buffered frame; the next call reports it
+		}
+		if len(pkt) > 0 {
+			packets = append(packets, pkt)
+		}
+	}
+	return packets, nil
+}
+
+// frameBuffered reports whether a whole frame can be read without blocking
+func (t *TCPTransport) frameBuffered() bool {
+	if t.r.Buffered() < 2 {
+		return false
+	}
+	hdr, err := t.r.Peek(2)
+	if err != nil {
+		return false
+	}
+	return t.r.Buffered() >= 2+int(binary.BigEndian.Uint16(hdr))
+}
+
+// RecvBatchContext is RecvBatch; cancelling ctx expires the connection's read
+// deadline. A frame cut off that way leaves the stream unusable, which is fine
+// since cancelling means the TUN is shutting down.
+func (t *TCPTransport) RecvBatchContext(ctx context.Context) ([][]byte, error) {
+	stop := context.AfterFunc(ctx, func() {
+		t.conn.SetReadDeadline(time.Unix(1, 0))
+	})
+	packets, err := t.RecvBatch()
+	if !stop() {
+		t.conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			return nil, ctx.Err()
+		}
+	}
+	return packets, err
+}
+
+func (t *TCPTransport) Close() {
+	t.conn.Close()
+}
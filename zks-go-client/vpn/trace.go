@@ -0,0 +1,97 @@
+package vpn
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/netip"
+	"strings"
+)
+
+// tcpFlagNames are the TCP flags in header bit order, lowest first
+var tcpFlagNames = []string{"FIN", "SYN", "RST", "PSH", "ACK", "URG", "ECE", "CWR"}
+
+// tracePacket logs pkt for --trace-packets. dir says where it's going:
+// "out" (device to transport), "in" (transport to device), or why not.
+func tracePacket(dir string, pkt []byte) {
+	log.Printf("🔎 %s %s", dir, describePacket(pkt))
+}
+
+// describePacket decodes the IP header and, for TCP, UDP and ICMP, the
+// header after it into one line, e.g.
+//
+//	TCP 10.0.85.1:51234 -> 1.1.1.1:443 [SYN] len=60 ttl=64
+//
+// pkt must have passed checkPacket.
+func describePacket(pkt []byte) string {
+	var src, dst netip.Addr
+	var proto, ttl byte
+	var payload []byte
+	var extra string
+	switch pkt[0] >> 4 {
+	case 4:
+		src = netip.AddrFrom4([4]byte(pkt[12:16]))
+		dst = netip.AddrFrom4([4]byte(pkt[16:20]))
+		proto, ttl = pkt[9], pkt[8]
+		payload = pkt[int(pkt[0]&0x0f)*4:]
+		frag := binary.BigEndian.Uint16(pkt[6:8])
+		if frag&0x1fff != 0 {
+			// Later fragments carry no transport header
+			return fmt.Sprintf("%s %s -> %s fragment offset=%d len=%d ttl=%d", protoName(proto), src, dst, int(frag&0x1fff)*8, len(pkt), ttl)
+		}
+		if frag&0x2000 != 0 {
+			extra = " MF"
+		}
+		if frag&0x4000 != 0 {
+			extra += " DF"
+		}
+	case 6:
+		src = netip.AddrFrom16([16]byte(pkt[8:24]))
+		dst = netip.AddrFrom16([16]byte(pkt[24:40]))
+		proto, ttl = pkt[6], pkt[7]
+		payload = pkt[ipv6HeaderLen:]
+	}
+	if tos := packetTOS(pkt); tos != 0 {
+		extra += fmt.Sprintf(" dscp=%d", tos>>2)
+	}
+
+	switch proto {
+	case protoTCP:
+		flags := payload[13]
+		var names []string
+		for i, name := range tcpFlagNames {
+			if flags&(1<<i) != 0 {
+				names = append(names, name)
+			}
+		}
+		return fmt.Sprintf("TCP %s -> %s [%s] seq=%d ack=%d win=%d len=%d ttl=%d%s",
+			netip.AddrPortFrom(src, binary.BigEndian.Uint16(payload[0:2])),
+			netip.AddrPortFrom(dst, binary.BigEndian.Uint16(payload[2:4])),
+			strings.Join(names, ","),
+			binary.BigEndian.Uint32(payload[4:8]), binary.BigEndian.Uint32(payload[8:12]),
+			binary.BigEndian.Uint16(payload[14:16]), len(pkt), ttl, extra)
+	case protoUDP:
+		return fmt.Sprintf("UDP %s -> %s len=%d ttl=%d%s",
+			netip.AddrPortFrom(src, binary.BigEndian.Uint16(payload[0:2])),
+			netip.AddrPortFrom(dst, binary.BigEndian.Uint16(payload[2:4])),
+			len(pkt), ttl, extra)
+	case protoICMP, protoICMPv6:
+		return fmt.Sprintf("%s %s -> %s type=%d code=%d len=%d ttl=%d%s", protoName(proto), src, dst, payload[0], payload[1], len(pkt), ttl, extra)
+	}
+	return fmt.Sprintf("%s %s -> %s len=%d ttl=%d%s", protoName(proto), src, dst, len(pkt), ttl, extra)
+}
+
+// protoName names the IP protocols describePacket decodes, and numbers the rest
+func protoName(proto byte) string {
+	switch proto {
+	case protoTCP:
+		return "TCP"
+	case protoUDP:
+		return "UDP"
+	case protoICMP:
+		return "ICMP"
+	case protoICMPv6:
+		return "ICMPv6"
+	}
+	return fmt.Sprintf("proto=%d", proto)
+}
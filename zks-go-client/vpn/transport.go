@@ -1,104 +1,563 @@
 package vpn
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log"
+	"math"
 	"net"
+	"net/netip"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/zks-vpn/zks-go-client/bufpool"
+	"github.com/zks-vpn/zks-go-client/metrics"
 	"github.com/zks-vpn/zks-go-client/protocol"
 	"github.com/zks-vpn/zks-go-client/relay"
+	"golang.org/x/net/ipv4"
 )
 
-// Transport defines the interface for sending/receiving VPN packets
+// Transport defines the interface for sending/receiving VPN packets.
+//
+// Packet ownership: SendBatch must be done with the packets when it returns
+// (encode, encrypt or copy them, never queue the caller's slices), so the
+// caller may hand them back to bufpool right after. Packets from Recv and
+// RecvBatch belong to the caller; they are usually pooled buffers, and the
+// caller may bufpool.Put them once it no longer references them.
 type Transport interface {
-	// SendBatch sends a batch of IP packets
+	// SendBatch sends a batch of IP packets. It must not retain them.
 	SendBatch(packets [][]byte) error
 	// Recv receives a message (IpPacket or BatchIpPacket)
 	Recv() (protocol.TunnelMessage, error)
+	// RecvBatch receives the next group of IP packets, skipping non-IP messages.
+	// The caller owns the returned slices.
+	RecvBatch() ([][]byte, error)
 	// Close closes the transport
 	Close()
 }
 
+// ContextTransport is a Transport whose receive can be cancelled.
+// Every transport in this package implements it.
+type ContextTransport interface {
+	Transport
+	// RecvBatchContext is RecvBatch, returning ctx.Err() once ctx is done
+	RecvBatchContext(ctx context.Context) ([][]byte, error)
+}
+
+// recvBatchContext cancels the receive through t when it supports it.
+// Otherwise it falls back to a plain RecvBatch, which only Close unblocks.
+func recvBatchContext(ctx context.Context, t Transport) ([][]byte, error) {
+	if ct, ok := t.(ContextTransport); ok {
+		return ct.RecvBatchContext(ctx)
+	}
+	return t.RecvBatch()
+}
+
+// Leaser is implemented by transports whose peer assigns the tunnel address
+type Leaser interface {
+	// Lease waits for the assigned address, or fails if the peer won't send one
+	Lease(ctx context.Context) (netip.Prefix, error)
+}
+
+// errNoLease means the transport has no peer that hands out addresses
+var errNoLease = errors.New("peer does not assign addresses")
+
+// leaseFrom asks t for a lease if it supports them
+func leaseFrom(ctx context.Context, t Transport) (netip.Prefix, error) {
+	if l, ok := t.(Leaser); ok {
+		return l.Lease(ctx)
+	}
+	return netip.Prefix{}, errNoLease
+}
+
+// DefaultMaxMessageSize bounds an encoded relay batch. Cloudflare Workers
+// drop WebSocket messages over 1 MiB; this leaves room for the link
+// encryption and anything else on the way.
+const DefaultMaxMessageSize = 512 * 1024
+
 // RelayTransport wraps the WebSocket relay connection
 type RelayTransport struct {
-	conn *relay.Connection
+	conn relay.Conn
+	opts RelayTransportOptions
+}
+
+// RelayTransportOptions configures a RelayTransport
+type RelayTransportOptions struct {
+	// Compress DEFLATEs batches when the peer negotiated FeatureCompression.
+	// Batches that don't shrink (TLS, PSK-encrypted packets) go out as is.
+	Compress bool
+	// MaxMessageSize splits batches that would encode to more bytes than
+	// this into several messages, sent in order (0 = DefaultMaxMessageSize).
+	// A single packet over the limit still goes out on its own.
+	MaxMessageSize int
 }
 
 // NewRelayTransport creates a new RelayTransport
-func NewRelayTransport(conn *relay.Connection) *RelayTransport {
-	return &RelayTransport{conn: conn}
+func NewRelayTransport(conn relay.Conn) *RelayTransport {
+	return NewRelayTransportWithOptions(conn, RelayTransportOptions{})
+}
+
+// NewRelayTransportWithOptions is NewRelayTransport with compression settings
+func NewRelayTransportWithOptions(conn relay.Conn, opts RelayTransportOptions) *RelayTransport {
+	if opts.MaxMessageSize <= 0 {
+		opts.MaxMessageSize = DefaultMaxMessageSize
+	}
+	return &RelayTransport{conn: conn, opts: opts}
 }
 
 func (t *RelayTransport) SendBatch(packets [][]byte) error {
 	if len(packets) == 0 {
 		return nil
 	}
-	// Wrap in BatchIpPacket
-	msg := &protocol.BatchIpPacket{Packets: packets}
-	return t.conn.Send(msg)
+	// Peers from before the Hello handshake may not take batches
+	features := t.conn.Capabilities().Features
+	if !features.Has(protocol.FeatureBatching) {
+		for _, pkt := range packets {
+			if err := t.conn.Send(&protocol.IpPacket{Payload: pkt}); err != nil {
+				metrics.TransportSendErrors.Inc()
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Wrap in BatchIpPacket, as many as it takes to stay under the size
+	// limit. Compression only ever shrinks them.
+	compress := t.opts.Compress && features.Has(protocol.FeatureCompression)
+	for len(packets) > 0 {
+		n := batchFits(packets, t.opts.MaxMessageSize)
+		if n < len(packets) {
+			metrics.RelaySplitBatches.Inc()
+		}
+		batch := &protocol.BatchIpPacket{Packets: packets[:n]}
+		var msg protocol.TunnelMessage = batch
+		if compress {
+			msg = protocol.CompressBatch(batch)
+		}
+		if err := t.conn.Send(msg); err != nil {
+			metrics.TransportSendErrors.Inc()
+			return err
+		}
+		packets = packets[n:]
+	}
+	return nil
+}
+
+// batchFits returns how many of packets, at least one, a BatchIpPacket of
+// at most limit bytes holds
+func batchFits(packets [][]byte, limit int) int {
+	size := 3 // Command and count
+	for i, pkt := range packets {
+		size += 4 + len(pkt)
+		if size > limit || i == math.MaxUint16 {
+			return max(i, 1)
+		}
+	}
+	return len(packets)
 }
 
 func (t *RelayTransport) Recv() (protocol.TunnelMessage, error) {
 	return t.conn.Recv()
 }
 
+// RecvBatch unwraps the next IpPacket or BatchIpPacket from the relay
+func (t *RelayTransport) RecvBatch() ([][]byte, error) {
+	return recvPackets(t.Recv)
+}
+
+// RecvBatchContext is RecvBatch, cancelled through relay.Conn.RecvContext
+func (t *RelayTransport) RecvBatchContext(ctx context.Context) ([][]byte, error) {
+	return recvPackets(func() (protocol.TunnelMessage, error) {
+		return t.conn.RecvContext(ctx)
+	})
+}
+
+// recvPackets implements RecvBatch on top of recv for message-based transports
+func recvPackets(recv func() (protocol.TunnelMessage, error)) ([][]byte, error) {
+	for {
+		msg, err := recv()
+		if err != nil {
+			return nil, err
+		}
+		switch m := msg.(type) {
+		case *protocol.BatchIpPacket:
+			if len(m.Packets) > 0 {
+				return m.Packets, nil
+			}
+		case *protocol.IpPacket:
+			if len(m.Payload) > 0 {
+				return [][]byte{m.Payload}, nil
+			}
+		}
+	}
+}
+
+// Lease waits for the address the Exit Peer assigns, if it negotiated FeatureLease
+func (t *RelayTransport) Lease(ctx context.Context) (netip.Prefix, error) {
+	if !t.conn.Capabilities().Features.Has(protocol.FeatureLease) {
+		return netip.Prefix{}, errNoLease
+	}
+	return t.conn.Lease(ctx)
+}
+
 func (t *RelayTransport) Close() {
 	t.conn.Close()
 }
 
 // UDPTransport implements direct UDP connection to Entry Node
-// Note: This sends RAW IP packets over UDP (no encryption layer yet)
-// Security relies on inner TLS/HTTPS of the traffic itself.
+// Note: This sends RAW IP packets over UDP. Wrap it in an EncryptedTransport
+// (--psk) for end-to-end encryption; otherwise security relies on the inner
+// TLS/HTTPS of the traffic itself.
 type UDPTransport struct {
 	conn *net.UDPConn
+	// pc exposes batch I/O (sendmmsg/recvmmsg) on Linux
+	pc *ipv4.PacketConn
+	// recvMsgs are reused across recvmmsg calls (RecvBatch has a single caller)
+	recvMsgs []ipv4.Message
+
+	// maxDatagram is the largest payload that fits the path MTU unfragmented
+	maxDatagram     int
+	oversizedLogged atomic.Bool
+	truncatedLogged atomic.Bool
+
+	// preserveDSCP copies each packet's DSCP onto the socket (IP_TOS)
+	preserveDSCP bool
+	outerIPv6    bool
+	tosMu        sync.Mutex // Held while the socket's ToS is set and used
+	tos          byte       // ToS currently set on the socket
+	tosLogged    atomic.Bool
+}
+
+// DefaultUDPPathMTU is the Ethernet MTU, assumed towards the Entry Node
+const DefaultUDPPathMTU = 1500
+
+// UDPTransportOptions configures a UDPTransport
+type UDPTransportOptions struct {
+	// MTU is the path MTU towards the Entry Node (0 = DefaultUDPPathMTU).
+	// Packets that wouldn't fit in one datagram with the outer IP and UDP
+	// headers are dropped instead of being left to IP fragmentation.
+	MTU int
+	// PreserveDSCP sets the outer IP_TOS (IPV6_TCLASS) of each datagram to
+	// the DSCP of the packet inside, so QoS markings survive the tunnel.
+	// The inner header must be readable: raw packets, or an
+	// EncryptedTransport directly on top. Linux only; elsewhere it is a
+	// no-op and datagrams keep the default ToS.
+	PreserveDSCP bool
+	// Interface binds the socket to this network interface (see netbind)
+	// instead of leaving the choice to the routing table
+	Interface string
+	// LocalAddr is the local address and port to send from, checked by
+	// ParseUDPBind (empty = the OS picks, UDPBindRandom = a random high port)
+	LocalAddr string
 }
 
 // NewUDPTransport creates a new UDPTransport connected to the Entry Node
 func NewUDPTransport(addr string) (*UDPTransport, error) {
+	return NewUDPTransportWithOptions(addr, UDPTransportOptions{})
+}
+
+// NewUDPTransportWithOptions is NewUDPTransport with a custom path MTU
+func NewUDPTransportWithOptions(addr string, opts UDPTransportOptions) (*UDPTransport, error) {
+	if opts.MTU == 0 {
+		opts.MTU = DefaultUDPPathMTU
+	}
 	udpAddr, err := net.ResolveUDPAddr("udp", addr)
 	if err != nil {
 		return nil, fmt.Errorf("resolve failed: %w", err)
 	}
-	
+
+	// Outer headers: IPv4 (20) or IPv6 (40), plus UDP (8)
+	overhead := 20 + 8
+	if udpAddr.IP.To4() == nil {
+		overhead = 40 + 8
+	}
+	if opts.MTU-overhead < MinMTU {
+		return nil, fmt.Errorf("path MTU %d is too small (minimum %d)", opts.MTU, MinMTU+overhead)
+	}
+
 	// Connect to the Entry Node
-	conn, err := net.DialUDP("udp", nil, udpAddr)
+	conn, err := dialUDP(udpAddr, opts.LocalAddr, opts.Interface)
 	if err != nil {
 		return nil, fmt.Errorf("dial failed: %w", err)
 	}
-	
-	return &UDPTransport{conn: conn}, nil
+
+	if opts.PreserveDSCP && !dscpSupported {
+		log.Printf("⚠️ DSCP preservation is not supported on %s; datagrams keep the default ToS", runtime.GOOS)
+		opts.PreserveDSCP = false
+	}
+
+	return &UDPTransport{
+		conn:         conn,
+		pc:           ipv4.NewPacketConn(conn),
+		maxDatagram:  opts.MTU - overhead,
+		preserveDSCP: opts.PreserveDSCP,
+		outerIPv6:    udpAddr.IP.To4() == nil,
+	}, nil
+}
+
+// LocalPort returns the UDP port the transport sends from
+func (t *UDPTransport) LocalPort() int {
+	return t.conn.LocalAddr().(*net.UDPAddr).Port
 }
 
+// SendBatch sends each packet as one datagram, dropping any too large
+// for the path MTU
 func (t *UDPTransport) SendBatch(packets [][]byte) error {
-	for _, pkt := range packets {
-		// Send each packet individually over UDP
-		// TODO: Use sendmmsg for optimization on supported platforms
-		_, err := t.conn.Write(pkt)
-		if err != nil {
-			return err
+	var tos []byte
+	if t.preserveDSCP {
+		tos = packetTOSes(packets)
+	}
+	return t.sendBatchDSCP(packets, tos)
+}
+
+// marksDSCP reports whether PreserveDSCP is on
+func (t *UDPTransport) marksDSCP() bool {
+	return t.preserveDSCP
+}
+
+// sendBatchDSCP is SendBatch with each datagram's outer ToS given by the
+// caller; tos is ignored unless PreserveDSCP is set
+func (t *UDPTransport) sendBatchDSCP(packets [][]byte, tos []byte) error {
+	if !t.preserveDSCP {
+		tos = nil
+	}
+	fits, fitsTOS := packets, tos
+	for i, pkt := range packets {
+		if len(pkt) <= t.maxDatagram {
+			if len(fits) < len(packets) {
+				fits = append(fits, pkt)
+				if tos != nil {
+					fitsTOS = append(fitsTOS, tos[i])
+				}
+			}
+			continue
 		}
+		if len(fits) == len(packets) {
+			fits = append([][]byte(nil), packets[:i]...)
+			if tos != nil {
+				fitsTOS = append([]byte(nil), tos[:i]...)
+			}
+		}
+		metrics.OversizedPackets.Inc()
+		metrics.DroppedPackets.Inc()
+		if !t.oversizedLogged.Swap(true) {
+			log.Printf("⚠️ Dropping %d-byte packets: only %d bytes fit the path MTU to the Entry Node (lower --mtu)", len(pkt), t.maxDatagram)
+		}
+	}
+	if len(fits) == 0 {
+		return nil
+	}
+	// Platform-specific: sendmmsg on Linux, one write per packet elsewhere
+	if err := t.sendBatch(fits, fitsTOS); err != nil {
+		metrics.TransportSendErrors.Inc()
+		return err
 	}
 	return nil
 }
 
 func (t *UDPTransport) Recv() (protocol.TunnelMessage, error) {
-	// Buffer for receiving UDP packet
-	// Max UDP size is 65535, but MTU is usually 1500. Safe to use larger buffer.
-	buf := make([]byte, 65535)
-	
-	n, _, err := t.conn.ReadFromUDP(buf)
-	if err != nil {
-		return nil, err
+	for {
+		// Read straight into a pooled buffer; the caller owns it from here
+		buf := bufpool.Get()
+		n, _, err := t.conn.ReadFromUDP(buf)
+		if err != nil {
+			bufpool.Put(buf)
+			return nil, err
+		}
+		if n == len(buf) {
+			// Filled the buffer: the kernel discarded the rest of the datagram
+			bufpool.Put(buf)
+			t.dropTruncated()
+			continue
+		}
+
+		// Wrap in IpPacket for compatibility with StartTUN logic
+		return &protocol.IpPacket{Payload: buf[:n]}, nil
+	}
+}
+
+// dropTruncated counts a datagram that didn't fit the receive buffer. It is
+// never forwarded: a cut-off IP packet would only confuse the TUN.
+func (t *UDPTransport) dropTruncated() {
+	metrics.OversizedPackets.Inc()
+	metrics.DroppedPackets.Inc()
+	if !t.truncatedLogged.Swap(true) {
+		log.Printf("⚠️ Dropping truncated datagrams from the Entry Node (larger than %d bytes)", bufpool.Size)
 	}
-	
-	// Copy data to a new slice to fit exact size
-	// (StartTUN expects to own the data)
-	payload := make([]byte, n)
-	copy(payload, buf[:n])
-	
-	// Wrap in IpPacket for compatibility with StartTUN logic
-	return &protocol.IpPacket{Payload: payload}, nil
+}
+
+// RecvBatch receives one or more datagrams (recvmmsg on Linux)
+func (t *UDPTransport) RecvBatch() ([][]byte, error) {
+	return t.recvBatch()
+}
+
+// RecvBatchContext is RecvBatch; cancelling ctx expires the socket's read deadline
+func (t *UDPTransport) RecvBatchContext(ctx context.Context) ([][]byte, error) {
+	stop := context.AfterFunc(ctx, func() {
+		t.conn.SetReadDeadline(time.Unix(1, 0))
+	})
+	packets, err := t.recvBatch()
+	if !stop() {
+		t.conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			return nil, ctx.Err()
+		}
+	}
+	return packets, err
 }
 
 func (t *UDPTransport) Close() {
 	t.conn.Close()
 }
+
+// EncryptedTransport wraps another Transport and encrypts every IP packet
+// with ChaCha20-Poly1305 under a pre-shared key, so the path is protected
+// end-to-end even when the underlying transport (e.g. raw UDP) is not.
+// Each packet is sent as [Nonce (12 bytes) | Ciphertext | Tag (16 bytes)].
+type EncryptedTransport struct {
+	inner    Transport
+	cipher   *protocol.WasifVernam
+	rejected atomic.Uint64
+}
+
+// NewEncryptedTransport wraps inner with a key derived from the room ID and passphrase.
+// Both peers must use the same room and passphrase.
+func NewEncryptedTransport(inner Transport, roomID, passphrase string) (*EncryptedTransport, error) {
+	key, err := protocol.DerivePSK(roomID, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("key derivation failed: %w", err)
+	}
+	cipher, err := protocol.NewWasifVernam(key)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedTransport{inner: inner, cipher: cipher}, nil
+}
+
+func (t *EncryptedTransport) SendBatch(packets [][]byte) error {
+	encrypted := make([][]byte, 0, len(packets))
+	// The inner transport is done with the ciphertexts once SendBatch returns
+	defer func() {
+		for _, ct := range encrypted {
+			bufpool.Put(ct)
+		}
+	}()
+	for _, pkt := range packets {
+		var ct []byte
+		var err error
+		if len(pkt)+12+16 <= bufpool.Size {
+			ct, err = t.cipher.EncryptTo(bufpool.Get(), pkt)
+		} else {
+			ct, err = t.cipher.Encrypt(pkt)
+		}
+		if err != nil {
+			return fmt.Errorf("encryption failed: %w", err)
+		}
+		encrypted = append(encrypted, ct)
+	}
+	// The ciphertext hides the DSCP; read it from the plaintext instead
+	if ds, ok := t.inner.(dscpSender); ok && ds.marksDSCP() {
+		return ds.sendBatchDSCP(encrypted, packetTOSes(packets))
+	}
+	return t.inner.SendBatch(encrypted)
+}
+
+// Recv returns the next message with its packets decrypted.
+// Packets that fail authentication are dropped.
+func (t *EncryptedTransport) Recv() (protocol.TunnelMessage, error) {
+	for {
+		msg, err := t.inner.Recv()
+		if err != nil {
+			return nil, err
+		}
+
+		switch m := msg.(type) {
+		case *protocol.IpPacket:
+			plaintext, ok := t.open(m.Payload)
+			if !ok {
+				continue
+			}
+			return &protocol.IpPacket{Payload: plaintext}, nil
+
+		case *protocol.BatchIpPacket:
+			packets := make([][]byte, 0, len(m.Packets))
+			for _, pkt := range m.Packets {
+				if plaintext, ok := t.open(pkt); ok {
+					packets = append(packets, plaintext)
+				}
+			}
+			if len(packets) == 0 {
+				continue
+			}
+			return &protocol.BatchIpPacket{Packets: packets}, nil
+
+		default:
+			return msg, nil
+		}
+	}
+}
+
+// RecvBatch returns the next group of packets, decrypted.
+// Packets that fail authentication are dropped.
+func (t *EncryptedTransport) RecvBatch() ([][]byte, error) {
+	return t.RecvBatchContext(context.Background())
+}
+
+// RecvBatchContext is RecvBatch, cancellable if the inner transport is
+func (t *EncryptedTransport) RecvBatchContext(ctx context.Context) ([][]byte, error) {
+	for {
+		packets, err := recvBatchContext(ctx, t.inner)
+		if err != nil {
+			return nil, err
+		}
+		plain := packets[:0]
+		for _, pkt := range packets {
+			plaintext, ok := t.open(pkt)
+			bufpool.Put(pkt) // Decrypted into a fresh buffer; the ciphertext is ours to recycle
+			if ok {
+				plain = append(plain, plaintext)
+			}
+		}
+		if len(plain) > 0 {
+			return plain, nil
+		}
+	}
+}
+
+// Lease passes through to the inner transport
+func (t *EncryptedTransport) Lease(ctx context.Context) (netip.Prefix, error) {
+	return leaseFrom(ctx, t.inner)
+}
+
+func (t *EncryptedTransport) open(ciphertext []byte) ([]byte, bool) {
+	var plaintext []byte
+	var err error
+	if len(ciphertext) <= bufpool.Size {
+		buf := bufpool.Get()
+		if plaintext, err = t.cipher.DecryptTo(buf, ciphertext); err != nil {
+			bufpool.Put(buf)
+		}
+	} else {
+		plaintext, err = t.cipher.Decrypt(ciphertext)
+	}
+	if err != nil {
+		metrics.DroppedPackets.Inc()
+		if t.rejected.Add(1) == 1 {
+			log.Printf("⚠️ Dropping packets that fail authentication (wrong --psk on the peer?)")
+		}
+		return nil, false
+	}
+	return plaintext, true
+}
+
+// Rejected returns how many packets were dropped for failing authentication
+func (t *EncryptedTransport) Rejected() uint64 {
+	return t.rejected.Load()
+}
+
+func (t *EncryptedTransport) Close() {
+	t.inner.Close()
+}
@@ -0,0 +1,52 @@
+package vpn
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/zks-vpn/zks-go-client/bufpool"
+)
+
+// BenchmarkEncryptedBatch sends batches through an EncryptedTransport over a
+// MemTransport and receives them. "recycled" hands the received packets
+// back to bufpool as the TUN writer does; "dropped" leaves them to the GC,
+// which is what every packet cost before the pool.
+func BenchmarkEncryptedBatch(b *testing.B) {
+	for _, recycle := range []bool{true, false} {
+		name := "dropped"
+		if recycle {
+			name = "recycled"
+		}
+		for _, size := range []int{1, 64} {
+			b.Run(fmt.Sprintf("%s/%d", name, size), func(b *testing.B) {
+				mem := NewMemTransport()
+				defer mem.Close()
+				t, err := NewEncryptedTransport(mem, "bench-room", "bench-pass")
+				if err != nil {
+					b.Fatal(err)
+				}
+				packets := make([][]byte, size)
+				for i := range packets {
+					packets[i] = make([]byte, 1280)
+				}
+
+				b.ReportAllocs()
+				b.SetBytes(int64(size * 1280))
+				for range b.N {
+					if err := t.SendBatch(packets); err != nil {
+						b.Fatal(err)
+					}
+					got, err := t.RecvBatch()
+					if err != nil {
+						b.Fatal(err)
+					}
+					if recycle {
+						for _, pkt := range got {
+							bufpool.Put(pkt)
+						}
+					}
+				}
+			})
+		}
+	}
+}
@@ -1,301 +1,1005 @@
 package vpn
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"math"
+	"net"
+	"net/netip"
+	"os"
 	"os/exec"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/zks-vpn/zks-go-client/bufpool"
+	"github.com/zks-vpn/zks-go-client/events"
+	"github.com/zks-vpn/zks-go-client/metrics"
+	"github.com/zks-vpn/zks-go-client/pcap"
 	"github.com/zks-vpn/zks-go-client/protocol"
 	"golang.zx2c4.com/wireguard/tun"
 )
 
 const (
-	tunInterfaceName = "zks-tun0"
-	tunIP            = "10.0.85.1"
-	tunNetmask       = "255.255.255.0"
-	mtu              = 1420
-	// BatchSize = 1024: Optimized for Cloudflare WebSocket Relay architecture
-	// - WireGuard uses 128 for direct kernel reads (latency-optimized)
-	// - We use 1024 for WebSocket relay (quota-optimized: 100k req/day limit)
-	// - Opportunistic batching means latency is NOT affected (sends immediately)
-	// - Daily limit: ~136 GB, RAM/user: ~1.5 MB, Max users: ~85
-	batchSize = 1024
+	// DefaultIP is the local tunnel address used when none is configured
+	DefaultIP = "10.0.85.1"
+	// DefaultNetmask is the tunnel subnet mask used when none is configured
+	DefaultNetmask = "255.255.255.0"
+	// DefaultIPv6 is the ULA tunnel address and prefix length used when none is configured
+	DefaultIPv6 = "fd00:85::1/64"
+
+	// DefaultDNS are the resolvers the system is pointed at while the tunnel
+	// is up; the split routes carry them through the tunnel
+	DefaultDNS = "1.1.1.1,8.8.8.8"
+
+	// DefaultLeaseTimeout is how long Start waits for the Exit Peer to assign an address
+	DefaultLeaseTimeout = 10 * time.Second
+
+	// DefaultMTU leaves headroom for WebSocket framing and encryption overhead
+	// on top of a 1500-byte path
+	DefaultMTU = 1420
+	// MinMTU and MaxMTU bound --mtu: 576 is the IPv4 minimum every host must
+	// accept, and the pooled packet buffers are sized for at most 1500
+	MinMTU = 576
+	MaxMTU = 1500
+
+	// readBatchSize is how many packets one TUN read may return on Linux
+	// with offloads (vnet_hdr), where the kernel hands over a whole GRO
+	// super-packet and wireguard-go splits it into MTU-sized segments:
+	// 128 covers 64 KB down to MinMTU (65535/(576-40) = 122). Devices
+	// without offloads return one packet per read. Filling BatchIpPackets
+	// for the relay's request quota is the batcher's job, across reads.
+	readBatchSize = 128
+	// tunOffset is headroom left in front of every packet handed to the
+	// wireguard-go device: macOS needs 4 bytes for the address family header
+	// and Linux needs 10 for the virtio-net header when offloads are enabled
+	tunOffset = 16
+)
+
+// splitDefaultRoutes cover the whole IPv4 space while staying more specific
+// than the system default route (the "Def1" trick), so the original default
+// route is never touched
+var splitDefaultRoutes = []string{"0.0.0.0/1", "128.0.0.0/1"}
+
+// splitDefaultRoutes6 is the same trick for IPv6
+var splitDefaultRoutes6 = []string{"::/1", "8000::/1"}
+
+var (
+	gatewayMu        sync.Mutex
+	gatewayOverride  string
+	gatewayInterface string
 )
 
-// StartTUN creates the TUN device and starts processing packets
-func StartTUN(transport Transport) error {
-	log.Printf("🔌 Creating TUN device: %s", tunInterfaceName)
+// SetGatewayOverride makes DefaultGateway return gw instead of detecting it.
+// An empty gw turns detection back on.
+func SetGatewayOverride(gw string) error {
+	if gw != "" && net.ParseIP(gw).To4() == nil {
+		return fmt.Errorf("invalid gateway %q: must be an IPv4 address", gw)
+	}
+	gatewayMu.Lock()
+	gatewayOverride = gw
+	gatewayMu.Unlock()
+	return nil
+}
+
+// SetGatewayInterface makes DefaultGateway and DefaultGateway6 return the
+// next hop of the default route through the interface name, e.g. the one
+// the relay connection is bound to, rather than the preferred default
+// route. An empty name goes back to the system default.
+func SetGatewayInterface(name string) {
+	gatewayMu.Lock()
+	gatewayInterface = name
+	gatewayMu.Unlock()
+}
+
+// DefaultGateway returns the IPv4 next hop of the system default route,
+// or the address set with SetGatewayOverride
+func DefaultGateway() (string, error) {
+	gatewayMu.Lock()
+	gw, iface := gatewayOverride, gatewayInterface
+	gatewayMu.Unlock()
+	if gw != "" {
+		return gw, nil
+	}
+	if iface != "" {
+		return getInterfaceGateway(iface)
+	}
+	return getDefaultGateway()
+}
+
+// AddHostRoute routes a single IPv4 host via gateway so it bypasses the tunnel
+func AddHostRoute(ip, gateway string) error {
+	return addHostRoute(ip, gateway)
+}
+
+// DefaultGateway6 returns the IPv6 next hop of the system default route.
+// Link-local gateways carry their interface as the zone, e.g. "fe80::1%eth0".
+func DefaultGateway6() (string, error) {
+	gatewayMu.Lock()
+	iface := gatewayInterface
+	gatewayMu.Unlock()
+	if iface != "" {
+		return getInterfaceGateway6(iface)
+	}
+	return getDefaultGateway6()
+}
+
+// AddHostRoute6 routes a single IPv6 host via gateway (as returned by
+// DefaultGateway6) so it bypasses the tunnel's IPv6 split routes
+func AddHostRoute6(ip, gateway string) error {
+	return addHostRoute6(ip, gateway)
+}
+
+// Options configures the TUN device
+type Options struct {
+	// IP is the local tunnel address, e.g. "10.0.85.1"
+	IP string
+	// Netmask is the tunnel subnet mask in dotted-quad form, e.g. "255.255.255.0"
+	Netmask string
+	// LeaseTimeout, when positive, makes Start wait this long for the peer
+	// to assign the address (see Leaser) before configuring the interface.
+	// IP and Netmask are used if no lease comes.
+	LeaseTimeout time.Duration
+	// MTU of the TUN device (0 = DefaultMTU)
+	MTU int
+	// Queues opens the device with this many queues, each read and written
+	// by a loop of its own, so packet processing spreads over several cores
+	// (0 = 1). The transport stays shared. Linux only.
+	Queues int
+	// ClampMSS rewrites the MSS of TCP SYNs in both directions down to MSS
+	// (0 = MTU minus the IPv4 and TCP headers; 20 less for IPv6)
+	ClampMSS bool
+	MSS      int
+	// InterfaceName names the TUN device ("" = DefaultInterfaceName). Two
+	// instances on one machine need different names.
+	InterfaceName string
+	// ReuseExisting keeps an interface of that name left over from a crashed
+	// run, clearing its addresses and routes, instead of deleting it and
+	// creating a fresh one (Linux and Windows)
+	ReuseExisting bool
+	// IPv6 is the tunnel address in prefix form, e.g. "fd00:85::1/64".
+	// Empty leaves IPv6 unconfigured.
+	IPv6 string
+	// DNS lists the resolvers to use while the tunnel is up, e.g.
+	// []string{"1.1.1.1"}. Empty leaves the system DNS alone.
+	DNS []string
+	// KillSwitch blocks all outbound traffic outside the tunnel except to
+	// KillSwitchAllow, the IPs of the relay or Entry Node. The rules outlive
+	// Stop until DisableKillSwitch is called.
+	KillSwitch      bool
+	KillSwitchAllow []string
+
+	// IncludeRoutes, when set, are the only CIDRs routed through the tunnel
+	// (plus the DNS servers) instead of the split default routes.
+	// ExcludeRoutes are CIDRs kept on the original gateway either way.
+	// NoDefaultRoute never adds the split default routes, even without
+	// IncludeRoutes: the tunnel then routes nothing until routes are added
+	// by hand.
+	IncludeRoutes  []string
+	ExcludeRoutes  []string
+	NoDefaultRoute bool
+
+	// Filter, if set, drops packets read from the device whose protocol or
+	// port it doesn't allow (see PacketFilter for how it works with routes)
+	Filter *PacketFilter
+
+	// BatchFlushInterval is how long back-to-back TUN reads are coalesced
+	// into one send (0 = DefaultBatchFlushInterval, negative sends every read
+	// on its own). BatchMaxPackets and BatchMaxBytes flush earlier
+	// (0 = DefaultBatchMaxPackets / DefaultBatchMaxBytes).
+	BatchFlushInterval time.Duration
+	BatchMaxPackets    int
+	BatchMaxBytes      int
+	// BatchAdaptive scales the flush interval and packet limit with the
+	// packet rate, from BatchMinFlushInterval and BatchMinPackets when
+	// traffic is sparse up to BatchFlushInterval and BatchMaxPackets under
+	// load (0 = DefaultBatchMinFlushInterval / DefaultBatchMinPackets).
+	BatchAdaptive         bool
+	BatchMinFlushInterval time.Duration
+	BatchMinPackets       int
+
+	// WriteFlushInterval is how long packets from the transport are held to
+	// share one device write with the ones that follow (0 =
+	// DefaultWriteFlushInterval, negative writes every received group on its
+	// own). WriteMaxPackets writes earlier (0 = DefaultWriteMaxPackets).
+	WriteFlushInterval time.Duration
+	WriteMaxPackets    int
+
+	// SendQueuePackets bounds the packets waiting between the TUN reader
+	// and the transport (0 = DefaultSendQueuePackets). When a congested
+	// relay lets it fill, SendQueuePolicy decides which packets are dropped
+	// ("" = DropOldest).
+	SendQueuePackets int
+	SendQueuePolicy  QueuePolicy
+
+	// Capture, if set, records every packet read from and written to the
+	// device (--pcap)
+	Capture *pcap.Writer
+	// TracePackets logs every packet crossing the device, decoded to its
+	// addresses, ports and TCP flags. Very chatty: for debugging only.
+	TracePackets bool
+
+	// OnDeviceLost decides what happens when the device goes away under
+	// us, e.g. a disabled adapter or a Wintun reset across sleep
+	// ("" = DeviceLostExit)
+	OnDeviceLost DeviceLostPolicy
+}
+
+// Validate fills in defaults and checks that IP is a usable host address inside Netmask's subnet
+func (o *Options) Validate() error {
+	if o.IP == "" {
+		o.IP = DefaultIP
+	}
+	if o.Netmask == "" {
+		o.Netmask = DefaultNetmask
+	}
+	if o.MTU == 0 {
+		o.MTU = DefaultMTU
+	}
+	if o.MTU < MinMTU || o.MTU > MaxMTU {
+		return fmt.Errorf("invalid MTU %d: must be between %d and %d", o.MTU, MinMTU, MaxMTU)
+	}
+	if maxMSS := o.MTU - ipv4HeaderLen - tcpHeaderLen; o.MSS != 0 && (o.MSS < MinMTU-ipv4HeaderLen-tcpHeaderLen || o.MSS > maxMSS) {
+		return fmt.Errorf("invalid MSS %d: must be between %d and %d (MTU %d)", o.MSS, MinMTU-ipv4HeaderLen-tcpHeaderLen, maxMSS, o.MTU)
+	}
+	if o.Queues == 0 {
+		o.Queues = 1
+	}
+	if o.Queues < 1 || o.Queues > MaxQueues {
+		return fmt.Errorf("invalid queue count %d: must be between 1 and %d", o.Queues, MaxQueues)
+	}
+	if o.Queues > 1 && !multiQueueSupported {
+		return fmt.Errorf("multiple TUN queues are only supported on Linux")
+	}
+	if o.InterfaceName == "" {
+		o.InterfaceName = DefaultInterfaceName
+	}
+	if err := validateInterfaceName(o.InterfaceName); err != nil {
+		return fmt.Errorf("invalid interface name %q: %v", o.InterfaceName, err)
+	}
+	if o.BatchFlushInterval == 0 {
+		o.BatchFlushInterval = DefaultBatchFlushInterval
+	}
+	if o.BatchMaxPackets <= 0 {
+		o.BatchMaxPackets = DefaultBatchMaxPackets
+	}
+	if o.BatchMaxPackets > math.MaxUint16 {
+		return fmt.Errorf("invalid batch size %d: a BatchIpPacket holds at most %d packets", o.BatchMaxPackets, math.MaxUint16)
+	}
+	if o.BatchMaxBytes <= 0 {
+		o.BatchMaxBytes = DefaultBatchMaxBytes
+	}
+	if o.BatchMinFlushInterval <= 0 {
+		o.BatchMinFlushInterval = min(DefaultBatchMinFlushInterval, o.BatchFlushInterval)
+	}
+	if o.BatchMinPackets <= 0 {
+		o.BatchMinPackets = min(DefaultBatchMinPackets, o.BatchMaxPackets)
+	}
+	if o.BatchAdaptive && o.BatchFlushInterval > 0 && o.BatchMinFlushInterval > o.BatchFlushInterval {
+		return fmt.Errorf("invalid batch flush interval: minimum %s is above maximum %s", o.BatchMinFlushInterval, o.BatchFlushInterval)
+	}
+	if o.BatchAdaptive && o.BatchMinPackets > o.BatchMaxPackets {
+		return fmt.Errorf("invalid batch size: minimum %d is above maximum %d", o.BatchMinPackets, o.BatchMaxPackets)
+	}
+	if o.WriteFlushInterval == 0 {
+		o.WriteFlushInterval = DefaultWriteFlushInterval
+	}
+	if o.WriteMaxPackets <= 0 {
+		o.WriteMaxPackets = DefaultWriteMaxPackets
+	}
+	if o.SendQueuePackets <= 0 {
+		o.SendQueuePackets = DefaultSendQueuePackets
+	}
+	switch o.SendQueuePolicy {
+	case "":
+		o.SendQueuePolicy = DropOldest
+	case DropOldest, DropNewest:
+	default:
+		return fmt.Errorf("invalid send queue policy %q: must be %q or %q", o.SendQueuePolicy, DropOldest, DropNewest)
+	}
+	switch o.OnDeviceLost {
+	case "":
+		o.OnDeviceLost = DeviceLostExit
+	case DeviceLostExit, DeviceLostRecreate:
+	default:
+		return fmt.Errorf("invalid device lost policy %q: must be %q or %q", o.OnDeviceLost, DeviceLostExit, DeviceLostRecreate)
+	}
+	if o.IPv6 != "" {
+		prefix, err := netip.ParsePrefix(o.IPv6)
+		if err != nil || !prefix.Addr().Is6() || prefix.Addr().Is4In6() {
+			return fmt.Errorf("invalid VPN IPv6 %q: must be an IPv6 address with prefix length, e.g. %s", o.IPv6, DefaultIPv6)
+		}
+	}
+	for _, dns := range o.DNS {
+		if _, err := netip.ParseAddr(dns); err != nil {
+			return fmt.Errorf("invalid DNS server %q: must be an IP address", dns)
+		}
+	}
+	for _, route := range append(append([]string(nil), o.IncludeRoutes...), o.ExcludeRoutes...) {
+		if _, err := netip.ParsePrefix(route); err != nil {
+			return fmt.Errorf("invalid route %q: must be a CIDR, e.g. 192.168.0.0/16", route)
+		}
+	}
+	if o.KillSwitch && (len(o.IncludeRoutes) > 0 || len(o.ExcludeRoutes) > 0 || o.NoDefaultRoute) {
+		return fmt.Errorf("the kill switch blocks all traffic outside the tunnel, so it can't be combined with include or exclude routes or with no default route")
+	}
+	for _, allow := range o.KillSwitchAllow {
+		if _, err := netip.ParseAddr(allow); err != nil {
+			return fmt.Errorf("invalid kill switch address %q: must be an IP address", allow)
+		}
+	}
+
+	ip := net.ParseIP(o.IP).To4()
+	if ip == nil {
+		return fmt.Errorf("invalid VPN IP %q: must be an IPv4 address", o.IP)
+	}
+	maskIP := net.ParseIP(o.Netmask).To4()
+	if maskIP == nil {
+		return fmt.Errorf("invalid VPN netmask %q: must be a dotted-quad IPv4 mask", o.Netmask)
+	}
+	mask := net.IPMask(maskIP)
+	ones, bits := mask.Size()
+	if bits == 0 {
+		return fmt.Errorf("invalid VPN netmask %q: mask bits must be contiguous", o.Netmask)
+	}
+
+	// Anything up to /30 has network and broadcast addresses that hosts can't use
+	if ones <= 30 {
+		network := ip.Mask(mask)
+		broadcast := make(net.IP, len(network))
+		for i := range network {
+			broadcast[i] = network[i] | ^mask[i]
+		}
+		if ip.Equal(network) || ip.Equal(broadcast) {
+			return fmt.Errorf("VPN IP %s is not a host address in %s/%d", o.IP, network, ones)
+		}
+	}
+	return nil
+}
+
+// packetDevice is what the packet loops need of a device: batched reads and
+// writes of packets at an offset. Every tun.Device (and each queue of a
+// multiQueueDevice) is one; tests run the loops on a memory device.
+type packetDevice interface {
+	Read(bufs [][]byte, sizes []int, offset int) (int, error)
+	Write(bufs [][]byte, offset int) (int, error)
+	BatchSize() int
+}
+
+// TUN is the system-wide VPN device plus the packet loops between it and a Transport
+type TUN struct {
+	transport Transport
+	opts      Options
+
+	mu       sync.Mutex
+	device   tun.Device
+	done     chan struct{}
+	up       chan struct{} // Closed once traffic flows through the device
+	stopOnce sync.Once
+
+	captureFailed atomic.Bool
+	stats         tunCounters
+	mss           *mssClamp // nil unless ClampMSS
+
+	// ctx is cancelled by Stop to unblock the transport side of the loops.
+	// The device read has no cancellation and still relies on closing the device.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewTUN creates a TUN that will carry its traffic over transport.
+// The options are validated here, before any device is created.
+func NewTUN(transport Transport, opts Options) (*TUN, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &TUN{
+		transport: transport,
+		opts:      opts,
+		done:      make(chan struct{}),
+		up:        make(chan struct{}),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+	if opts.ClampMSS {
+		t.mss = newMSSClamp(opts.MTU, opts.MSS)
+	}
+	return t, nil
+}
+
+// ErrTUNUnavailable matches the errors Start returns when this process can't
+// create a TUN device at all, for lack of privileges or of the TUN driver,
+// as opposed to a bad setting or a busy interface
+var ErrTUNUnavailable = errors.New("TUN device unavailable")
+
+// unavailableError is a device creation failure matching ErrTUNUnavailable
+type unavailableError struct{ err error }
+
+func (e unavailableError) Error() string        { return "failed to create TUN device: " + e.err.Error() }
+func (e unavailableError) Unwrap() error        { return e.err }
+func (e unavailableError) Is(target error) bool { return target == ErrTUNUnavailable }
+
+// Start creates and configures the TUN device, then processes packets until
+// an error occurs or Stop is called. On error the network configuration is
+// restored before returning. If the device goes away meanwhile, Start
+// either fails with an error matching ErrDeviceGone or, with
+// DeviceLostRecreate, replaces it and carries on.
+func (t *TUN) Start() error {
+	log.Printf("🔌 Creating TUN device: %s (MTU %d)", t.opts.InterfaceName, t.opts.MTU)
+	if t.opts.Queues > 1 {
+		log.Printf("   %d queues, one read loop each", t.opts.Queues)
+	}
+
+	// Wintun is a DLL next to the executable; say exactly what's wrong with it
+	// (or extract the bundled copy) instead of a bare CreateTUN failure
+	if err := prepareTUNDriver(); err != nil {
+		return unavailableError{err}
+	}
+
+	dev, err := t.createDevice()
+	if err != nil {
+		return err
+	}
+	if dev == nil {
+		return nil // Stop raced with device creation
+	}
+
+	// The transport -> device loop starts first: reading the transport is
+	// also what delivers the lease
+	errChan := make(chan error, 2)
+	go t.writeLoop(errChan)
+
+	if t.opts.LeaseTimeout > 0 {
+		t.acceptLease()
+		select {
+		case <-t.done:
+			return nil
+		default:
+		}
+	}
+
+	// Everything configure records is undone if the device has to be replaced
+	mark := journalMark()
+	realName, err := t.configure(dev)
+	if err != nil {
+		t.Stop()
+		return err
+	}
+
+	// Fail closed: without the kill switch the user asked for, don't run at all
+	if t.opts.KillSwitch {
+		log.Printf("🛡️ Enabling kill switch (allowing only %s and %s)", realName, strings.Join(t.opts.KillSwitchAllow, ", "))
+		err := fmt.Errorf("no tunnel endpoint IPs to allow, it would block the tunnel itself")
+		if len(t.opts.KillSwitchAllow) > 0 {
+			err = enableKillSwitch(realName, t.opts.KillSwitchAllow)
+		}
+		if err != nil {
+			disableKillSwitch() // Drop whatever part of it got installed
+			t.Stop()
+			return fmt.Errorf("failed to enable kill switch: %v", err)
+		}
+		killSwitchOn.Store(true)
+	}
+
+	// Start the device -> transport loop, and the sender behind its queue
+	queue := newSendQueue(t.opts.SendQueuePackets, t.opts.SendQueuePolicy, &t.stats)
+	if t.opts.BatchFlushInterval > 0 {
+		go newBatcher(t.transport, t.opts, queue, &t.stats, t.done).run()
+	} else {
+		go t.sendLoop(queue)
+	}
+	go t.readLoop(dev, queue, errChan)
+	go t.watchDevice(dev, realName, errChan)
+
+	log.Printf("✅ VPN tunnel established! Traffic should now flow through %s", t.opts.IP)
+	events.Emit("tunnel_up", events.Fields{"interface": realName, "ip": t.opts.IP})
+	close(t.up)
+
+	// Wait for error or Stop
+	for {
+		select {
+		case err := <-errChan:
+			select {
+			case <-t.done:
+				// Closing the device in Stop unblocks the loops with an error
+				return nil
+			default:
+			}
+			var gone deviceGoneError
+			if errors.As(err, &gone) {
+				if gone.dev != t.currentDevice() {
+					continue // Reported again for a device already replaced
+				}
+				log.Printf("❌ TUN device %s is gone: %v", realName, gone.err)
+				events.Emit("device_lost", events.Fields{"interface": realName, "error": gone.err.Error(), "action": string(t.opts.OnDeviceLost)})
+				if t.opts.OnDeviceLost == DeviceLostRecreate {
+					if dev, realName, err = t.recreateDevice(gone.dev, mark); err == nil {
+						go t.readLoop(dev, queue, errChan)
+						go t.watchDevice(dev, realName, errChan)
+						continue
+					}
+					select {
+					case <-t.done:
+						return nil
+					default:
+					}
+				}
+			}
+			t.Stop()
+			return err
+		case <-t.done:
+			return nil
+		}
+	}
+}
+
+// createDevice clears a stale interface of our name away and creates the
+// TUN device. It returns a nil device if Stop was called meanwhile.
+func (t *TUN) createDevice() (tun.Device, error) {
+	if err := prepareInterface(t.opts.InterfaceName, t.opts.ReuseExisting); err != nil {
+		return nil, fmt.Errorf("failed to create TUN device: %v", err)
+	}
 
-	// Create TUN device using Wintun
-	dev, err := tun.CreateTUN(tunInterfaceName, mtu)
+	// Create TUN device (Wintun on Windows, /dev/net/tun on Linux, utun on macOS)
+	var dev tun.Device
+	var err error
+	if t.opts.Queues > 1 {
+		dev, err = createMultiQueueTUN(t.opts.InterfaceName, t.opts.MTU, t.opts.Queues)
+	} else {
+		dev, err = tun.CreateTUN(t.opts.InterfaceName, t.opts.MTU)
+	}
+	if errors.Is(err, os.ErrPermission) || errors.Is(err, os.ErrNotExist) {
+		return nil, unavailableError{err} // Not root, or no /dev/net/tun
+	}
 	if err != nil {
-		return fmt.Errorf("failed to create TUN device: %v", err)
+		return nil, fmt.Errorf("failed to create TUN device: %v", err)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	select {
+	case <-t.done:
+		dev.Close()
+		return nil, nil
+	default:
 	}
-	defer dev.Close()
+	t.device = dev
+	return dev, nil
+}
 
-	// Get the real interface name (Wintun might rename it)
+// currentDevice returns the device the loops should use, nil while a lost
+// one is being replaced
+func (t *TUN) currentDevice() tun.Device {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.device
+}
+
+// configure applies the address, MTU, DNS and routes to dev and returns its
+// real name. On failure part of it may be applied; the journal undoes it.
+func (t *TUN) configure(dev tun.Device) (string, error) {
+	// Get the real interface name (Wintun might rename it, utun gets a number)
 	realName, err := dev.Name()
 	if err != nil {
-		realName = tunInterfaceName
+		realName = t.opts.InterfaceName
 	}
 	log.Printf("🌐 TUN device created: %s", realName)
 
 	// Configure IP address
-	log.Printf("🔧 Configuring IP: %s/%s", tunIP, tunNetmask)
-	if err := configureInterface(realName, tunIP, tunNetmask); err != nil {
-		return fmt.Errorf("failed to configure interface: %v", err)
+	log.Printf("🔧 Configuring IP: %s/%s", t.opts.IP, t.opts.Netmask)
+	if err := configureInterface(realName, t.opts.IP, t.opts.Netmask); err != nil {
+		return "", fmt.Errorf("failed to configure interface: %v", err)
+	}
+	if err := setInterfaceMTU(realName, t.opts.MTU); err != nil {
+		log.Printf("⚠️ Could not set MTU %d: %v", t.opts.MTU, err)
+	}
+
+	// DNS goes before the routes: Windows looks up the physical adapter by
+	// asking which interface reaches the internet
+	if len(t.opts.DNS) > 0 {
+		log.Printf("🔧 Configuring DNS: %s", strings.Join(t.opts.DNS, ", "))
+		if err := configureDNS(realName, t.opts.DNS); err != nil {
+			// Non-fatal - VPN will work but may have DNS leaks
+			log.Printf("⚠️ DNS configuration warning: %v", err)
+		}
 	}
 
-	// Configure Routing (The "Def1" trick)
+	// Configure Routing (The "Def1" trick, or just --include-routes)
 	log.Printf("twisted_rightwards_arrows Configuring VPN routes...")
-	if err := configureRouting(realName); err != nil {
-		return fmt.Errorf("failed to configure routing: %v", err)
+	routes, routes6 := t.tunnelRoutes()
+	if t.opts.NoDefaultRoute && len(t.opts.IncludeRoutes) == 0 {
+		log.Printf("⚠️ No default route and no include routes: the tunnel is up but routes nothing (add routes via %s by hand)", realName)
+	}
+	if err := configureRouting(realName, t.opts.IP, routes); err != nil {
+		return "", fmt.Errorf("failed to configure routing: %v", err)
 	}
 
-	// Start packet processing loops
-	errChan := make(chan error, 2)
+	// IPv6 is best effort: hosts with IPv6 disabled still get a working IPv4 tunnel
+	if t.opts.IPv6 != "" {
+		log.Printf("🔧 Configuring IPv6: %s", t.opts.IPv6)
+		if err := configureIPv6(realName, netip.MustParsePrefix(t.opts.IPv6), routes6); err != nil {
+			log.Printf("⚠️ IPv6 configuration failed, IPv6 traffic will not use the tunnel: %v", err)
+		}
+	}
 
-	// Read from TUN -> Send to Transport
-	go func() {
-		// Buffer for reading from TUN
-		// WireGuard tun.Read expects [][]byte
-		// We allocate these once and reuse them for the syscall
-		buffs := make([][]byte, batchSize)
-		for i := 0; i < batchSize; i++ {
-			buffs[i] = make([]byte, mtu)
-		}
-		sizes := make([]int, batchSize)
-
-		for {
-			n, err := dev.Read(buffs, sizes, 0)
-			if err != nil {
-				errChan <- fmt.Errorf("TUN read error: %v", err)
-				return
-			}
+	// Excluded CIDRs are more specific than the split routes, so they win
+	if len(t.opts.ExcludeRoutes) > 0 {
+		addExcludeRoutes(t.opts.ExcludeRoutes)
+	}
+	return realName, nil
+}
 
-			// Collect packets into a batch
-			batch := make([][]byte, 0, n)
-			for i := 0; i < n; i++ {
-				if sizes[i] > 0 {
-					// Zero-Copy Optimization:
-					// Copy into pooled buffer for batch sending
-					pooledBuf := protocol.GetBuffer()
-					copy(pooledBuf, buffs[i][:sizes[i]])
-					packet := pooledBuf[:sizes[i]]
-					batch = append(batch, packet)
-				}
-			}
+// IP is the tunnel address, the leased one once Up is closed
+func (t *TUN) IP() string {
+	return t.opts.IP
+}
 
-			// Send batch via Transport
-			if len(batch) > 0 {
-				if err := transport.SendBatch(batch); err != nil {
-					// If send fails, return all buffers in batch
-					for _, pkt := range batch {
-						protocol.PutBuffer(pkt)
-					}
-				}
-			}
+// Up is closed once Start has configured the device and routes and
+// traffic flows through the tunnel
+func (t *TUN) Up() <-chan struct{} {
+	return t.up
+}
+
+// RoutesAll reports whether o sends everything through the tunnel, i.e.
+// the split default routes are added
+func (o *Options) RoutesAll() bool {
+	return len(o.IncludeRoutes) == 0 && !o.NoDefaultRoute
+}
+
+// tunnelRoutes returns the IPv4 and IPv6 routes to send through the TUN:
+// the split default routes, or with IncludeRoutes or NoDefaultRoute those
+// CIDRs and the DNS servers, so the resolvers we point the system at stay
+// inside the tunnel
+func (t *TUN) tunnelRoutes() (routes, routes6 []string) {
+	if t.opts.RoutesAll() {
+		return splitDefaultRoutes, splitDefaultRoutes6
+	}
+	include := append([]string(nil), t.opts.IncludeRoutes...)
+	for _, dns := range t.opts.DNS {
+		addr := netip.MustParseAddr(dns)
+		if dns == t.opts.IP || addr.IsLoopback() {
+			continue // Our own resolver (--internal-dns) is local
+		}
+		include = append(include, netip.PrefixFrom(addr, addr.BitLen()).String())
+	}
+	for _, route := range include {
+		prefix := netip.MustParsePrefix(route).Masked()
+		if prefix.Addr().Is4() {
+			routes = append(routes, prefix.String())
+		} else {
+			routes6 = append(routes6, prefix.String())
+		}
+	}
+	return routes, routes6
+}
+
+// addExcludeRoutes routes each CIDR via the original gateway of its family.
+// Failures only warn: the CIDR then goes through the tunnel, which is safe.
+func addExcludeRoutes(excludes []string) {
+	gateway, gwErr := DefaultGateway()
+	gateway6, gw6Err := DefaultGateway6()
+	for _, route := range excludes {
+		prefix := netip.MustParsePrefix(route).Masked()
+		gw, err := gateway, gwErr
+		if prefix.Addr().Is6() {
+			gw, err = gateway6, gw6Err
 		}
-	}()
+		if err == nil {
+			log.Printf("🔓 Excluding %s from the tunnel (via %s)", prefix, gw)
+			err = addExcludeRoute(prefix, gw)
+		}
+		if err != nil {
+			log.Printf("   ⚠️ Could not exclude %s, it will use the tunnel: %v", prefix, err)
+		}
+	}
+}
+
+// acceptLease waits up to LeaseTimeout for the peer to assign an address
+// and switches IP and Netmask to it
+func (t *TUN) acceptLease() {
+	ctx, cancel := context.WithTimeout(t.ctx, t.opts.LeaseTimeout)
+	defer cancel()
+
+	log.Printf("⏳ Waiting for the Exit Peer to assign an address...")
+	prefix, err := leaseFrom(ctx, t.transport)
+	if err != nil {
+		log.Printf("⚠️ No address lease (%v), using %s", err, t.opts.IP)
+		return
+	}
+
+	leased := t.opts
+	leased.IP = prefix.Addr().String()
+	// A resolver on our own address (--internal-dns) moves with it
+	leased.DNS = slices.Clone(t.opts.DNS)
+	if i := slices.Index(leased.DNS, t.opts.IP); i >= 0 {
+		leased.DNS[i] = leased.IP
+	}
+	leased.Netmask = net.IP(net.CIDRMask(prefix.Bits(), 32)).String()
+	if !prefix.Addr().Is4() {
+		err = fmt.Errorf("not an IPv4 address")
+	} else {
+		err = leased.Validate()
+	}
+	if err != nil {
+		log.Printf("⚠️ Ignoring lease %s (%v), using %s", prefix, err, t.opts.IP)
+		return
+	}
+	t.opts = leased
+}
+
+// Stop restores the original routes and DNS settings and closes the device.
+// It is safe to call more than once and from a signal handler.
+func (t *TUN) Stop() {
+	t.stopOnce.Do(func() {
+		t.mu.Lock()
+		close(t.done)
+		dev := t.device
+		t.mu.Unlock()
+		t.cancel()
+
+		// Undo routes before closing: on some platforms they vanish with the device
+		RestoreNetwork()
+		if dev != nil {
+			dev.Close()
+		}
+	})
+}
+
+// readLoop reads from TUN -> sendQueue -> sends to Transport.
+// Each device read is already a batch; when coalescing is enabled the
+// batcher merges closely spaced reads into a single BatchIpPacket.
+// The queue keeps a slow relay from stalling device reads. It runs until
+// dev fails, and is started again for a replacement device. A multi-queue
+// device gets one loop per queue, all feeding the same sendQueue.
+func (t *TUN) readLoop(dev tun.Device, queue *sendQueue, errChan chan<- error) {
+	if mq, ok := dev.(*multiQueueDevice); ok {
+		for _, q := range mq.queues {
+			go t.readQueue(dev, q, queue, errChan)
+		}
+		return
+	}
+	t.readQueue(dev, dev, queue, errChan)
+}
 
-	// Read from Transport -> Write to TUN
-	go func() {
-		for {
-			msg, err := transport.Recv()
-			if err != nil {
-				errChan <- fmt.Errorf("transport recv error: %v", err)
-				return
+// readQueue is readLoop for one queue q of dev, which its failures are
+// reported against
+func (t *TUN) readQueue(dev tun.Device, q packetDevice, queue *sendQueue, errChan chan<- error) {
+	// Buffer for reading from TUN
+	// WireGuard tun.Read expects [][]byte
+	// We allocate these once and reuse them for the syscall
+	count := 1
+	if q.BatchSize() > 1 {
+		count = max(q.BatchSize(), readBatchSize)
+	}
+	buffs := make([][]byte, count)
+	for i := range buffs {
+		buffs[i] = make([]byte, tunOffset+t.opts.MTU)
+	}
+	sizes := make([]int, count)
+
+	for {
+		n, err := q.Read(buffs, sizes, tunOffset)
+		if errors.Is(err, tun.ErrTooManySegments) {
+			// The first n segments are good; TCP resends the rest
+			metrics.DroppedPackets.Inc()
+			t.stats.dropped.Add(1)
+			err = nil
+		}
+		if err != nil {
+			metrics.TunReadErrors.Inc()
+			t.stats.readErrors.Add(1)
+			if isDeviceGone(err) {
+				err = deviceGoneError{dev: dev, err: err}
 			}
+			t.report(errChan, fmt.Errorf("TUN read error: %w", err))
+			return
+		}
 
-			// Handle BatchIpPacket (multiple packets in one message)
-			if batchPacket, ok := msg.(*protocol.BatchIpPacket); ok {
-				// Write all packets in batch to TUN
-				if len(batchPacket.Packets) > 0 {
-					_, err := dev.Write(batchPacket.Packets, 0)
-					if err != nil {
-						log.Printf("❌ TUN batch write error: %v", err)
-					}
-				}
+		// Collect packets into a batch
+		batch := make([][]byte, 0, n)
+		bytes := 0
+		for i := 0; i < n; i++ {
+			if sizes[i] == 0 {
 				continue
 			}
-
-			// Handle single IpPacket (backwards compatibility)
-			if ipPacket, ok := msg.(*protocol.IpPacket); ok {
-				if len(ipPacket.Payload) > 0 {
-					_, err := dev.Write([][]byte{ipPacket.Payload}, 0)
-					if err != nil {
-						log.Printf("❌ TUN write error: %v", err)
-					}
+			// Truncated or inconsistent headers would only confuse the exit
+			pkt, ok := validPacket(buffs[i][tunOffset : tunOffset+sizes[i]])
+			if !ok {
+				metrics.DroppedPackets.Inc()
+				t.stats.dropped.Add(1)
+				continue
+			}
+			if t.opts.Filter != nil && !t.opts.Filter.Allow(pkt) {
+				if t.opts.TracePackets {
+					tracePacket("out filtered", pkt)
 				}
+				t.stats.filtered.Add(1)
+				continue
+			}
+			// Zero-Copy Optimization:
+			// Copy into pooled buffer for batch sending
+			pooledBuf := bufpool.Get()
+			packet := pooledBuf[:copy(pooledBuf, pkt)]
+			if completeChecksums(packet) {
+				metrics.ChecksumCompleted.Inc()
+			}
+			if t.mss != nil {
+				t.mss.apply(packet)
+			}
+			if t.opts.TracePackets {
+				tracePacket("out", packet)
 			}
+			batch = append(batch, packet)
+			bytes += len(packet)
+			metrics.TunToRelayPacketSize.Observe(len(packet))
 		}
-	}()
+		if len(batch) == 0 {
+			continue
+		}
+		if t.opts.Capture != nil {
+			t.capture(pcap.Outbound, batch)
+		}
+		queue.push(readBatch{packets: batch, bytes: bytes})
+	}
+}
 
-	log.Printf("✅ VPN tunnel established! Traffic should now flow through %s", tunIP)
-	
-	// Wait for error
-	return <-errChan
+// sendLoop sends every read on its own when coalescing is disabled
+func (t *TUN) sendLoop(queue *sendQueue) {
+	for {
+		select {
+		case <-queue.ready:
+			if rb, ok := queue.take(); ok {
+				sendCounted(t.transport, &t.stats, rb.packets, rb.bytes)
+			}
+		case <-t.done:
+			return
+		}
+	}
 }
 
-func configureInterface(ifaceName, ip, netmask string) error {
-	// netsh interface ip set address "zks-tun0" static 10.0.85.1 255.255.255.0
-	cmd := exec.Command("netsh", "interface", "ip", "set", "address", ifaceName, "static", ip, netmask)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("netsh set address failed: %v, output: %s", err, out)
+// writeLoop reads from Transport -> writes to TUN.
+// RecvBatch hands over whole groups of packets (a BatchIpPacket or a
+// recvmmsg burst) so each group is one scatter/gather device write; with
+// WriteFlushInterval set, groups that arrive close together share one
+// (see writeCoalescer).
+func (t *TUN) writeLoop(errChan chan<- error) {
+	if t.opts.WriteFlushInterval > 0 {
+		groups := make(chan [][]byte, writeQueueGroups)
+		go t.recvLoop(groups, errChan)
+		newWriteCoalescer(t, groups).run()
+		return
 	}
-	
-	// Configure DNS to prevent DNS leaks
-	if err := configureDNS(ifaceName); err != nil {
-		log.Printf("⚠️ DNS configuration warning: %v", err)
-		// Non-fatal - VPN will work but may have DNS leaks
+	for {
+		packets, err := t.recv(errChan)
+		if err != nil {
+			return
+		}
+		t.writeCounted(packets)
 	}
-	
-	return nil
 }
 
-// configureDNS implements modern Windows DNS leak prevention using NRPT
-func configureDNS(ifaceName string) error {
-	log.Printf("🔒 Configuring DNS leak prevention (NRPT)...")
-	
-	// Step 1: Set DNS servers on TUN interface to Cloudflare/Google DNS
-	dnsServers := []string{"1.1.1.1", "8.8.8.8"}
-	
-	for i, dns := range dnsServers {
-		var cmd *exec.Cmd
-		if i == 0 {
-			// Primary DNS
-			cmd = exec.Command("powershell", "-NoProfile", "-Command", 
-				fmt.Sprintf("Set-DnsClientServerAddress -InterfaceAlias '%s' -ServerAddresses '%s'", ifaceName, dns))
-		} else {
-			// Add secondary DNS
-			cmd = exec.Command("netsh", "interface", "ipv4", "add", "dns", ifaceName, dns, "index="+fmt.Sprint(i+1))
-		}
-		
-		if out, err := cmd.CombinedOutput(); err != nil {
-			log.Printf("⚠️ Failed to set DNS server %s: %v, output: %s", dns, err, out)
-		}
-	}
-	
-	// Step 2: Add NRPT rule to route ALL DNS queries through VPN interface
-	// This is the modern Windows approach used by Always On VPN
-	// NRPT = Name Resolution Policy Table
-	nrptCmd := fmt.Sprintf(`
-		# Remove existing NRPT rules for this namespace
-		Get-DnsClientNrptRule | Where-Object {$_.Namespace -eq '.'} | Remove-DnsClientNrptRule -Force -ErrorAction SilentlyContinue
-		
-		# Add NRPT rule for all DNS queries (namespace = '.')
-		# This forces ALL DNS through the VPN's DNS servers
-		Add-DnsClientNrptRule -Namespace '.' -NameServers '%s','%s' -Comment 'ZKS-VPN DNS Leak Prevention'
-	`, dnsServers[0], dnsServers[1])
-	
-	cmd := exec.Command("powershell", "-NoProfile", "-Command", nrptCmd)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		log.Printf("⚠️ NRPT rule failed (non-fatal): %v, output: %s", err, out)
-		// Fallback approach: Clear DNS cache
-		exec.Command("ipconfig", "/flushdns").Run()
-		return fmt.Errorf("NRPT not supported, using basic DNS config")
-	}
-	
-	log.Printf("✅ DNS leak prevention configured (NRPT active)")
-	
-	// Flush DNS cache to apply changes immediately
-	exec.Command("ipconfig", "/flushdns").Run()
-	
-	return nil
+// recv returns the next group of packets from the transport. A failure
+// other than Stop is counted and reported on errChan.
+func (t *TUN) recv(errChan chan<- error) ([][]byte, error) {
+	packets, err := recvBatchContext(t.ctx, t.transport)
+	if err != nil && t.ctx.Err() == nil {
+		metrics.TransportRecvErrors.Inc()
+		errChan <- fmt.Errorf("transport recv error: %v", err)
+	}
+	return packets, err
 }
 
-func configureRouting(ifaceName string) error {
-	// 1. Get Interface Index
-	// powershell -Command "(Get-NetAdapter -Name 'zks-tun0').InterfaceIndex"
-	cmd := exec.Command("powershell", "-Command", fmt.Sprintf("(Get-NetAdapter -Name '%s').InterfaceIndex", ifaceName))
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("failed to get interface index: %v", err)
+// writeCounted writes packets to the device, counting a failure, and
+// recycles them. A device that went away is left to readLoop and
+// watchDevice to report, rather than logging every write to it.
+func (t *TUN) writeCounted(packets [][]byte) {
+	if err := t.writePackets(packets); err != nil {
+		metrics.TunWriteErrors.Inc()
+		t.stats.writeErrors.Add(1)
+		if !isDeviceGone(err) {
+			log.Printf("❌ TUN write error: %v", err)
+		}
 	}
-	ifIndex := strings.TrimSpace(string(out))
-	log.Printf("🔢 TUN Interface Index: %s", ifIndex)
+	// writePackets copied them into device buffers; we own the originals
+	for _, pkt := range packets {
+		bufpool.Put(pkt)
+	}
+}
 
-	// Set Interface Metric to 1 to ensure our routes take precedence
-	// Windows Automatic Metric can assign high values (e.g. 25-50) which overrides our route metric
-	log.Printf("📉 Setting TUN interface metric to 1...")
-	exec.Command("netsh", "interface", "ipv4", "set", "interface", ifIndex, "metric=1").Run()
+// writePackets writes packets to the current device, dropping them while
+// there is none
+func (t *TUN) writePackets(packets [][]byte) error {
+	dev := t.currentDevice()
+	if dev == nil {
+		// Between a lost device and its replacement
+		metrics.DroppedPackets.Add(len(packets))
+		t.stats.dropped.Add(uint64(len(packets)))
+		return nil
+	}
+	return t.writeDevice(dev, packets)
+}
 
-	// 2. Get the original default gateway (robust method)
-	// We get all NextHops for 0.0.0.0/0 and filter in Go to avoid PowerShell syntax issues
-	cmd = exec.Command("powershell", "-Command", "Get-NetRoute -DestinationPrefix '0.0.0.0/0' | Select-Object -ExpandProperty NextHop")
-	out, err = cmd.CombinedOutput()
-	if err != nil {
-		log.Printf("⚠️ Could not get default gateway: %v", err)
-	}
-	
-	gatewayOutput := strings.TrimSpace(string(out))
-	originalGateway := ""
-	for _, line := range strings.Split(gatewayOutput, "\r\n") {
-		line = strings.TrimSpace(line)
-		if line != "" && line != "0.0.0.0" && line != "::" {
-			originalGateway = line
-			break
-		}
-	}
-	log.Printf("🌐 Original gateway: %s", originalGateway)
-
-	// NOTE: Relay bypass routes are now handled in main.go BEFORE TUN creation
-	// This is done by addRelayBypassRoutes() which resolves the relay hostname
-	// and adds specific /32 routes for only those IPs.
-	// DO NOT add broad Cloudflare bypass routes here (104.16.0.0/12 etc.)
-	// as they cause IP leaks by bypassing IP check sites.
-
-	// 3. Add VPN routes (0.0.0.0/1 and 128.0.0.0/1) pointing to TUN interface
-	routes := []string{
-		"0.0.0.0/1",
-		"128.0.0.0/1",
-	}
-
-	for _, route := range routes {
-		log.Printf("🛣️ Adding route: %s -> Interface %s", route, ifIndex)
-		
-		// Modern Windows approach: Use PowerShell's New-NetRoute cmdlet
-		// This is the most reliable method for Windows 10/11
-		// Format: New-NetRoute -DestinationPrefix "0.0.0.0/1" -InterfaceIndex <idx> -RouteMetric 1
-		psCmd := fmt.Sprintf(
-			"if (Get-NetRoute -DestinationPrefix '%s' -InterfaceIndex %s -ErrorAction SilentlyContinue) { Remove-NetRoute -DestinationPrefix '%s' -InterfaceIndex %s -Confirm:$false -ErrorAction SilentlyContinue }; New-NetRoute -DestinationPrefix '%s' -InterfaceIndex %s -RouteMetric 1 -ErrorAction Stop",
-			route, ifIndex, route, ifIndex, route, ifIndex,
-		)
-		
-		cmd := exec.Command("powershell", "-NoProfile", "-Command", psCmd)
-		out, err := cmd.CombinedOutput()
-		
-		if err != nil {
-			log.Printf("⚠️ PowerShell New-NetRoute failed for %s: %v, output: %s", route, err, out)
-			
-			// Fallback 1: Try netsh
-			log.Printf("   Trying netsh fallback...")
-			cmd = exec.Command("netsh", "interface", "ipv4", "add", "route", route, "interface="+ifIndex, "metric=1")
-			if out, err := cmd.CombinedOutput(); err != nil {
-				log.Printf("   ⚠️ netsh also failed: %v, output: %s", err, out)
-				
-				// Fallback 2: Try route.exe
-				log.Printf("   Trying route.exe fallback...")
-				parts := strings.Split(route, "/")
-				network := parts[0]
-				mask := "128.0.0.0"
-				cmd = exec.Command("route", "add", network, "mask", mask, "0.0.0.0", "IF", ifIndex, "METRIC", "1")
-				if out, err := cmd.CombinedOutput(); err != nil {
-					log.Printf("   ❌ route.exe also failed: %v, output: %s", err, out)
-					log.Printf("   ⚠️ WARNING: Route %s could not be added! VPN may leak traffic!", route)
-					continue
-				}
-				log.Printf("   ✅ route.exe succeeded for %s", route)
-			} else {
-				log.Printf("   ✅ netsh succeeded for %s", route)
-			}
-		} else {
-			log.Printf("✅ Successfully added route %s via PowerShell", route)
+// writeDevice writes packets to dev in one scatter/gather call, copying
+// each into a pooled buffer with the tunOffset headroom the platform driver
+// needs. Malformed packets are dropped up front: they'd inject garbage into
+// the kernel stack, and one bad entry in a BatchIpPacket would otherwise
+// fail the write for all of them.
+func (t *TUN) writeDevice(dev packetDevice, packets [][]byte) error {
+	buffs := make([][]byte, 0, len(packets))
+	bytes := 0
+	for _, pkt := range packets {
+		pkt, ok := validPacket(pkt)
+		if !ok {
+			metrics.DroppedPackets.Inc()
+			t.stats.dropped.Add(1)
+			continue
+		}
+		if tunOffset+len(pkt) > protocol.BufferPoolSize {
+			metrics.DroppedPackets.Inc()
+			t.stats.dropped.Add(1)
+			continue // Larger than any MTU we configure
 		}
+		buf := protocol.GetBuffer()
+		copy(buf[tunOffset:], pkt)
+		if t.mss != nil {
+			t.mss.apply(buf[tunOffset : tunOffset+len(pkt)])
+		}
+		if t.opts.TracePackets {
+			tracePacket("in", buf[tunOffset:tunOffset+len(pkt)])
+		}
+		buffs = append(buffs, buf[:tunOffset+len(pkt)])
+		bytes += len(pkt)
+		metrics.RelayToTunPacketSize.Observe(len(pkt))
 	}
-	
-	log.Printf("🎯 Route configuration complete")
-	return nil
+
+	if len(buffs) == 0 {
+		return nil
+	}
+	if t.opts.Capture != nil {
+		captured := make([][]byte, len(buffs))
+		for i, buf := range buffs {
+			captured[i] = buf[tunOffset:]
+		}
+		t.capture(pcap.Inbound, captured)
+	}
+
+	var err error
+	if mq, ok := dev.(*multiQueueDevice); ok {
+		err = mq.write(buffs, tunOffset)
+	} else {
+		_, err = dev.Write(buffs, tunOffset)
+	}
+	if err == nil {
+		metrics.RelayToTunPackets.Add(len(buffs))
+		metrics.RelayToTunBytes.Add(bytes)
+		t.stats.packetsIn.Add(uint64(len(buffs)))
+		t.stats.bytesIn.Add(uint64(bytes))
+	}
+
+	for _, buf := range buffs {
+		protocol.PutBuffer(buf)
+	}
+	return err
 }
 
+// capture records packets for --pcap. A failing capture is reported once
+// and then stays off.
+func (t *TUN) capture(dir pcap.Direction, packets [][]byte) {
+	if err := t.opts.Capture.WritePackets(dir, packets); err != nil && t.captureFailed.CompareAndSwap(false, true) {
+		log.Printf("⚠️ Packet capture stopped: %v", err)
+	}
+}
+
+// runCmd runs a configuration command, folding its output into the error
+func runCmd(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s %s failed: %v, output: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
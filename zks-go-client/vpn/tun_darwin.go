@@ -0,0 +1,220 @@
+//go:build darwin
+
+package vpn
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// DefaultInterfaceName asks for the next free utun device; the kernel numbers them
+const DefaultInterfaceName = "utun"
+
+// validateInterfaceName allows only what macOS can create: "utun" or "utunN"
+func validateInterfaceName(name string) error {
+	n, ok := strings.CutPrefix(name, "utun")
+	if !ok {
+		return fmt.Errorf(`must be "utun" or "utun<N>" on macOS`)
+	}
+	if n != "" {
+		if _, err := strconv.ParseUint(n, 10, 31); err != nil {
+			return fmt.Errorf(`must be "utun" or "utun<N>" on macOS`)
+		}
+	}
+	return nil
+}
+
+func configureInterface(ifaceName, ip, netmask string) error {
+	// utun is point-to-point: ifconfig utun4 10.0.85.1 10.0.85.1 up
+	return runCmd("ifconfig", ifaceName, ip, ip, "netmask", netmask, "up")
+}
+
+// setInterfaceMTU is a no-op: CreateTUN already set the MTU on the utun
+func setInterfaceMTU(ifaceName string, mtu int) error {
+	return nil
+}
+
+func configureRouting(ifaceName, ip string, routes []string) error {
+	originalGateway, err := DefaultGateway()
+	if err != nil {
+		log.Printf("⚠️ Could not get default gateway: %v", err)
+	}
+	log.Printf("🌐 Original gateway: %s", originalGateway)
+
+	for _, route := range routes {
+		log.Printf("🛣️ Adding route: %s -> %s", route, ifaceName)
+		if err := runCmd("route", "-n", "add", "-net", route, ip); err != nil {
+			log.Printf("   ⚠️ WARNING: Route %s could not be added! VPN may leak traffic! (%v)", route, err)
+			continue
+		}
+		recordUndo("route "+route, func() error {
+			return runCmd("route", "-n", "delete", "-net", route, ip)
+		})
+		log.Printf("✅ Successfully added route %s", route)
+	}
+
+	log.Printf("🎯 Route configuration complete")
+	return nil
+}
+
+// configureDNS sets servers on every network service, since macOS resolves
+// through the primary service rather than the utun
+func configureDNS(ifaceName string, servers []string) error {
+	out, err := exec.Command("networksetup", "-listallnetworkservices").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("networksetup failed: %v, output: %s", err, out)
+	}
+
+	// The first line is a notice; disabled services start with "*"
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	for _, service := range lines[1:] {
+		service = strings.TrimSpace(service)
+		if service == "" || strings.HasPrefix(service, "*") {
+			continue
+		}
+
+		// "There aren't any DNS Servers set on Wi-Fi." means DHCP; "Empty" restores that
+		previous := []string{"Empty"}
+		if cur, err := exec.Command("networksetup", "-getdnsservers", service).Output(); err == nil && !strings.Contains(string(cur), " ") {
+			previous = strings.Fields(string(cur))
+		}
+
+		if err := runCmd("networksetup", append([]string{"-setdnsservers", service}, servers...)...); err != nil {
+			log.Printf("   ⚠️ Could not set DNS on %s: %v", service, err)
+			continue
+		}
+		recordUndo("DNS on "+service, func() error {
+			return runCmd("networksetup", append([]string{"-setdnsservers", service}, previous...)...)
+		})
+	}
+	return nil
+}
+
+func configureIPv6(ifaceName string, prefix netip.Prefix, routes []string) error {
+	// ifconfig utun4 inet6 fd00:85::1 prefixlen 64
+	if err := runCmd("ifconfig", ifaceName, "inet6", prefix.Addr().String(), "prefixlen", strconv.Itoa(prefix.Bits())); err != nil {
+		return err
+	}
+
+	for _, route := range routes {
+		log.Printf("🛣️ Adding route: %s -> %s", route, ifaceName)
+		if err := runCmd("route", "-n", "add", "-inet6", "-net", route, "-interface", ifaceName); err != nil {
+			log.Printf("   ⚠️ WARNING: Route %s could not be added! IPv6 may leak traffic! (%v)", route, err)
+			continue
+		}
+		recordUndo("route "+route, func() error {
+			return runCmd("route", "-n", "delete", "-inet6", "-net", route, "-interface", ifaceName)
+		})
+		log.Printf("✅ Successfully added route %s", route)
+	}
+	return nil
+}
+
+// getDefaultGateway parses the "gateway:" line of `route -n get default`
+func getDefaultGateway() (string, error) {
+	return routeGetGateway("-n", "get", "default")
+}
+
+// getInterfaceGateway asks for the default route scoped to name
+func getInterfaceGateway(name string) (string, error) {
+	gw, err := routeGetGateway("-n", "get", "-ifscope", name, "default")
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+	return gw, nil
+}
+
+// getInterfaceGateway6 asks for the IPv6 default route scoped to name
+func getInterfaceGateway6(name string) (string, error) {
+	gw, err := routeGetGateway("-n", "get", "-inet6", "-ifscope", name, "default")
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+	return gw, nil
+}
+
+// routeGetGateway runs `route` with args and returns its "gateway:" line
+func routeGetGateway(args ...string) (string, error) {
+	out, err := exec.Command("route", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("route get failed: %v, output: %s", err, out)
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		if gw, ok := strings.CutPrefix(line, "gateway:"); ok {
+			return strings.TrimSpace(gw), nil
+		}
+	}
+	return "", fmt.Errorf("no default gateway found")
+}
+
+// getDefaultGateway6 reads the gateway line of `route -n get -inet6 default`,
+// which macOS prints with the zone for link-local routers ("fe80::1%en0")
+func getDefaultGateway6() (string, error) {
+	out, err := exec.Command("route", "-n", "get", "-inet6", "default").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("route get failed: %v, output: %s", err, out)
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		if gw, ok := strings.CutPrefix(line, "gateway:"); ok {
+			return strings.TrimSpace(gw), nil
+		}
+	}
+	return "", fmt.Errorf("no IPv6 default gateway found")
+}
+
+func addHostRoute6(ip, gateway string) error {
+	if err := runCmd("route", "-n", "add", "-inet6", "-host", ip, gateway); err != nil {
+		return err
+	}
+	recordUndo("host route "+ip, func() error {
+		return runCmd("route", "-n", "delete", "-inet6", "-host", ip, gateway)
+	})
+	return nil
+}
+
+// addExcludeRoute routes prefix via gateway outside the tunnel
+func addExcludeRoute(prefix netip.Prefix, gateway string) error {
+	family := "-inet"
+	if prefix.Addr().Is6() {
+		family = "-inet6"
+	}
+	if err := runCmd("route", "-n", "add", family, "-net", prefix.String(), gateway); err != nil {
+		return err
+	}
+	recordUndo("exclude route "+prefix.String(), func() error {
+		return runCmd("route", "-n", "delete", family, "-net", prefix.String(), gateway)
+	})
+	return nil
+}
+
+func addHostRoute(ip, gateway string) error {
+	if err := runCmd("route", "-n", "add", "-host", ip, gateway); err != nil {
+		return err
+	}
+	recordUndo("host route "+ip, func() error {
+		return runCmd("route", "-n", "delete", "-host", ip, gateway)
+	})
+	return nil
+}
+
+// isDeviceGone reports whether err from the utun device means it went away
+func isDeviceGone(err error) bool {
+	for _, gone := range []error{os.ErrClosed, unix.EBADF, unix.ENXIO, unix.EIO} {
+		if errors.Is(err, gone) {
+			return true
+		}
+	}
+	return false
+}
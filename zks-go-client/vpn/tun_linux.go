@@ -0,0 +1,239 @@
+//go:build linux
+
+package vpn
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// DefaultInterfaceName is the TUN device name used when none is configured
+const DefaultInterfaceName = "zks-tun0"
+
+// validateInterfaceName applies the kernel's rules (dev_valid_name): under
+// IFNAMSIZ (16) bytes including the NUL, no '/', ':' or whitespace. A "%d"
+// in the name makes the kernel pick the next free number.
+func validateInterfaceName(name string) error {
+	if len(name) > 15 {
+		return fmt.Errorf("at most 15 bytes on Linux")
+	}
+	if name == "." || name == ".." || strings.ContainsAny(name, "/: \t\n\r\v\f") {
+		return fmt.Errorf("must not be . or .. or contain '/', ':' or whitespace")
+	}
+	return nil
+}
+
+func configureInterface(ifaceName, ip, netmask string) error {
+	mask := net.ParseIP(netmask).To4()
+	if mask == nil {
+		return fmt.Errorf("invalid netmask: %s", netmask)
+	}
+	ones, _ := net.IPMask(mask).Size()
+
+	// ip addr add 10.0.85.1/24 dev zks-tun0
+	if err := runCmd("ip", "addr", "add", fmt.Sprintf("%s/%d", ip, ones), "dev", ifaceName); err != nil {
+		return err
+	}
+	// ip link set dev zks-tun0 up
+	return runCmd("ip", "link", "set", "dev", ifaceName, "up")
+}
+
+// setInterfaceMTU is a no-op: CreateTUN already set the MTU on the device
+func setInterfaceMTU(ifaceName string, mtu int) error {
+	return nil
+}
+
+func configureRouting(ifaceName, ip string, routes []string) error {
+	originalGateway, err := DefaultGateway()
+	if err != nil {
+		log.Printf("⚠️ Could not get default gateway: %v", err)
+	}
+	log.Printf("🌐 Original gateway: %s", originalGateway)
+
+	for _, route := range routes {
+		log.Printf("🛣️ Adding route: %s -> %s", route, ifaceName)
+		// "replace" instead of "add" so a leftover route from a crashed run doesn't fail us
+		if err := runCmd("ip", "route", "replace", route, "dev", ifaceName, "src", ip); err != nil {
+			log.Printf("   ⚠️ WARNING: Route %s could not be added! VPN may leak traffic! (%v)", route, err)
+			continue
+		}
+		recordUndo("route "+route, func() error {
+			return runCmd("ip", "route", "del", route, "dev", ifaceName)
+		})
+		log.Printf("✅ Successfully added route %s", route)
+	}
+
+	log.Printf("🎯 Route configuration complete")
+	return nil
+}
+
+// configureDNS hands servers to systemd-resolved for the TUN link, with the
+// "~." routing domain so every query goes there instead of the physical link
+func configureDNS(ifaceName string, servers []string) error {
+	if _, err := exec.LookPath("resolvectl"); err != nil {
+		return fmt.Errorf("resolvectl not found (systemd-resolved is required)")
+	}
+	if err := runCmd("resolvectl", append([]string{"dns", ifaceName}, servers...)...); err != nil {
+		return err
+	}
+	recordUndo("DNS on "+ifaceName, func() error {
+		return runCmd("resolvectl", "revert", ifaceName)
+	})
+	return runCmd("resolvectl", "domain", ifaceName, "~.")
+}
+
+func configureIPv6(ifaceName string, prefix netip.Prefix, routes []string) error {
+	// ip -6 addr add fd00:85::1/64 dev zks-tun0
+	if err := runCmd("ip", "-6", "addr", "add", prefix.String(), "dev", ifaceName); err != nil {
+		return err
+	}
+
+	for _, route := range routes {
+		log.Printf("🛣️ Adding route: %s -> %s", route, ifaceName)
+		if err := runCmd("ip", "-6", "route", "replace", route, "dev", ifaceName, "src", prefix.Addr().String()); err != nil {
+			log.Printf("   ⚠️ WARNING: Route %s could not be added! IPv6 may leak traffic! (%v)", route, err)
+			continue
+		}
+		recordUndo("route "+route, func() error {
+			return runCmd("ip", "-6", "route", "del", route, "dev", ifaceName)
+		})
+		log.Printf("✅ Successfully added route %s", route)
+	}
+	return nil
+}
+
+// getDefaultGateway parses `ip -4 route show default`:
+// "default via 192.168.1.1 dev eth0 proto dhcp metric 100"
+func getDefaultGateway() (string, error) {
+	return defaultRouteVia("ip", "-4", "route", "show", "default")
+}
+
+// getInterfaceGateway is getDefaultGateway for the default route through name
+func getInterfaceGateway(name string) (string, error) {
+	gw, err := defaultRouteVia("ip", "-4", "route", "show", "default", "dev", name)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+	return gw, nil
+}
+
+// getInterfaceGateway6 is getDefaultGateway6 for the default route through
+// name. The gateway is zoned with name even when it isn't link-local,
+// which only pins the host routes to it.
+func getInterfaceGateway6(name string) (string, error) {
+	gw, err := defaultRouteVia("ip", "-6", "route", "show", "default", "dev", name)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+	return gw + "%" + name, nil
+}
+
+// defaultRouteVia runs an `ip route show` command and returns the "via"
+// address of the first route it lists
+func defaultRouteVia(name string, args ...string) (string, error) {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("ip route failed: %v, output: %s", err, out)
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		for i := 0; i+1 < len(fields); i++ {
+			if fields[i] == "via" {
+				return fields[i+1], nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no default gateway found")
+}
+
+// getDefaultGateway6 parses `ip -6 route show default`:
+// "default via fe80::1 dev eth0 proto ra metric 1024 expires 1798sec"
+func getDefaultGateway6() (string, error) {
+	out, err := exec.Command("ip", "-6", "route", "show", "default").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("ip route failed: %v, output: %s", err, out)
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		var via, dev string
+		fields := strings.Fields(line)
+		for i := 0; i+1 < len(fields); i++ {
+			switch fields[i] {
+			case "via":
+				via = fields[i+1]
+			case "dev":
+				dev = fields[i+1]
+			}
+		}
+		if via != "" && dev != "" {
+			return via + "%" + dev, nil
+		}
+	}
+	return "", fmt.Errorf("no IPv6 default gateway found")
+}
+
+func addHostRoute6(ip, gateway string) error {
+	via, dev, _ := strings.Cut(gateway, "%")
+	args := []string{"-6", "route", "replace", ip + "/128", "via", via}
+	if dev != "" {
+		args = append(args, "dev", dev)
+	}
+	if err := runCmd("ip", args...); err != nil {
+		return err
+	}
+	recordUndo("host route "+ip, func() error {
+		return runCmd("ip", "-6", "route", "del", ip+"/128")
+	})
+	return nil
+}
+
+// addExcludeRoute routes prefix via gateway outside the tunnel. Unlike the
+// host routes it uses "add", so an existing route for the same prefix (the
+// LAN's own, say) is left alone instead of being replaced and later deleted.
+func addExcludeRoute(prefix netip.Prefix, gateway string) error {
+	args := []string{"-4", "route", "add", prefix.String(), "via", gateway}
+	if prefix.Addr().Is6() {
+		via, dev, _ := strings.Cut(gateway, "%")
+		args = []string{"-6", "route", "add", prefix.String(), "via", via}
+		if dev != "" {
+			args = append(args, "dev", dev)
+		}
+	}
+	if err := runCmd("ip", args...); err != nil {
+		return err
+	}
+	recordUndo("exclude route "+prefix.String(), func() error {
+		return runCmd("ip", args[0], "route", "del", prefix.String())
+	})
+	return nil
+}
+
+func addHostRoute(ip, gateway string) error {
+	if err := runCmd("ip", "route", "replace", ip+"/32", "via", gateway); err != nil {
+		return err
+	}
+	recordUndo("host route "+ip, func() error {
+		return runCmd("ip", "route", "del", ip+"/32", "via", gateway)
+	})
+	return nil
+}
+
+// isDeviceGone reports whether err from the TUN device means the interface
+// was deleted under us: reads then fail with EBADFD
+func isDeviceGone(err error) bool {
+	for _, gone := range []error{os.ErrClosed, unix.EBADFD, unix.ENODEV, unix.ENXIO, unix.EIO} {
+		if errors.Is(err, gone) {
+			return true
+		}
+	}
+	return false
+}
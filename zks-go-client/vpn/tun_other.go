@@ -0,0 +1,80 @@
+//go:build !windows && !linux && !darwin
+
+package vpn
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"runtime"
+)
+
+// DefaultInterfaceName is the TUN device name used when none is configured
+const DefaultInterfaceName = "zks-tun0"
+
+func validateInterfaceName(name string) error {
+	return nil
+}
+
+var errUnsupported = fmt.Errorf("VPN mode is not supported on %s", runtime.GOOS)
+
+func configureInterface(ifaceName, ip, netmask string) error {
+	return errUnsupported
+}
+
+func setInterfaceMTU(ifaceName string, mtu int) error {
+	return errUnsupported
+}
+
+func configureRouting(ifaceName, ip string, routes []string) error {
+	return errUnsupported
+}
+
+func configureDNS(ifaceName string, servers []string) error {
+	return errUnsupported
+}
+
+func configureIPv6(ifaceName string, prefix netip.Prefix, routes []string) error {
+	return errUnsupported
+}
+
+func getDefaultGateway() (string, error) {
+	return "", errUnsupported
+}
+
+func getDefaultGateway6() (string, error) {
+	return "", errUnsupported
+}
+
+func getInterfaceGateway(name string) (string, error) {
+	return "", errUnsupported
+}
+
+func getInterfaceGateway6(name string) (string, error) {
+	return "", errUnsupported
+}
+
+func addHostRoute6(ip, gateway string) error {
+	return errUnsupported
+}
+
+func addExcludeRoute(prefix netip.Prefix, gateway string) error {
+	return errUnsupported
+}
+
+func addHostRoute(ip, gateway string) error {
+	return errUnsupported
+}
+
+func checkPrivileges() error {
+	return errUnsupported
+}
+
+func checkTUNDriver() error {
+	return errUnsupported
+}
+
+func isDeviceGone(err error) bool {
+	return errors.Is(err, os.ErrClosed)
+}
@@ -0,0 +1,89 @@
+package vpn
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/zks-vpn/zks-go-client/bufpool"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// benchDevice is a tun.Device that reads copies of pkt until left runs out,
+// and counts its calls. Each queue of a multiQueueDevice gets its own, so
+// the counters need no locking.
+type benchDevice struct {
+	pkt     []byte
+	batch   int
+	left    int // Packets still to read
+	reads   int
+	writes  int
+	written int // Packets
+}
+
+func (d *benchDevice) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	if d.left <= 0 {
+		return 0, os.ErrClosed
+	}
+	n := min(len(bufs), d.left)
+	for i := range n {
+		sizes[i] = copy(bufs[i][offset:], d.pkt)
+	}
+	d.left -= n
+	d.reads++
+	return n, nil
+}
+
+func (d *benchDevice) Write(bufs [][]byte, offset int) (int, error) {
+	d.writes++
+	d.written += len(bufs)
+	return len(bufs), nil
+}
+
+func (d *benchDevice) BatchSize() int           { return d.batch }
+func (d *benchDevice) File() *os.File           { return nil }
+func (d *benchDevice) MTU() (int, error)        { return 1500, nil }
+func (d *benchDevice) Name() (string, error)    { return "bench", nil }
+func (d *benchDevice) Events() <-chan tun.Event { return nil }
+func (d *benchDevice) Close() error             { return nil }
+
+// benchTUN is a TUN with its loops and no device or transport
+func benchTUN() *TUN {
+	return &TUN{opts: Options{MTU: 1500}, done: make(chan struct{})}
+}
+
+// drain takes what readQueue queues and recycles it, until stop is closed
+func drain(queue *sendQueue, stop <-chan struct{}) {
+	for {
+		select {
+		case <-queue.ready:
+			if rb, ok := queue.take(); ok {
+				for _, pkt := range rb.packets {
+					bufpool.Put(pkt)
+				}
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// BenchmarkReadQueue reads b.N packets through readQueue from a device
+// returning one packet per read, as readLoop did before batching, and one
+// returning up to readBatchSize, as a Linux TUN with offloads can
+func BenchmarkReadQueue(b *testing.B) {
+	for _, batch := range []int{1, readBatchSize} {
+		b.Run(fmt.Sprintf("batch/%d", batch), func(b *testing.B) {
+			t := benchTUN()
+			defer close(t.done)
+			dev := &benchDevice{pkt: udpPacket(1280, 0), batch: batch, left: b.N}
+			queue := newSendQueue(DefaultSendQueuePackets, DropOldest, &t.stats)
+			go drain(queue, t.done)
+
+			b.SetBytes(1280)
+			t.readQueue(dev, dev, queue, make(chan error, 1))
+			b.ReportMetric(float64(dev.reads)/float64(b.N), "reads/pkt")
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "pkts/s")
+		})
+	}
+}
@@ -0,0 +1,361 @@
+//go:build windows
+
+package vpn
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"golang.org/x/sys/windows"
+)
+
+// DefaultInterfaceName is the Wintun adapter name used when none is configured
+const DefaultInterfaceName = "zks-tun0"
+
+// validateInterfaceName keeps to what Wintun stores (127 UTF-16 units) and
+// to what can go inside the quoted netsh and PowerShell arguments we build
+func validateInterfaceName(name string) error {
+	if len(utf16.Encode([]rune(name))) > 127 {
+		return fmt.Errorf("at most 127 characters on Windows")
+	}
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f || r == '"' || r == '\'' || r == '`' {
+			return fmt.Errorf("must not contain quotes or control characters")
+		}
+	}
+	if strings.TrimSpace(name) != name {
+		return fmt.Errorf("must not start or end with a space")
+	}
+	return nil
+}
+
+func configureInterface(ifaceName, ip, netmask string) error {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return fmt.Errorf("invalid IP: %s", ip)
+	}
+	mask := net.ParseIP(netmask).To4()
+	if mask == nil {
+		return fmt.Errorf("invalid netmask: %s", netmask)
+	}
+	ones, _ := net.IPMask(mask).Size()
+
+	luid, err := interfaceLUID(ifaceName)
+	if err != nil {
+		return err
+	}
+	// The address goes on as a /32, making the TUN a point-to-point link:
+	// with the whole subnet on-link Windows tried neighbor discovery for
+	// peers in it, which never answers on a TUN and showed up as
+	// "destination unreachable" on fresh connections. Same as:
+	// netsh interface ip set address "zks-tun0" static 10.0.85.1 255.255.255.255
+	if err := addUnicastAddress(luid, netip.PrefixFrom(addr, 32)); err != nil {
+		return fmt.Errorf("failed to assign %s/32: %w", ip, err)
+	}
+
+	// The rest of the subnet (the Exit Peer, other clients) is routed into
+	// the TUN explicitly instead
+	subnet := netip.PrefixFrom(addr, ones).Masked()
+	if ones < 32 {
+		remove, err := addRoute(luid, 0, subnet, netip.Addr{}, 1)
+		if err != nil {
+			return fmt.Errorf("failed to route %s to %s: %w", subnet, ifaceName, err)
+		}
+		recordUndo("route "+subnet.String(), remove)
+	}
+	return nil
+}
+
+// physicalDNSMetric is the interface metric the physical adapter is pushed
+// to while the tunnel is up. Windows asks the DNS servers of the adapter with
+// the lowest metric first, and the TUN sits at 1.
+const physicalDNSMetric = 100
+
+// configureDNS points the TUN adapter at servers, lowers the physical
+// adapter's priority and adds an NRPT rule so every query uses servers
+func configureDNS(ifaceName string, servers []string) error {
+	log.Printf("🔒 Configuring DNS leak prevention (NRPT)...")
+
+	// Step 1: Set DNS servers on the TUN adapter, e.g.
+	// netsh interface ipv4 set dnsservers name=zks-tun0 source=static address=1.1.1.1 register=none validate=no
+	for i, dns := range servers {
+		family := "ipv4"
+		if strings.Contains(dns, ":") {
+			family = "ipv6"
+		}
+		args := []string{"interface", family, "add", "dnsservers", "name=" + ifaceName, "address=" + dns, fmt.Sprintf("index=%d", i+1), "validate=no"}
+		if i == 0 {
+			args = []string{"interface", family, "set", "dnsservers", "name=" + ifaceName, "source=static", "address=" + dns, "register=none", "validate=no"}
+		}
+		if out, err := exec.Command("netsh", args...).CombinedOutput(); err != nil {
+			log.Printf("⚠️ Failed to set DNS server %s: %v, output: %s", dns, err, out)
+		}
+	}
+	recordUndo("TUN DNS servers", func() error {
+		for _, family := range []string{"ipv4", "ipv6"} {
+			exec.Command("netsh", "interface", family, "set", "dnsservers", "name="+ifaceName, "source=dhcp").Run()
+		}
+		return nil
+	})
+
+	// Step 2: Push the physical adapter's metric above the TUN's so Windows
+	// stops preferring its (ISP/router) DNS servers
+	if err := lowerPhysicalDNSPriority(); err != nil {
+		log.Printf("⚠️ Could not lower physical adapter DNS priority: %v", err)
+	}
+
+	// Step 3: Add NRPT rule to route ALL DNS queries through VPN interface
+	// This is the modern Windows approach used by Always On VPN
+	// NRPT = Name Resolution Policy Table
+	quoted := make([]string, len(servers))
+	for i, dns := range servers {
+		quoted[i] = "'" + dns + "'"
+	}
+	nrptCmd := fmt.Sprintf(`
+		# Remove existing NRPT rules for this namespace
+		Get-DnsClientNrptRule | Where-Object {$_.Namespace -eq '.'} | Remove-DnsClientNrptRule -Force -ErrorAction SilentlyContinue
+		
+		# Add NRPT rule for all DNS queries (namespace = '.')
+		# This forces ALL DNS through the VPN's DNS servers
+		Add-DnsClientNrptRule -Namespace '.' -NameServers %s -Comment 'ZKS-VPN DNS Leak Prevention'
+	`, strings.Join(quoted, ","))
+	
+	cmd := exec.Command("powershell", "-NoProfile", "-Command", nrptCmd)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log.Printf("⚠️ NRPT rule failed (non-fatal): %v, output: %s", err, out)
+		// Fallback approach: Clear DNS cache
+		exec.Command("ipconfig", "/flushdns").Run()
+		return fmt.Errorf("NRPT not supported, using basic DNS config")
+	}
+	
+	log.Printf("✅ DNS leak prevention configured (NRPT active)")
+	recordUndo("NRPT DNS rule", func() error {
+		cmd := exec.Command("powershell", "-NoProfile", "-Command",
+			"Get-DnsClientNrptRule | Where-Object {$_.Comment -eq 'ZKS-VPN DNS Leak Prevention'} | Remove-DnsClientNrptRule -Force")
+		out, err := cmd.CombinedOutput()
+		exec.Command("ipconfig", "/flushdns").Run()
+		if err != nil {
+			return fmt.Errorf("%v, output: %s", err, out)
+		}
+		return nil
+	})
+	
+	// Flush DNS cache to apply changes immediately
+	exec.Command("ipconfig", "/flushdns").Run()
+	
+	return nil
+}
+
+// setInterfaceMTU pins the IPv4 MTU on the adapter; Wintun doesn't always
+// apply the MTU passed to CreateTUN to the IP interface
+func setInterfaceMTU(ifaceName string, mtu int) error {
+	luid, err := interfaceLUID(ifaceName)
+	if err != nil {
+		return err
+	}
+	return updateInterface(luid, windows.AF_INET, func(row *windows.MibIpInterfaceRow) {
+		row.NlMtu = uint32(mtu)
+	})
+}
+
+func configureRouting(ifaceName, ip string, routes []string) error {
+	luid, err := interfaceLUID(ifaceName)
+	if err != nil {
+		return err
+	}
+	log.Printf("🔢 TUN Interface LUID: %#x", luid)
+
+	// Set Interface Metric to 1 to ensure our routes take precedence
+	// Windows Automatic Metric can assign high values (e.g. 25-50) which overrides our route metric
+	log.Printf("📉 Setting TUN interface metric to 1...")
+	err = updateInterface(luid, windows.AF_INET, func(row *windows.MibIpInterfaceRow) {
+		row.UseAutomaticMetric = 0
+		row.Metric = 1
+	})
+	if err != nil {
+		log.Printf("⚠️ Could not set interface metric: %v", err)
+	} else {
+		recordUndo("interface metric", func() error {
+			return updateInterface(luid, windows.AF_INET, func(row *windows.MibIpInterfaceRow) {
+				row.UseAutomaticMetric = 1
+			})
+		})
+	}
+
+	// 2. Get the original default gateway
+	originalGateway, err := DefaultGateway()
+	if err != nil {
+		log.Printf("⚠️ Could not get default gateway: %v", err)
+	}
+	log.Printf("🌐 Original gateway: %s", originalGateway)
+
+	// NOTE: Relay bypass routes are now handled in main.go BEFORE TUN creation
+	// This is done by addRelayBypassRoutes() which resolves the relay hostname
+	// and adds specific /32 routes for only those IPs.
+	// DO NOT add broad Cloudflare bypass routes here (104.16.0.0/12 etc.)
+	// as they cause IP leaks by bypassing IP check sites.
+
+	// 3. Add VPN routes (0.0.0.0/1 and 128.0.0.0/1, or --include-routes) pointing to TUN interface
+	addSplitRoutes(luid, ifaceName, routes)
+	
+	log.Printf("🎯 Route configuration complete")
+	return nil
+}
+
+// addSplitRoutes installs on-link routes through the TUN, recording their undo
+func addSplitRoutes(luid uint64, ifaceName string, routes []string) {
+	for _, route := range routes {
+		log.Printf("🛣️ Adding route: %s -> %s", route, ifaceName)
+		remove, err := addRoute(luid, 0, netip.MustParsePrefix(route), netip.Addr{}, 1)
+		if err != nil {
+			log.Printf("   ⚠️ WARNING: Route %s could not be added! VPN may leak traffic! (%v)", route, err)
+			continue
+		}
+		recordUndo("route "+route, remove)
+		log.Printf("✅ Successfully added route %s", route)
+	}
+}
+
+func configureIPv6(ifaceName string, prefix netip.Prefix, routes []string) error {
+	luid, err := interfaceLUID(ifaceName)
+	if err != nil {
+		return err
+	}
+	if err := addUnicastAddress(luid, prefix); err != nil {
+		return fmt.Errorf("failed to assign %s: %w", prefix, err)
+	}
+
+	addSplitRoutes(luid, ifaceName, routes)
+	return nil
+}
+
+// addExcludeRoute routes prefix via gateway outside the tunnel. IPv4 routes
+// go on the adapter that reaches the gateway, IPv6 ones on the gateway's zone.
+func addExcludeRoute(prefix netip.Prefix, gateway string) error {
+	gw, err := netip.ParseAddr(gateway)
+	if err != nil {
+		return fmt.Errorf("invalid gateway: %s", gateway)
+	}
+
+	var ifIndex uint32
+	if gw.Is4() {
+		if err := windows.GetBestInterfaceEx(&windows.SockaddrInet4{Addr: gw.As4()}, &ifIndex); err != nil {
+			return fmt.Errorf("no interface reaches gateway %s: %w", gateway, err)
+		}
+	} else {
+		idx, err := strconv.ParseUint(gw.Zone(), 10, 32)
+		if err != nil {
+			return fmt.Errorf("gateway %s has no interface index", gateway)
+		}
+		ifIndex = uint32(idx)
+	}
+
+	remove, err := addRoute(0, ifIndex, prefix, gw.WithZone(""), 1)
+	if err != nil {
+		return fmt.Errorf("route add failed: %w", err)
+	}
+	recordUndo("exclude route "+prefix.String(), remove)
+	return nil
+}
+
+func addHostRoute(ip, gateway string) error {
+	dest, err := netip.ParseAddr(ip)
+	if err != nil {
+		return fmt.Errorf("invalid IP: %s", ip)
+	}
+	gw, err := netip.ParseAddr(gateway)
+	if err != nil {
+		return fmt.Errorf("invalid gateway: %s", gateway)
+	}
+
+	// The route belongs on whichever adapter reaches the gateway
+	var ifIndex uint32
+	if err := windows.GetBestInterfaceEx(&windows.SockaddrInet4{Addr: gw.As4()}, &ifIndex); err != nil {
+		return fmt.Errorf("no interface reaches gateway %s: %w", gateway, err)
+	}
+
+	remove, err := addRoute(0, ifIndex, netip.PrefixFrom(dest, 32), gw, 1)
+	if err != nil {
+		return fmt.Errorf("route add failed: %w", err)
+	}
+	recordUndo("host route "+ip, remove)
+	return nil
+}
+
+// addHostRoute6 takes the interface from the gateway's zone, which
+// getDefaultGateway6 sets to the interface index
+func addHostRoute6(ip, gateway string) error {
+	dest, err := netip.ParseAddr(ip)
+	if err != nil || !dest.Is6() {
+		return fmt.Errorf("invalid IPv6 address: %s", ip)
+	}
+	gw, err := netip.ParseAddr(gateway)
+	if err != nil {
+		return fmt.Errorf("invalid gateway: %s", gateway)
+	}
+	ifIndex, err := strconv.ParseUint(gw.Zone(), 10, 32)
+	if err != nil {
+		return fmt.Errorf("gateway %s has no interface index", gateway)
+	}
+
+	remove, err := addRoute(0, uint32(ifIndex), netip.PrefixFrom(dest, 128), gw.WithZone(""), 1)
+	if err != nil {
+		return fmt.Errorf("route add failed: %w", err)
+	}
+	recordUndo("host route "+ip, remove)
+	return nil
+}
+
+// lowerPhysicalDNSPriority raises the metric of the adapter that currently
+// carries the default route. Call it before the split routes go in.
+func lowerPhysicalDNSPriority() error {
+	var ifIndex uint32
+	if err := windows.GetBestInterfaceEx(&windows.SockaddrInet4{Addr: [4]byte{1, 1, 1, 1}}, &ifIndex); err != nil {
+		return fmt.Errorf("no default interface: %w", err)
+	}
+	luid, err := interfaceLUIDFromIndex(ifIndex)
+	if err != nil {
+		return err
+	}
+
+	var oldAuto uint8
+	var oldMetric uint32
+	err = updateInterface(luid, windows.AF_INET, func(row *windows.MibIpInterfaceRow) {
+		oldAuto, oldMetric = row.UseAutomaticMetric, row.Metric
+		row.UseAutomaticMetric = 0
+		if row.Metric < physicalDNSMetric {
+			row.Metric = physicalDNSMetric
+		}
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("📉 Physical interface %d metric %d -> %d", ifIndex, oldMetric, max(oldMetric, physicalDNSMetric))
+	recordUndo(fmt.Sprintf("interface %d metric", ifIndex), func() error {
+		return updateInterface(luid, windows.AF_INET, func(row *windows.MibIpInterfaceRow) {
+			row.UseAutomaticMetric = oldAuto
+			row.Metric = oldMetric
+		})
+	})
+	return nil
+}
+
+// isDeviceGone reports whether err from the Wintun device means the adapter
+// or its session went away: disabled, removed, or reset by a driver update
+// or sleep. wireguard-go turns the end of the session into os.ErrClosed.
+func isDeviceGone(err error) bool {
+	for _, gone := range []error{os.ErrClosed, windows.ERROR_DEVICE_NOT_CONNECTED, windows.ERROR_DEV_NOT_EXIST, windows.ERROR_INVALID_HANDLE, windows.ERROR_GEN_FAILURE} {
+		if errors.Is(err, gone) {
+			return true
+		}
+	}
+	return false
+}
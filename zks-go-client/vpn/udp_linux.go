@@ -0,0 +1,120 @@
+//go:build linux
+
+package vpn
+
+import (
+	"log"
+
+	"github.com/zks-vpn/zks-go-client/bufpool"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/sys/unix"
+)
+
+// dscpSupported: the outer ToS is set with setsockopt(IP_TOS/IPV6_TCLASS)
+const dscpSupported = true
+
+// sendBatch pushes the batch to the kernel with sendmmsg(2). With tos, each
+// run of packets sharing a ToS goes out after setting it on the socket.
+func (t *UDPTransport) sendBatch(packets [][]byte, tos []byte) error {
+	if tos == nil {
+		return t.writeBatch(packets)
+	}
+
+	t.tosMu.Lock()
+	defer t.tosMu.Unlock()
+	for len(packets) > 0 {
+		n := 1
+		for n < len(packets) && tos[n] == tos[0] {
+			n++
+		}
+		if tos[0] != t.tos {
+			if err := t.setTOS(tos[0]); err != nil {
+				// Still worth sending, just without the marking
+				if !t.tosLogged.Swap(true) {
+					log.Printf("⚠️ Could not set the ToS of datagrams to the Entry Node: %v", err)
+				}
+			} else {
+				t.tos = tos[0]
+			}
+		}
+		if err := t.writeBatch(packets[:n]); err != nil {
+			return err
+		}
+		packets, tos = packets[n:], tos[n:]
+	}
+	return nil
+}
+
+// setTOS sets the ToS (traffic class on IPv6) of the datagrams sent next
+func (t *UDPTransport) setTOS(tos byte) error {
+	raw, err := t.conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if t.outerIPv6 {
+			serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_TCLASS, int(tos))
+		} else {
+			serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, int(tos))
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// writeBatch sends packets with sendmmsg(2), looping only if the kernel
+// accepts part of them
+func (t *UDPTransport) writeBatch(packets [][]byte) error {
+	msgs := make([]ipv4.Message, len(packets))
+	for i, pkt := range packets {
+		msgs[i].Buffers = [][]byte{pkt}
+	}
+
+	for len(msgs) > 0 {
+		// Connected socket: no per-message address needed
+		n, err := t.pc.WriteBatch(msgs, 0)
+		if err != nil {
+			return err
+		}
+		msgs = msgs[n:]
+	}
+	return nil
+}
+
+const (
+	// udpRecvBatch is how many datagrams one recvmmsg call may return
+	udpRecvBatch = 64
+	// udpRecvBufSize fits an MTU-sized packet plus encryption overhead
+	udpRecvBufSize = bufpool.Size
+)
+
+// recvBatch pulls up to udpRecvBatch datagrams with a single recvmmsg(2)
+func (t *UDPTransport) recvBatch() ([][]byte, error) {
+	if t.recvMsgs == nil {
+		t.recvMsgs = make([]ipv4.Message, udpRecvBatch)
+		for i := range t.recvMsgs {
+			t.recvMsgs[i].Buffers = [][]byte{bufpool.Get()}
+		}
+	}
+
+	n, err := t.pc.ReadBatch(t.recvMsgs, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// Hand out the filled buffers themselves and refill their slots from the pool
+	packets := make([][]byte, 0, n)
+	for i := range t.recvMsgs[:n] {
+		msg := &t.recvMsgs[i]
+		if msg.Flags&unix.MSG_TRUNC != 0 {
+			t.dropTruncated() // Larger than any packet we send
+			continue
+		}
+		packets = append(packets, msg.Buffers[0][:msg.N])
+		msg.Buffers[0] = bufpool.Get()
+	}
+	return packets, nil
+}
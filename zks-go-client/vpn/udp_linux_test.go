@@ -0,0 +1,72 @@
+//go:build linux
+
+package vpn
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+// udpSink is a loopback UDP socket that discards what it receives, for
+// UDPTransport to send to
+func udpSink(b *testing.B) string {
+	b.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// BenchmarkUDPSendBatch compares one sendmmsg(2) per batch (SendBatch) with
+// one write(2) per packet, the path other platforms take
+func BenchmarkUDPSendBatch(b *testing.B) {
+	for _, size := range []int{1, 32, 64} {
+		packets := make([][]byte, size)
+		for i := range packets {
+			packets[i] = make([]byte, 1280)
+		}
+
+		b.Run(fmt.Sprintf("sendmmsg/%d", size), func(b *testing.B) {
+			t, err := NewUDPTransport(udpSink(b))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer t.Close()
+			b.SetBytes(int64(size * 1280))
+			for range b.N {
+				if err := t.SendBatch(packets); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(b.N*size)/b.Elapsed().Seconds(), "pkts/s")
+		})
+
+		b.Run(fmt.Sprintf("write/%d", size), func(b *testing.B) {
+			t, err := NewUDPTransport(udpSink(b))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer t.Close()
+			b.SetBytes(int64(size * 1280))
+			for range b.N {
+				for _, pkt := range packets {
+					if _, err := t.conn.Write(pkt); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+			b.ReportMetric(float64(b.N*size)/b.Elapsed().Seconds(), "pkts/s")
+		})
+	}
+}
@@ -0,0 +1,29 @@
+//go:build !linux
+
+package vpn
+
+import "github.com/zks-vpn/zks-go-client/protocol"
+
+// dscpSupported: IP_TOS marking is only implemented on Linux. Elsewhere
+// PreserveDSCP is a no-op and datagrams go out with the default ToS.
+const dscpSupported = false
+
+// sendBatch sends each packet individually; sendmmsg is Linux-only. tos is
+// always nil here (see dscpSupported).
+func (t *UDPTransport) sendBatch(packets [][]byte, tos []byte) error {
+	for _, pkt := range packets {
+		if _, err := t.conn.Write(pkt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recvBatch reads a single datagram; recvmmsg is Linux-only
+func (t *UDPTransport) recvBatch() ([][]byte, error) {
+	msg, err := t.Recv()
+	if err != nil {
+		return nil, err
+	}
+	return [][]byte{msg.(*protocol.IpPacket).Payload}, nil
+}
@@ -0,0 +1,104 @@
+package vpn
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"strconv"
+	"syscall"
+
+	"github.com/zks-vpn/zks-go-client/netbind"
+)
+
+// UDPBindRandom as UDPTransportOptions.LocalAddr binds to a random port in
+// the dynamic range rather than the one the OS would pick
+const UDPBindRandom = "random"
+
+const (
+	// udpRandomPortMin and udpRandomPortMax bound UDPBindRandom: the IANA
+	// dynamic/private range, which no service is registered on
+	udpRandomPortMin = 49152
+	udpRandomPortMax = 65535
+	// udpRandomPortAttempts is how many random ports are tried before
+	// giving up because they are all in use
+	udpRandomPortAttempts = 8
+)
+
+// ParseUDPBind checks a UDPTransportOptions.LocalAddr setting: empty (the OS
+// picks the address and port), UDPBindRandom, or [ip]:port such as
+// :51820, 0.0.0.0:40000 or [::]:0, where port 0 lets the OS pick the port.
+// It returns nil for empty and UDPBindRandom.
+func ParseUDPBind(setting string) (*net.UDPAddr, error) {
+	if setting == "" || setting == UDPBindRandom {
+		return nil, nil
+	}
+	host, port, err := net.SplitHostPort(setting)
+	if err != nil {
+		return nil, fmt.Errorf("invalid UDP bind address %q: want [ip]:port or %q", setting, UDPBindRandom)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid UDP bind port %q", port)
+	}
+	addr := &net.UDPAddr{Port: int(p)}
+	if host != "" {
+		ip, err := netip.ParseAddr(host)
+		if err != nil {
+			return nil, fmt.Errorf("invalid UDP bind address %q: host must be an IP address", setting)
+		}
+		addr.IP = ip.AsSlice()
+		addr.Zone = ip.Zone()
+	}
+	return addr, nil
+}
+
+// StickyUDPBind returns the setting that rebinds to port, the one a
+// UDPTransport dialed with setting ended up on, keeping the address part.
+// Redialing with it after a reconnect keeps the source the Entry Node and
+// NATs on the way see, so their mappings survive.
+func StickyUDPBind(setting string, port int) string {
+	host := ""
+	if addr, err := ParseUDPBind(setting); err == nil && addr != nil && addr.IP != nil {
+		host = addr.IP.String()
+		if addr.Zone != "" {
+			host += "%" + addr.Zone
+		}
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// dialUDP connects to addr from the local address the setting asks for,
+// drawing another random port when UDPBindRandom drew one in use
+func dialUDP(addr *net.UDPAddr, setting, iface string) (*net.UDPConn, error) {
+	if setting != UDPBindRandom {
+		local, err := ParseUDPBind(setting)
+		if err != nil {
+			return nil, err
+		}
+		d := net.Dialer{}
+		if local != nil {
+			d.LocalAddr = local
+		}
+		c, err := netbind.Dialer(d, iface).Dial("udp", addr.String())
+		if err != nil {
+			return nil, err
+		}
+		return c.(*net.UDPConn), nil
+	}
+
+	var err error
+	for range udpRandomPortAttempts {
+		port := udpRandomPortMin + rand.IntN(udpRandomPortMax-udpRandomPortMin+1)
+		var c net.Conn
+		c, err = netbind.Dialer(net.Dialer{LocalAddr: &net.UDPAddr{Port: port}}, iface).Dial("udp", addr.String())
+		if err == nil {
+			return c.(*net.UDPConn), nil
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("no free random port after %d attempts: %w", udpRandomPortAttempts, err)
+}
@@ -0,0 +1,8 @@
+//go:build !windows
+
+package vpn
+
+// prepareTUNDriver has nothing to do: the kernel provides the TUN driver
+func prepareTUNDriver() error {
+	return nil
+}
@@ -0,0 +1,93 @@
+package vpn
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"golang.org/x/sys/windows"
+)
+
+// bundledWintun is a wintun.dll built into the executable for this
+// architecture, or nil. See SetBundledWintun.
+var bundledWintun []byte
+
+// SetBundledWintun registers a wintun.dll for the running architecture that
+// Start extracts next to the executable when none can be loaded
+func SetBundledWintun(dll []byte) {
+	bundledWintun = dll
+}
+
+// loadWintun loads wintun.dll from the same places the Wintun package
+// does: next to the executable or in System32
+func loadWintun() error {
+	h, err := windows.LoadLibraryEx("wintun.dll", 0, windows.LOAD_LIBRARY_SEARCH_APPLICATION_DIR|windows.LOAD_LIBRARY_SEARCH_SYSTEM32)
+	if err != nil {
+		return err
+	}
+	windows.FreeLibrary(h)
+	return nil
+}
+
+// wintunArch names the directory of the Wintun release zip that has the
+// DLL for this build (bin\amd64, bin\arm64, bin\x86, ...)
+func wintunArch() string {
+	if runtime.GOARCH == "386" {
+		return "x86"
+	}
+	return runtime.GOARCH
+}
+
+// wintunPath is where the DLL is expected: next to the executable
+func wintunPath() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(exe), "wintun.dll"), nil
+}
+
+// wintunError explains why loadErr happened and how to fix it
+func wintunError(path string, loadErr error) error {
+	if errors.Is(loadErr, windows.ERROR_BAD_EXE_FORMAT) {
+		return fmt.Errorf("%s is built for another architecture; replace it with bin\\%s\\wintun.dll from https://www.wintun.net", path, wintunArch())
+	}
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s can't be loaded: %w", path, loadErr)
+	}
+	return fmt.Errorf("wintun.dll is missing: copy bin\\%s\\wintun.dll from https://www.wintun.net to %s", wintunArch(), path)
+}
+
+// prepareTUNDriver makes sure CreateTUN can load wintun.dll, extracting the
+// bundled copy when it's missing or built for another architecture
+func prepareTUNDriver() error {
+	loadErr := loadWintun()
+	if loadErr == nil {
+		return nil
+	}
+	path, err := wintunPath()
+	if err != nil {
+		return fmt.Errorf("wintun.dll can't be loaded: %w", loadErr)
+	}
+	if len(bundledWintun) == 0 {
+		return wintunError(path, loadErr)
+	}
+
+	// Keep whatever was there; it may be a newer DLL that just failed to load
+	if _, err := os.Stat(path); err == nil {
+		if err := os.Rename(path, path+".old"); err != nil {
+			return fmt.Errorf("%w (moving it aside for the bundled copy failed: %v)", wintunError(path, loadErr), err)
+		}
+	}
+	log.Printf("📦 Extracting the bundled wintun.dll (%s) to %s", wintunArch(), path)
+	if err := os.WriteFile(path, bundledWintun, 0o644); err != nil {
+		return fmt.Errorf("failed to extract wintun.dll: %w", err)
+	}
+	if err := loadWintun(); err != nil {
+		return fmt.Errorf("bundled wintun.dll can't be loaded either: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package vpn
+
+import "time"
+
+const (
+	// DefaultWriteFlushInterval is how long received packets may be held to fill a device write
+	DefaultWriteFlushInterval = 200 * time.Microsecond
+	// DefaultWriteMaxPackets writes a coalesced batch once it holds this many packets
+	DefaultWriteMaxPackets = 128
+	// writeQueueGroups is how many received groups may wait for the writer
+	writeQueueGroups = 64
+)
+
+// writeCoalescer merges groups of packets from the transport into fewer
+// device writes, the receive side's counterpart of batcher. A peer that
+// doesn't batch sends every packet as its own IpPacket, which would
+// otherwise cost a write syscall each.
+//
+// A group that arrives after the link has been idle for a flush interval
+// is written immediately. Groups that follow closely behind are held for
+// up to the flush interval, or until maxPackets are pending.
+type writeCoalescer struct {
+	t          *TUN
+	groups     <-chan [][]byte
+	interval   time.Duration
+	maxPackets int
+}
+
+func newWriteCoalescer(t *TUN, groups <-chan [][]byte) *writeCoalescer {
+	return &writeCoalescer{
+		t:          t,
+		groups:     groups,
+		interval:   t.opts.WriteFlushInterval,
+		maxPackets: t.opts.WriteMaxPackets,
+	}
+}
+
+// recvLoop feeds groups until the transport fails or the TUN stops, then
+// closes it
+func (t *TUN) recvLoop(groups chan<- [][]byte, errChan chan<- error) {
+	defer close(groups)
+	for {
+		packets, err := t.recv(errChan)
+		if err != nil {
+			return
+		}
+		select {
+		case groups <- packets:
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// run owns the pending packets and writes them to the device
+func (w *writeCoalescer) run() {
+	var pending [][]byte
+	var lastFlush time.Time
+
+	flush := func() {
+		if len(pending) > 0 {
+			w.t.writeCounted(pending)
+		}
+		pending = nil
+		lastFlush = time.Now()
+	}
+
+	for {
+		packets, ok := <-w.groups
+		if !ok {
+			return
+		}
+		pending = append(pending, packets...)
+
+		// Idle link: don't make the first packet wait for company
+		if len(pending) >= w.maxPackets || time.Since(lastFlush) >= w.interval {
+			flush()
+			continue
+		}
+
+		timer := time.NewTimer(w.interval)
+	collect:
+		for len(pending) < w.maxPackets {
+			select {
+			case packets, ok := <-w.groups:
+				if !ok {
+					timer.Stop()
+					flush()
+					return
+				}
+				pending = append(pending, packets...)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+		flush()
+	}
+}
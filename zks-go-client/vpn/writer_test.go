@@ -0,0 +1,49 @@
+package vpn
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/zks-vpn/zks-go-client/bufpool"
+)
+
+// BenchmarkWriteBurst writes a burst of 64 packets arriving one per group
+// (a peer that doesn't batch), each in its own device write as writeLoop
+// does without WriteFlushInterval, and through a writeCoalescer
+func BenchmarkWriteBurst(b *testing.B) {
+	const burst = 64
+	pkt := udpPacket(1280, 0)
+	for _, coalesce := range []bool{false, true} {
+		name := "separate"
+		if coalesce {
+			name = "coalesced"
+		}
+		b.Run(fmt.Sprintf("%s/%d", name, burst), func(b *testing.B) {
+			t := benchTUN()
+			t.opts.WriteFlushInterval = DefaultWriteFlushInterval
+			t.opts.WriteMaxPackets = DefaultWriteMaxPackets
+			dev := &benchDevice{}
+			t.device = dev
+
+			b.SetBytes(burst * 1280)
+			for range b.N {
+				if !coalesce {
+					for range burst {
+						t.writeCounted([][]byte{bufpool.Copy(pkt)})
+					}
+					continue
+				}
+				groups := make(chan [][]byte, burst)
+				for range burst {
+					groups <- [][]byte{bufpool.Copy(pkt)}
+				}
+				close(groups)
+				newWriteCoalescer(t, groups).run()
+			}
+			if dev.written != b.N*burst {
+				b.Fatalf("wrote %d of %d packets", dev.written, b.N*burst)
+			}
+			b.ReportMetric(float64(dev.writes)/float64(b.N), "writes/burst")
+		})
+	}
+}
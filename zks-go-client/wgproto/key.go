@@ -0,0 +1,79 @@
+package wgproto
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// Key is a Curve25519 private or public key, written in base64 like
+// WireGuard's own `wg genkey` / `wg pubkey` output
+type Key [32]byte
+
+// NewPrivateKey generates a random private key
+func NewPrivateKey() (Key, error) {
+	var k Key
+	if _, err := rand.Read(k[:]); err != nil {
+		return Key{}, err
+	}
+	// Clamp like curve25519 implementations do, so the key prints the same
+	// as one from `wg genkey`
+	k[0] &= 248
+	k[31] = (k[31] & 127) | 64
+	return k, nil
+}
+
+// ParseKey decodes a base64 key
+func ParseKey(s string) (Key, error) {
+	var k Key
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(b) != len(k) {
+		return Key{}, fmt.Errorf("invalid key %q: want 32 bytes in base64", s)
+	}
+	copy(k[:], b)
+	return k, nil
+}
+
+// ParseKeys decodes a list of base64 keys
+func ParseKeys(list []string) ([]Key, error) {
+	keys := make([]Key, 0, len(list))
+	for _, s := range list {
+		k, err := ParseKey(s)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// PublicKey returns the public half of a private key
+func (k Key) PublicKey() Key {
+	var pub Key
+	b, _ := curve25519.X25519(k[:], curve25519.Basepoint)
+	copy(pub[:], b)
+	return pub
+}
+
+// IsZero reports whether k is unset
+func (k Key) IsZero() bool {
+	return k == Key{}
+}
+
+func (k Key) String() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+// dh is X25519, rejecting low-order points (an all-zero result)
+func dh(private, public Key) ([32]byte, error) {
+	var out [32]byte
+	ss, err := curve25519.X25519(private[:], public[:])
+	if err != nil {
+		return out, err
+	}
+	copy(out[:], ss)
+	return out, nil
+}
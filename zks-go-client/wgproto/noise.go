@@ -0,0 +1,308 @@
+// Package wgproto runs the WireGuard protocol (Noise_IKpsk2 handshake and
+// data messages) between the client and the Exit Peer, on top of whatever
+// carries their packets: the relay, UDP or TCP.
+//
+// The relay link has its own X25519 key exchange, but nothing stops the
+// relay from answering it itself. Here each side has a static key pair and
+// only talks to peers whose public keys it was given, so a relay in the
+// middle can't read or inject traffic without one of the private keys.
+//
+// Messages use WireGuard's layouts and key schedule, carried as IP packets
+// of the inner transport. Not implemented: cookie replies (mac2 is always
+// zero, it's for UDP endpoints under load), padding, and keepalives beyond
+// the one confirming a new session.
+package wgproto
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	construction = "Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s"
+	identifier   = "WireGuard v1 zx2c4 Jason@zx2c4.com"
+	labelMac1    = "mac1----"
+)
+
+// Message types and sizes, as in WireGuard
+const (
+	msgInitiation = 1
+	msgResponse   = 2
+	msgData       = 4
+
+	initiationSize = 148 // type(4) sender(4) ephemeral(32) static(48) timestamp(28) mac1(16) mac2(16)
+	responseSize   = 92  // type(4) sender(4) receiver(4) ephemeral(32) empty(16) mac1(16) mac2(16)
+	dataHeaderSize = 16  // type(4) receiver(4) counter(8)
+	tagSize        = chacha20poly1305.Overhead
+)
+
+var errHandshake = errors.New("handshake message failed to verify")
+
+var initialChainKey, initialHash [32]byte
+
+func init() {
+	initialChainKey = blake2s.Sum256([]byte(construction))
+	initialHash = mixHash(initialChainKey, []byte(identifier))
+}
+
+// handshake is the state one side keeps between the two messages
+type handshake struct {
+	localIndex  uint32
+	remoteIndex uint32
+	chainKey    [32]byte
+	hash        [32]byte
+	ephemeral   Key // Our ephemeral private key
+	remoteEph   Key // Initiator's ephemeral public key (responder only)
+	peer        Key // Peer's static public key
+	timestamp   [12]byte
+	sentAt      time.Time
+}
+
+// createInitiation builds the first handshake message to peer
+func createInitiation(static, peer Key, index uint32) ([]byte, *handshake, error) {
+	eph, err := NewPrivateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	hs := &handshake{localIndex: index, peer: peer, ephemeral: eph, sentAt: time.Now()}
+	hs.hash = mixHash(initialHash, peer[:])
+
+	msg := make([]byte, initiationSize)
+	msg[0] = msgInitiation
+	binary.LittleEndian.PutUint32(msg[4:8], index)
+	ephPub := eph.PublicKey()
+	copy(msg[8:40], ephPub[:])
+	hs.chainKey = kdf1(initialChainKey, ephPub[:])
+	hs.hash = mixHash(hs.hash, ephPub[:])
+
+	ss, err := dh(eph, peer)
+	if err != nil {
+		return nil, nil, err
+	}
+	var key [32]byte
+	hs.chainKey, key = kdf2(hs.chainKey, ss[:])
+	staticPub := static.PublicKey()
+	seal(msg[40:40], key, staticPub[:], hs.hash)
+	hs.hash = mixHash(hs.hash, msg[40:88])
+
+	if ss, err = dh(static, peer); err != nil {
+		return nil, nil, err
+	}
+	hs.chainKey, key = kdf2(hs.chainKey, ss[:])
+	ts := tai64n(time.Now())
+	seal(msg[88:88], key, ts[:], hs.hash)
+	hs.hash = mixHash(hs.hash, msg[88:116])
+
+	putMac1(msg, peer)
+	return msg, hs, nil
+}
+
+// consumeInitiation checks an initiation sent to static and returns the
+// state to answer it with. The caller checks hs.peer and hs.timestamp.
+func consumeInitiation(msg []byte, static Key) (*handshake, error) {
+	staticPub := static.PublicKey()
+	if len(msg) != initiationSize || !checkMac1(msg, staticPub) {
+		return nil, errHandshake
+	}
+	hs := &handshake{remoteIndex: binary.LittleEndian.Uint32(msg[4:8])}
+	copy(hs.remoteEph[:], msg[8:40])
+	hs.hash = mixHash(initialHash, staticPub[:])
+	hs.chainKey = kdf1(initialChainKey, hs.remoteEph[:])
+	hs.hash = mixHash(hs.hash, hs.remoteEph[:])
+
+	ss, err := dh(static, hs.remoteEph)
+	if err != nil {
+		return nil, errHandshake
+	}
+	var key [32]byte
+	hs.chainKey, key = kdf2(hs.chainKey, ss[:])
+	peer, err := open(nil, key, msg[40:88], hs.hash)
+	if err != nil {
+		return nil, errHandshake
+	}
+	copy(hs.peer[:], peer)
+	hs.hash = mixHash(hs.hash, msg[40:88])
+
+	if ss, err = dh(static, hs.peer); err != nil {
+		return nil, errHandshake
+	}
+	hs.chainKey, key = kdf2(hs.chainKey, ss[:])
+	ts, err := open(nil, key, msg[88:116], hs.hash)
+	if err != nil {
+		return nil, errHandshake
+	}
+	copy(hs.timestamp[:], ts)
+	hs.hash = mixHash(hs.hash, msg[88:116])
+	return hs, nil
+}
+
+// createResponse answers a consumed initiation and returns the response
+// with the responder's (send, receive) keys
+func createResponse(hs *handshake, psk Key, index uint32) ([]byte, [32]byte, [32]byte, error) {
+	var send, recv [32]byte
+	eph, err := NewPrivateKey()
+	if err != nil {
+		return nil, send, recv, err
+	}
+	hs.localIndex = index
+
+	msg := make([]byte, responseSize)
+	msg[0] = msgResponse
+	binary.LittleEndian.PutUint32(msg[4:8], index)
+	binary.LittleEndian.PutUint32(msg[8:12], hs.remoteIndex)
+	ephPub := eph.PublicKey()
+	copy(msg[12:44], ephPub[:])
+	hs.chainKey = kdf1(hs.chainKey, ephPub[:])
+	hs.hash = mixHash(hs.hash, ephPub[:])
+
+	for _, pub := range []Key{hs.remoteEph, hs.peer} {
+		ss, err := dh(eph, pub)
+		if err != nil {
+			return nil, send, recv, err
+		}
+		hs.chainKey = kdf1(hs.chainKey, ss[:])
+	}
+	var tau, key [32]byte
+	hs.chainKey, tau, key = kdf3(hs.chainKey, psk[:])
+	hs.hash = mixHash(hs.hash, tau[:])
+	seal(msg[44:44], key, nil, hs.hash)
+	hs.hash = mixHash(hs.hash, msg[44:60])
+
+	putMac1(msg, hs.peer)
+	recv, send = kdf2(hs.chainKey, nil)
+	return msg, send, recv, nil
+}
+
+// consumeResponse checks the answer to hs and returns the initiator's
+// (send, receive) keys
+func consumeResponse(msg []byte, hs *handshake, static, psk Key) ([32]byte, [32]byte, error) {
+	var send, recv [32]byte
+	if len(msg) != responseSize || !checkMac1(msg, static.PublicKey()) ||
+		binary.LittleEndian.Uint32(msg[8:12]) != hs.localIndex {
+		return send, recv, errHandshake
+	}
+	var ephR Key
+	copy(ephR[:], msg[12:44])
+	chainKey := kdf1(hs.chainKey, ephR[:])
+	hash := mixHash(hs.hash, ephR[:])
+
+	for _, private := range []Key{hs.ephemeral, static} {
+		ss, err := dh(private, ephR)
+		if err != nil {
+			return send, recv, errHandshake
+		}
+		chainKey = kdf1(chainKey, ss[:])
+	}
+	chainKey, tau, key := kdf3(chainKey, psk[:])
+	hash = mixHash(hash, tau[:])
+	if _, err := open(nil, key, msg[44:60], hash); err != nil {
+		return send, recv, errHandshake
+	}
+
+	hs.remoteIndex = binary.LittleEndian.Uint32(msg[4:8])
+	send, recv = kdf2(chainKey, nil)
+	return send, recv, nil
+}
+
+func newBlake2s() hash.Hash {
+	h, _ := blake2s.New256(nil)
+	return h
+}
+
+func mixHash(h [32]byte, data []byte) [32]byte {
+	d := newBlake2s()
+	d.Write(h[:])
+	d.Write(data)
+	var out [32]byte
+	d.Sum(out[:0])
+	return out
+}
+
+func hmacBlake2s(key []byte, data ...[]byte) [32]byte {
+	m := hmac.New(newBlake2s, key)
+	for _, d := range data {
+		m.Write(d)
+	}
+	var out [32]byte
+	m.Sum(out[:0])
+	return out
+}
+
+// kdf1, kdf2 and kdf3 are WireGuard's HKDF with HMAC-BLAKE2s
+func kdf1(key [32]byte, input []byte) [32]byte {
+	prk := hmacBlake2s(key[:], input)
+	return hmacBlake2s(prk[:], []byte{1})
+}
+
+func kdf2(key [32]byte, input []byte) ([32]byte, [32]byte) {
+	prk := hmacBlake2s(key[:], input)
+	t1 := hmacBlake2s(prk[:], []byte{1})
+	t2 := hmacBlake2s(prk[:], t1[:], []byte{2})
+	return t1, t2
+}
+
+func kdf3(key [32]byte, input []byte) ([32]byte, [32]byte, [32]byte) {
+	prk := hmacBlake2s(key[:], input)
+	t1 := hmacBlake2s(prk[:], []byte{1})
+	t2 := hmacBlake2s(prk[:], t1[:], []byte{2})
+	t3 := hmacBlake2s(prk[:], t2[:], []byte{3})
+	return t1, t2, t3
+}
+
+// putMac1 fills in mac1, which proves the sender knows the receiver's
+// public key, over everything before it. mac2 stays zero.
+func putMac1(msg []byte, receiver Key) {
+	off := len(msg) - 32
+	mac := mac1(msg[:off], receiver)
+	copy(msg[off:off+16], mac[:])
+}
+
+func checkMac1(msg []byte, receiver Key) bool {
+	off := len(msg) - 32
+	mac := mac1(msg[:off], receiver)
+	return hmac.Equal(mac[:], msg[off:off+16])
+}
+
+func mac1(data []byte, receiver Key) [16]byte {
+	key := blake2s.Sum256(append([]byte(labelMac1), receiver[:]...))
+	m, _ := blake2s.New128(key[:])
+	m.Write(data)
+	var out [16]byte
+	m.Sum(out[:0])
+	return out
+}
+
+// seal and open are the handshake AEAD: ChaCha20-Poly1305 with a zero
+// nonce, which is safe because every handshake key is used once
+func seal(dst []byte, key [32]byte, plaintext []byte, ad [32]byte) []byte {
+	aead, _ := chacha20poly1305.New(key[:])
+	var nonce [chacha20poly1305.NonceSize]byte
+	return aead.Seal(dst, nonce[:], plaintext, ad[:])
+}
+
+func open(dst []byte, key [32]byte, ciphertext []byte, ad [32]byte) ([]byte, error) {
+	aead, _ := chacha20poly1305.New(key[:])
+	var nonce [chacha20poly1305.NonceSize]byte
+	return aead.Open(dst, nonce[:], ciphertext, ad[:])
+}
+
+func newAEAD(key [32]byte) cipher.AEAD {
+	aead, _ := chacha20poly1305.New(key[:])
+	return aead
+}
+
+// tai64n is the initiation timestamp; the responder refuses any that isn't
+// newer than the last one from the same peer, so initiations can't be replayed
+func tai64n(t time.Time) [12]byte {
+	var ts [12]byte
+	binary.BigEndian.PutUint64(ts[0:8], 0x400000000000000a+uint64(t.Unix()))
+	binary.BigEndian.PutUint32(ts[8:12], uint32(t.Nanosecond()))
+	return ts
+}
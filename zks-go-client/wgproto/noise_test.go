@@ -0,0 +1,83 @@
+package wgproto
+
+import (
+	"errors"
+	"testing"
+)
+
+func mustKey(t *testing.T) Key {
+	t.Helper()
+	k, err := NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestHandshakeKeys(t *testing.T) {
+	client, server, psk := mustKey(t), mustKey(t), mustKey(t)
+
+	initiation, ihs, err := createInitiation(client, server.PublicKey(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rhs, err := consumeInitiation(initiation, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rhs.peer != client.PublicKey() || rhs.remoteIndex != 1 {
+		t.Fatalf("initiation from %s index %d", rhs.peer, rhs.remoteIndex)
+	}
+
+	resp, rsend, rrecv, err := createResponse(rhs, psk, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	isend, irecv, err := consumeResponse(resp, ihs, client, psk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isend != rrecv || irecv != rsend {
+		t.Fatal("the two sides derived different keys")
+	}
+	if isend == irecv {
+		t.Fatal("send and receive keys are the same")
+	}
+	if ihs.remoteIndex != 2 {
+		t.Fatalf("initiator learned index %d, want 2", ihs.remoteIndex)
+	}
+}
+
+func TestHandshakeRejects(t *testing.T) {
+	client, server, psk := mustKey(t), mustKey(t), mustKey(t)
+
+	// An initiation for another key fails mac1 and then decryption
+	initiation, ihs, err := createInitiation(client, server.PublicKey(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := consumeInitiation(initiation, mustKey(t)); !errors.Is(err, errHandshake) {
+		t.Fatalf("initiation accepted by the wrong static key: %v", err)
+	}
+
+	// A tampered initiation fails even with the right key
+	tampered := append([]byte(nil), initiation...)
+	tampered[50] ^= 1
+	putMac1(tampered, server.PublicKey())
+	if _, err := consumeInitiation(tampered, server); !errors.Is(err, errHandshake) {
+		t.Fatalf("tampered initiation accepted: %v", err)
+	}
+
+	// A response made with another preshared key fails the empty AEAD
+	rhs, err := consumeInitiation(initiation, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, _, _, err := createResponse(rhs, psk, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := consumeResponse(resp, ihs, client, mustKey(t)); !errors.Is(err, errHandshake) {
+		t.Fatalf("response accepted with the wrong preshared key: %v", err)
+	}
+}
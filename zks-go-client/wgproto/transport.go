@@ -0,0 +1,643 @@
+package wgproto
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zks-vpn/zks-go-client/bufpool"
+	"github.com/zks-vpn/zks-go-client/metrics"
+	"github.com/zks-vpn/zks-go-client/protocol"
+	"github.com/zks-vpn/zks-go-client/vpn"
+)
+
+// Timers, as in WireGuard
+const (
+	// RekeyAfterTime is when the initiator starts a fresh handshake
+	RekeyAfterTime = 120 * time.Second
+	// RejectAfterTime is when a session's keys stop being used at all
+	RejectAfterTime = 180 * time.Second
+	// RekeyTimeout is how long an initiation waits before it's resent
+	RekeyTimeout = 5 * time.Second
+	// DefaultHandshakeTimeout is how long Handshake keeps trying by default
+	DefaultHandshakeTimeout = 30 * time.Second
+)
+
+var (
+	errNoSession = errors.New("no WireGuard session with the peer yet")
+	errNoLease   = errors.New("peer does not assign addresses")
+)
+
+// Options configures a Transport
+type Options struct {
+	// PrivateKey is this side's static key
+	PrivateKey Key
+	// Peers are the public keys allowed on the other side. The initiator
+	// (client) talks to exactly one, the Exit Peer's.
+	Peers []Key
+	// PresharedKey is mixed into every handshake (zero = none), which keeps
+	// recorded traffic safe even if Curve25519 is broken later
+	PresharedKey Key
+	// Initiator starts the handshakes; the other side only answers them
+	Initiator bool
+}
+
+// Transport wraps another Transport in a WireGuard session: IP packets go
+// out as WireGuard data messages, and handshake messages travel alongside
+// them. The initiator re-handshakes every RekeyAfterTime, so keys rotate
+// without dropping the tunnel; the previous session keeps decrypting
+// whatever was already in flight.
+//
+// A responder keeps sessions per peer, so one peer's handshake never rotates
+// out another's, and sends each packet to the peer its destination address
+// was last seen from. A session it answers stays next, unused for sending,
+// until the initiator's first data message under it arrives (the initiator
+// sends an empty one right away). Until then a replayed or forged initiation
+// can't displace the session in use.
+type Transport struct {
+	inner vpn.Transport
+	opts  Options
+
+	mu       sync.Mutex
+	peers    map[Key]*peerSessions
+	byIndex  map[uint32]*session // Every session in peers, by our index
+	routes   map[netip.Addr]Key  // Responder: the peer each address was last seen from
+	pending  *handshake          // Initiator: the initiation awaiting a response
+	latest   map[Key][12]byte    // Responder: newest initiation timestamp per peer
+	ready    chan struct{}       // Closed once the first session is up
+	readyOne sync.Once
+
+	rejected atomic.Uint64
+}
+
+// peerSessions are the sessions with one peer
+type peerSessions struct {
+	current  *session
+	previous *session
+	next     *session // Responder: answered, not yet confirmed by the initiator
+}
+
+// session is one handshake's worth of keys
+type session struct {
+	send, recv  cipher.AEAD
+	localIndex  uint32
+	remoteIndex uint32
+	created     time.Time
+	peer        Key
+	counter     atomic.Uint64 // Next counter to send
+
+	replayMu sync.Mutex
+	replay   replayWindow
+}
+
+// NewTransport runs WireGuard over inner. An initiator should call
+// Handshake before sending; a responder answers handshakes as they come.
+func NewTransport(inner vpn.Transport, opts Options) (*Transport, error) {
+	if opts.PrivateKey.IsZero() {
+		return nil, errors.New("a WireGuard private key is required")
+	}
+	if len(opts.Peers) == 0 {
+		return nil, errors.New("at least one WireGuard peer public key is required")
+	}
+	if opts.Initiator && len(opts.Peers) != 1 {
+		return nil, fmt.Errorf("the initiator needs exactly one peer public key, got %d", len(opts.Peers))
+	}
+	return &Transport{
+		inner:   inner,
+		opts:    opts,
+		peers:   make(map[Key]*peerSessions),
+		byIndex: make(map[uint32]*session),
+		routes:  make(map[netip.Addr]Key),
+		latest:  make(map[Key][12]byte),
+		ready:   make(chan struct{}),
+	}, nil
+}
+
+// Handshake sends initiations until the peer answers one or ctx is done.
+// Only the initiator needs it; later handshakes happen on their own.
+func (t *Transport) Handshake(ctx context.Context) error {
+	if !t.opts.Initiator {
+		return errors.New("only the initiator starts handshakes")
+	}
+	for {
+		if err := t.sendInitiation(); err != nil {
+			return err
+		}
+		attempt, cancel := context.WithTimeout(ctx, RekeyTimeout)
+		err := t.awaitResponse(attempt)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("no handshake response from the peer (wrong public key?): %w", ctx.Err())
+		}
+		if !errors.Is(err, context.DeadlineExceeded) {
+			return err
+		}
+	}
+}
+
+// awaitResponse reads from inner until the first session is up
+func (t *Transport) awaitResponse(ctx context.Context) error {
+	for {
+		select {
+		case <-t.ready:
+			return nil
+		default:
+		}
+		packets, err := recvBatchContext(ctx, t.inner)
+		if err != nil {
+			return err
+		}
+		for _, pkt := range packets {
+			// Nothing to decrypt before the first session
+			if plaintext, ok := t.receive(pkt); ok {
+				bufpool.Put(plaintext)
+			}
+		}
+	}
+}
+
+func (t *Transport) sendInitiation() error {
+	var index uint32
+	if err := binary.Read(rand.Reader, binary.LittleEndian, &index); err != nil {
+		return err
+	}
+	msg, hs, err := createInitiation(t.opts.PrivateKey, t.opts.Peers[0], index)
+	if err != nil {
+		return fmt.Errorf("failed to create handshake initiation: %w", err)
+	}
+	t.mu.Lock()
+	t.pending = hs
+	t.mu.Unlock()
+	return t.inner.SendBatch([][]byte{msg})
+}
+
+func (t *Transport) SendBatch(packets [][]byte) error {
+	if t.opts.Initiator {
+		return t.sendTo(t.opts.Peers[0], packets)
+	}
+
+	// Runs of packets for the same peer go out together; with one peer
+	// that's the whole batch
+	var err error
+	for start := 0; start < len(packets); {
+		t.mu.Lock()
+		peer := t.route(packets[start])
+		end := start + 1
+		for end < len(packets) && t.route(packets[end]) == peer {
+			end++
+		}
+		t.mu.Unlock()
+		if peer.IsZero() {
+			err = errNoSession // With no peer known for these addresses
+		} else if sendErr := t.sendTo(peer, packets[start:end]); sendErr != nil {
+			err = sendErr
+		}
+		start = end
+	}
+	return err
+}
+
+// route picks the peer a responder sends pkt to: the one its destination
+// was last seen from, or the only peer with a session. t.mu is held.
+func (t *Transport) route(pkt []byte) Key {
+	if dst, ok := packetAddr(pkt, false); ok {
+		if peer, ok := t.routes[dst]; ok {
+			return peer
+		}
+	}
+	var only Key
+	for peer, p := range t.peers {
+		if p.current == nil {
+			continue
+		}
+		if !only.IsZero() {
+			return Key{}
+		}
+		only = peer
+	}
+	return only
+}
+
+// sendTo seals packets under the current session with peer
+func (t *Transport) sendTo(peer Key, packets [][]byte) error {
+	t.mu.Lock()
+	var s *session
+	if p := t.peers[peer]; p != nil {
+		s = p.current
+	}
+	if s != nil && time.Since(s.created) >= RejectAfterTime {
+		s = nil
+	}
+	rekey := t.opts.Initiator && (s == nil || time.Since(s.created) >= RekeyAfterTime) &&
+		(t.pending == nil || time.Since(t.pending.sentAt) >= RekeyTimeout)
+	t.mu.Unlock()
+
+	if rekey {
+		if err := t.sendInitiation(); err != nil {
+			log.Printf("⚠️ WireGuard re-handshake failed: %v", err)
+		}
+	}
+	if s == nil {
+		return errNoSession
+	}
+
+	sealed := make([][]byte, 0, len(packets))
+	// The inner transport is done with the messages once SendBatch returns
+	defer func() {
+		for _, m := range sealed {
+			bufpool.Put(m)
+		}
+	}()
+	for _, pkt := range packets {
+		var msg []byte
+		if n := dataHeaderSize + len(pkt) + tagSize; n <= bufpool.Size {
+			msg = bufpool.Get()[:dataHeaderSize]
+		} else {
+			msg = make([]byte, dataHeaderSize, n)
+		}
+		counter := s.counter.Add(1) - 1
+		msg[0], msg[1], msg[2], msg[3] = msgData, 0, 0, 0
+		binary.LittleEndian.PutUint32(msg[4:8], s.remoteIndex)
+		binary.LittleEndian.PutUint64(msg[8:16], counter)
+		sealed = append(sealed, s.send.Seal(msg, dataNonce(counter), pkt, nil))
+	}
+	return t.inner.SendBatch(sealed)
+}
+
+// Recv returns the next message with its packets decrypted. Handshake
+// messages are handled here and never returned.
+func (t *Transport) Recv() (protocol.TunnelMessage, error) {
+	for {
+		msg, err := t.inner.Recv()
+		if err != nil {
+			return nil, err
+		}
+
+		switch m := msg.(type) {
+		case *protocol.IpPacket:
+			plaintext, ok := t.receive(m.Payload)
+			if !ok {
+				continue
+			}
+			return &protocol.IpPacket{Payload: plaintext}, nil
+
+		case *protocol.BatchIpPacket:
+			if packets := t.receiveAll(m.Packets); len(packets) > 0 {
+				return &protocol.BatchIpPacket{Packets: packets}, nil
+			}
+
+		default:
+			return msg, nil
+		}
+	}
+}
+
+// RecvBatch returns the next group of packets, decrypted
+func (t *Transport) RecvBatch() ([][]byte, error) {
+	return t.RecvBatchContext(context.Background())
+}
+
+// RecvBatchContext is RecvBatch, cancellable if the inner transport is
+func (t *Transport) RecvBatchContext(ctx context.Context) ([][]byte, error) {
+	for {
+		packets, err := recvBatchContext(ctx, t.inner)
+		if err != nil {
+			return nil, err
+		}
+		if packets = t.receiveAll(packets); len(packets) > 0 {
+			return packets, nil
+		}
+	}
+}
+
+// Lease passes through to the inner transport
+func (t *Transport) Lease(ctx context.Context) (netip.Prefix, error) {
+	if l, ok := t.inner.(vpn.Leaser); ok {
+		return l.Lease(ctx)
+	}
+	return netip.Prefix{}, errNoLease
+}
+
+func (t *Transport) Close() {
+	t.inner.Close()
+}
+
+// Rejected returns how many messages were dropped for failing authentication
+func (t *Transport) Rejected() uint64 {
+	return t.rejected.Load()
+}
+
+// receiveAll decrypts packets in place, dropping what receive rejects
+func (t *Transport) receiveAll(packets [][]byte) [][]byte {
+	kept := packets[:0]
+	for _, pkt := range packets {
+		if plaintext, ok := t.receive(pkt); ok {
+			kept = append(kept, plaintext)
+		}
+	}
+	return kept
+}
+
+// receive handles one WireGuard message from the peer and returns the IP
+// packet inside a data message. msg is consumed either way.
+func (t *Transport) receive(msg []byte) ([]byte, bool) {
+	if len(msg) < 4 || msg[1] != 0 || msg[2] != 0 || msg[3] != 0 {
+		t.reject(msg)
+		return nil, false
+	}
+	switch msg[0] {
+	case msgData:
+		return t.open(msg)
+	case msgInitiation:
+		if !t.opts.Initiator {
+			t.answer(msg)
+		}
+	case msgResponse:
+		if t.opts.Initiator {
+			t.complete(msg)
+		}
+	default:
+		t.reject(msg)
+		return nil, false
+	}
+	bufpool.Put(msg)
+	return nil, false
+}
+
+// answer is the responder's side of a handshake
+func (t *Transport) answer(msg []byte) {
+	hs, err := consumeInitiation(msg, t.opts.PrivateKey)
+	if err != nil || !t.allowed(hs.peer) {
+		t.reject(nil)
+		return
+	}
+
+	t.mu.Lock()
+	if last, ok := t.latest[hs.peer]; ok && bytes.Compare(hs.timestamp[:], last[:]) <= 0 {
+		t.mu.Unlock()
+		return // Replayed or out of date
+	}
+	t.latest[hs.peer] = hs.timestamp
+	t.mu.Unlock()
+
+	var index uint32
+	if err := binary.Read(rand.Reader, binary.LittleEndian, &index); err != nil {
+		return
+	}
+	resp, send, recv, err := createResponse(hs, t.opts.PresharedKey, index)
+	if err != nil {
+		t.reject(nil)
+		return
+	}
+	// Held as next before the response goes out, so data sent right after
+	// it under the new keys can be decrypted, which confirms it
+	s := newSession(hs, send, recv)
+	t.mu.Lock()
+	p := t.peerSessions(hs.peer)
+	if p.next != nil {
+		delete(t.byIndex, p.next.localIndex)
+	}
+	p.next = s
+	t.byIndex[s.localIndex] = s
+	t.mu.Unlock()
+	if err := t.inner.SendBatch([][]byte{resp}); err != nil {
+		log.Printf("⚠️ Failed to send WireGuard handshake response: %v", err)
+	}
+}
+
+// complete is the initiator receiving the response to its initiation
+func (t *Transport) complete(msg []byte) {
+	t.mu.Lock()
+	hs := t.pending
+	t.mu.Unlock()
+	if hs == nil {
+		return
+	}
+	send, recv, err := consumeResponse(msg, hs, t.opts.PrivateKey, t.opts.PresharedKey)
+	if err != nil {
+		t.reject(nil)
+		return
+	}
+	t.mu.Lock()
+	if t.pending == hs {
+		t.pending = nil
+	}
+	t.install(newSession(hs, send, recv))
+	t.mu.Unlock()
+
+	// Confirms the session to the responder, which doesn't send under it
+	// before then
+	if err := t.sendTo(hs.peer, [][]byte{{}}); err != nil {
+		log.Printf("⚠️ Failed to confirm the WireGuard session: %v", err)
+	}
+}
+
+func newSession(hs *handshake, send, recv [32]byte) *session {
+	return &session{
+		send:        newAEAD(send),
+		recv:        newAEAD(recv),
+		localIndex:  hs.localIndex,
+		remoteIndex: hs.remoteIndex,
+		created:     time.Now(),
+		peer:        hs.peer,
+	}
+}
+
+// peerSessions returns peer's sessions, creating them. t.mu is held.
+func (t *Transport) peerSessions(peer Key) *peerSessions {
+	p := t.peers[peer]
+	if p == nil {
+		p = &peerSessions{}
+		t.peers[peer] = p
+	}
+	return p
+}
+
+// install makes s the current session with its peer. t.mu is held.
+func (t *Transport) install(s *session) {
+	p := t.peerSessions(s.peer)
+	if p.previous != nil {
+		delete(t.byIndex, p.previous.localIndex)
+	}
+	first := p.current == nil
+	p.previous, p.current = p.current, s
+	t.byIndex[s.localIndex] = s
+
+	if first {
+		log.Printf("🤝 WireGuard session with %s established", s.peer)
+		t.readyOne.Do(func() { close(t.ready) })
+	}
+}
+
+// open decrypts a data message into a pooled buffer
+func (t *Transport) open(msg []byte) ([]byte, bool) {
+	defer bufpool.Put(msg)
+	if len(msg) < dataHeaderSize+tagSize {
+		t.reject(nil)
+		return nil, false
+	}
+	index := binary.LittleEndian.Uint32(msg[4:8])
+	counter := binary.LittleEndian.Uint64(msg[8:16])
+
+	t.mu.Lock()
+	s := t.byIndex[index]
+	t.mu.Unlock()
+	if s == nil || time.Since(s.created) >= RejectAfterTime {
+		metrics.DroppedPackets.Inc() // From a session we no longer have
+		return nil, false
+	}
+
+	var buf []byte
+	if len(msg)-dataHeaderSize-tagSize <= bufpool.Size {
+		buf = bufpool.Get()[:0]
+	}
+	plaintext, err := s.recv.Open(buf, dataNonce(counter), msg[dataHeaderSize:], nil)
+	if err != nil {
+		bufpool.Put(buf)
+		t.reject(nil)
+		return nil, false
+	}
+
+	s.replayMu.Lock()
+	fresh := s.replay.accept(counter)
+	s.replayMu.Unlock()
+	if !fresh {
+		bufpool.Put(plaintext)
+		metrics.DroppedPackets.Inc()
+		return nil, false
+	}
+
+	t.mu.Lock()
+	if p := t.peers[s.peer]; p != nil && p.next == s {
+		p.next = nil
+		t.install(s)
+	}
+	if src, ok := packetAddr(plaintext, true); ok && !t.opts.Initiator && t.routes[src] != s.peer {
+		t.routes[src] = s.peer
+	}
+	t.mu.Unlock()
+	if len(plaintext) == 0 {
+		bufpool.Put(plaintext) // Keepalive
+		return nil, false
+	}
+	return plaintext, true
+}
+
+// packetAddr returns the source or destination address of an IP packet
+func packetAddr(pkt []byte, source bool) (netip.Addr, bool) {
+	if len(pkt) == 0 {
+		return netip.Addr{}, false
+	}
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < 20 {
+			return netip.Addr{}, false
+		}
+		if source {
+			return netip.AddrFrom4([4]byte(pkt[12:16])), true
+		}
+		return netip.AddrFrom4([4]byte(pkt[16:20])), true
+	case 6:
+		if len(pkt) < 40 {
+			return netip.Addr{}, false
+		}
+		if source {
+			return netip.AddrFrom16([16]byte(pkt[8:24])), true
+		}
+		return netip.AddrFrom16([16]byte(pkt[24:40])), true
+	}
+	return netip.Addr{}, false
+}
+
+func (t *Transport) allowed(peer Key) bool {
+	for _, k := range t.opts.Peers {
+		if k == peer {
+			return true
+		}
+	}
+	return false
+}
+
+// reject counts a message that failed to verify; msg, if given, goes back to the pool
+func (t *Transport) reject(msg []byte) {
+	if msg != nil {
+		bufpool.Put(msg)
+	}
+	metrics.DroppedPackets.Inc()
+	if t.rejected.Add(1) == 1 {
+		log.Printf("⚠️ Dropping WireGuard messages that fail to verify (peer's key not in the allowed list?)")
+	}
+}
+
+// dataNonce is the little-endian counter after four zero bytes
+func dataNonce(counter uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.LittleEndian.PutUint64(nonce[4:], counter)
+	return nonce
+}
+
+// recvBatchContext cancels the receive through t when it supports it
+func recvBatchContext(ctx context.Context, t vpn.Transport) ([][]byte, error) {
+	if ct, ok := t.(vpn.ContextTransport); ok {
+		return ct.RecvBatchContext(ctx)
+	}
+	return t.RecvBatch()
+}
+
+// replayWindowSize is how far behind the newest counter a message can be
+// and still be accepted
+const replayWindowSize = 2048
+
+// replayWindow remembers which recent counters arrived, so a relay can't
+// replay data messages
+type replayWindow struct {
+	next uint64 // One past the highest counter accepted
+	seen [replayWindowSize / 64]uint64
+}
+
+func (w *replayWindow) accept(counter uint64) bool {
+	if counter >= w.next {
+		if counter-w.next >= replayWindowSize {
+			w.seen = [replayWindowSize / 64]uint64{}
+		} else {
+			for c := w.next; c < counter; c++ {
+				w.clear(c)
+			}
+		}
+		w.next = counter + 1
+		w.set(counter)
+		return true
+	}
+	if w.next-counter > replayWindowSize || w.has(counter) {
+		return false
+	}
+	w.set(counter)
+	return true
+}
+
+func (w *replayWindow) set(c uint64) {
+	i := c % replayWindowSize
+	w.seen[i/64] |= 1 << (i % 64)
+}
+
+func (w *replayWindow) clear(c uint64) {
+	i := c % replayWindowSize
+	w.seen[i/64] &^= 1 << (i % 64)
+}
+
+func (w *replayWindow) has(c uint64) bool {
+	i := c % replayWindowSize
+	return w.seen[i/64]&(1<<(i%64)) != 0
+}
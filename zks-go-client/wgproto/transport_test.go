@@ -0,0 +1,364 @@
+package wgproto
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zks-vpn/zks-go-client/protocol"
+)
+
+// pipeEnd is one end of an in-memory link between two Transports
+type pipeEnd struct {
+	in   <-chan [][]byte
+	out  chan<- [][]byte
+	done chan struct{}
+	once sync.Once
+}
+
+func newPipe() (*pipeEnd, *pipeEnd) {
+	ab, ba := make(chan [][]byte, 64), make(chan [][]byte, 64)
+	return &pipeEnd{in: ba, out: ab, done: make(chan struct{})},
+		&pipeEnd{in: ab, out: ba, done: make(chan struct{})}
+}
+
+// SendBatch copies packets, the caller recycles them once it returns
+func (p *pipeEnd) SendBatch(packets [][]byte) error {
+	batch := make([][]byte, len(packets))
+	for i, pkt := range packets {
+		batch[i] = append([]byte(nil), pkt...)
+	}
+	select {
+	case p.out <- batch:
+		return nil
+	case <-p.done:
+		return errors.New("closed")
+	}
+}
+
+func (p *pipeEnd) Recv() (protocol.TunnelMessage, error) {
+	packets, err := p.RecvBatch()
+	if err != nil {
+		return nil, err
+	}
+	return &protocol.BatchIpPacket{Packets: packets}, nil
+}
+
+func (p *pipeEnd) RecvBatch() ([][]byte, error) {
+	return p.RecvBatchContext(context.Background())
+}
+
+func (p *pipeEnd) RecvBatchContext(ctx context.Context) ([][]byte, error) {
+	select {
+	case packets := <-p.in:
+		return packets, nil
+	case <-p.done:
+		return nil, errors.New("closed")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (p *pipeEnd) Close() {
+	p.once.Do(func() { close(p.done) })
+}
+
+// ipPacket is an IPv4 header from src to dst followed by payload, which is
+// all a Transport looks at
+func ipPacket(src, dst string, payload string) []byte {
+	pkt := make([]byte, 20, 20+len(payload))
+	pkt[0] = 0x45
+	s, d := netip.MustParseAddr(src).As4(), netip.MustParseAddr(dst).As4()
+	copy(pkt[12:16], s[:])
+	copy(pkt[16:20], d[:])
+	return append(pkt, payload...)
+}
+
+// pump receives from t until it closes, passing the packets on
+func pump(t *Transport) <-chan []byte {
+	ch := make(chan []byte, 64)
+	go func() {
+		for {
+			packets, err := t.RecvBatch()
+			if err != nil {
+				return
+			}
+			for _, pkt := range packets {
+				ch <- append([]byte(nil), pkt...)
+			}
+		}
+	}()
+	return ch
+}
+
+// receive returns the next packet from ch
+func receive(t *testing.T, ch <-chan []byte) []byte {
+	t.Helper()
+	select {
+	case pkt := <-ch:
+		return pkt
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a packet")
+		return nil
+	}
+}
+
+// wgPair is a client and an Exit Peer Transport connected by a pipe, with
+// the server receiving; the client receives once its handshake is done
+type wgPair struct {
+	client, server     *Transport
+	clientIn, serverIn <-chan []byte
+	clientKey          Key
+	serverKey          Key
+}
+
+// newPair connects a client and a server. The server accepts allowed, or
+// the client when it is zero.
+func newPair(t *testing.T, clientPSK, serverPSK, allowed Key) *wgPair {
+	t.Helper()
+	p := &wgPair{clientKey: mustKey(t), serverKey: mustKey(t)}
+	if allowed.IsZero() {
+		allowed = p.clientKey.PublicKey()
+	}
+	a, b := newPipe()
+	var err error
+	p.client, err = NewTransport(a, Options{PrivateKey: p.clientKey, Peers: []Key{p.serverKey.PublicKey()}, PresharedKey: clientPSK, Initiator: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.server, err = NewTransport(b, Options{PrivateKey: p.serverKey, Peers: []Key{allowed}, PresharedKey: serverPSK})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		p.client.Close()
+		p.server.Close()
+	})
+	p.serverIn = pump(p.server)
+	return p
+}
+
+// connect runs the client's handshake and starts it receiving
+func (p *wgPair) connect(t *testing.T) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.client.Handshake(ctx); err != nil {
+		t.Fatal(err)
+	}
+	p.clientIn = pump(p.client)
+}
+
+// exchange sends a packet each way and checks it arrives intact
+func (p *wgPair) exchange(t *testing.T, payload string) {
+	t.Helper()
+	up := ipPacket("10.0.0.2", "192.0.2.1", payload)
+	if err := p.client.SendBatch([][]byte{up}); err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(t, p.serverIn); !bytes.Equal(got, up) {
+		t.Fatalf("server got %q, want %q", got, up)
+	}
+	down := ipPacket("192.0.2.1", "10.0.0.2", payload+" reply")
+	if err := p.server.SendBatch([][]byte{down}); err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(t, p.clientIn); !bytes.Equal(got, down) {
+		t.Fatalf("client got %q, want %q", got, down)
+	}
+}
+
+// sessions returns the server's sessions with the client
+func (p *wgPair) sessions() peerSessions {
+	p.server.mu.Lock()
+	defer p.server.mu.Unlock()
+	if s := p.server.peers[p.clientKey.PublicKey()]; s != nil {
+		return *s
+	}
+	return peerSessions{}
+}
+
+func TestTransportRoundTrip(t *testing.T) {
+	psk := mustKey(t)
+	p := newPair(t, psk, psk, Key{})
+	p.connect(t)
+	p.exchange(t, "hello")
+	p.exchange(t, "again")
+
+	// A re-handshake rotates the keys without losing packets
+	first := p.sessions().current
+	if err := p.client.sendInitiation(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for p.sessions().current == first {
+		if time.Now().After(deadline) {
+			t.Fatal("the new session was never confirmed")
+		}
+		p.exchange(t, "rekey")
+	}
+	if p.sessions().previous != first {
+		t.Fatal("the old session was not kept as previous")
+	}
+	p.exchange(t, "after")
+}
+
+func TestTransportHandshakeRejected(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		clientPSK  Key
+		serverPSK  Key
+		otherPeer  bool // The server only accepts some other client
+		rejectedBy func(*wgPair) *Transport
+	}{
+		{name: "psk", clientPSK: Key{1}, serverPSK: Key{2}, rejectedBy: func(p *wgPair) *Transport { return p.client }},
+		{name: "static key", otherPeer: true, rejectedBy: func(p *wgPair) *Transport { return p.server }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var allowed Key
+			if tc.otherPeer {
+				allowed = mustKey(t).PublicKey()
+			}
+			p := newPair(t, tc.clientPSK, tc.serverPSK, allowed)
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+			if err := p.client.Handshake(ctx); err == nil {
+				t.Fatal("handshake succeeded")
+			}
+			if tc.rejectedBy(p).Rejected() == 0 {
+				t.Fatal("nothing was rejected")
+			}
+			if err := p.client.SendBatch([][]byte{ipPacket("10.0.0.2", "192.0.2.1", "x")}); !errors.Is(err, errNoSession) {
+				t.Fatalf("sent without a session: %v", err)
+			}
+		})
+	}
+}
+
+func TestTransportUnconfirmedSession(t *testing.T) {
+	p := newPair(t, Key{}, Key{}, Key{})
+	p.connect(t)
+	p.exchange(t, "hello")
+	working := p.sessions().current
+
+	// An initiation the client never follows up on, as a replayed one would
+	// be, is answered but must not displace the session in use
+	msg, _, err := createInitiation(p.clientKey, p.serverKey.PublicKey(), 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.server.receive(msg); ok {
+		t.Fatal("an initiation was returned as data")
+	}
+	s := p.sessions()
+	if s.current != working || s.next == nil {
+		t.Fatal("the answered session replaced the working one")
+	}
+	p.exchange(t, "still working")
+	if p.sessions().current != working {
+		t.Fatal("the unconfirmed session became current")
+	}
+}
+
+func TestTransportRoutesPeers(t *testing.T) {
+	// Two clients of one server, which hears both and is heard by both;
+	// each client can only decrypt its own messages
+	serverKey := mustKey(t)
+	keys := []Key{mustKey(t), mustKey(t)}
+	up, down := make(chan [][]byte, 64), make(chan [][]byte, 64)
+	server, err := NewTransport(&pipeEnd{in: up, out: down, done: make(chan struct{})},
+		Options{PrivateKey: serverKey, Peers: []Key{keys[0].PublicKey(), keys[1].PublicKey()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	serverIn := pump(server)
+
+	ins := []chan [][]byte{make(chan [][]byte, 64), make(chan [][]byte, 64)}
+	go func() {
+		for batch := range down {
+			for _, in := range ins {
+				copied := make([][]byte, len(batch))
+				for i, pkt := range batch {
+					copied[i] = append([]byte(nil), pkt...)
+				}
+				in <- copied
+			}
+		}
+	}()
+	addrs := []string{"10.0.0.2", "10.0.0.3"}
+	clients := make([]*Transport, len(keys))
+	clientIns := make([]<-chan []byte, len(keys))
+	for i, key := range keys {
+		clients[i], err = NewTransport(&pipeEnd{in: ins[i], out: up, done: make(chan struct{})},
+			Options{PrivateKey: key, Peers: []Key{serverKey.PublicKey()}, Initiator: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(clients[i].Close)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err = clients[i].Handshake(ctx)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		clientIns[i] = pump(clients[i])
+
+		// The server learns each client's address from its packets
+		pkt := ipPacket(addrs[i], "192.0.2.1", "hello")
+		if err := clients[i].SendBatch([][]byte{pkt}); err != nil {
+			t.Fatal(err)
+		}
+		receive(t, serverIn)
+	}
+
+	batch := [][]byte{ipPacket("192.0.2.1", addrs[1], "to 1"), ipPacket("192.0.2.1", addrs[0], "to 0")}
+	if err := server.SendBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+	for i := range clients {
+		if got := receive(t, clientIns[i]); !bytes.Equal(got, batch[1-i]) {
+			t.Fatalf("client %d got %q", i, got)
+		}
+	}
+	select {
+	case pkt := <-clientIns[0]:
+		t.Fatalf("client 0 also got %q", pkt)
+	case pkt := <-clientIns[1]:
+		t.Fatalf("client 1 also got %q", pkt)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	var w replayWindow
+	for _, tc := range []struct {
+		counter uint64
+		want    bool
+	}{
+		{0, true},
+		{0, false}, // Duplicate
+		{5, true},
+		{3, true}, // Out of order inside the window
+		{4, true},
+		{3, false},
+		{5, false},
+		{2100, true},
+		{2100 - replayWindowSize + 1, true}, // The oldest still inside
+		{2100 - replayWindowSize, false},    // Just outside
+		{52, false},
+		{2099, true},
+		{2099, false},
+		{10000, true}, // A jump past the whole window
+		{9999, true},
+		{2100, false},
+	} {
+		if got := w.accept(tc.counter); got != tc.want {
+			t.Fatalf("accept(%d) = %v, want %v", tc.counter, got, tc.want)
+		}
+	}
+}
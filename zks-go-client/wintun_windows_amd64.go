@@ -0,0 +1,17 @@
+package main
+
+import (
+	_ "embed"
+
+	"github.com/zks-vpn/zks-go-client/vpn"
+)
+
+// wintunDLL is the amd64 Wintun driver kept next to main.go, so a fresh
+// machine doesn't need it installed by hand
+//
+//go:embed wintun.dll
+var wintunDLL []byte
+
+func init() {
+	vpn.SetBundledWintun(wintunDLL)
+}